@@ -0,0 +1,156 @@
+// Package accesslog writes request records as access log lines.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/logfile"
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+// Formats lists the supported log formats.
+var Formats = []string{"combined", "common", "json"}
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// Logger is a router.Recorder writing one line per request.
+type Logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	format string
+}
+
+// New writes access logs in the given format to w.
+func New(w io.Writer, format string) (*Logger, error) {
+	if !validFormat(format) {
+		return nil, fmt.Errorf("unknown access log format %q (want one of %s)", format, strings.Join(Formats, ", "))
+	}
+	return &Logger{w: w, format: format}, nil
+}
+
+// Open writes access logs to dest, which is a file path or one of "stdout"
+// and "stderr". Files are appended to and rotated according to rotation.
+func Open(dest, format string, rotation logfile.Options) (*Logger, error) {
+	switch dest {
+	case "stdout":
+		return New(os.Stdout, format)
+	case "stderr":
+		return New(os.Stderr, format)
+	}
+
+	f, err := logfile.Open(dest, rotation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %v", err)
+	}
+	l, err := New(f, format)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.closer = f
+	return l, nil
+}
+
+func validFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Record implements router.Recorder.
+func (l *Logger) Record(rec *router.Record) {
+	var line []byte
+	switch l.format {
+	case "json":
+		line, _ = json.Marshal(jsonRecord(rec))
+		line = append(line, '\n')
+	default:
+		line = []byte(clfLine(rec, l.format == "combined"))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		log.Debugf("Failed to write access log: %v", err)
+	}
+}
+
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// clfLine formats rec in Common Log Format, optionally extended with the
+// referer and user agent as in Apache's "combined" format. The Tailscale
+// login name stands in for the authenticated user.
+func clfLine(rec *router.Record, combined bool) string {
+	host := rec.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	uri := rec.Path
+	if rec.Query != "" {
+		uri += "?" + rec.Query
+	}
+
+	size := "-"
+	if rec.BytesOut > 0 {
+		size = strconv.FormatInt(rec.BytesOut, 10)
+	}
+
+	line := fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`,
+		host, dash(rec.User), rec.Time.Format(clfTime),
+		rec.Method, escape(uri), rec.Proto, rec.Status, size)
+	if combined {
+		line += fmt.Sprintf(` "%s" "%s"`, escape(dash(rec.Referer)), escape(dash(rec.UserAgent)))
+	}
+	return line + "\n"
+}
+
+func jsonRecord(rec *router.Record) map[string]interface{} {
+	return map[string]interface{}{
+		"time":        rec.Time,
+		"route":       rec.Route,
+		"method":      rec.Method,
+		"host":        rec.Host,
+		"path":        rec.Path,
+		"query":       rec.Query,
+		"proto":       rec.Proto,
+		"status":      rec.Status,
+		"bytes_in":    rec.BytesIn,
+		"bytes_out":   rec.BytesOut,
+		"duration_ms": float64(rec.Duration.Microseconds()) / 1000,
+		"remote_addr": rec.RemoteAddr,
+		"user":        rec.User,
+		"node":        rec.Node,
+		"user_agent":  rec.UserAgent,
+		"referer":     rec.Referer,
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escape keeps quotes and control characters from breaking log parsers.
+func escape(s string) string {
+	return strings.NewReplacer(`"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)
+}
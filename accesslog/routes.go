@@ -0,0 +1,94 @@
+package accesslog
+
+import (
+	"errors"
+	"math/rand/v2"
+
+	"github.com/whitehawk2/tsrouter/logfile"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+// Routes is a router.Recorder sending each route's records to the access
+// log its log settings name, sampled at its log.sample_rate.
+type Routes struct {
+	def     *Logger
+	loggers map[string]*Logger // route -> logger; nil for routes logging nowhere
+	rates   map[string]float64
+	opened  []*Logger
+}
+
+// OpenRoutes opens dest, the access log for routes without one of their
+// own, and every route's log.access_log; routes writing to the same
+// destination share a Logger. dest may be empty. It returns nil when no
+// route has an access log.
+func OpenRoutes(dest, format string, routes []models.Route, rotation logfile.Options) (*Routes, error) {
+	rs := &Routes{loggers: map[string]*Logger{}, rates: map[string]float64{}}
+	byDest := map[string]*Logger{}
+	open := func(dest string) (*Logger, error) {
+		if l, ok := byDest[dest]; ok {
+			return l, nil
+		}
+		l, err := Open(dest, format, rotation)
+		if err != nil {
+			return nil, err
+		}
+		byDest[dest] = l
+		rs.opened = append(rs.opened, l)
+		return l, nil
+	}
+
+	if dest != "" {
+		l, err := open(dest)
+		if err != nil {
+			return nil, err
+		}
+		rs.def = l
+	}
+	for _, r := range routes {
+		switch r.Log.AccessLog {
+		case "":
+		case "off":
+			rs.loggers[r.Name] = nil
+		default:
+			l, err := open(r.Log.AccessLog)
+			if err != nil {
+				rs.Close()
+				return nil, err
+			}
+			rs.loggers[r.Name] = l
+		}
+		if r.Log.SampleRate > 0 && r.Log.SampleRate < 1 {
+			rs.rates[r.Name] = r.Log.SampleRate
+		}
+	}
+	if len(rs.opened) == 0 {
+		return nil, nil
+	}
+	return rs, nil
+}
+
+// Record implements router.Recorder. Server errors are logged whatever the
+// sample rate, so sampling never hides a failing backend.
+func (rs *Routes) Record(rec *router.Record) {
+	l, ok := rs.loggers[rec.Route]
+	if !ok {
+		l = rs.def
+	}
+	if l == nil {
+		return
+	}
+	if rate, ok := rs.rates[rec.Route]; ok && rec.Status < 500 && rand.Float64() >= rate {
+		return
+	}
+	l.Record(rec)
+}
+
+// Close closes every access log opened.
+func (rs *Routes) Close() error {
+	var errs []error
+	for _, l := range rs.opened {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,143 @@
+// Package admin serves local management endpoints, such as health probes
+// for container orchestrators, on a separate listener from the proxy.
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/audit"
+)
+
+// Server is the admin HTTP server. Ready starts out false and is flipped by
+// the caller once the node is up and the proxy listener is bound.
+type Server struct {
+	mux   *http.ServeMux
+	srv   *http.Server
+	ready atomic.Bool
+
+	// backendsHealthy, when set, must also report true for /readyz to pass.
+	backendsHealthy func() bool
+
+	audit *audit.Log
+
+	closing chan struct{} // closed on Shutdown, to end event streams
+}
+
+// New returns a server with /healthz, /readyz and the OpenAPI document
+// registered. backendsHealthy may be nil when backend health isn't being
+// checked. Every request that changes anything is recorded in auditLog,
+// which may be nil.
+func New(backendsHealthy func() bool, auditLog *audit.Log) *Server {
+	s := &Server{
+		mux:             http.NewServeMux(),
+		backendsHealthy: backendsHealthy,
+		audit:           auditLog,
+		closing:         make(chan struct{}),
+	}
+	s.srv = &http.Server{Handler: s.audited(s.mux)}
+	s.srv.RegisterOnShutdown(func() { close(s.closing) })
+	s.mux.HandleFunc("GET /healthz", s.healthz)
+	s.mux.HandleFunc("GET /readyz", s.readyz)
+	s.mux.HandleFunc("GET /openapi.yaml", s.openAPIYAML)
+	s.mux.HandleFunc("GET /openapi.json", s.openAPIJSON)
+	return s
+}
+
+// Handle registers an additional endpoint.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// SetReady marks the node as up (or, during shutdown, as going away).
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// Start listens on addr and serves in the background.
+func (s *Server) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin address %s: %v", addr, err)
+	}
+	if host, _, err := net.SplitHostPort(ln.Addr().String()); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+			log.Warnf("Admin endpoints listening on non-loopback address %s", ln.Addr())
+		}
+	}
+	log.Infof("Admin endpoints available at http://%s", ln.Addr())
+
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Admin server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the server, waiting for in-flight requests until ctx is
+// done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// audited records non-GET requests in the audit log. The admin listener
+// isn't on the tailnet, so the actor is the caller's address.
+func (s *Server) audited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		e := audit.Entry{
+			Actor:  "admin:" + r.RemoteAddr,
+			Action: "admin " + r.Method + " " + r.URL.Path,
+		}
+		if r.URL.RawQuery != "" {
+			e.Details = map[string]string{"query": r.URL.RawQuery}
+		}
+		if sw.code >= 400 {
+			e.Error = http.StatusText(sw.code)
+		}
+		if err := s.audit.Record(e); err != nil {
+			log.Warn(err)
+		}
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	var reasons []string
+	if !s.ready.Load() {
+		reasons = append(reasons, "node not ready")
+	}
+	if s.backendsHealthy != nil && !s.backendsHealthy() {
+		reasons = append(reasons, "backends unhealthy")
+	}
+	if len(reasons) > 0 {
+		http.Error(w, "not ready: "+strings.Join(reasons, ", "), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
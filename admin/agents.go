@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/whitehawk2/tsrouter/controller"
+)
+
+// HandleAgents exposes c as GET /agents, the agents that have been in
+// touch, and PUT /agents/{name}, which replaces an agent's routes file with
+// the body and pushes it. The body is YAML unless the Content-Type says
+// JSON or TOML.
+func (s *Server) HandleAgents(c *controller.Controller) {
+	s.mux.HandleFunc("GET /agents", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.Agents())
+	})
+	s.mux.HandleFunc("PUT /agents/{name}", func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.Push(r.PathValue("name"), routesExt(r), data); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
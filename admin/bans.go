@@ -0,0 +1,22 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+// HandleBans exposes b as GET /bans (the current bans) and DELETE
+// /bans/{client}, which lifts one, e.g. DELETE /bans/ip:203.0.113.7.
+func (s *Server) HandleBans(b *router.Bans) {
+	s.mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, b.List())
+	})
+	s.mux.HandleFunc("DELETE /bans/{client}", func(w http.ResponseWriter, r *http.Request) {
+		if !b.Unban(r.PathValue("client")) {
+			http.Error(w, "client not banned", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
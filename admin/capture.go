@@ -0,0 +1,37 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+// HandleCaptures exposes c as GET /captures (every buffered exchange) and
+// GET /captures/{id}.
+func (s *Server) HandleCaptures(c *router.Capture) {
+	s.mux.HandleFunc("GET /captures", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.List())
+	})
+	s.mux.HandleFunc("GET /captures/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid capture ID", http.StatusBadRequest)
+			return
+		}
+		e := c.Get(id)
+		if e == nil {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, e)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/events"
+)
+
+// eventsKeepalive is how often an idle event stream gets a comment, so
+// proxies in between don't time it out.
+const eventsKeepalive = 30 * time.Second
+
+// HandleEvents streams the events published on bus as GET /events, as
+// Server-Sent Events named after their type, with the event as JSON data.
+// ?types= takes a comma-separated list of the types to stream, by default
+// all of them.
+func (s *Server) HandleEvents(bus *events.Bus) {
+	s.mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		var types []events.Type
+		if list := r.URL.Query().Get("types"); list != "" {
+			for _, name := range strings.Split(list, ",") {
+				t := events.Type(strings.TrimSpace(name))
+				if !slices.Contains(events.Types, t) {
+					http.Error(w, fmt.Sprintf("unknown event type %q", name), http.StatusBadRequest)
+					return
+				}
+				types = append(types, t)
+			}
+		}
+
+		ch, unsubscribe := bus.Subscribe()
+		defer unsubscribe()
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		send := func(e events.Event) error {
+			if len(types) > 0 && !slices.Contains(types, e.Type) {
+				return nil
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		keepalive := time.NewTicker(eventsKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case e := <-ch:
+				if err := send(e); err != nil {
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+					return
+				}
+			case <-s.closing:
+				// Send what's still queued, such as the shutdown event.
+				for {
+					select {
+					case e := <-ch:
+						if send(e) != nil {
+							return
+						}
+					default:
+						return
+					}
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
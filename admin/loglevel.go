@@ -0,0 +1,90 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LogLevel changes the global log level at runtime and puts the configured
+// level back after a while, so debug logging can't be left on by accident.
+type LogLevel struct {
+	base   log.Level
+	revert time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// NewLogLevel returns a LogLevel reverting to base after revert; a zero
+// revert keeps changes until the next one.
+func NewLogLevel(base log.Level, revert time.Duration) *LogLevel {
+	return &LogLevel{base: base, revert: revert}
+}
+
+// Set switches to level for d, or for the default revert duration when d is
+// zero. Setting the base level cancels a pending revert.
+func (l *LogLevel) Set(level log.Level, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	log.SetLevel(level)
+	if d == 0 {
+		d = l.revert
+	}
+	if level == l.base || d <= 0 {
+		log.Infof("Log level set to %s", level)
+		return
+	}
+	log.Infof("Log level set to %s for %s", level, d)
+	l.timer = time.AfterFunc(d, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.timer = nil
+		log.SetLevel(l.base)
+		log.Infof("Log level reverted to %s", l.base)
+	})
+}
+
+// Toggle switches between debug and the base level.
+func (l *LogLevel) Toggle() {
+	if log.GetLevel() == log.DebugLevel {
+		l.Set(l.base, 0)
+		return
+	}
+	l.Set(log.DebugLevel, 0)
+}
+
+// ServeHTTP reports the current level on GET, and changes it on PUT with
+// ?level=<level> and an optional ?duration=<duration>.
+func (l *LogLevel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level, err := log.ParseLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var d time.Duration
+		if v := r.FormValue("duration"); v != "" {
+			if d, err = time.ParseDuration(v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid duration: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		l.Set(level, d)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, log.GetLevel())
+}
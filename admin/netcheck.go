@@ -0,0 +1,42 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Netcheck is the body of GET /netcheck, as printed by `tsrouter netcheck`.
+type Netcheck struct {
+	Time        time.Time `json:"time"`
+	UDP         bool      `json:"udp"`
+	IPv4        string    `json:"ipv4,omitempty"`
+	IPv6        string    `json:"ipv6,omitempty"`
+	NAT         string    `json:"nat"`
+	PortMapping []string  `json:"port_mapping,omitempty"`
+	HomeDERP    string    `json:"home_derp,omitempty"`
+	NearestDERP string    `json:"nearest_derp,omitempty"`
+	DERP        []DERP    `json:"derp"`
+}
+
+// DERP is the measured latency to one DERP region; Latency is zero when
+// the region didn't answer.
+type DERP struct {
+	ID      int           `json:"id"`
+	Code    string        `json:"code"`
+	Name    string        `json:"name"`
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// HandleNetcheck serves GET /netcheck, running a fresh report with run on
+// every request.
+func (s *Server) HandleNetcheck(run func(ctx context.Context) (*Netcheck, error)) {
+	s.mux.HandleFunc("GET /netcheck", func(w http.ResponseWriter, r *http.Request) {
+		nc, err := run(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, nc)
+	})
+}
@@ -0,0 +1,41 @@
+package admin
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OpenAPI is the OpenAPI 3 document describing the admin API, served as
+// GET /openapi.yaml and GET /openapi.json.
+//
+//go:embed openapi.yaml
+var OpenAPI []byte
+
+// openAPIJSON is OpenAPI converted to JSON once, on first use.
+var openAPIJSON = sync.OnceValues(func() ([]byte, error) {
+	var doc map[string]any
+	if err := yaml.Unmarshal(OpenAPI, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI document: %v", err)
+	}
+	return json.MarshalIndent(doc, "", "  ")
+})
+
+func (s *Server) openAPIYAML(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(OpenAPI)
+}
+
+func (s *Server) openAPIJSON(w http.ResponseWriter, r *http.Request) {
+	data, err := openAPIJSON()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
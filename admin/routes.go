@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// RoutesPlan is the body of a PUT /routes response: the routes the desired
+// set adds, changes, removes and leaves alone, by name. Applied is set when
+// it was applied, which restarts the instance with it.
+type RoutesPlan struct {
+	Added     []string `json:"added"`
+	Changed   []string `json:"changed"`
+	Removed   []string `json:"removed"`
+	Unchanged []string `json:"unchanged"`
+	Applied   bool     `json:"applied"`
+}
+
+// ApplyRoutesFunc applies the routes document data, in the format of ext,
+// or with dryRun only plans it.
+type ApplyRoutesFunc func(ext string, data []byte, dryRun bool) (RoutesPlan, error)
+
+// HandleRoutes serves PUT /routes, which replaces every route with the ones
+// in the body, so routes left out are removed. Applying the routes already
+// running changes nothing. With ?dry_run=1 the plan is returned but not
+// applied.
+func (s *Server) HandleRoutes(apply ApplyRoutesFunc) {
+	s.mux.HandleFunc("PUT /routes", func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dryRun := r.URL.Query().Get("dry_run")
+		plan, err := apply(routesExt(r), data, dryRun != "" && dryRun != "0" && dryRun != "false")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, plan)
+	})
+}
+
+// routesExt is the format of a routes document in a request body: YAML
+// unless the Content-Type says JSON or TOML.
+func routesExt(r *http.Request) string {
+	switch ct := r.Header.Get("Content-Type"); {
+	case strings.Contains(ct, "json"):
+		return ".json"
+	case strings.Contains(ct, "toml"):
+		return ".toml"
+	}
+	return ".yaml"
+}
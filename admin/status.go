@@ -0,0 +1,74 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/metrics"
+)
+
+// Status is the body of GET /status, as printed by `tsrouter status`.
+type Status struct {
+	Hostname string        `json:"hostname"`
+	Ready    bool          `json:"ready"`
+	Uptime   time.Duration `json:"uptime"`
+	Window   time.Duration `json:"window"`
+	Routes   []RouteStatus `json:"routes"`
+	Node     *NodeStatus   `json:"node,omitempty"`
+	Certs    []CertStatus  `json:"certificates"`
+}
+
+// CertStatus describes a certificate the node serves.
+type CertStatus struct {
+	Name     string    `json:"name"`
+	Expires  time.Time `json:"expires"`
+	Renewals uint64    `json:"renewals"`
+}
+
+// NodeStatus describes the Tailscale node, as reported by tailscaled. It's
+// nil until the node has started.
+type NodeStatus struct {
+	DNSName   string       `json:"dns_name"`
+	IPs       []string     `json:"ips"`
+	DERP      string       `json:"derp,omitempty"`
+	KeyExpiry *time.Time   `json:"key_expiry,omitempty"`
+	Peers     []PeerStatus `json:"peers"`
+}
+
+// PeerStatus describes an online peer. Addr is the direct address in use,
+// empty while the peer is relayed through DERP; Active is set when traffic
+// was exchanged with it in the last couple of minutes.
+type PeerStatus struct {
+	Hostname      string    `json:"hostname"`
+	DNSName       string    `json:"dns_name"`
+	IPs           []string  `json:"ips"`
+	OS            string    `json:"os,omitempty"`
+	Addr          string    `json:"addr,omitempty"`
+	Relay         string    `json:"relay,omitempty"`
+	Active        bool      `json:"active"`
+	LastHandshake time.Time `json:"last_handshake"`
+	RxBytes       int64     `json:"rx_bytes"`
+	TxBytes       int64     `json:"tx_bytes"`
+}
+
+// RouteStatus describes one route. Healthy is nil when backend health
+// isn't checked, and Stats covers the metrics window.
+type RouteStatus struct {
+	Name     string             `json:"name"`
+	Port     int                `json:"port"`
+	Protocol string             `json:"protocol"`
+	Path     string             `json:"path"`
+	Target   string             `json:"target"`
+	Healthy  *bool              `json:"healthy,omitempty"`
+	Stats    metrics.RouteStats `json:"stats"`
+}
+
+// HandleStatus serves GET /status from status, filling in readiness.
+func (s *Server) HandleStatus(status func(ctx context.Context) Status) {
+	s.mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		st := status(r.Context())
+		st.Ready = s.ready.Load()
+		writeJSON(w, st)
+	})
+}
@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+// defaultSwitchWatch is how long a switched backend is watched unless
+// ?watch= says otherwise.
+const defaultSwitchWatch = 30 * time.Second
+
+// HandleSwitches serves POST /routes/{name}/switch, which moves a route to
+// the backend in ?target= while it keeps serving. The target is probed at
+// ?probe= (the root by default) first, then watched for ?watch= (30s by
+// default, 0 to skip), and the route goes back to its old backend if the
+// target fails meanwhile. The request returns once the switch is over:
+// 200 with the result if the target kept the route, 502 with the result
+// if its probe failed or it was rolled back.
+func (s *Server) HandleSwitches(sw *router.Switches) {
+	s.mux.HandleFunc("POST /routes/{name}/switch", func(w http.ResponseWriter, r *http.Request) {
+		target := r.FormValue("target")
+		if target == "" {
+			http.Error(w, "target is required", http.StatusBadRequest)
+			return
+		}
+		opts := router.SwitchOptions{ProbePath: r.FormValue("probe"), Watch: defaultSwitchWatch}
+		if v := r.FormValue("watch"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid watch duration", http.StatusBadRequest)
+				return
+			}
+			opts.Watch = d
+		}
+
+		res, err := sw.Switch(r.Context(), r.PathValue("name"), target, opts)
+		switch {
+		case errors.Is(err, router.ErrNoRoute):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, router.ErrSwitching):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if !res.Switched {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		writeJSON(w, res)
+	})
+}
@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/stats"
+)
+
+const defaultUsageSince = 24 * time.Hour
+
+// Usage is the body of GET /stats/usage.
+type Usage struct {
+	Since time.Time         `json:"since"`
+	Usage []stats.UsageStat `json:"usage"`
+}
+
+// Traffic is the body of GET /stats/traffic.
+type Traffic struct {
+	Since   time.Time           `json:"since"`
+	Traffic []stats.CounterStat `json:"traffic"`
+}
+
+// HandleUsage serves GET /stats/usage: requests and bytes per route, user
+// and node, from ?since=<duration> ago (24h by default), optionally for a
+// single ?route=<name>.
+func (s *Server) HandleUsage(usage func(ctx context.Context, since time.Time, route string) ([]stats.UsageStat, error)) {
+	s.mux.HandleFunc("GET /stats/usage", func(w http.ResponseWriter, r *http.Request) {
+		since, err := sinceParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows, err := usage(r.Context(), since, r.FormValue("route"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, Usage{Since: since, Usage: rows})
+	})
+}
+
+// HandleTraffic serves GET /stats/traffic: requests and bytes per route
+// and status class, from ?since=<duration> ago (24h by default). The key
+// of each row is the status class.
+func (s *Server) HandleTraffic(traffic func(ctx context.Context, since time.Time) ([]stats.CounterStat, error)) {
+	s.mux.HandleFunc("GET /stats/traffic", func(w http.ResponseWriter, r *http.Request) {
+		since, err := sinceParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows, err := traffic(r.Context(), since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rows == nil {
+			rows = []stats.CounterStat{}
+		}
+		writeJSON(w, Traffic{Since: since, Traffic: rows})
+	})
+}
+
+func sinceParam(r *http.Request) (time.Time, error) {
+	d := defaultUsageSince
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			return time.Time{}, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	return time.Now().Add(-d), nil
+}
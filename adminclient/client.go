@@ -0,0 +1,264 @@
+// Package adminclient is a client for the admin API of a running tsrouter
+// instance, as described by its OpenAPI document, admin/openapi.yaml.
+package adminclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/admin"
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+// maxErrorBody bounds how much of an error response ends up in an Error.
+const maxErrorBody = 4 << 10
+
+// Client talks to one instance's admin API. Requests have no timeout of
+// their own; use the context passed to each method.
+type Client struct {
+	HTTPClient *http.Client
+	BaseURL    string // e.g. http://127.0.0.1:9180
+}
+
+// NewClient returns a client for the admin API at addr, the instance's
+// admin_addr, or a base URL such as http://127.0.0.1:9180.
+func NewClient(addr string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Client{
+		HTTPClient: http.DefaultClient,
+		BaseURL:    strings.TrimSuffix(addr, "/"),
+	}
+}
+
+// Error is a response with a status other than the one expected, such as
+// 404 for an endpoint whose feature isn't enabled.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string // the response body, which the admin API keeps to plain text
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s %s: HTTP %d", e.Method, e.Path, e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s: HTTP %d - %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// send sends a request, with body as the body if non-nil, and returns the
+// response if its status is want. The caller closes its body.
+func (c *Client) send(ctx context.Context, method, path, contentType string, body []byte, want int) (*http.Response, error) {
+	endpoint := c.BaseURL + path
+	log.WithFields(log.Fields{
+		"method":   method,
+		"endpoint": endpoint,
+	}).Debug("Sending admin API request")
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != want {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return nil, &Error{Method: method, Path: path, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
+
+// getJSON decodes the JSON body of a GET request to path into out.
+func (c *Client) getJSON(ctx context.Context, path string, out interface{}) error {
+	resp, err := c.send(ctx, http.MethodGet, path, "", nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %v", path, err)
+	}
+	return nil
+}
+
+// raw returns the body of a GET request to path.
+func (c *Client) raw(ctx context.Context, path string) ([]byte, error) {
+	resp, err := c.send(ctx, http.MethodGet, path, "", nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// text returns the body of a request to path, without surrounding space.
+func (c *Client) text(ctx context.Context, method, path string) (string, error) {
+	resp, err := c.send(ctx, method, path, "", nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return strings.TrimSpace(string(data)), err
+}
+
+// Healthz checks the instance is running.
+func (c *Client) Healthz(ctx context.Context) error {
+	_, err := c.text(ctx, http.MethodGet, "/healthz")
+	return err
+}
+
+// Ready checks the instance is ready to serve. When it isn't, the error is
+// an *Error with status 503 and the reasons as its Message.
+func (c *Client) Ready(ctx context.Context) error {
+	_, err := c.text(ctx, http.MethodGet, "/readyz")
+	return err
+}
+
+// OpenAPI returns the instance's OpenAPI document, as YAML.
+func (c *Client) OpenAPI(ctx context.Context) ([]byte, error) {
+	return c.raw(ctx, "/openapi.yaml")
+}
+
+// Status returns readiness, per-route health and latency, the node and its
+// certificates.
+func (c *Client) Status(ctx context.Context) (*admin.Status, error) {
+	var st admin.Status
+	if err := c.getJSON(ctx, "/status", &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Netcheck has the instance probe its network, which takes a few seconds.
+func (c *Client) Netcheck(ctx context.Context) (*admin.Netcheck, error) {
+	var nc admin.Netcheck
+	if err := c.getJSON(ctx, "/netcheck", &nc); err != nil {
+		return nil, err
+	}
+	return &nc, nil
+}
+
+// Metrics returns the instance's metrics, in the Prometheus text format.
+func (c *Client) Metrics(ctx context.Context) ([]byte, error) {
+	return c.raw(ctx, "/metrics")
+}
+
+// LogLevel returns the current log level.
+func (c *Client) LogLevel(ctx context.Context) (log.Level, error) {
+	s, err := c.text(ctx, http.MethodGet, "/loglevel")
+	if err != nil {
+		return 0, err
+	}
+	return log.ParseLevel(s)
+}
+
+// SetLogLevel switches the log level for d, or until log_level_revert has
+// passed when d is zero.
+func (c *Client) SetLogLevel(ctx context.Context, level log.Level, d time.Duration) error {
+	q := url.Values{"level": {level.String()}}
+	if d != 0 {
+		q.Set("duration", d.String())
+	}
+	_, err := c.text(ctx, http.MethodPut, "/loglevel?"+q.Encode())
+	return err
+}
+
+// Usage returns requests and bytes per route, user and node over the last
+// since, 24h when zero, for a single route unless route is empty. It needs
+// stats enabled.
+func (c *Client) Usage(ctx context.Context, since time.Duration, route string) (*admin.Usage, error) {
+	q := url.Values{}
+	if since != 0 {
+		q.Set("since", since.String())
+	}
+	if route != "" {
+		q.Set("route", route)
+	}
+	var u admin.Usage
+	if err := c.getJSON(ctx, withQuery("/stats/usage", q), &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Traffic returns requests and bytes per route and status class over the
+// last since, 24h when zero. It needs stats enabled.
+func (c *Client) Traffic(ctx context.Context, since time.Duration) (*admin.Traffic, error) {
+	q := url.Values{}
+	if since != 0 {
+		q.Set("since", since.String())
+	}
+	var t admin.Traffic
+	if err := c.getJSON(ctx, withQuery("/stats/traffic", q), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Captures returns every buffered exchange, oldest first. It needs
+// capture_size set.
+func (c *Client) Captures(ctx context.Context) ([]*router.Exchange, error) {
+	var list []*router.Exchange
+	if err := c.getJSON(ctx, "/captures", &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Capture returns one captured exchange.
+func (c *Client) Capture(ctx context.Context, id uint64) (*router.Exchange, error) {
+	var e router.Exchange
+	if err := c.getJSON(ctx, "/captures/"+strconv.FormatUint(id, 10), &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Bans returns the clients currently banned, ending soonest first.
+func (c *Client) Bans(ctx context.Context) ([]router.Ban, error) {
+	var bans []router.Ban
+	if err := c.getJSON(ctx, "/bans", &bans); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// Unban lifts the ban on client, e.g. ip:203.0.113.7. A client that isn't
+// banned is an *Error with status 404.
+func (c *Client) Unban(ctx context.Context, client string) error {
+	resp, err := c.send(ctx, http.MethodDelete, "/bans/"+url.PathEscape(client), "", nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func withQuery(path string, q url.Values) string {
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
+}
@@ -0,0 +1,69 @@
+package adminclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/events"
+)
+
+// maxEventSize bounds a single event of the stream.
+const maxEventSize = 1 << 20
+
+// Events streams the instance's events of the given types, all of them if
+// none are given, calling fn with each until ctx is done, the instance
+// ends the stream, or fn returns an error, which Events then returns. An
+// instance shutting down sends its shutdown event before the stream ends.
+func (c *Client) Events(ctx context.Context, types []events.Type, fn func(events.Event) error) error {
+	path := "/events"
+	if len(types) > 0 {
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = string(t)
+		}
+		path += "?" + url.Values{"types": {strings.Join(names, ",")}}.Encode()
+	}
+	resp, err := c.send(ctx, http.MethodGet, path, "", nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, maxEventSize)
+	var data strings.Builder
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			// A blank line ends an event.
+			if data.Len() == 0 {
+				continue
+			}
+			var e events.Event
+			if err := json.Unmarshal([]byte(data.String()), &e); err != nil {
+				return fmt.Errorf("failed to decode event: %v", err)
+			}
+			data.Reset()
+			if err := fn(e); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// Keepalive comments and the event: name, which the data repeats,
+		// are skipped.
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sc.Err()
+}
@@ -0,0 +1,93 @@
+package adminclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/admin"
+	"github.com/whitehawk2/tsrouter/controller"
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+// ApplyRoutes replaces every route of the instance with the ones in the
+// routes document data, in the format of ext (.yaml, .json or .toml), and
+// returns the plan. With dryRun the plan is returned but not applied. It
+// needs admin_routes enabled; an invalid document is an *Error with status
+// 422.
+func (c *Client) ApplyRoutes(ctx context.Context, ext string, data []byte, dryRun bool) (*admin.RoutesPlan, error) {
+	path := "/routes"
+	if dryRun {
+		path += "?dry_run=1"
+	}
+	resp, err := c.send(ctx, http.MethodPut, path, routesContentType(ext), data, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var plan admin.RoutesPlan
+	if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+		return nil, fmt.Errorf("failed to decode %s response: %v", path, err)
+	}
+	return &plan, nil
+}
+
+// Switch moves route to the backend target, probing and watching it as
+// opts say, and returns once the switch is over. It needs admin_routes
+// enabled. A target that failed its probe or was rolled back is an *Error
+// with status 502, returned along with the result.
+func (c *Client) Switch(ctx context.Context, route, target string, opts router.SwitchOptions) (*router.SwitchResult, error) {
+	q := url.Values{"target": {target}, "watch": {opts.Watch.String()}}
+	if opts.ProbePath != "" {
+		q.Set("probe", opts.ProbePath)
+	}
+	path := withQuery("/routes/"+url.PathEscape(route)+"/switch", q)
+	resp, err := c.send(ctx, http.MethodPost, path, "", nil, http.StatusOK)
+	if err != nil {
+		var res router.SwitchResult
+		if e, ok := err.(*Error); ok && e.StatusCode == http.StatusBadGateway && json.Unmarshal([]byte(e.Message), &res) == nil {
+			return &res, err
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res router.SwitchResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("failed to decode %s response: %v", path, err)
+	}
+	return &res, nil
+}
+
+// Agents returns the agents that have been in touch with a controller
+// instance.
+func (c *Client) Agents(ctx context.Context) ([]controller.AgentStatus, error) {
+	var agents []controller.AgentStatus
+	if err := c.getJSON(ctx, "/agents", &agents); err != nil {
+		return nil, err
+	}
+	return agents, nil
+}
+
+// PushAgentRoutes replaces the routes file of the agent name on a
+// controller instance with data, in the format of ext, and pushes it.
+func (c *Client) PushAgentRoutes(ctx context.Context, name, ext string, data []byte) error {
+	resp, err := c.send(ctx, http.MethodPut, "/agents/"+url.PathEscape(name), routesContentType(ext), data, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func routesContentType(ext string) string {
+	switch strings.TrimPrefix(strings.ToLower(ext), ".") {
+	case "json":
+		return "application/json"
+	case "toml":
+		return "application/toml"
+	}
+	return "application/yaml"
+}
@@ -0,0 +1,332 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// LetsEncrypt is the default ACME directory.
+	LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+	renewBefore   = 30 * 24 * time.Hour
+	renewInterval = 12 * time.Hour
+	issueTimeout  = 10 * time.Minute
+)
+
+// ACMEOptions configures certificates issued over ACME.
+type ACMEOptions struct {
+	Domains   []string
+	Email     string
+	Directory string
+
+	// Challenge is dns-01 (the default) or http-01. HTTP-01 challenges are
+	// answered by HandleChallenges, so they can only succeed once the
+	// node is serving; NewACME leaves the first certificate to Renew.
+	Challenge string
+
+	// Hook is run as `<hook> present <record> <value>` before a DNS-01
+	// challenge is answered and `<hook> cleanup <record> <value>` after,
+	// the same interface as lego's exec provider. It must not exit until
+	// the TXT record is visible to the CA.
+	Hook string
+
+	// CacheDir keeps the account key and the issued certificate across
+	// restarts.
+	CacheDir string
+
+	// OnIssue, when set, is called with each certificate issued.
+	OnIssue func(leaf *x509.Certificate)
+}
+
+// ACMECert is a certificate issued over ACME for custom domains and renewed
+// in the background.
+type ACMECert struct {
+	opts   ACMEOptions
+	client *acme.Client
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	tokens map[string]string // HTTP-01 token -> key authorization
+}
+
+// NewACME returns an ACMECert, loading a cached certificate if there is one
+// and issuing a new one otherwise.
+func NewACME(ctx context.Context, opts ACMEOptions) (*ACMECert, error) {
+	if opts.Directory == "" {
+		opts.Directory = LetsEncrypt
+	}
+	if err := os.MkdirAll(opts.CacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create ACME cache: %v", err)
+	}
+	key, err := loadOrCreateKey(filepath.Join(opts.CacheDir, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ACMECert{opts: opts, client: &acme.Client{Key: key, DirectoryURL: opts.Directory}, tokens: map[string]string{}}
+	if cert, err := tls.LoadX509KeyPair(c.certPath(), c.keyPath()); err == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err == nil && c.covers(cert.Leaf) {
+			c.cert = &cert
+		}
+	}
+	if c.needsRenewal() && opts.Challenge != "http-01" {
+		if err := c.issue(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Certificate returns the current certificate.
+func (c *ACMECert) Certificate() *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert
+}
+
+// Renew renews the certificate when it gets close to expiring, or issues
+// it if there's none yet, until ctx is done. Failures are logged and
+// retried on the next check.
+func (c *ACMECert) Renew(ctx context.Context) {
+	t := time.NewTicker(renewInterval)
+	defer t.Stop()
+	for {
+		if c.needsRenewal() {
+			if err := c.issue(ctx); err != nil {
+				log.WithField("domains", c.opts.Domains).Warnf("Failed to renew certificate: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// HandleChallenges answers the CA's HTTP-01 challenge requests for
+// pending authorizations, and passes every other request to next.
+func (c *ACMECert) HandleChallenges(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c.mu.RLock()
+		keyAuth, ok := c.tokens[token]
+		c.mu.RUnlock()
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+func (c *ACMECert) certPath() string { return filepath.Join(c.opts.CacheDir, "cert.pem") }
+func (c *ACMECert) keyPath() string  { return filepath.Join(c.opts.CacheDir, "key.pem") }
+
+// covers reports whether a cached certificate is for the configured
+// domains, which may have changed since it was issued.
+func (c *ACMECert) covers(leaf *x509.Certificate) bool {
+	for _, d := range c.opts.Domains {
+		if leaf.VerifyHostname(strings.Replace(d, "*", "wildcard", 1)) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *ACMECert) needsRenewal() bool {
+	cert := c.Certificate()
+	return cert == nil || time.Until(cert.Leaf.NotAfter) < renewBefore
+}
+
+// issue runs a full ACME order for the configured domains, answering
+// every authorization with a DNS-01 challenge through the hook, or an
+// HTTP-01 one.
+func (c *ACMECert) issue(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, issueTimeout)
+	defer cancel()
+	entry := log.WithField("domains", c.opts.Domains)
+	entry.Info("Requesting certificate over ACME")
+
+	acct := &acme.Account{}
+	if c.opts.Email != "" {
+		acct.Contact = []string{"mailto:" + c.opts.Email}
+	}
+	if _, err := c.client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return fmt.Errorf("failed to register ACME account: %v", err)
+	}
+
+	order, err := c.client.AuthorizeOrder(ctx, acme.DomainIDs(c.opts.Domains...))
+	if err != nil {
+		return fmt.Errorf("failed to create ACME order: %v", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := c.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+	if order, err = c.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("ACME order failed: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: c.opts.Domains}, key)
+	if err != nil {
+		return err
+	}
+	der, _, err := c.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize ACME order: %v", err)
+	}
+
+	var chain []byte
+	for _, b := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return fmt.Errorf("issued certificate is unusable: %v", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(c.keyPath(), keyPEM, 0o600); err != nil {
+		return fmt.Errorf("failed to cache certificate key: %v", err)
+	}
+	if err := os.WriteFile(c.certPath(), chain, 0o600); err != nil {
+		return fmt.Errorf("failed to cache certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	entry.WithField("expires", cert.Leaf.NotAfter).Info("Issued certificate")
+	if c.opts.OnIssue != nil {
+		c.opts.OnIssue(cert.Leaf)
+	}
+	return nil
+}
+
+func (c *ACMECert) authorize(ctx context.Context, url string) error {
+	authz, err := c.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to get ACME authorization: %v", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	typ := c.opts.Challenge
+	if typ == "" {
+		typ = "dns-01"
+	}
+	var chal *acme.Challenge
+	for _, ch := range authz.Challenges {
+		if ch.Type == typ {
+			chal = ch
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("CA offered no %s challenge for %s", typ, authz.Identifier.Value)
+	}
+
+	if typ == "http-01" {
+		keyAuth, err := c.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.tokens[chal.Token] = keyAuth
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.tokens, chal.Token)
+			c.mu.Unlock()
+		}()
+	} else {
+		value, err := c.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		record := "_acme-challenge." + authz.Identifier.Value + "."
+		if err := c.runHook(ctx, "present", record, value); err != nil {
+			return err
+		}
+		defer func() {
+			if err := c.runHook(context.Background(), "cleanup", record, value); err != nil {
+				log.Warn(err)
+			}
+		}()
+	}
+
+	if _, err := c.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("failed to accept ACME challenge: %v", err)
+	}
+	if _, err := c.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("ACME authorization for %s failed: %v", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+func (c *ACMECert) runHook(ctx context.Context, action, record, value string) error {
+	out, err := exec.CommandContext(ctx, c.opts.Hook, action, record, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("DNS hook %s %s failed: %v: %s", action, record, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid private key %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write private key: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,118 @@
+// Package certs provides TLS certificates other than the node's Tailscale
+// certificate: key pairs loaded from files, reloaded when they're rotated,
+// certificates issued over ACME with DNS-01 challenges, and ones from a
+// local CA for the node's short hostname and IP addresses.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkInterval is how often FileCert looks for rotated files.
+const checkInterval = time.Minute
+
+// FileCert is a key pair loaded from PEM files. It's reloaded when either
+// file changes, so rotated certificates are picked up without a restart.
+type FileCert struct {
+	certFile, keyFile string
+
+	// OnReload, when set, is called with each rotated certificate loaded.
+	OnReload func(leaf *x509.Certificate)
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// LoadFile loads the key pair in certFile and keyFile.
+func LoadFile(certFile, keyFile string) (*FileCert, error) {
+	c := &FileCert{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Certificate returns the current key pair, first reloading it if the files
+// have changed since the last check. A pair that fails to load is logged
+// and the previous one kept.
+func (c *FileCert) Certificate() *tls.Certificate {
+	c.mu.RLock()
+	cert, stale := c.cert, time.Since(c.checked) > checkInterval
+	c.mu.RUnlock()
+	if !stale {
+		return cert
+	}
+
+	c.mu.Lock()
+	c.checked = time.Now()
+	c.mu.Unlock()
+	mod, err := c.latestModTime()
+	if err != nil {
+		log.WithField("cert", c.certFile).Warnf("Failed to check certificate: %v", err)
+		return cert
+	}
+	c.mu.RLock()
+	changed := mod.After(c.modTime)
+	c.mu.RUnlock()
+	if !changed {
+		return cert
+	}
+	if err := c.reload(); err != nil {
+		log.WithField("cert", c.certFile).Warnf("Keeping previous certificate: %v", err)
+		return cert
+	}
+	log.WithField("cert", c.certFile).Info("Reloaded certificate")
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.OnReload != nil {
+		c.OnReload(c.cert.Leaf)
+	}
+	return c.cert
+}
+
+func (c *FileCert) reload() error {
+	mod, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair %s: %v", c.certFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse certificate %s: %v", c.certFile, err)
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = mod
+	c.checked = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *FileCert) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
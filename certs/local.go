@@ -0,0 +1,195 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	localCAValidity   = 10 * 365 * 24 * time.Hour
+	localLeafValidity = 90 * 24 * time.Hour
+	// localLeafRenewal is how long before it expires a leaf is reissued.
+	localLeafRenewal = 30 * 24 * time.Hour
+)
+
+// tailnetRanges are the Tailscale address ranges the local CA may sign
+// certificates for.
+var tailnetRanges = []*net.IPNet{
+	{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)},
+	{IP: net.ParseIP("fd7a:115c:a1e0::"), Mask: net.CIDRMask(48, 128)},
+}
+
+// LocalCert is a certificate for the names a public CA won't issue one
+// for, the node's short hostname and IP addresses, signed by a CA of its
+// own kept in a directory. Clients have to trust the CA, in CAFile. The CA
+// is name constrained to the hostname and Tailscale addresses, so even
+// with its key it can't sign certificates for other sites.
+type LocalCert struct {
+	dir      string
+	hostname string
+	names    func() ([]string, []net.IP)
+
+	mu    sync.Mutex
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+	cert  *tls.Certificate
+}
+
+// NewLocal loads the CA in dir, creating it on first use, constrained to
+// hostname. names returns the names and addresses the certificate should
+// cover; it's called on each handshake, so the certificate follows them if
+// they change.
+func NewLocal(dir, hostname string, names func() ([]string, []net.IP)) (*LocalCert, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create local CA directory: %v", err)
+	}
+	c := &LocalCert{dir: dir, hostname: strings.ToLower(hostname), names: names}
+	key, err := loadOrCreateKey(filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	c.caKey = key.(*ecdsa.PrivateKey)
+	if c.ca, err = c.loadOrCreateCA(); err != nil {
+		return nil, err
+	}
+	if !c.ca.PermittedDNSDomainsCritical {
+		log.WithField("ca", c.CAFile()).Warn("Local CA has no name constraints and can sign certificates for any site; remove its directory to replace it with a constrained one")
+	}
+	return c, nil
+}
+
+// CAFile is the PEM file holding the CA certificate for clients to trust.
+func (c *LocalCert) CAFile() string { return filepath.Join(c.dir, "ca.pem") }
+
+// Certificate returns a certificate for the current names, issuing one
+// when they've changed or the last one is close to expiring. It returns
+// nil when there are no names yet, or issuing fails.
+func (c *LocalCert) Certificate() *tls.Certificate {
+	dnsNames, ips := c.names()
+	// Names outside the CA's constraints, such as a short name the node
+	// got because its hostname was taken, would be refused by clients.
+	dnsNames = slices.DeleteFunc(dnsNames, func(n string) bool { return !c.permits(n) })
+	if len(dnsNames) == 0 && len(ips) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && time.Until(c.cert.Leaf.NotAfter) > localLeafRenewal &&
+		slices.Equal(c.cert.Leaf.DNSNames, dnsNames) && slices.EqualFunc(c.cert.Leaf.IPAddresses, ips, net.IP.Equal) {
+		return c.cert
+	}
+	cert, err := c.issue(dnsNames, ips)
+	if err != nil {
+		log.Warnf("Failed to issue local certificate: %v", err)
+		return c.cert
+	}
+	log.WithField("names", dnsNames).Debug("Issued local certificate")
+	c.cert = cert
+	return cert
+}
+
+func (c *LocalCert) issue(dnsNames []string, ips []net.IP) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: firstName(dnsNames, ips)},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(localLeafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, &key.PublicKey, c.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, c.ca.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func (c *LocalCert) loadOrCreateCA() (*x509.Certificate, error) {
+	if data, err := os.ReadFile(c.CAFile()); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid local CA certificate %s", c.CAFile())
+		}
+		return x509.ParseCertificate(block.Bytes)
+	}
+
+	host, _ := os.Hostname()
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "tsrouter local CA " + host, Organization: []string{"tsrouter"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(localCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		// Critical, so clients that don't understand the constraints
+		// reject the CA rather than trust it for everything.
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{c.hostname},
+		PermittedIPRanges:           tailnetRanges,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &c.caKey.PublicKey, c.caKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(c.CAFile(), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write local CA certificate: %v", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// permits reports whether the CA's name constraints allow name. A CA
+// without constraints allows every name.
+func (c *LocalCert) permits(name string) bool {
+	if len(c.ca.PermittedDNSDomains) == 0 {
+		return true
+	}
+	for _, d := range c.ca.PermittedDNSDomains {
+		if strings.EqualFold(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func serialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return n
+}
+
+func firstName(dnsNames []string, ips []net.IP) string {
+	if len(dnsNames) > 0 {
+		return dnsNames[0]
+	}
+	return ips[0].String()
+}
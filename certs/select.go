@@ -0,0 +1,102 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source is anything holding a current certificate.
+type Source interface {
+	Certificate() *tls.Certificate
+}
+
+// Selector picks the certificate for a TLS handshake: the first custom
+// certificate valid for the requested server name, or without one, for
+// the address the client connected to, or the fallback (the node's
+// Tailscale certificate) for every other name.
+type Selector struct {
+	Custom   []Source
+	Fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	mu   sync.Mutex
+	seen map[string]*Stat // by certificate name
+}
+
+// Stat describes a certificate the selector has served or been told about
+// with Observe. Renewals counts how often a later certificate replaced it.
+type Stat struct {
+	Name     string
+	NotAfter time.Time
+	Renewals uint64
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *Selector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" && hello.Conn != nil {
+		// Clients connecting to an IP address send no server name.
+		if host, _, err := net.SplitHostPort(hello.Conn.LocalAddr().String()); err == nil {
+			name = host
+		}
+	}
+	if name != "" {
+		for _, src := range s.Custom {
+			cert := src.Certificate()
+			if cert != nil && cert.Leaf != nil && cert.Leaf.VerifyHostname(name) == nil {
+				s.Observe(cert)
+				return cert, nil
+			}
+		}
+	}
+	cert, err := s.Fallback(hello)
+	if err == nil {
+		s.Observe(cert)
+	}
+	return cert, err
+}
+
+// Observe records cert in Stats, for a certificate about to be served
+// before any handshake asked for it.
+func (s *Selector) Observe(cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if leaf == nil {
+		return
+	}
+	name := leaf.Subject.CommonName
+	if len(leaf.DNSNames) > 0 {
+		name = leaf.DNSNames[0]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.seen = map[string]*Stat{}
+	}
+	st, ok := s.seen[name]
+	switch {
+	case !ok:
+		s.seen[name] = &Stat{Name: name, NotAfter: leaf.NotAfter}
+	case leaf.NotAfter.After(st.NotAfter):
+		st.NotAfter = leaf.NotAfter
+		st.Renewals++
+	}
+}
+
+// Stats returns the certificates served so far, sorted by name.
+func (s *Selector) Stats() []Stat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]Stat, 0, len(s.seen))
+	for _, st := range s.seen {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
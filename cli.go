@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command is a node in the CLI tree. A command either runs itself or
+// dispatches to one of its subcommands by name.
+type command struct {
+	name        string
+	usage       string // argument synopsis shown after the command path
+	summary     string
+	description string   // longer help text, shown by --help only
+	examples    []string // full command lines, shown by --help only
+	hidden      bool     // left out of help and completion
+	flags       *flag.FlagSet
+	run         func(ctx context.Context, args []string) error
+	subcommands []*command
+}
+
+func (c *command) lookup(name string) *command {
+	for _, sub := range c.subcommands {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// runCommand resolves args against the command tree and runs the matching
+// command. path is the chain of command names used in usage messages.
+func runCommand(ctx context.Context, c *command, path string, args []string) error {
+	if len(args) > 0 {
+		if sub := c.lookup(args[0]); sub != nil {
+			return runCommand(ctx, sub, path+" "+sub.name, args[1:])
+		}
+	}
+
+	fs := c.flags
+	if fs == nil {
+		fs = flag.NewFlagSet(path, flag.ExitOnError)
+	}
+	fs.Usage = func() { printUsage(c, path) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if c.run == nil {
+		printUsage(c, path)
+		os.Exit(1)
+	}
+	return c.run(ctx, fs.Args())
+}
+
+func printUsage(c *command, path string) {
+	out := os.Stderr
+	fmt.Fprintf(out, "Usage: %s", path)
+	if len(c.subcommands) > 0 {
+		fmt.Fprint(out, " <command>")
+	}
+	if c.flags != nil {
+		fmt.Fprint(out, " [flags]")
+	}
+	if c.usage != "" {
+		fmt.Fprintf(out, " %s", c.usage)
+	}
+	fmt.Fprintln(out)
+	if c.summary != "" {
+		fmt.Fprintf(out, "\n%s\n", c.summary)
+	}
+	if c.description != "" {
+		fmt.Fprintf(out, "\n%s\n", strings.TrimSpace(c.description))
+	}
+
+	if subs := visibleSubcommands(c); len(subs) > 0 {
+		fmt.Fprintln(out, "\nCommands:")
+		for _, sub := range subs {
+			fmt.Fprintf(out, "  %-12s %s\n", sub.name, sub.summary)
+		}
+	}
+
+	if c.flags != nil {
+		fmt.Fprintln(out, "\nFlags:")
+		c.flags.VisitAll(func(f *flag.Flag) {
+			name, usage := flag.UnquoteUsage(f)
+			if tv, ok := f.Value.(interface{ TypeName() string }); ok {
+				name = tv.TypeName()
+			}
+			synopsis := "--" + f.Name
+			if name != "" {
+				synopsis += " <" + name + ">"
+			}
+			fmt.Fprintf(out, "  %-28s %s", synopsis, usage)
+			if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" {
+				fmt.Fprintf(out, " (default %q)", f.DefValue)
+			}
+			fmt.Fprintln(out)
+		})
+	}
+
+	if len(c.examples) > 0 {
+		fmt.Fprintln(out, "\nExamples:")
+		for _, ex := range c.examples {
+			fmt.Fprintf(out, "  %s\n", ex)
+		}
+	}
+
+	if len(c.subcommands) > 0 {
+		fmt.Fprintf(out, "\nRun \"%s <command> --help\" for more about a command.\n", path)
+	}
+}
+
+func visibleSubcommands(c *command) []*command {
+	var subs []*command
+	for _, sub := range c.subcommands {
+		if !sub.hidden {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// newFlagSet returns a flag set for a command. Options from models.Config
+// are added with config.BindFlags.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// completeFiles tells the shell scripts to fall back to file completion.
+const completeFiles = ":files"
+
+const bashCompletion = `# bash completion for tsrouter
+_tsrouter() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local IFS=$'\n'
+    local out
+    out=$(tsrouter __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)
+    if [ "$out" = ":files" ]; then
+        COMPREPLY=($(compgen -f -- "$cur"))
+        return
+    fi
+    COMPREPLY=($(compgen -W "$out" -- "$cur"))
+}
+complete -o default -F _tsrouter tsrouter
+`
+
+const zshCompletion = `#compdef tsrouter
+_tsrouter() {
+    local -a out
+    out=("${(@f)$(tsrouter __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if [[ "${out[1]}" == ":files" ]]; then
+        _files
+        return
+    fi
+    compadd -- "${out[@]}"
+}
+compdef _tsrouter tsrouter
+`
+
+const fishCompletion = `# fish completion for tsrouter
+function __tsrouter_complete
+    set -l args (commandline -opc)[2..-1] (commandline -ct)
+    set -l out (tsrouter __complete $args 2>/dev/null)
+    if test "$out[1]" = ":files"
+        __fish_complete_path (commandline -ct)
+    else
+        printf '%s\n' $out
+    end
+end
+complete -c tsrouter -f -a '(__tsrouter_complete)'
+`
+
+func completionCommand() *command {
+	return &command{
+		name:    "completion",
+		usage:   "<bash|zsh|fish>",
+		summary: "Print a shell completion script",
+		description: `
+The scripts call back into tsrouter to complete commands, flags and flag
+values, including hostnames from the --config file and existing instances.`,
+		examples: []string{
+			"source <(tsrouter completion bash)",
+			"tsrouter completion zsh > \"${fpath[1]}/_tsrouter\"",
+			"tsrouter completion fish > ~/.config/fish/completions/tsrouter.fish",
+		},
+		flags: flag.NewFlagSet("completion", flag.ExitOnError),
+		run: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected exactly one shell: bash, zsh or fish")
+			}
+			scripts := map[string]string{
+				"bash": bashCompletion,
+				"zsh":  zshCompletion,
+				"fish": fishCompletion,
+			}
+			script, ok := scripts[args[0]]
+			if !ok {
+				return fmt.Errorf("unsupported shell %q", args[0])
+			}
+			_, err := io.WriteString(os.Stdout, script)
+			return err
+		},
+	}
+}
+
+// completeCommand is the hidden hook the completion scripts call with the
+// words typed so far, the last one being the word under the cursor.
+func completeCommand(root *command) *command {
+	return &command{
+		name:   "__complete",
+		hidden: true,
+		run: func(ctx context.Context, args []string) error {
+			for _, c := range complete(root, args) {
+				fmt.Println(c)
+			}
+			return nil
+		},
+	}
+}
+
+func complete(root *command, args []string) []string {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	cur, prev := args[len(args)-1], args[:len(args)-1]
+
+	c := root
+	for _, w := range prev {
+		if sub := c.lookup(w); sub != nil {
+			c = sub
+		}
+	}
+
+	if len(prev) > 0 && c.flags != nil {
+		if f := takesValue(c.flags, prev[len(prev)-1]); f != nil {
+			return completeFlagValue(f.Name, prev)
+		}
+	}
+
+	var out []string
+	if strings.HasPrefix(cur, "-") {
+		if c.flags != nil {
+			c.flags.VisitAll(func(f *flag.Flag) {
+				out = append(out, "--"+f.Name)
+			})
+		}
+		return out
+	}
+	for _, sub := range visibleSubcommands(c) {
+		out = append(out, sub.name)
+	}
+	return out
+}
+
+// takesValue returns the flag named by word if it expects a separate value
+// argument, i.e. it's a non-boolean flag given without "=".
+func takesValue(fs *flag.FlagSet, word string) *flag.Flag {
+	if !strings.HasPrefix(word, "-") || strings.Contains(word, "=") {
+		return nil
+	}
+	f := fs.Lookup(strings.TrimLeft(word, "-"))
+	if f == nil {
+		return nil
+	}
+	if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+		return nil
+	}
+	return f
+}
+
+func completeFlagValue(name string, prev []string) []string {
+	switch name {
+	case "config":
+		return []string{completeFiles}
+	case "log-level":
+		return []string{"error", "info", "debug"}
+	case "output":
+		return []string{"table", "json"}
+	case "hostname":
+		return completeHostnames(flagValue(prev, "config"), flagValue(prev, "state-dir"))
+	}
+	return nil
+}
+
+// completeHostnames offers the hostname from the config being used, plus
+// every hostname that already has instance state in its state directory.
+// The config is resolved as serve does, from configPath or TSROUTER_CONFIG
+// and the environment, with stateDir from an already typed --state-dir;
+// remote configs aren't fetched.
+func completeHostnames(configPath, stateDir string) []string {
+	loadEnvConfig()
+	cfg := &models.Config{}
+	flags := &config.Flags{ConfigPath: configPath}
+	if !config.IsRemote(flags.Path()) {
+		if resolved, _, err := config.Resolve(flags); err == nil {
+			cfg = resolved
+		}
+	}
+	if stateDir != "" {
+		cfg.StateDir = stateDir
+	}
+
+	seen := map[string]bool{}
+	if cfg.Hostname != "" {
+		seen[cfg.Hostname] = true
+	}
+	if root, err := stateRoot(cfg); err == nil {
+		entries, _ := os.ReadDir(root)
+		for _, e := range entries {
+			if e.IsDir() {
+				seen[e.Name()] = true
+			}
+		}
+	}
+
+	out := make([]string, 0, len(seen))
+	for h := range seen {
+		out = append(out, h)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// flagValue finds the value of a flag among already typed words.
+func flagValue(words []string, name string) string {
+	for i, w := range words {
+		trimmed := strings.TrimLeft(w, "-")
+		if trimmed == w {
+			continue
+		}
+		if v, ok := strings.CutPrefix(trimmed, name+"="); ok {
+			return v
+		}
+		if trimmed == name && i+1 < len(words) {
+			return words[i+1]
+		}
+	}
+	return ""
+}
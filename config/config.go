@@ -0,0 +1,816 @@
+// Package config loads and validates tsrouter configuration files, which
+// may be written in YAML, TOML or JSON.
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/accesslog"
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"github.com/whitehawk2/tsrouter/events"
+	"github.com/whitehawk2/tsrouter/firewall"
+	"github.com/whitehawk2/tsrouter/identity"
+	"github.com/whitehawk2/tsrouter/metrics"
+	"github.com/whitehawk2/tsrouter/mock"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/notify"
+	"github.com/whitehawk2/tsrouter/schedule"
+)
+
+var hostnameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Load reads a config file on its own, without defaults, environment or
+// flags. The result is not validated.
+func Load(path string) (*models.Config, error) {
+	cfg := &models.Config{}
+	if err := loadFile(path, cfg, newSource()); err != nil {
+		return nil, errdefs.Wrap(errdefs.ErrConfig, err)
+	}
+	return cfg, nil
+}
+
+// loadFile decodes a YAML, TOML or JSON config file, and the files it
+// includes, over the values already in cfg, after migrating them to the
+// current schema and resolving ${ENV} and file: references in their
+// strings. Key positions are recorded in src.
+func loadFile(path string, cfg *models.Config, src *Source) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %v", err)
+	}
+	tree, err := parseFile(path, data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	src.File = path
+	src.lines = positions(path, data)
+
+	from, ps := migrate(tree)
+	if from < Version {
+		src.Migrated = append(src.Migrated, path)
+	}
+	ps = append(ps, interpolate(tree, filepath.Dir(path))...)
+	ps = append(ps, includeFiles(path, tree, src)...)
+	ps = append(ps, decode(tree, cfg)...)
+	return src.locate(ps).err()
+}
+
+// Normalize fills in defaults: a config with only target_port or mock gets
+// a single catch-all route to that local port or those mock responses,
+// ports entries become routes of their own, and routes get default names,
+// paths, ports and protocols.
+func Normalize(cfg *models.Config) {
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	if len(cfg.Routes) == 0 && cfg.TargetPort != 0 {
+		cfg.Routes = []models.Route{{
+			Name:   "default",
+			Path:   "/",
+			Target: fmt.Sprintf("http://localhost:%d", cfg.TargetPort),
+		}}
+	}
+	if len(cfg.Routes) == 0 && cfg.Mock != "" {
+		dir, err := filepath.Abs(cfg.Mock)
+		if err != nil {
+			dir = cfg.Mock
+		}
+		cfg.Routes = []models.Route{{
+			Name:   "mock",
+			Path:   "/",
+			Target: "mock://" + filepath.ToSlash(dir),
+		}}
+	}
+	for _, p := range cfg.Ports {
+		if r, err := parsePort(p); err == nil {
+			cfg.Routes = append(cfg.Routes, r)
+		}
+	}
+	for i := range cfg.Webhooks {
+		if cfg.Webhooks[i].Format == "" {
+			cfg.Webhooks[i].Format = "json"
+		}
+	}
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		if r.Path == "" {
+			r.Path = "/"
+		}
+		if r.Name == "" {
+			r.Name = routeName(r.Path, i)
+		}
+		if r.Port == 0 {
+			r.Port = 443
+		}
+		if r.Protocol == "" {
+			r.Protocol = "https"
+		}
+		if r.Index == "" && isFastCGI(r.Target) {
+			r.Index = "index.php"
+		}
+	}
+}
+
+func routeName(path string, i int) string {
+	name := strings.Trim(path, "/")
+	if name == "" {
+		if i == 0 {
+			return "default"
+		}
+		return fmt.Sprintf("route%d", i)
+	}
+	return strings.ReplaceAll(name, "/", "-")
+}
+
+// Validate checks a normalized config and returns every problem found as
+// Problems, located using src when it's non-nil.
+func Validate(cfg *models.Config, src *Source) error {
+	var ps Problems
+
+	if cfg.Hostname == "" {
+		ps.add("hostname", "hostname is required")
+	} else if !hostnameRe.MatchString(cfg.Hostname) {
+		ps.add("hostname", "%q must be a lowercase DNS label (letters, digits, hyphens)", cfg.Hostname)
+	}
+
+	switch strings.ToLower(cfg.LogLevel) {
+	case "error", "info", "debug":
+	default:
+		ps.add("log_level", "%q must be one of error, info, debug", cfg.LogLevel)
+	}
+
+	accessLogs := cfg.AccessLog != ""
+	for _, r := range cfg.Routes {
+		accessLogs = accessLogs || (r.Log.AccessLog != "" && r.Log.AccessLog != "off")
+	}
+	if accessLogs && !slices.Contains(accesslog.Formats, cfg.AccessLogFormat) {
+		ps.add("access_log_format", "%q must be one of %s", cfg.AccessLogFormat, strings.Join(accesslog.Formats, ", "))
+	}
+
+	if cfg.APITimeout <= 0 {
+		ps.add("api_timeout", "must be positive")
+	}
+
+	if cfg.LogLevelRevert < 0 {
+		ps.add("log_level_revert", "must not be negative")
+	}
+
+	if cfg.LogMaxSize < 0 || cfg.LogMaxBackups < 0 || cfg.LogMaxAge < 0 || cfg.LogRotateInterval < 0 {
+		ps.add("log_max_size", "log rotation settings must not be negative")
+	}
+	if cfg.LogRepeatWindow < 0 {
+		ps.add("log_repeat_window", "must not be negative")
+	} else if cfg.LogRepeatWindow > 0 && cfg.LogRepeatBurst < 1 {
+		ps.add("log_repeat_burst", "must be at least 1")
+	}
+
+	for i, h := range cfg.Webhooks {
+		at := fmt.Sprintf("webhooks[%d]", i)
+		if err := validateURL("url", h.URL); err != nil {
+			ps.add(at+".url", "%v", err)
+		}
+		if !slices.Contains(notify.Formats, h.Format) {
+			ps.add(at+".format", "%q must be one of %s", h.Format, strings.Join(notify.Formats, ", "))
+		}
+		for j, e := range h.Events {
+			if !slices.Contains(events.Types, events.Type(e)) {
+				ps.add(fmt.Sprintf("%s.events[%d]", at, j), "unknown event %q", e)
+			}
+		}
+	}
+
+	if cfg.HeartbeatURL != "" {
+		if err := validateURL("heartbeat_url", cfg.HeartbeatURL); err != nil {
+			ps.add("heartbeat_url", "%v", err)
+		}
+		if cfg.HeartbeatInterval <= 0 {
+			ps.add("heartbeat_interval", "must be positive")
+		}
+		if cfg.HealthCheckInterval <= 0 {
+			ps.add("heartbeat_url", "requires health checks: health_check_interval must be positive")
+		}
+	}
+
+	if cfg.LocalProxyProtocol && cfg.LocalAddr == "" {
+		ps.add("local_proxy_protocol", "requires local_addr")
+	}
+	if cfg.LocalForwardedFor && cfg.LocalAddr == "" {
+		ps.add("local_forwarded_for", "requires local_addr")
+	}
+
+	if cfg.DNSCacheTTL < 0 {
+		ps.add("dns_cache_ttl", "must not be negative")
+	}
+	if cfg.ClientWriteTimeout < 0 {
+		ps.add("client_write_timeout", "must not be negative")
+	}
+	if cfg.ClientMinRate < 0 {
+		ps.add("client_min_rate", "must not be negative")
+	}
+
+	if cfg.HALease != "" {
+		if cfg.HALeaseTTL < 3*time.Second {
+			ps.add("ha_lease_ttl", "must be at least 3s")
+		}
+		if fi, err := os.Stat(filepath.Dir(cfg.HALease)); err != nil || !fi.IsDir() {
+			ps.add("ha_lease", "%q is not in an existing directory", cfg.HALease)
+		}
+	}
+
+	if cfg.StartupAttempts < 1 {
+		ps.add("startup_attempts", "must be at least 1")
+	}
+	if cfg.StartupBackoffMax < time.Second {
+		ps.add("startup_backoff_max", "must be at least 1s")
+	}
+
+	if cfg.AdminRoutes {
+		if cfg.AdminAddr == "" {
+			ps.add("admin_routes", "requires admin_addr")
+		}
+		if cfg.MemoryState {
+			ps.add("admin_routes", "conflicts with memory_state: the routes are kept in the state directory")
+		}
+		if cfg.Controller != "" {
+			ps.add("admin_routes", "conflicts with controller: an agent takes its routes from the controller")
+		}
+	}
+
+	if cfg.Controller != "" {
+		if err := validateURL("controller", cfg.Controller); err != nil {
+			ps.add("controller", "%v", err)
+		}
+	}
+	if cfg.ControllerPort != 0 {
+		if cfg.ControllerPort < 1 || cfg.ControllerPort > 65535 {
+			ps.add("controller_port", "%d is out of range", cfg.ControllerPort)
+		}
+		if cfg.ControllerDir == "" {
+			ps.add("controller_dir", "is required to serve the controller API")
+		} else if fi, err := os.Stat(cfg.ControllerDir); err != nil || !fi.IsDir() {
+			ps.add("controller_dir", "%q is not a directory", cfg.ControllerDir)
+		}
+		for _, r := range cfg.Routes {
+			if r.Port == cfg.ControllerPort {
+				ps.add("controller_port", "port %d is also used by route %q", r.Port, r.Name)
+				break
+			}
+		}
+	}
+	if cfg.StatePassphrase != "" && cfg.StateKeyCommand != "" {
+		ps.add("state_key_command", "conflicts with state_passphrase: set only one")
+	}
+	if cfg.TTL < 0 || cfg.TTLIdle < 0 {
+		ps.add("ttl", "ttl and ttl_idle must not be negative")
+	}
+	if cfg.MemoryState {
+		for _, c := range []struct {
+			key string
+			set bool
+		}{
+			{"state_dir", cfg.StateDir != ""},
+			{"state_passphrase", cfg.StatePassphrase != ""},
+			{"state_key_command", cfg.StateKeyCommand != ""},
+			{"stats", cfg.Stats},
+		} {
+			if c.set {
+				ps.add(c.key, "conflicts with memory_state, which keeps nothing on disk")
+			}
+		}
+	}
+
+	switch cfg.ListenIP {
+	case "both", "ipv4", "ipv6":
+	default:
+		ps.add("listen_ip", "%q must be one of both, ipv4, ipv6", cfg.ListenIP)
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		ps.add("tls_cert_file", "tls_cert_file and tls_key_file must be set together")
+	}
+	if len(cfg.TLSACMEDomains) > 0 {
+		switch cfg.TLSACMEChallenge {
+		case "dns-01":
+			if cfg.TLSACMEDNSHook == "" {
+				ps.add("tls_acme_dns_hook", "required for tls_acme_domains, to publish the DNS-01 challenge records")
+			}
+		case "http-01":
+			// The CA connects on public port 80, which tailnet ports and
+			// Funnel never are, so only a forwarded local_addr can answer.
+			if cfg.LocalAddr == "" {
+				ps.add("tls_acme_challenge", "http-01 needs local_addr, with public port 80 forwarded to it; use dns-01 otherwise")
+			}
+			for _, d := range cfg.TLSACMEDomains {
+				if strings.HasPrefix(d, "*.") {
+					ps.add("tls_acme_domains", "wildcard %q needs the dns-01 challenge", d)
+				}
+			}
+		default:
+			ps.add("tls_acme_challenge", "%q must be dns-01 or http-01", cfg.TLSACMEChallenge)
+		}
+		if err := validateURL("tls_acme_directory", cfg.TLSACMEDirectory); err != nil {
+			ps.add("tls_acme_directory", "%v", err)
+		}
+	}
+
+	for _, a := range []struct{ key, addr string }{{"admin_addr", cfg.AdminAddr}, {"local_addr", cfg.LocalAddr}} {
+		if a.addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			ps.add(a.key, "%q must be host:port: %v", a.addr, err)
+		}
+	}
+	if cfg.AdminAddr != "" && cfg.AdminAddr == cfg.LocalAddr {
+		ps.add("local_addr", "conflicts with admin_addr: use a different port")
+	}
+
+	if cfg.ACLGrants {
+		if name, path, _ := strings.Cut(cfg.ACLCapability, "/"); name == "" || path == "" {
+			ps.add("acl_capability", "%q must be a domain and path, e.g. example.com/cap/tsrouter", cfg.ACLCapability)
+		}
+		if cfg.LocalAddr != "" {
+			ps.add("local_addr", "conflicts with acl_grants: local requests have no Tailscale identity to check")
+		}
+	}
+
+	if cfg.BanAuthFailures < 0 || cfg.BanClientErrors < 0 {
+		ps.add("ban_auth_failures", "ban thresholds must not be negative")
+	}
+	if cfg.BanAuthFailures > 0 || cfg.BanClientErrors > 0 {
+		if cfg.BanWindow <= 0 {
+			ps.add("ban_window", "must be positive")
+		}
+		if cfg.BanDuration <= 0 {
+			ps.add("ban_duration", "must be positive")
+		}
+	}
+
+	if cfg.GeoIPDB != "" {
+		if _, err := os.Stat(cfg.GeoIPDB); err != nil {
+			ps.add("geoip_db", "%v", err)
+		}
+	}
+
+	if cfg.CaptureSize < 0 || cfg.CaptureBodyLimit < 0 {
+		ps.add("capture_size", "capture settings must not be negative")
+	} else if cfg.CaptureSize > 0 && cfg.AdminAddr == "" {
+		ps.add("capture_size", "requires admin_addr, which serves the captures")
+	}
+
+	if cfg.MetricsWindow <= 0 {
+		ps.add("metrics_window", "must be positive")
+	}
+	if cfg.SLOLatency < 0 {
+		ps.add("slo_latency", "must not be negative")
+	}
+	if cfg.SLOErrorRatio < 0 || cfg.SLOErrorRatio >= 1 {
+		ps.add("slo_error_ratio", "%g must be between 0 and 1", cfg.SLOErrorRatio)
+	}
+	if cfg.MetricsPush != "" {
+		if u, err := url.Parse(cfg.MetricsPush); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			ps.add("metrics_push", "%q must be an http or https URL", cfg.MetricsPush)
+		}
+		if !slices.Contains(metrics.PushFormats, cfg.MetricsPushFormat) {
+			ps.add("metrics_push_format", "%q must be one of %s", cfg.MetricsPushFormat, strings.Join(metrics.PushFormats, ", "))
+		}
+		if cfg.MetricsPushInterval < time.Second {
+			ps.add("metrics_push_interval", "must be at least 1s")
+		}
+	}
+	if cfg.StatsDAddr != "" && !strings.HasPrefix(cfg.StatsDAddr, "unix://") {
+		if _, _, err := net.SplitHostPort(cfg.StatsDAddr); err != nil {
+			ps.add("statsd_addr", "%q must be host:port or unix:///path", cfg.StatsDAddr)
+		}
+	}
+
+	if cfg.TargetPort < 0 || cfg.TargetPort > 65535 {
+		ps.add("target_port", "%d is out of range", cfg.TargetPort)
+	}
+
+	if len(cfg.Routes) == 0 && cfg.Controller == "" && cfg.ControllerPort == 0 {
+		ps.add("routes", "no routes configured: set target_port, mock or ports, or add routes")
+	}
+	names := map[string]bool{}
+	paths := map[string]string{}        // port and path -> route name
+	protocols := map[int]models.Route{} // port -> first route on it
+	for i, r := range cfg.Routes {
+		at := fmt.Sprintf("routes[%d]", i)
+		if names[r.Name] {
+			ps.add(at+".name", "duplicate route name %q", r.Name)
+		}
+		names[r.Name] = true
+
+		if r.Port < 1 || r.Port > 65535 {
+			ps.add(at+".port", "%d is out of range", r.Port)
+		}
+		if !slices.Contains(Protocols, r.Protocol) {
+			ps.add(at+".protocol", "%q must be one of %s", r.Protocol, strings.Join(Protocols, ", "))
+		}
+		if first, ok := protocols[r.Port]; !ok {
+			protocols[r.Port] = r
+		} else if first.Protocol != r.Protocol {
+			ps.add(at+".protocol", "port %d already serves %s for route %q", r.Port, first.Protocol, first.Name)
+		} else if r.Protocol == "tcp" {
+			ps.add(at+".port", "port %d is already forwarded by route %q; tcp ports take a single route", r.Port, first.Name)
+		}
+
+		if !strings.HasPrefix(r.Path, "/") {
+			ps.add(at+".path", "%q must start with /", r.Path)
+		}
+		key := fmt.Sprintf("%d%s", r.Port, r.Path)
+		if other, ok := paths[key]; ok {
+			ps.add(at+".path", "%q on port %d already used by route %q", r.Path, r.Port, other)
+		}
+		paths[key] = r.Name
+
+		if (r.ClientCert == "") != (r.ClientKey == "") {
+			ps.add(at+".client_cert", "client_cert and client_key must be set together")
+		}
+		if (r.ClientCert != "" || r.CACert != "") && !strings.HasPrefix(r.Target, "https://") {
+			ps.add(at+".client_cert", "client certificates and ca_cert need an https target")
+		}
+		if (r.TLSServerName != "" || len(r.TLSALPN) > 0) && !strings.HasPrefix(r.Target, "https://") {
+			ps.add(at+".tls_server_name", "tls_server_name and tls_alpn need an https target")
+		}
+
+		if r.GRPCWeb && (r.Protocol == "tcp" || isFastCGI(r.Target) || isLocal(r.Target)) {
+			ps.add(at+".grpc_web", "needs an http or https target")
+		}
+		if r.Coalesce && r.Protocol == "tcp" {
+			ps.add(at+".coalesce", "only applies to HTTP routes")
+		}
+		if r.SlowRequestThreshold < 0 {
+			ps.add(at+".slow_request_threshold", "must not be negative")
+		} else if r.SlowRequestThreshold > 0 && r.Protocol == "tcp" {
+			ps.add(at+".slow_request_threshold", "only applies to HTTP routes")
+		}
+		if r.MaxRequestDuration < 0 {
+			ps.add(at+".max_request_duration", "must not be negative")
+		} else if r.MaxRequestDuration > 0 && r.Protocol == "tcp" {
+			ps.add(at+".max_request_duration", "only applies to HTTP routes")
+		}
+		if r.ViaTailnet && (isFastCGI(r.Target) || isLocal(r.Target)) {
+			ps.add(at+".via_tailnet", "needs an http, https or tcp target")
+		}
+		if r.WebDAV.Enabled && !strings.HasPrefix(r.Target, "file://") {
+			ps.add(at+".webdav", "needs a file:// target, the directory to share")
+		}
+		switch strings.ToLower(r.Log.Level) {
+		case "", "error", "info", "debug":
+		default:
+			ps.add(at+".log.level", "%q must be one of error, info, debug", r.Log.Level)
+		}
+		if r.Log.SampleRate < 0 || r.Log.SampleRate > 1 {
+			ps.add(at+".log.sample_rate", "must be between 0 and 1")
+		} else if r.Log.SampleRate > 0 && (r.Log.AccessLog == "off" || r.Log.AccessLog == "" && cfg.AccessLog == "") {
+			ps.add(at+".log.sample_rate", "needs an access log, access_log or log.access_log")
+		}
+
+		if c := r.Cache; c.Enabled {
+			if r.Protocol == "tcp" {
+				ps.add(at+".cache", "only applies to HTTP routes")
+			}
+			if c.TTL < 0 || c.StaleWhileRevalidate < 0 || c.StaleIfError < 0 || c.MaxEntries < 0 {
+				ps.add(at+".cache", "cache settings must not be negative")
+			}
+		}
+
+		if od := r.OnDemand; len(od.Command) > 0 {
+			if r.Protocol == "tcp" || isLocal(r.Target) || r.ViaTailnet {
+				ps.add(at+".on_demand", "needs a local http, https or fastcgi target")
+			}
+			if od.IdleTimeout < 0 || od.StartTimeout < 0 {
+				ps.add(at+".on_demand", "timeouts must not be negative")
+			}
+		} else if r.OnDemand.IdleTimeout != 0 || r.OnDemand.StartTimeout != 0 {
+			ps.add(at+".on_demand.command", "required to start the backend on demand")
+		}
+
+		if sc := r.Schedule; len(sc.Windows) > 0 {
+			if r.Protocol == "tcp" {
+				ps.add(at+".schedule", "only applies to HTTP routes")
+			}
+			if _, err := schedule.Parse(sc.Windows, sc.Timezone); err != nil {
+				ps.add(at+".schedule", "%v", err)
+			}
+			if sc.ClosedPage != "" {
+				if _, err := os.Stat(sc.ClosedPage); err != nil {
+					ps.add(at+".schedule.closed_page", "%v", err)
+				}
+			}
+		} else if r.Schedule.Timezone != "" || r.Schedule.ClosedPage != "" {
+			ps.add(at+".schedule.windows", "required for a schedule")
+		}
+
+		if pc := r.Posture; pc.RejectExpired || len(pc.RequireTags) > 0 {
+			if r.Protocol == "tcp" {
+				ps.add(at+".posture", "only applies to HTTP routes")
+			}
+			for j, tag := range pc.RequireTags {
+				if !strings.HasPrefix(tag, "tag:") {
+					ps.add(fmt.Sprintf("%s.posture.require_tags[%d]", at, j), "%q must start with tag:", tag)
+				}
+			}
+			if pc.DeniedPage != "" {
+				if _, err := os.Stat(pc.DeniedPage); err != nil {
+					ps.add(at+".posture.denied_page", "%v", err)
+				}
+			}
+		} else if r.Posture.DeniedPage != "" {
+			ps.add(at+".posture", "denied_page needs reject_expired or require_tags")
+		}
+
+		if fw := r.Firewall; len(fw.Rules) > 0 || len(fw.Signatures) > 0 {
+			if r.Protocol == "tcp" {
+				ps.add(at+".firewall", "only applies to HTTP routes")
+			}
+			if _, err := firewall.New(fw); err != nil {
+				ps.add(at+".firewall", "%v", err)
+			}
+		}
+
+		for _, l := range []struct {
+			key  string
+			list []string
+		}{{"allow", r.PublicIPs.Allow}, {"deny", r.PublicIPs.Deny}} {
+			if len(l.list) == 0 {
+				continue
+			}
+			if r.Protocol == "tcp" {
+				ps.add(at+".public_ips", "only applies to HTTP routes")
+			}
+			if _, err := firewall.ParsePrefixes(l.list); err != nil {
+				ps.add(at+".public_ips."+l.key, "%v", err)
+			}
+		}
+
+		for _, l := range []struct {
+			key  string
+			list []string
+		}{{"allow_countries", r.PublicIPs.AllowCountries}, {"deny_countries", r.PublicIPs.DenyCountries}} {
+			if len(l.list) == 0 {
+				continue
+			}
+			if r.Protocol == "tcp" {
+				ps.add(at+".public_ips", "only applies to HTTP routes")
+			}
+			if cfg.GeoIPDB == "" {
+				ps.add(at+".public_ips."+l.key, "requires geoip_db, to look up countries")
+			}
+			for j, c := range l.list {
+				if len(c) != 2 || strings.Trim(strings.ToUpper(c), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+					ps.add(fmt.Sprintf("%s.public_ips.%s[%d]", at, l.key, j), "%q must be a two-letter ISO country code, e.g. DE", c)
+				}
+			}
+		}
+
+		if rw := r.RewriteBody; len(rw.Replace) > 0 {
+			if r.Protocol == "tcp" || isFastCGI(r.Target) || isLocal(r.Target) || r.GRPCWeb {
+				ps.add(at+".rewrite_body", "needs an http or https target")
+			}
+			for j, rep := range rw.Replace {
+				if rep.Find == "" {
+					ps.add(fmt.Sprintf("%s.rewrite_body.replace[%d].find", at, j), "must not be empty")
+				}
+			}
+			if rw.MaxBytes < 0 {
+				ps.add(at+".rewrite_body.max_bytes", "must not be negative")
+			}
+		} else if len(rw.ContentTypes) > 0 {
+			ps.add(at+".rewrite_body", "content_types without replace has no effect")
+		}
+
+		if r.Subpath.Enabled {
+			if r.Protocol == "tcp" || isFastCGI(r.Target) || isLocal(r.Target) || r.GRPCWeb {
+				ps.add(at+".subpath", "needs an http or https target")
+			}
+			if strings.Trim(r.Path, "/") == "" {
+				ps.add(at+".subpath", "needs a route path other than /")
+			}
+		} else if r.Subpath.BaseHref {
+			ps.add(at+".subpath.base_href", "needs subpath.enabled")
+		}
+
+		if c := r.Cookies; len(c.Domain) > 0 || len(c.Path) > 0 || c.Secure || c.SameSite != "" {
+			if r.Protocol == "tcp" || isFastCGI(r.Target) || isLocal(r.Target) || r.GRPCWeb {
+				ps.add(at+".cookies", "needs an http or https target")
+			}
+			for from, to := range c.Path {
+				if !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+					ps.add(at+".cookies.path", "%q: %q: paths must start with /", from, to)
+				}
+			}
+			switch strings.ToLower(c.SameSite) {
+			case "", "lax", "strict", "none":
+			default:
+				ps.add(at+".cookies.same_site", "%q must be lax, strict or none", c.SameSite)
+			}
+		}
+
+		if wh := r.WebhookRelay; wh.Provider != "" || wh.SecretFile != "" {
+			switch wh.Provider {
+			case "github", "stripe", "standard":
+			default:
+				ps.add(at+".webhook_relay.provider", "%q must be github, stripe or standard", wh.Provider)
+			}
+			if r.Protocol == "tcp" {
+				ps.add(at+".webhook_relay", "only applies to HTTP routes")
+			}
+			if wh.SecretFile == "" {
+				ps.add(at+".webhook_relay.secret_file", "is required")
+			} else if _, err := os.Stat(wh.SecretFile); err != nil {
+				ps.add(at+".webhook_relay.secret_file", "%v", err)
+			}
+			if r.SignIn.Enabled {
+				ps.add(at+".webhook_relay", "can't be combined with sign_in")
+			}
+			if wh.ReplayWindow < 0 || wh.MaxBody < 0 {
+				ps.add(at+".webhook_relay", "replay_window and max_body must not be negative")
+			}
+		}
+
+		if len(r.IdentityHeaders) > 0 || r.SSOPreset != "" {
+			if r.Protocol == "tcp" {
+				ps.add(at+".identity_headers", "only applies to HTTP routes")
+			}
+			if r.SSOPreset != "" && !slices.Contains(identity.Presets(), r.SSOPreset) {
+				ps.add(at+".sso_preset", "unknown preset %q, want one of %s", r.SSOPreset, strings.Join(identity.Presets(), ", "))
+			} else if _, err := identity.Parse(r.SSOPreset, r.IdentityHeaders); err != nil {
+				ps.add(at+".identity_headers", "%v", err)
+			}
+		}
+
+		if r.SignIn.Enabled && r.Protocol == "tcp" {
+			ps.add(at+".sign_in", "only applies to HTTP routes")
+		}
+		if r.SignIn.Session < 0 {
+			ps.add(at+".sign_in.session", "must not be negative")
+		}
+
+		if r.Strict.Enabled && r.Protocol == "tcp" {
+			ps.add(at+".strict", "only applies to HTTP routes")
+		}
+		if r.Strict.MaxHeaders < 0 || r.Strict.MaxHeaderBytes < 0 {
+			ps.add(at+".strict", "limits must not be negative")
+		}
+
+		for _, t := range []struct{ key, target string }{{"http", r.Sniff.HTTP}, {"tls", r.Sniff.TLS}, {"ssh", r.Sniff.SSH}} {
+			if t.target == "" {
+				continue
+			}
+			if r.Protocol != "tcp" {
+				ps.add(at+".sniff", "only applies to tcp routes")
+			} else if _, _, err := net.SplitHostPort(t.target); err != nil {
+				ps.add(at+".sniff."+t.key, "target %q must be host:port", t.target)
+			}
+		}
+		if r.Sniff.Timeout < 0 {
+			ps.add(at+".sniff.timeout", "must not be negative")
+		}
+		if (r.TCP != models.TCPOptions{}) && r.Protocol != "tcp" {
+			ps.add(at+".tcp", "only applies to tcp routes")
+		}
+		if r.TCP.ReadBuffer < 0 || r.TCP.WriteBuffer < 0 {
+			ps.add(at+".tcp", "buffer sizes must not be negative")
+		}
+
+		switch {
+		case r.Protocol == "tcp":
+			if _, _, err := net.SplitHostPort(r.Target); err != nil {
+				ps.add(at+".target", "tcp target %q must be host:port", r.Target)
+			}
+		case strings.HasPrefix(r.Target, "file://"):
+			if err := validateStatic(r.Target); err != nil {
+				ps.add(at+".target", "%v", err)
+			}
+		case strings.HasPrefix(r.Target, "mock://"):
+			if err := validateMock(r.Target); err != nil {
+				ps.add(at+".target", "%v", err)
+			}
+		case isFastCGI(r.Target):
+			if err := validateFastCGI(r.Target); err != nil {
+				ps.add(at+".target", "%v", err)
+			}
+			if !strings.HasPrefix(r.Root, "/") {
+				ps.add(at+".root", "fastcgi targets need the absolute document root on the FastCGI server")
+			}
+		default:
+			if err := validateTarget(r.Target); err != nil {
+				ps.add(at+".target", "%v", err)
+			}
+		}
+	}
+
+	return src.locate(ps).err()
+}
+
+// checkConflicts reports options that can't be combined. It runs before
+// Normalize, which would otherwise hide them.
+func checkConflicts(cfg *models.Config) Problems {
+	var ps Problems
+	if cfg.TargetPort != 0 && len(cfg.Routes) > 0 {
+		ps.add("target_port", "conflicts with routes: target_port is shorthand for a single route, set one or the other")
+	}
+	if cfg.Mock != "" && (cfg.TargetPort != 0 || len(cfg.Routes) > 0) {
+		ps.add("mock", "conflicts with routes and target_port: mock is shorthand for a single route, set one or the other")
+	}
+	if cfg.Controller != "" && (cfg.TargetPort != 0 || cfg.Mock != "" || len(cfg.Routes) > 0 || len(cfg.Ports) > 0) {
+		ps.add("controller", "conflicts with routes, ports, target_port and mock: an agent takes its routes from the controller")
+	}
+	if cfg.FailFast && cfg.RetryForever {
+		ps.add("retry_forever", "conflicts with fail_fast: set one or the other")
+	}
+	return ps
+}
+
+func validateTarget(target string) error {
+	return validateURL("target", target)
+}
+
+func validateStatic(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %v", target, err)
+	}
+	if u.Host != "" || !filepath.IsAbs(u.Path) {
+		return fmt.Errorf("target %q must be file:///absolute/path", target)
+	}
+	if fi, err := os.Stat(u.Path); err != nil {
+		return fmt.Errorf("target %q: %v", target, err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("target %q is not a directory", target)
+	}
+	return nil
+}
+
+// validateMock checks a mock:// target is a fixture directory or an
+// OpenAPI document that parses.
+func validateMock(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %v", target, err)
+	}
+	if u.Host != "" || !filepath.IsAbs(u.Path) {
+		return fmt.Errorf("target %q must be mock:///absolute/path, a directory of fixtures or an OpenAPI document", target)
+	}
+	if _, err := mock.New(u.Path); err != nil {
+		return fmt.Errorf("target %q: %v", target, err)
+	}
+	return nil
+}
+
+// isLocal reports whether target is answered by tsrouter itself, from
+// files or mock responses, with no backend to proxy to.
+func isLocal(target string) bool {
+	return strings.HasPrefix(target, "file://") || strings.HasPrefix(target, "mock://")
+}
+
+func isFastCGI(target string) bool {
+	return strings.HasPrefix(target, "fastcgi://") || strings.HasPrefix(target, "fastcgi+unix://")
+}
+
+func validateFastCGI(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %v", target, err)
+	}
+	if u.Scheme == "fastcgi+unix" {
+		if u.Host != "" || u.Path == "" {
+			return fmt.Errorf("target %q must be fastcgi+unix:///path/to/socket", target)
+		}
+		return nil
+	}
+	if u.Port() == "" {
+		return fmt.Errorf("target %q must be fastcgi://host:port", target)
+	}
+	return nil
+}
+
+// validateURL checks that value is an absolute http(s) URL; what names the
+// setting in messages.
+func validateURL(what, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", what)
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %v", what, value, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s %q must use http or https", what, value)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s %q has no host", what, value)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// parseFile turns a config file into a generic tree of maps, slices and
+// scalars, choosing the format from the file extension. All formats then go
+// through the same decoder, so they share one schema and one set of rules.
+func parseFile(path string, data []byte) (map[string]interface{}, error) {
+	tree := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", "":
+		if err := yaml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&tree); err != nil {
+			if se, ok := err.(*json.SyntaxError); ok {
+				return nil, fmt.Errorf("line %d: %v", lineAt(data, se.Offset), err)
+			}
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q (use .yaml, .toml or .json)", ext)
+	}
+	return tree, nil
+}
+
+// decode copies a parsed tree onto dst, a pointer to a struct whose fields
+// are named by their yaml tags. Keys missing from the tree leave the
+// existing field values alone; unknown keys and type mismatches are
+// collected as problems.
+func decode(tree map[string]interface{}, dst interface{}) Problems {
+	var ps Problems
+	decodeValue("", tree, reflect.ValueOf(dst).Elem(), &ps)
+	return ps
+}
+
+func decodeValue(path string, in interface{}, out reflect.Value, ps *Problems) {
+	if out.Type() == durationType {
+		s, ok := in.(string)
+		if !ok {
+			typeError(ps, path, "duration", in)
+			return
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			ps.add(path, "invalid duration %q", s)
+			return
+		}
+		out.SetInt(int64(d))
+		return
+	}
+
+	switch out.Kind() {
+	case reflect.Struct:
+		m, ok := in.(map[string]interface{})
+		if !ok {
+			typeError(ps, path, "table", in)
+			return
+		}
+		fields := structFields(out.Type())
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			idx, ok := fields[key]
+			if !ok {
+				unknownKey(ps, joinPath(path, key), key, fields)
+				continue
+			}
+			decodeValue(joinPath(path, key), m[key], out.FieldByIndex(idx), ps)
+		}
+
+	case reflect.Slice:
+		items, ok := toList(in)
+		if !ok {
+			// Allow "a, b" for lists of strings, like the flag and env forms.
+			if s, isStr := in.(string); isStr && out.Type().Elem().Kind() == reflect.String {
+				v, _ := parseValue(out.Type(), s)
+				out.Set(v)
+				return
+			}
+			typeError(ps, path, "list", in)
+			return
+		}
+		slice := reflect.MakeSlice(out.Type(), len(items), len(items))
+		for i, item := range items {
+			decodeValue(fmt.Sprintf("%s[%d]", path, i), item, slice.Index(i), ps)
+		}
+		out.Set(slice)
+
+	case reflect.Map:
+		m, ok := in.(map[string]interface{})
+		if !ok {
+			typeError(ps, path, "table", in)
+			return
+		}
+		result := reflect.MakeMapWithSize(out.Type(), len(m))
+		for key, val := range m {
+			elem := reflect.New(out.Type().Elem()).Elem()
+			decodeValue(joinPath(path, key), val, elem, ps)
+			result.SetMapIndex(reflect.ValueOf(key), elem)
+		}
+		out.Set(result)
+
+	case reflect.String:
+		s, ok := in.(string)
+		if !ok {
+			typeError(ps, path, "string", in)
+			return
+		}
+		out.SetString(s)
+
+	case reflect.Bool:
+		b, ok := in.(bool)
+		if !ok {
+			typeError(ps, path, "boolean", in)
+			return
+		}
+		out.SetBool(b)
+
+	case reflect.Int, reflect.Int64:
+		n, ok := toFloat(in)
+		if !ok || n != math.Trunc(n) {
+			typeError(ps, path, "integer", in)
+			return
+		}
+		out.SetInt(int64(n))
+
+	case reflect.Float64:
+		n, ok := toFloat(in)
+		if !ok {
+			typeError(ps, path, "number", in)
+			return
+		}
+		out.SetFloat(n)
+
+	default:
+		ps.add(path, "unsupported field type %s", out.Type())
+	}
+}
+
+func unknownKey(ps *Problems, path, key string, fields map[string][]int) {
+	known := make([]string, 0, len(fields))
+	for k := range fields {
+		known = append(known, k)
+	}
+	if s := suggest(key, known); s != "" {
+		ps.add(path, "unknown key %q (did you mean %q?)", key, s)
+		return
+	}
+	ps.add(path, "unknown key %q", key)
+}
+
+// structFields maps yaml tag names to field indexes.
+func structFields(t reflect.Type) map[string][]int {
+	fields := map[string][]int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if key != "" && key != "-" {
+			fields[key] = f.Index
+		}
+	}
+	return fields
+}
+
+func toList(in interface{}) ([]interface{}, bool) {
+	switch v := in.(type) {
+	case []interface{}:
+		return v, true
+	case []map[string]interface{}: // TOML arrays of tables
+		items := make([]interface{}, len(v))
+		for i, m := range v {
+			items[i] = m
+		}
+		return items, true
+	}
+	return nil, false
+}
+
+func toFloat(in interface{}) (float64, bool) {
+	switch v := in.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func joinPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func typeError(ps *Problems, path, want string, got interface{}) {
+	ps.add(path, "expected %s, got %s", want, describe(got))
+}
+
+func describe(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int64, uint64, float64, json.Number:
+		return "number"
+	case map[string]interface{}:
+		return "table"
+	case []interface{}, []map[string]interface{}:
+		return "list"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// maxHostnameLen is the DNS label limit; longer expansions are cut to it.
+const maxHostnameLen = 63
+
+var nonLabelRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// branchEnv lists the variables CI systems put the branch in, since their
+// checkouts are usually detached.
+var branchEnv = []string{"GITHUB_HEAD_REF", "GITHUB_REF_NAME", "CI_COMMIT_REF_NAME", "BRANCH_NAME"}
+
+// hostnameVars are the values available to hostname templates. Each is
+// looked up only if the template uses it, and turned into something that
+// fits in a DNS label.
+type hostnameVars struct {
+	configPath string
+}
+
+// User is the local user name, without any Windows domain.
+func (v hostnameVars) User() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	name := u.Username
+	if i := strings.LastIndex(name, `\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return label(name), nil
+}
+
+// Host is the machine's hostname, up to the first dot.
+func (v hostnameVars) Host() (string, error) {
+	h, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	h, _, _ = strings.Cut(h, ".")
+	return label(h), nil
+}
+
+// Service is the name of the config file without its extension.
+func (v hostnameVars) Service() (string, error) {
+	if v.configPath == "" {
+		return "", fmt.Errorf("{{.Service}} is the config file name, but no config file is used")
+	}
+	base := filepath.Base(v.configPath)
+	return label(strings.TrimSuffix(base, filepath.Ext(base))), nil
+}
+
+// GitBranch is the branch checked out in the config file's directory (or
+// the working directory), or the branch a CI job runs for.
+func (v hostnameVars) GitBranch() (string, error) {
+	for _, name := range branchEnv {
+		if b := os.Getenv(name); b != "" {
+			return label(b), nil
+		}
+	}
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	if v.configPath != "" {
+		cmd.Dir = filepath.Dir(v.configPath)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			msg, _, _ := strings.Cut(strings.TrimSpace(string(ee.Stderr)), "\n")
+			return "", fmt.Errorf("failed to get git branch: %s", msg)
+		}
+		return "", fmt.Errorf("failed to get git branch: %v", err)
+	}
+	b := strings.TrimSpace(string(out))
+	if b == "HEAD" {
+		return "", fmt.Errorf("failed to get git branch: HEAD is detached")
+	}
+	return label(b), nil
+}
+
+// label lowercases s and replaces everything but letters and digits with
+// hyphens, so "feature/Login_v2" becomes "feature-login-v2".
+func label(s string) string {
+	return strings.Trim(nonLabelRe.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// expandHostname expands a hostname containing template actions, such as
+// "{{.User}}-{{.Service}}" or "dev-{{.GitBranch}}".
+func expandHostname(cfg *models.Config, configPath string) Problems {
+	if !strings.Contains(cfg.Hostname, "{{") {
+		return nil
+	}
+	var ps Problems
+	tmpl, err := template.New("hostname").Option("missingkey=error").Parse(cfg.Hostname)
+	if err != nil {
+		ps.add("hostname", "invalid template: %v", err)
+		return ps
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, hostnameVars{configPath: configPath}); err != nil {
+		ps.add("hostname", "failed to expand %q: %v", cfg.Hostname, err)
+		return ps
+	}
+
+	name := b.String()
+	if len(name) > maxHostnameLen {
+		name = strings.TrimRight(name[:maxHostnameLen], "-")
+	}
+	cfg.Hostname = name
+	return nil
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// includeFiles merges the files matched by the include globs of the config
+// file at path into its parsed tree, in order: the globs in the order
+// given, each glob's matches sorted by name. Lists such as routes are
+// appended to; any other key may only be set in one file. Globs are
+// relative to the config file's directory, and included files can't
+// include others.
+func includeFiles(path string, tree map[string]interface{}, src *Source) Problems {
+	val, ok := tree["include"]
+	if !ok {
+		return nil
+	}
+	delete(tree, "include")
+
+	var ps Problems
+	var patterns []string
+	if s, ok := val.(string); ok {
+		patterns = []string{s}
+	} else if items, ok := toList(val); ok {
+		for i, item := range items {
+			s, ok := item.(string)
+			if !ok {
+				typeError(&ps, fmt.Sprintf("include[%d]", i), "string", item)
+				continue
+			}
+			patterns = append(patterns, s)
+		}
+	} else {
+		typeError(&ps, "include", "glob or list of globs", val)
+	}
+
+	dir := filepath.Dir(path)
+	seen := map[string]bool{filepath.Clean(path): true}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			ps.add("include", "invalid glob %q: %v", pattern, err)
+			continue
+		}
+		for _, m := range matches {
+			if seen[filepath.Clean(m)] {
+				continue
+			}
+			seen[filepath.Clean(m)] = true
+			ps = append(ps, mergeFile(m, tree, src)...)
+		}
+	}
+	return ps
+}
+
+// mergeFile merges the config file at path into tree, recording where its
+// keys are in src.
+func mergeFile(path string, tree map[string]interface{}, src *Source) Problems {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Problems{{Path: "include", Msg: fmt.Sprintf("failed to read %s: %v", path, err)}}
+	}
+	inc, err := parseFile(path, data)
+	if err != nil {
+		return Problems{{Path: "include", Msg: fmt.Sprintf("failed to parse %s: %v", path, err)}}
+	}
+	lines := positions(path, data)
+
+	var ps Problems
+	from, vps := migrate(inc)
+	for _, p := range vps {
+		ps = append(ps, Problem{Path: "include", Msg: fmt.Sprintf("%s: %s: %s", path, p.Path, p.Msg)})
+	}
+	if from < Version {
+		src.Migrated = append(src.Migrated, path)
+	}
+	if _, ok := inc["include"]; ok {
+		ps = append(ps, Problem{Path: "include", Msg: fmt.Sprintf("%s: included files can't include others", path)})
+		delete(inc, "include")
+	}
+	interpolated := interpolate(inc, filepath.Dir(path))
+
+	keys := make([]string, 0, len(inc))
+	for key := range inc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	offsets := map[string]int{} // merged keys -> index their list items start at
+	fresh := map[string]bool{}  // keys first set by this file
+	for _, key := range keys {
+		if items, ok := toList(inc[key]); ok {
+			existing, _ := toList(tree[key])
+			if _, set := tree[key]; set && existing == nil {
+				ps = append(ps, Problem{Path: key, Msg: "is also set in " + path})
+				continue
+			}
+			offsets[key] = len(existing)
+			fresh[key] = existing == nil
+			tree[key] = append(append([]interface{}{}, existing...), items...)
+		} else if _, set := tree[key]; set {
+			ps = append(ps, Problem{Path: key, Msg: "is also set in " + path})
+			continue
+		} else {
+			tree[key] = inc[key]
+			offsets[key] = 0
+			fresh[key] = true
+		}
+	}
+
+	for p, line := range lines {
+		top := strings.FieldsFunc(p, func(r rune) bool { return r == '.' || r == '[' })[0]
+		if offset, ok := offsets[top]; ok && (p != top || fresh[top]) {
+			src.at(shiftIndex(p, top, offset), path, line)
+		}
+	}
+	for _, p := range interpolated {
+		top := strings.FieldsFunc(p.Path, func(r rune) bool { return r == '.' || r == '[' })[0]
+		p.Path = shiftIndex(p.Path, top, offsets[top])
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// shiftIndex moves a path below the list key, such as routes[0].target, by
+// offset items.
+func shiftIndex(path, key string, offset int) string {
+	rest, ok := strings.CutPrefix(path, key+"[")
+	if !ok || offset == 0 {
+		return path
+	}
+	i := strings.IndexByte(rest, ']')
+	n, err := strconv.Atoi(rest[:max(i, 0)])
+	if i < 0 || err != nil {
+		return path
+	}
+	return fmt.Sprintf("%s[%d]%s", key, n+offset, rest[i+1:])
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// filePrefix marks a value that should be replaced by the contents of a
+// file, e.g. "client_secret: file:/run/secrets/ts". file:// URLs, such as
+// static targets, are left as they are.
+const filePrefix = "file:"
+
+// envRefRe matches $${...} (an escaped literal) and ${NAME} or
+// ${NAME:-default}.
+var envRefRe = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate resolves ${ENV} references and file: values in every string of
+// a parsed config tree. Relative file paths are taken relative to baseDir,
+// the directory of the config file.
+func interpolate(tree map[string]interface{}, baseDir string) Problems {
+	var ps Problems
+	for key, val := range tree {
+		tree[key] = interpolateValue(key, val, baseDir, &ps)
+	}
+	return ps
+}
+
+func interpolateValue(path string, val interface{}, baseDir string, ps *Problems) interface{} {
+	switch v := val.(type) {
+	case string:
+		resolved, err := interpolateString(v, baseDir)
+		if err != nil {
+			ps.add(path, "%v", err)
+			return v
+		}
+		return resolved
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = interpolateValue(joinPath(path, key), item, baseDir, ps)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = interpolateValue(fmt.Sprintf("%s[%d]", path, i), item, baseDir, ps)
+		}
+	case []map[string]interface{}:
+		for i, item := range v {
+			interpolateValue(fmt.Sprintf("%s[%d]", path, i), item, baseDir, ps)
+		}
+	}
+	return val
+}
+
+func interpolateString(s, baseDir string) (string, error) {
+	var missing []string
+	s = envRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envRefRe.FindStringSubmatch(ref)
+		if val, ok := os.LookupEnv(m[1]); ok {
+			return val
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		missing = append(missing, m[1])
+		return ref
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	if name, ok := strings.CutPrefix(s, filePrefix); ok && !strings.HasPrefix(name, "//") {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(baseDir, name)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("failed to read referenced file: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return s, nil
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeepsFileURLs(t *testing.T) {
+	dir := t.TempDir()
+	docs := filepath.Join(dir, "docs")
+	if err := os.Mkdir(docs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "tsrouter.yaml")
+	data := "client_secret: file:secret\nroutes:\n  - path: /docs\n    target: file://" + docs + "\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got, want := cfg.Routes[0].Target, "file://"+docs; got != want {
+		t.Errorf("target = %q, want %q", got, want)
+	}
+	if got, want := cfg.ClientSecret, "s3cret"; got != want {
+		t.Errorf("client_secret = %q, want %q", got, want)
+	}
+}
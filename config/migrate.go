@@ -0,0 +1,146 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the config schema version this tsrouter reads and writes.
+// Files without a version key are taken as version 1, the schema before
+// versioning; older versions are migrated on load.
+const Version = 1
+
+// migrations[v-1] upgrades a parsed version v tree to version v+1. A
+// breaking change to the schema bumps Version and adds the migration here,
+// so existing files keep loading. Migrations see the file's strings as
+// written, before ${VAR} and file: references are resolved.
+var migrations []func(tree map[string]interface{}) Problems
+
+// migrate upgrades a parsed config file to Version, removing its version
+// key, and returns the version it was written for.
+func migrate(tree map[string]interface{}) (int, Problems) {
+	val, ok := tree["version"]
+	if !ok {
+		return 1, nil
+	}
+	delete(tree, "version")
+
+	var ps Problems
+	n, ok := toFloat(val)
+	if !ok || n != math.Trunc(n) {
+		typeError(&ps, "version", "integer", val)
+		return Version, ps
+	}
+	from := int(n)
+	switch {
+	case from < 1:
+		ps.add("version", "must be at least 1")
+		return Version, ps
+	case from > Version:
+		ps.add("version", "%d is newer than this tsrouter reads (up to %d), upgrade tsrouter", from, Version)
+		return Version, ps
+	}
+	for v := from; v < Version; v++ {
+		ps = append(ps, migrations[v-1](tree)...)
+	}
+	return from, ps
+}
+
+// Migration is the result of MigrateFile.
+type Migration struct {
+	From int
+	// Data is the file's new content, or nil if it's already current.
+	Data []byte
+	// Reencoded is set when the file had to be written out anew, which
+	// loses its comments and key order, rather than just given a version.
+	Reencoded bool
+}
+
+// MigrateFile upgrades the config file at path to Version, returning the
+// new content rather than writing it. Files it includes are left alone;
+// migrate them separately.
+func MigrateFile(path string) (*Migration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	tree, err := parseFile(path, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	_, versioned := tree["version"]
+	from, ps := migrate(tree)
+	if err := ps.err(); err != nil {
+		src := newSource()
+		src.File = path
+		src.lines = positions(path, data)
+		return nil, src.locate(ps).err()
+	}
+
+	m := &Migration{From: from}
+	switch {
+	case from == Version && versioned:
+	case from == Version:
+		m.Data = addVersion(path, data, len(tree) == 0)
+	default:
+		m.Data, err = encodeFile(path, tree)
+		m.Reencoded = true
+	}
+	return m, err
+}
+
+// addVersion puts a version key at the top of a current file, leaving the
+// rest as it is.
+func addVersion(path string, data []byte, empty bool) []byte {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return append([]byte(fmt.Sprintf("version = %d\n\n", Version)), data...)
+	case ".json":
+		i := bytes.IndexByte(data, '{')
+		if empty {
+			return []byte(fmt.Sprintf("{\n  \"version\": %d\n}\n", Version))
+		}
+		return append(append(data[:i+1:i+1], fmt.Sprintf("\n  \"version\": %d,", Version)...), data[i+1:]...)
+	}
+	line := fmt.Sprintf("version: %d\n\n", Version)
+	if rest, ok := bytes.CutPrefix(data, []byte("---\n")); ok {
+		return append([]byte("---\n"+line), rest...)
+	}
+	return append([]byte(line), data...)
+}
+
+// encodeFile writes out a migrated tree in the format of path, with the
+// version first.
+func encodeFile(path string, tree map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		fmt.Fprintf(&buf, "version = %d\n\n", Version)
+		if err := toml.NewEncoder(&buf).Encode(tree); err != nil {
+			return nil, err
+		}
+	case ".json":
+		tree["version"] = Version
+		data, err := json.MarshalIndent(tree, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(append(data, '\n'))
+	default:
+		fmt.Fprintf(&buf, "version: %d\n\n", Version)
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(tree); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
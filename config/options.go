@@ -0,0 +1,283 @@
+package config
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// EnvPrefix prefixes the environment variable of every option.
+const EnvPrefix = "TSROUTER_"
+
+// Scope selects which options a command exposes as flags.
+type Scope int
+
+const (
+	// ScopeAll exposes every option.
+	ScopeAll Scope = iota
+	// ScopeAPI exposes only what's needed to talk to the Tailscale API.
+	ScopeAPI
+)
+
+// option describes one scalar field of models.Config.
+type option struct {
+	Key   string // key in the config file
+	Flag  string
+	Env   []string // in order of preference
+	Usage string
+	Def   string
+	api   bool
+	index []int
+	typ   reflect.Type
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// options returns the settable scalar options of models.Config, in field
+// order. Lists and nested structs (such as routes) are file-only.
+func options() []option {
+	var opts []option
+	t := reflect.TypeOf(models.Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" || !isScalar(f.Type) {
+			continue
+		}
+
+		env := []string{EnvPrefix + strings.ToUpper(key)}
+		if legacy := f.Tag.Get("env"); legacy != "" {
+			env = append(env, strings.Split(legacy, ",")...)
+		}
+		opts = append(opts, option{
+			Key:   key,
+			Flag:  strings.ReplaceAll(key, "_", "-"),
+			Env:   env,
+			Usage: f.Tag.Get("usage"),
+			Def:   f.Tag.Get("default"),
+			api:   f.Tag.Get("scope") == "api",
+			index: f.Index,
+			typ:   f.Type,
+		})
+	}
+	return opts
+}
+
+func isScalar(t reflect.Type) bool {
+	if t == durationType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Int, reflect.Bool, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// typeName is the placeholder shown for the option's value in help output.
+func (o option) typeName() string {
+	if o.typ == durationType {
+		return "duration"
+	}
+	switch o.typ.Kind() {
+	case reflect.Int:
+		return "int"
+	case reflect.Bool:
+		return ""
+	case reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "list"
+	}
+	return "string"
+}
+
+// set parses raw according to the option's type and stores it in cfg.
+func (o option) set(cfg *models.Config, raw string) error {
+	v, err := parseValue(o.typ, raw)
+	if err != nil {
+		return fmt.Errorf("invalid value %q: %v", raw, err)
+	}
+	reflect.ValueOf(cfg).Elem().FieldByIndex(o.index).Set(v)
+	return nil
+}
+
+func parseValue(t reflect.Type, raw string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	if t == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(int64(d))
+		return v, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return v, fmt.Errorf("not an integer")
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return v, fmt.Errorf("not a boolean")
+		}
+		v.SetBool(b)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return v, fmt.Errorf("not a number")
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	}
+	return v, nil
+}
+
+// Flags records the option values given on the command line.
+type Flags struct {
+	ConfigPath      string
+	ConfigSHA256    string
+	ConfigPublicKey string
+	set             map[string]string
+	remoteSum       [32]byte // of the remote config last loaded
+}
+
+// BindFlags registers the --config flags and one flag per option in scope.
+func BindFlags(fs *flag.FlagSet, scope Scope) *Flags {
+	f := &Flags{set: map[string]string{}}
+	fs.StringVar(&f.ConfigPath, "config", "", "Path to a config file, or an http(s)://, s3:// or git+ URL to fetch it from")
+	fs.StringVar(&f.ConfigSHA256, "config-sha256", "", "SHA-256 checksum a remote config must match")
+	fs.StringVar(&f.ConfigPublicKey, "config-public-key", "", "PEM Ed25519 public key a remote config's .sig signature must verify with")
+	for _, opt := range options() {
+		if scope == ScopeAPI && !opt.api {
+			continue
+		}
+		fs.Var(&optionFlag{flags: f, opt: opt}, opt.Flag, opt.Usage)
+	}
+	return f
+}
+
+// optionFlag is a flag.Value that records the raw value for the loader,
+// which applies it after the file and environment.
+type optionFlag struct {
+	flags *Flags
+	opt   option
+}
+
+func (o *optionFlag) String() string {
+	if o == nil || o.flags == nil {
+		return ""
+	}
+	if v, ok := o.flags.set[o.opt.Key]; ok {
+		return v
+	}
+	return o.opt.Def
+}
+
+func (o *optionFlag) Set(s string) error {
+	if _, err := parseValue(o.opt.typ, s); err != nil {
+		return err
+	}
+	o.flags.set[o.opt.Key] = s
+	return nil
+}
+
+func (o *optionFlag) IsBoolFlag() bool { return o.opt.typ.Kind() == reflect.Bool }
+
+// TypeName lets help output show a meaningful value placeholder.
+func (o *optionFlag) TypeName() string { return o.opt.typeName() }
+
+// Resolve builds the effective config. Later sources win:
+//
+//	defaults < config file < environment < flags
+//
+// The config file is taken from --config, or TSROUTER_CONFIG if unset. The
+// result is normalized but not validated; the returned Source can be passed
+// to Validate to locate problems.
+func Resolve(flags *Flags) (*models.Config, *Source, error) {
+	if flags == nil {
+		flags = &Flags{}
+	}
+	cfg := &models.Config{}
+	src := newSource()
+	opts := options()
+
+	for _, opt := range opts {
+		if opt.Def != "" {
+			if err := opt.set(cfg, opt.Def); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	path := flags.Path()
+	if IsRemote(path) {
+		local, sum, err := fetchRemote(context.Background(), path, flags)
+		if err != nil {
+			return nil, nil, errdefs.Wrap(errdefs.ErrConfig, err)
+		}
+		flags.remoteSum = sum
+		path = local
+	}
+	if path != "" {
+		if err := loadFile(path, cfg, src); err != nil {
+			return nil, nil, errdefs.Wrap(errdefs.ErrConfig, err)
+		}
+	}
+
+	var ps Problems
+	for _, opt := range opts {
+		for _, name := range opt.Env {
+			if raw, ok := os.LookupEnv(name); ok && raw != "" {
+				src.override(opt.Key, name)
+				if err := opt.set(cfg, raw); err != nil {
+					ps.add(opt.Key, "%v", err)
+				}
+				break
+			}
+		}
+	}
+
+	for _, opt := range opts {
+		if raw, ok := flags.set[opt.Key]; ok {
+			src.override(opt.Key, "--"+opt.Flag)
+			if err := opt.set(cfg, raw); err != nil {
+				ps.add(opt.Key, "%v", err)
+			}
+		}
+	}
+
+	ps = append(ps, expandHostname(cfg, path)...)
+	ps = append(ps, applyProfile(cfg, flags.set)...)
+	ps = append(ps, checkConflicts(cfg)...)
+	ps = append(ps, checkPorts(cfg)...)
+	if err := src.locate(ps).err(); err != nil {
+		return nil, nil, err
+	}
+
+	Normalize(cfg)
+	return cfg, src, nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// Protocols lists the protocols a node port can serve.
+var Protocols = []string{"https", "http", "tcp"}
+
+var portRe = regexp.MustCompile(`^(\d+)\s*(?:\(\s*(\w+)\s*\))?\s*->\s*(\S+)$`)
+
+// parsePort expands a "ports" shorthand entry such as "443->3000",
+// "8443->http://127.0.0.1:9090" or "2222(tcp)->22" into a route. The
+// protocol defaults to https; a bare target port means localhost.
+func parsePort(s string) (models.Route, error) {
+	m := portRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return models.Route{}, fmt.Errorf("%q must look like <port>[(<protocol>)]-><target>, e.g. 2222(tcp)->22", s)
+	}
+	port, _ := strconv.Atoi(m[1])
+	r := models.Route{
+		Name:     fmt.Sprintf("port-%d", port),
+		Path:     "/",
+		Port:     port,
+		Protocol: strings.ToLower(m[2]),
+		Target:   m[3],
+	}
+	if r.Protocol == "" {
+		r.Protocol = "https"
+	}
+
+	target := r.Target
+	if _, err := strconv.Atoi(target); err == nil {
+		target = net.JoinHostPort("localhost", target)
+	}
+	switch {
+	case r.Protocol == "tcp":
+		r.Target = target
+	case !strings.Contains(target, "://"):
+		r.Target = "http://" + target
+	}
+	return r, nil
+}
+
+// checkPorts reports "ports" entries that can't be parsed. It runs before
+// Normalize, which skips them.
+func checkPorts(cfg *models.Config) Problems {
+	var ps Problems
+	for i, s := range cfg.Ports {
+		if _, err := parsePort(s); err != nil {
+			ps.add(fmt.Sprintf("ports[%d]", i), "%v", err)
+		}
+	}
+	return ps
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// DefaultProfile is used when no profile is selected.
+const DefaultProfile = "default"
+
+// Profile is a named set of credentials in the credentials file.
+type Profile struct {
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	Tailnet      string `toml:"tailnet"`
+}
+
+// DefaultCredentialsFile returns the credentials file used when
+// credentials_file isn't set.
+func DefaultCredentialsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "tsrouter", "credentials")
+}
+
+// LoadProfiles reads a credentials file: TOML with one table per profile.
+func LoadProfiles(path string) (map[string]Profile, error) {
+	profiles := map[string]Profile{}
+	md, err := toml.DecodeFile(path, &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown key %q", path, undecoded[0].String())
+	}
+	return profiles, nil
+}
+
+// applyProfile fills in the credentials cfg doesn't set from the selected
+// profile. A missing credentials file is only an error when a profile or
+// file was asked for explicitly. An explicitly selected profile also wins
+// over credentials from the config file and environment, so a stray
+// TS_CLIENT_ID can't pair with another tailnet's secret; only flags, listed
+// in fromFlags, still override it.
+func applyProfile(cfg *models.Config, fromFlags map[string]string) Problems {
+	var ps Problems
+	path, name := cfg.CredentialsFile, cfg.Profile
+	explicit := path != "" || name != ""
+	if path == "" {
+		path = DefaultCredentialsFile()
+	}
+	if name == "" {
+		name = DefaultProfile
+	}
+	if path == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) && !explicit {
+		return nil
+	}
+	profiles, err := LoadProfiles(path)
+	if err != nil {
+		ps.add("credentials_file", "%v", err)
+		return ps
+	}
+	p, ok := profiles[name]
+	if !ok {
+		if !explicit {
+			return nil
+		}
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		ps.add("profile", "no profile %q in %s (have: %s)", name, path, strings.Join(names, ", "))
+		return ps
+	}
+
+	fill := func(key string, dst *string, v string) {
+		if v == "" {
+			return
+		}
+		if _, ok := fromFlags[key]; ok {
+			return
+		}
+		if *dst == "" || explicit {
+			*dst = v
+		}
+	}
+	fill("client_id", &cfg.ClientID, p.ClientID)
+	fill("client_secret", &cfg.ClientSecret, p.ClientSecret)
+	fill("tailnet", &cfg.Tailnet, p.Tailnet)
+	return nil
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExplicitProfileOverridesEnv(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", home)
+	if err := os.Mkdir(filepath.Join(home, "tsrouter"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	creds := DefaultCredentialsFile()
+	data := `[default]
+client_id = "default-id"
+client_secret = "default-secret"
+tailnet = "default.example"
+
+[other]
+client_id = "other-id"
+client_secret = "other-secret"
+tailnet = "other.example"
+`
+	if err := os.WriteFile(creds, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TS_CLIENT_ID", "env-id")
+	t.Setenv("TS_CLIENT_SECRET", "env-secret")
+	t.Setenv("TS_TAILNET", "env.example")
+
+	resolve := func(set map[string]string) *Flags { return &Flags{set: set} }
+
+	// The default profile only fills in what the environment leaves unset.
+	cfg, _, err := Resolve(resolve(map[string]string{}))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if cfg.ClientID != "env-id" || cfg.ClientSecret != "env-secret" || cfg.Tailnet != "env.example" {
+		t.Errorf("without --profile got %q/%q/%q, want the environment's credentials", cfg.ClientID, cfg.ClientSecret, cfg.Tailnet)
+	}
+
+	cfg, _, err = Resolve(resolve(map[string]string{"profile": "other"}))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if cfg.ClientID != "other-id" || cfg.ClientSecret != "other-secret" || cfg.Tailnet != "other.example" {
+		t.Errorf("with --profile other got %q/%q/%q, want the profile's credentials", cfg.ClientID, cfg.ClientSecret, cfg.Tailnet)
+	}
+
+	// Flags still win over the selected profile.
+	cfg, _, err = Resolve(resolve(map[string]string{"profile": "other", "tailnet": "flag.example"}))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if cfg.ClientID != "other-id" || cfg.Tailnet != "flag.example" {
+		t.Errorf("with --profile other --tailnet got %q/%q, want other-id/flag.example", cfg.ClientID, cfg.Tailnet)
+	}
+}
@@ -0,0 +1,260 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	fetchTimeout  = time.Minute
+	maxRemoteSize = 10 << 20
+)
+
+// IsRemote reports whether a --config value names a remote source: an
+// http(s):// URL, s3://bucket/key, or a file in a git repository,
+// git+<repo URL>//<path>[?ref=<branch or tag>].
+func IsRemote(path string) bool {
+	for _, prefix := range []string{"http://", "https://", "s3://", "git+"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the config file given by --config or TSROUTER_CONFIG.
+func (f *Flags) Path() string {
+	if f.ConfigPath != "" {
+		return f.ConfigPath
+	}
+	return os.Getenv(EnvPrefix + "CONFIG")
+}
+
+// verifier returns the checksum and public key remote configs must match,
+// from the flags or TSROUTER_CONFIG_SHA256 and TSROUTER_CONFIG_PUBLIC_KEY.
+func (f *Flags) verifier() (sum string, key string) {
+	sum, key = f.ConfigSHA256, f.ConfigPublicKey
+	if sum == "" {
+		sum = os.Getenv(EnvPrefix + "CONFIG_SHA256")
+	}
+	if key == "" {
+		key = os.Getenv(EnvPrefix + "CONFIG_PUBLIC_KEY")
+	}
+	return sum, key
+}
+
+// CheckRemote fetches the remote config again and reports whether it
+// differs from the one last loaded by Resolve. A config that fails
+// verification is an error.
+func CheckRemote(ctx context.Context, f *Flags) (bool, error) {
+	_, sum, err := fetchRemote(ctx, f.Path(), f)
+	if err != nil {
+		return false, err
+	}
+	return sum != f.remoteSum, nil
+}
+
+// fetchRemote downloads a remote config into the user cache directory and
+// verifies it, returning the local file and the checksum of its contents.
+// With a public key, the signature is fetched from the same place with
+// .sig appended.
+func fetchRemote(ctx context.Context, src string, f *Flags) (string, [32]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		cache = os.TempDir()
+	}
+	id := sha256.Sum256([]byte(src))
+	dir := filepath.Join(cache, "tsrouter", "config", hex.EncodeToString(id[:8]))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", [32]byte{}, fmt.Errorf("failed to create config cache: %v", err)
+	}
+	wantSum, keyFile := f.verifier()
+
+	var local string
+	var data, sig []byte
+	switch {
+	case strings.HasPrefix(src, "git+"):
+		if local, err = fetchGit(ctx, strings.TrimPrefix(src, "git+"), filepath.Join(dir, "repo")); err != nil {
+			return "", [32]byte{}, err
+		}
+		if data, err = os.ReadFile(local); err != nil {
+			return "", [32]byte{}, fmt.Errorf("failed to read config: %v", err)
+		}
+		if keyFile != "" {
+			if sig, err = os.ReadFile(local + ".sig"); err != nil {
+				return "", [32]byte{}, fmt.Errorf("failed to read config signature: %v", err)
+			}
+		}
+	default:
+		get := getHTTP
+		if strings.HasPrefix(src, "s3://") {
+			get = getS3
+		}
+		u, err := url.Parse(src)
+		if err != nil {
+			return "", [32]byte{}, fmt.Errorf("invalid config URL: %v", err)
+		}
+		if data, err = get(ctx, u); err != nil {
+			return "", [32]byte{}, err
+		}
+		if keyFile != "" {
+			su := *u
+			su.Path += ".sig"
+			if sig, err = get(ctx, &su); err != nil {
+				return "", [32]byte{}, fmt.Errorf("failed to get config signature: %v", err)
+			}
+		}
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			name = "tsrouter.yaml"
+		}
+		local = filepath.Join(dir, name)
+	}
+
+	sum := sha256.Sum256(data)
+	if wantSum != "" {
+		want, err := hex.DecodeString(wantSum)
+		if err != nil || !hmac.Equal(want, sum[:]) {
+			return "", sum, fmt.Errorf("config from %s doesn't match the checksum %s", src, wantSum)
+		}
+	}
+	if keyFile != "" {
+		if err := verifySignature(keyFile, data, sig); err != nil {
+			return "", sum, fmt.Errorf("config from %s: %v", src, err)
+		}
+	}
+	if !strings.HasPrefix(src, "git+") {
+		tmp := local + ".tmp"
+		if err := os.WriteFile(tmp, data, 0o600); err != nil {
+			return "", sum, fmt.Errorf("failed to cache config: %v", err)
+		}
+		if err := os.Rename(tmp, local); err != nil {
+			return "", sum, fmt.Errorf("failed to cache config: %v", err)
+		}
+	}
+	return local, sum, nil
+}
+
+// verifySignature checks sig, raw or base64, as the Ed25519 signature of
+// data by the PEM public key in keyFile, as made by
+// `openssl pkeyutl -sign -rawin`.
+func verifySignature(keyFile string, data, sig []byte) error {
+	pemData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read public key: %v", err)
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return fmt.Errorf("no PEM public key in %s", keyFile)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	key, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("public key in %s isn't Ed25519", keyFile)
+	}
+	if len(sig) != ed25519.SignatureSize {
+		if sig, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig))); err != nil {
+			return fmt.Errorf("signature is neither raw nor base64")
+		}
+	}
+	if !ed25519.Verify(key, data, sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func getHTTP(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return do(req)
+}
+
+func do(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", req.URL.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", req.URL.Redacted(), err)
+	}
+	if len(data) > maxRemoteSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", req.URL.Redacted(), maxRemoteSize)
+	}
+	return data, nil
+}
+
+// fetchGit checks out the ref of a repo URL (with the file after //) into
+// dir, and returns the file's local path. The git command does the work,
+// so its credential helpers and SSH keys apply.
+func fetchGit(ctx context.Context, src, dir string) (string, error) {
+	ref := "HEAD"
+	if i := strings.LastIndex(src, "?ref="); i >= 0 {
+		src, ref = src[:i], src[i+len("?ref="):]
+	}
+	scheme := strings.Index(src, "://")
+	sep := strings.Index(src[max(scheme+3, 0):], "//")
+	if scheme < 0 || sep < 0 {
+		return "", fmt.Errorf("git config source %q must be git+<repo URL>//<path>", src)
+	}
+	repo, file := src[:scheme+3+sep], src[scheme+3+sep+2:]
+	if !filepath.IsLocal(filepath.FromSlash(file)) {
+		return "", fmt.Errorf("git config source %q: path %q must be inside the repository", src, file)
+	}
+
+	git := func(args ...string) error {
+		out, err := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return "", err
+		}
+		if err := git("init", "-q"); err != nil {
+			return "", err
+		}
+	}
+	// Set every time, in case the URL in the config source changed.
+	git("remote", "remove", "origin")
+	if err := git("remote", "add", "origin", repo); err != nil {
+		return "", err
+	}
+	if err := git("fetch", "-q", "--depth", "1", "origin", ref); err != nil {
+		return "", err
+	}
+	if err := git("checkout", "-q", "--force", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(file)), nil
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// LoadRoutes reads a routes file on a controller: a config file setting
+// only routes and ports, for one agent. It's migrated to the current
+// schema, references and includes are resolved, and the result is checked to decode and returned as JSON, for
+// DecodeRoutes on the agent. Validation needs the agent's own options, so
+// it's left to the agent.
+func LoadRoutes(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes: %v", err)
+	}
+	tree, err := parseFile(path, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	src := newSource()
+	src.File = path
+	src.lines = positions(path, data)
+
+	_, ps := migrate(tree)
+	ps = append(ps, interpolate(tree, filepath.Dir(path))...)
+	ps = append(ps, includeFiles(path, tree, src)...)
+	ps = append(ps, checkRouteKeys(tree)...)
+	cfg := &models.Config{}
+	ps = append(ps, decode(tree, cfg)...)
+	ps = append(ps, checkPorts(cfg)...)
+	if err := src.locate(ps).err(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+// ParseRoutes turns a routes document in the format of ext into JSON for
+// DecodeRoutes. Unlike a file's, its strings are taken as they are:
+// ${VAR} and file: references aren't resolved.
+func ParseRoutes(ext string, data []byte) ([]byte, error) {
+	tree, err := parseFile("routes"+ext, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routes: %v", err)
+	}
+	_, ps := migrate(tree)
+	ps = append(ps, checkRouteKeys(tree)...)
+	if err := ps.err(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+// DecodeRoutes decodes routes from LoadRoutes or ParseRoutes onto cfg,
+// which has none of its own, then normalizes and validates the result.
+func DecodeRoutes(cfg *models.Config, data []byte) error {
+	tree, err := parseFile("routes.json", data)
+	if err != nil {
+		return fmt.Errorf("failed to parse routes: %v", err)
+	}
+	ps := checkRouteKeys(tree)
+	ps = append(ps, decode(tree, cfg)...)
+	ps = append(ps, checkPorts(cfg)...)
+	if err := ps.err(); err != nil {
+		return err
+	}
+	Normalize(cfg)
+	if len(cfg.Routes) == 0 {
+		return Problems{{Path: "routes", Msg: "no routes given"}}
+	}
+	return Validate(cfg, nil)
+}
+
+// checkRouteKeys reports keys other than routes and ports in a routes
+// file, once migrate has removed its version.
+func checkRouteKeys(tree map[string]interface{}) Problems {
+	var ps Problems
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key != "routes" && key != "ports" {
+			ps.add(key, "only routes and ports can be set in a routes file")
+		}
+	}
+	return ps
+}
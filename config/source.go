@@ -0,0 +1,287 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a single config error attached to a key path such as
+// "routes[1].target".
+type Problem struct {
+	Path     string
+	Msg      string
+	Location string // "file:line", "TSROUTER_X" or "--x"; empty if unknown
+	line     int
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.Location != "" {
+		b.WriteString(p.Location + ": ")
+	}
+	if p.Path != "" {
+		b.WriteString(p.Path + ": ")
+	}
+	b.WriteString(p.Msg)
+	return b.String()
+}
+
+// Problems is the error returned when loading or validation fails. It lists
+// every problem found rather than stopping at the first.
+type Problems []Problem
+
+func (ps Problems) Error() string {
+	if len(ps) == 1 {
+		return "invalid config: " + ps[0].String()
+	}
+	lines := make([]string, len(ps))
+	for i, p := range ps {
+		lines[i] = p.String()
+	}
+	return "invalid config:\n  - " + strings.Join(lines, "\n  - ")
+}
+
+func (ps *Problems) add(path, format string, a ...interface{}) {
+	*ps = append(*ps, Problem{Path: path, Msg: fmt.Sprintf(format, a...)})
+}
+
+// Is makes Problems of class errdefs.ErrConfig.
+func (ps Problems) Is(target error) bool { return target == errdefs.ErrConfig }
+
+// err returns ps as an error, or nil if there are no problems.
+func (ps Problems) err() error {
+	if len(ps) == 0 {
+		return nil
+	}
+	return ps
+}
+
+// Source records where each config value came from, so problems can point
+// at the offending line or setting.
+type Source struct {
+	File string
+	// Migrated lists the files, the config file and those it includes,
+	// written for an older schema version and migrated on load.
+	Migrated []string
+
+	lines  map[string]int    // key path -> line in File, or in files[path]
+	files  map[string]string // key path -> included file it came from
+	origin map[string]string // top-level key -> env var or flag that overrode it
+}
+
+func newSource() *Source {
+	return &Source{lines: map[string]int{}, files: map[string]string{}, origin: map[string]string{}}
+}
+
+// at records that the key path is on line of an included file.
+func (s *Source) at(path, file string, line int) {
+	s.lines[path] = line
+	s.files[path] = file
+}
+
+func (s *Source) override(key, origin string) {
+	s.origin[key] = origin
+}
+
+// locate fills in Location for each problem, falling back to the closest
+// enclosing key that has a known position, and sorts them by line.
+func (s *Source) locate(ps Problems) Problems {
+	if s == nil {
+		return ps
+	}
+	for i := range ps {
+		p := &ps[i]
+		top := strings.FieldsFunc(p.Path, func(r rune) bool { return r == '.' || r == '[' })
+		if len(top) > 0 {
+			if origin, ok := s.origin[top[0]]; ok {
+				p.Location = origin
+				continue
+			}
+		}
+		for path := p.Path; path != ""; path = parentPath(path) {
+			if line, ok := s.lines[path]; ok {
+				file := s.File
+				if f, ok := s.files[path]; ok {
+					file = f
+				}
+				p.line = line
+				p.Location = fmt.Sprintf("%s:%d", file, line)
+				break
+			}
+		}
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].line < ps[j].line })
+	return ps
+}
+
+func parentPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// positions finds the line of every key (and list item) in a config file.
+func positions(path string, data []byte) map[string]int {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return tomlPositions(data)
+	case ".json":
+		return jsonPositions(data)
+	}
+	return yamlPositions(data)
+}
+
+func yamlPositions(data []byte) map[string]int {
+	pos := map[string]int{}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		return pos
+	}
+
+	var walk func(path string, n *yaml.Node)
+	walk = func(path string, n *yaml.Node) {
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key := joinPath(path, n.Content[i].Value)
+				pos[key] = n.Content[i].Line
+				walk(key, n.Content[i+1])
+			}
+		case yaml.SequenceNode:
+			for i, item := range n.Content {
+				key := fmt.Sprintf("%s[%d]", path, i)
+				pos[key] = item.Line
+				walk(key, item)
+			}
+		}
+	}
+	walk("", doc.Content[0])
+	return pos
+}
+
+func jsonPositions(data []byte) map[string]int {
+	pos := map[string]int{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	var walk func(path string) bool
+	walk = func(path string) bool {
+		tok, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return false
+				}
+				key := joinPath(path, fmt.Sprint(keyTok))
+				pos[key] = lineAt(data, dec.InputOffset())
+				if !walk(key) {
+					return false
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				key := fmt.Sprintf("%s[%d]", path, i)
+				pos[key] = nextLine(data, dec.InputOffset())
+				if !walk(key) {
+					return false
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err == nil
+	}
+	walk("")
+	return pos
+}
+
+// tomlPositions does a line-oriented scan, which is enough for the flat
+// tables and arrays of tables tsrouter configs use.
+func tomlPositions(data []byte) map[string]int {
+	pos := map[string]int{}
+	counts := map[string]int{}
+	table := ""
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+		case strings.HasPrefix(text, "[["):
+			name := strings.TrimSpace(strings.Trim(text, "[] "))
+			table = fmt.Sprintf("%s[%d]", name, counts[name])
+			counts[name]++
+			pos[table] = line
+		case strings.HasPrefix(text, "["):
+			table = strings.TrimSpace(strings.Trim(text, "[] "))
+			pos[table] = line
+		default:
+			if key, _, ok := strings.Cut(text, "="); ok {
+				key = strings.Trim(strings.TrimSpace(key), `"'`)
+				pos[joinPath(table, key)] = line
+			}
+		}
+	}
+	return pos
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// nextLine returns the line of the next value after offset, skipping
+// separators and whitespace.
+func nextLine(data []byte, offset int64) int {
+	for offset < int64(len(data)) && strings.ContainsRune(" \t\r\n,", rune(data[offset])) {
+		offset++
+	}
+	return lineAt(data, offset)
+}
+
+// suggest returns the candidate closest to key, if it's close enough to be
+// a likely typo.
+func suggest(key string, candidates []string) string {
+	best, bestDist := "", len(key)/2+1
+	for _, c := range candidates {
+		if d := levenshtein(key, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
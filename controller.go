@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/controller"
+	"github.com/whitehawk2/tsrouter/events"
+	"github.com/whitehawk2/tsrouter/models"
+	"tailscale.com/tsnet"
+)
+
+const (
+	// controllerWait is how long an agent's requests wait for new routes.
+	controllerWait = 50 * time.Second
+	// controllerRetry is how long an agent waits after failing to reach
+	// the controller.
+	controllerRetry = 10 * time.Second
+
+	// controllerRoutesName is the file in the instance directory keeping
+	// the routes an agent last applied.
+	controllerRoutesName = "controller-routes.json"
+)
+
+// errRoutesPushed is the cause of the shutdown when the controller pushes
+// new routes.
+var errRoutesPushed = errors.New("controller pushed new routes")
+
+// controllerRoutes sets cfg's routes from the controller, falling back to
+// the ones last applied when it can't be reached or sends routes that
+// don't validate. It returns the version of the routes set.
+func controllerRoutes(ctx context.Context, agent *controller.Agent, cfg *models.Config) (string, error) {
+	data, version, err := agent.Fetch(ctx, "", 0)
+	if err == nil {
+		next := routeless(cfg)
+		if err = config.DecodeRoutes(&next, data); err == nil {
+			if err := agent.Save(data, version); err != nil {
+				log.Warn(err)
+			}
+			reportRoutes(ctx, agent, version, nil)
+			*cfg = next
+			return version, nil
+		}
+		reportRoutes(ctx, agent, version, err)
+		err = fmt.Errorf("controller sent invalid routes: %v", err)
+	}
+	log.Warn(err)
+
+	data, version, cerr := agent.Cached()
+	if cerr != nil {
+		return "", fmt.Errorf("no routes to start with: %v", cerr)
+	}
+	if err := config.DecodeRoutes(cfg, data); err != nil {
+		return "", fmt.Errorf("invalid saved routes: %v", err)
+	}
+	log.WithField("version", version).Warn("Starting with the routes last applied")
+	return version, nil
+}
+
+// watchController waits for the controller to push new routes until ctx
+// is done, and calls restart once it has pushed routes that validate,
+// publishing the change on bus. Routes that don't are reported back and
+// the current ones kept.
+func watchController(ctx context.Context, agent *controller.Agent, cfg *models.Config, running string, bus *events.Bus, restart context.CancelCauseFunc) {
+	have := running
+	for {
+		data, version, err := agent.Fetch(ctx, have, controllerWait)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warn(err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(controllerRetry):
+			}
+			continue
+		}
+		if version == have {
+			continue
+		}
+		have = version
+		if version == running {
+			reportRoutes(ctx, agent, version, nil)
+			continue
+		}
+
+		next := routeless(cfg)
+		if err := config.DecodeRoutes(&next, data); err != nil {
+			log.Warnf("Controller pushed invalid routes, keeping the current ones: %v", err)
+			reportRoutes(ctx, agent, version, err)
+			continue
+		}
+		if err := agent.Save(data, version); err != nil {
+			log.Warn(err)
+		}
+		publishRoutesChanged(bus, planRoutes(cfg.Routes, next.Routes), "controller")
+		log.WithField("version", version).Info("Controller pushed new routes, restarting")
+		restart(errRoutesPushed)
+		return
+	}
+}
+
+// reportRoutes tells the controller which routes are running, or why
+// version was rejected. It's only informational, so failures are logged.
+func reportRoutes(ctx context.Context, agent *controller.Agent, version string, applyErr error) {
+	if err := agent.Report(ctx, version, applyErr); err != nil {
+		log.Debug(err)
+	}
+}
+
+// listenController serves the controller API on a tailnet port, over
+// HTTPS with the node's certificate.
+func listenController(s *tsnet.Server, getCert getCertFunc, lo listenOptions, port int, ctl *controller.Controller, whoIs controller.WhoIsFunc) (*nodePort, error) {
+	ln, err := s.Listen(lo.network("tcp"), fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on controller port %d: %v", port, err)
+	}
+	srv := &http.Server{Handler: ctl.Handler(whoIs, nodeTag)}
+	srv.RegisterOnShutdown(ctl.Close)
+	return &nodePort{
+		name:     fmt.Sprintf("controller port %d", port),
+		port:     port,
+		protocol: "https",
+		ln:       tls.NewListener(ln, &tls.Config{GetCertificate: getCert, NextProtos: []string{"h2", "http/1.1"}}),
+		srv:      srv,
+	}, nil
+}
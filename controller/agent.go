@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Agent takes its routes from a controller.
+type Agent struct {
+	base   string
+	client *http.Client
+	cache  string
+}
+
+// NewAgent returns an agent of the controller at controllerURL, reached
+// through client, which should dial over the tailnet. The routes last
+// applied are kept in the cache file.
+func NewAgent(controllerURL string, client *http.Client, cache string) *Agent {
+	return &Agent{base: strings.TrimSuffix(controllerURL, "/"), client: client, cache: cache}
+}
+
+// Fetch returns the controller's routes for this agent and their version.
+// When have is the version the agent already runs, it waits up to wait
+// for a new one, and returns no routes and have if none comes.
+func (a *Agent) Fetch(ctx context.Context, have string, wait time.Duration) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait+30*time.Second)
+	defer cancel()
+	u := a.base + routesPath
+	if have != "" && wait > 0 {
+		u += "?wait=" + url.QueryEscape(wait.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if have != "" {
+		req.Header.Set("If-None-Match", `"`+have+`"`)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to reach the controller: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read routes from the controller: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, strings.Trim(resp.Header.Get("ETag"), `"`), nil
+	case http.StatusNotModified:
+		return nil, have, nil
+	}
+	return nil, "", fmt.Errorf("controller returned %s: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+// Report tells the controller that version is running or, when applyErr
+// is set, why it was rejected.
+func (a *Agent) Report(ctx context.Context, version string, applyErr error) error {
+	rep := Report{Version: version}
+	if applyErr != nil {
+		rep.Error = applyErr.Error()
+	}
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", a.base+statusPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to report to the controller: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("controller returned %s for the status report", resp.Status)
+	}
+	return nil
+}
+
+type cached struct {
+	Version string          `json:"version"`
+	Routes  json.RawMessage `json:"routes"`
+}
+
+// Save keeps routes as the last applied, so the agent can start with them
+// when the controller can't be reached.
+func (a *Agent) Save(routes []byte, version string) error {
+	data, err := json.Marshal(cached{Version: version, Routes: routes})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.cache), 0o700); err != nil {
+		return fmt.Errorf("failed to save routes: %v", err)
+	}
+	tmp := a.cache + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save routes: %v", err)
+	}
+	return os.Rename(tmp, a.cache)
+}
+
+// Cached returns the routes last saved and their version.
+func (a *Agent) Cached() ([]byte, string, error) {
+	data, err := os.ReadFile(a.cache)
+	if err != nil {
+		return nil, "", fmt.Errorf("no saved routes: %v", err)
+	}
+	var c cached
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, "", fmt.Errorf("invalid saved routes in %s: %v", a.cache, err)
+	}
+	return c.Routes, c.Version, nil
+}
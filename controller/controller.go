@@ -0,0 +1,302 @@
+// Package controller lets one tsrouter instance manage the routes of
+// others over the tailnet. The controller serves each agent the routes
+// file named after its hostname, and agents long-poll it for changes, so
+// a change reaches them as soon as it's made.
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/config"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+const (
+	routesPath = "/v1/routes"
+	statusPath = "/v1/status"
+
+	// maxWait is the longest a routes request waits for a change.
+	maxWait = time.Minute
+	// pollInterval is how often waiting requests check the routes file,
+	// to notice edits made without Push.
+	pollInterval = 2 * time.Second
+)
+
+// extensions are the routes file formats, in the order they're looked for.
+var extensions = []string{".yaml", ".yml", ".toml", ".json"}
+
+var nameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var errNoRoutes = errors.New("no routes file for this agent")
+
+// WhoIsFunc identifies the tailnet peer at a remote address.
+type WhoIsFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+// AgentStatus is what the controller knows about an agent. Served is the
+// version of the routes last sent to it, Applied the version it reports
+// running, and Error why it rejected Served, if it did.
+type AgentStatus struct {
+	Name     string    `json:"name"`
+	Node     string    `json:"node"`
+	LastSeen time.Time `json:"last_seen"`
+	Served   string    `json:"served,omitempty"`
+	Applied  string    `json:"applied,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Report is the body of an agent's status report.
+type Report struct {
+	Version string `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Controller serves routes files from a directory to agents.
+type Controller struct {
+	dir string
+
+	mu      sync.Mutex
+	agents  map[string]*AgentStatus
+	changed chan struct{} // closed and replaced by Push
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// New returns a controller serving the routes files in dir.
+func New(dir string) *Controller {
+	return &Controller{
+		dir:     dir,
+		agents:  map[string]*AgentStatus{},
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Close ends the requests waiting for changes, for shutting down.
+func (c *Controller) Close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+// Routes returns agent's routes as sent to it, and their version.
+func (c *Controller) Routes(agent string) ([]byte, string, error) {
+	path := c.routesFile(agent)
+	if path == "" {
+		return nil, "", errNoRoutes
+	}
+	data, err := config.LoadRoutes(path)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+	return data, hex.EncodeToString(sum[:6]), nil
+}
+
+// routesFile returns the path of agent's routes file, or "" if it has
+// none.
+func (c *Controller) routesFile(agent string) string {
+	for _, ext := range extensions {
+		path := filepath.Join(c.dir, agent+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// Push replaces agent's routes file with data, in the format given by
+// ext, and sends it to the agent right away. It's checked first, and left
+// alone when it doesn't decode.
+func (c *Controller) Push(agent, ext string, data []byte) error {
+	if !nameRe.MatchString(agent) {
+		return fmt.Errorf("%q is not a valid agent hostname", agent)
+	}
+	tmp, err := os.CreateTemp(c.dir, "."+agent+"-*"+ext)
+	if err != nil {
+		return fmt.Errorf("failed to write routes: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write routes: %v", err)
+	}
+	path := filepath.Join(c.dir, agent+ext)
+	if _, err := config.LoadRoutes(tmp.Name()); err != nil {
+		return errors.New(strings.ReplaceAll(err.Error(), tmp.Name(), path))
+	}
+
+	for _, other := range extensions {
+		if other != ext {
+			os.Remove(filepath.Join(c.dir, agent+other))
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write routes: %v", err)
+	}
+
+	c.mu.Lock()
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// Agents lists the agents that have been in touch, by name.
+func (c *Controller) Agents() []AgentStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]AgentStatus, 0, len(c.agents))
+	for _, a := range c.agents {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// seen records that agent, on node, was in touch, and applies update to
+// its status.
+func (c *Controller) seen(agent, node string, update func(*AgentStatus)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a := c.agents[agent]
+	if a == nil {
+		a = &AgentStatus{Name: agent}
+		c.agents[agent] = a
+	}
+	a.Node = node
+	a.LastSeen = time.Now()
+	if update != nil {
+		update(a)
+	}
+}
+
+func (c *Controller) changes() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changed
+}
+
+// Handler returns the API agents call over the tailnet. Only nodes with
+// tag are served, each the routes named after its own node, so one agent
+// can't read another's.
+func (c *Controller) Handler(whoIs WhoIsFunc, tag string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+routesPath, func(w http.ResponseWriter, r *http.Request) {
+		agent, node, ok := identify(w, r, whoIs, tag)
+		if ok {
+			c.serveRoutes(w, r, agent, node)
+		}
+	})
+	mux.HandleFunc("POST "+statusPath, func(w http.ResponseWriter, r *http.Request) {
+		agent, node, ok := identify(w, r, whoIs, tag)
+		if !ok {
+			return
+		}
+		var rep Report
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&rep); err != nil {
+			http.Error(w, "invalid status report: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.seen(agent, node, func(a *AgentStatus) {
+			if rep.Error == "" {
+				a.Applied = rep.Version
+			}
+			a.Error = rep.Error
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// identify names the agent calling, from its node's name. It writes the
+// error response and returns false if the caller isn't an agent.
+func identify(w http.ResponseWriter, r *http.Request, whoIs WhoIsFunc, tag string) (agent, node string, ok bool) {
+	who, err := whoIs(r.Context(), r.RemoteAddr)
+	if err != nil || who.Node == nil {
+		http.Error(w, "Forbidden: unknown peer", http.StatusForbidden)
+		return "", "", false
+	}
+	if !slices.Contains(who.Node.Tags, tag) {
+		http.Error(w, "Forbidden: agents must be tagged "+tag, http.StatusForbidden)
+		return "", "", false
+	}
+	// The node's hostname is up to the node, but its computed name is kept
+	// unique by the control plane, so only that names its routes file. A
+	// node whose hostname differs, because another already has it, is
+	// refused rather than served the other's routes.
+	agent = strings.ToLower(who.Node.ComputedName)
+	if hostname := who.Node.Hostinfo.Hostname(); !strings.EqualFold(hostname, agent) {
+		http.Error(w, fmt.Sprintf("Forbidden: hostname %q doesn't match node name %q", hostname, agent), http.StatusForbidden)
+		return "", "", false
+	}
+	if !nameRe.MatchString(agent) {
+		http.Error(w, "Forbidden: invalid agent name", http.StatusForbidden)
+		return "", "", false
+	}
+	return agent, strings.TrimSuffix(who.Node.Name, "."), true
+}
+
+// serveRoutes answers a routes request. With If-None-Match set to the
+// version the agent has, it waits up to the wait query parameter for a
+// new one, answering 304 Not Modified if none comes.
+func (c *Controller) serveRoutes(w http.ResponseWriter, r *http.Request, agent, node string) {
+	have := strings.Trim(r.Header.Get("If-None-Match"), `"`)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+	wait = min(wait, maxWait)
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	for {
+		changed := c.changes()
+		data, version, err := c.Routes(agent)
+		switch {
+		case errors.Is(err, errNoRoutes):
+			c.seen(agent, node, nil)
+			http.Error(w, fmt.Sprintf("no routes for %s in the controller", agent), http.StatusNotFound)
+			return
+		case err != nil:
+			c.seen(agent, node, nil)
+			http.Error(w, fmt.Sprintf("routes for %s are invalid on the controller: %v", agent, err), http.StatusServiceUnavailable)
+			return
+		case version != have:
+			c.seen(agent, node, func(a *AgentStatus) { a.Served = version })
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"`+version+`"`)
+			w.Write(data)
+			return
+		}
+		c.seen(agent, node, nil)
+
+		select {
+		case <-changed:
+		case <-poll.C:
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-c.closed:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/metrics"
+)
+
+// Alert thresholds used when the config sets no SLO.
+const (
+	defaultAlertLatency    = time.Second
+	defaultAlertErrorRatio = 0.05
+)
+
+func metricsCommand() *command {
+	return &command{
+		name:    "metrics",
+		summary: "Generate monitoring for tsrouter's metrics",
+		examples: []string{
+			"tsrouter metrics dashboard --config tsrouter.yaml > dashboard.json",
+		},
+		subcommands: []*command{
+			metricsDashboardCommand(),
+		},
+	}
+}
+
+func metricsDashboardCommand() *command {
+	fs := newFlagSet("metrics dashboard")
+	flags := config.BindFlags(fs, config.ScopeAll)
+	job := fs.String("job", "tsrouter", "Prometheus job label the instance is scraped or pushed as (empty matches any)")
+	alerts := fs.Bool("alerts", false, "Print Prometheus alert rules instead of the dashboard")
+	dir := fs.String("dir", "", "Write both, as tsrouter-dashboard.json and tsrouter-alerts.yaml, to this directory")
+
+	return &command{
+		name:    "dashboard",
+		summary: "Print a Grafana dashboard or Prometheus alert rules for the configured routes",
+		description: `
+Generates a Grafana dashboard with an overview of every route, a row of
+traffic, latency and error panels for each configured route, and the node's
+Tailscale peers and certificates. With --alerts, prints Prometheus alert
+rules instead: the instance being down, each route's 5xx ratio and p99
+latency exceeding slo_error_ratio and slo_latency (5% and 1s when unset)
+over metrics_window, and a certificate expiring within cert_expiry_warning.
+Regenerate both when routes change.`,
+		examples: []string{
+			"tsrouter metrics dashboard --config tsrouter.yaml > dashboard.json",
+			"tsrouter metrics dashboard --config tsrouter.yaml --alerts > /etc/prometheus/rules/tsrouter.yaml",
+			"tsrouter metrics dashboard --config tsrouter.yaml --dir monitoring/",
+		},
+		flags: fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+
+			opts := metrics.DashboardOptions{
+				Title:      "tsrouter",
+				Job:        *job,
+				Window:     cfg.MetricsWindow,
+				Latency:    cfg.SLOLatency,
+				ErrorRatio: cfg.SLOErrorRatio,
+				CertExpiry: cfg.CertExpiryWarning,
+			}
+			if cfg.Hostname != "" {
+				opts.Title += " " + cfg.Hostname
+			}
+			if opts.Latency == 0 {
+				opts.Latency = defaultAlertLatency
+			}
+			if opts.ErrorRatio == 0 {
+				opts.ErrorRatio = defaultAlertErrorRatio
+			}
+			for _, r := range cfg.Routes {
+				opts.Routes = append(opts.Routes, r.Name)
+			}
+
+			dashboard, err := metrics.Dashboard(opts)
+			if err != nil {
+				return err
+			}
+			rules, err := metrics.AlertRules(opts)
+			if err != nil {
+				return err
+			}
+			if *dir == "" {
+				if *alerts {
+					_, err = os.Stdout.Write(rules)
+				} else {
+					_, err = fmt.Println(string(dashboard))
+				}
+				return err
+			}
+
+			if err := os.MkdirAll(*dir, 0o755); err != nil {
+				return err
+			}
+			for name, data := range map[string][]byte{
+				"tsrouter-dashboard.json": append(dashboard, '\n'),
+				"tsrouter-alerts.yaml":    rules,
+			} {
+				path := filepath.Join(*dir, name)
+				if err := os.WriteFile(path, data, 0o644); err != nil {
+					return err
+				}
+				fmt.Println("Wrote", path)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// deviceFilter selects devices by tag, hostname prefix and last-seen age.
+// A zero-valued filter matches every device.
+type deviceFilter struct {
+	tag            string
+	hostnamePrefix string
+	offlineFor     time.Duration
+}
+
+func (f *deviceFilter) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.tag, "tag", "", "Only devices carrying this tag (e.g. tag:server)")
+	fs.StringVar(&f.hostnamePrefix, "hostname-prefix", "", "Only devices whose hostname starts with this prefix")
+	fs.DurationVar(&f.offlineFor, "offline-for", 0, "Only devices not seen for at least this long")
+}
+
+func (f *deviceFilter) empty() bool {
+	return f.tag == "" && f.hostnamePrefix == "" && f.offlineFor == 0
+}
+
+func (f *deviceFilter) match(d models.TailscaleDevice) bool {
+	if f.tag != "" && !d.HasTag(f.tag) {
+		return false
+	}
+	if f.hostnamePrefix != "" && !strings.HasPrefix(d.Hostname, f.hostnamePrefix) {
+		return false
+	}
+	if f.offlineFor > 0 && time.Since(d.LastSeen) < f.offlineFor {
+		return false
+	}
+	return true
+}
+
+func devicesCommand() *command {
+	return &command{
+		name:    "devices",
+		summary: "List and prune tailnet devices",
+		examples: []string{
+			"tsrouter devices list --tag tag:server",
+			"tsrouter devices delete --hostname-prefix preview- --offline-for 24h",
+		},
+		subcommands: []*command{
+			devicesListCommand(),
+			devicesActionCommand("delete", "Delete devices from the tailnet", "Deleted"),
+			devicesActionCommand("expire", "Expire device node keys", "Expired"),
+		},
+	}
+}
+
+func devicesListCommand() *command {
+	var filter deviceFilter
+	fs := newFlagSet("devices list")
+	flags := config.BindFlags(fs, config.ScopeAPI)
+	filter.register(fs)
+	output := outputFlag(fs)
+
+	return &command{
+		name:    "list",
+		summary: "List devices",
+		flags:   fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			api, err := newAPIClient(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			devices, err := api.ListDevices(ctx)
+			if err != nil {
+				return err
+			}
+
+			shown := []models.TailscaleDevice{}
+			for _, d := range devices {
+				if filter.match(d) {
+					shown = append(shown, d)
+				}
+			}
+			if output.json() {
+				return printJSON(shown)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tHOSTNAME\tADDRESSES\tTAGS\tLAST SEEN\tEXPIRES")
+			for _, d := range shown {
+				expires := "never"
+				if !d.KeyExpiryDisabled && !d.Expires.IsZero() {
+					expires = d.Expires.Local().Format(time.DateTime)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					d.ID, d.Hostname,
+					strings.Join(d.Addresses, ","),
+					strings.Join(d.Tags, ","),
+					d.LastSeen.Local().Format(time.DateTime),
+					expires)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+// devicesActionCommand builds the delete and expire commands, which share
+// their selection logic and differ only in the API call they make.
+func devicesActionCommand(name, summary, past string) *command {
+	var filter deviceFilter
+	fs := newFlagSet("devices " + name)
+	flags := config.BindFlags(fs, config.ScopeAPI)
+	filter.register(fs)
+	dryRun := fs.Bool("dry-run", false, "Print the matching devices without changing anything")
+
+	return &command{
+		name:    name,
+		usage:   "[device-id...]",
+		summary: summary + " by ID or filter",
+		flags:   fs,
+		run: func(ctx context.Context, args []string) error {
+			if len(args) == 0 && filter.empty() {
+				return fmt.Errorf("refusing to %s every device: pass device IDs or at least one filter", name)
+			}
+
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			api, err := newAPIClient(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			targets := args
+			if len(targets) == 0 {
+				devices, err := api.ListDevices(ctx)
+				if err != nil {
+					return err
+				}
+				for _, d := range devices {
+					if filter.match(d) {
+						targets = append(targets, d.ID)
+						fmt.Printf("Matched %s (%s)\n", d.ID, d.Hostname)
+					}
+				}
+			}
+
+			if *dryRun {
+				return nil
+			}
+
+			auditLog, err := openAuditLog(cfg)
+			if err != nil {
+				return err
+			}
+			defer auditLog.Close()
+
+			action := api.DeleteDevice
+			if name == "expire" {
+				action = api.ExpireDevice
+			}
+			for _, id := range targets {
+				err := action(ctx, id)
+				recordAudit(auditLog, "device."+name, id, nil, err)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s %s\n", past, id)
+			}
+			return nil
+		},
+	}
+}
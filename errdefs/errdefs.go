@@ -0,0 +1,52 @@
+// Package errdefs defines the classes of tsrouter failures, so callers can
+// tell them apart with errors.Is, e.g. errors.Is(err, errdefs.ErrAuth),
+// and the CLI can exit with a code per class.
+package errdefs
+
+import "errors"
+
+var (
+	// ErrConfig is an invalid config, or a file it refers to that can't
+	// be used.
+	ErrConfig = errors.New("config error")
+	// ErrAuth is a rejected OAuth client or API credential.
+	ErrAuth = errors.New("authentication error")
+	// ErrAPI is a Tailscale API request that failed for another reason:
+	// unreachable, timed out or answered with an error.
+	ErrAPI = errors.New("tailscale api error")
+	// ErrTailnet is the node failing to start, come up or listen on the
+	// tailnet.
+	ErrTailnet = errors.New("tailnet error")
+	// ErrBackend is a route's backend that can't be reached or started.
+	ErrBackend = errors.New("backend error")
+)
+
+// Classes lists every class, in the order Class checks them.
+var Classes = []error{ErrConfig, ErrAuth, ErrAPI, ErrTailnet, ErrBackend}
+
+type classified struct {
+	class error
+	err   error
+}
+
+func (e *classified) Error() string   { return e.err.Error() }
+func (e *classified) Unwrap() []error { return []error{e.class, e.err} }
+
+// Wrap marks err as being of class, keeping its message. It returns nil
+// for a nil err, and err itself when it's already of a class.
+func Wrap(class, err error) error {
+	if err == nil || Class(err) != nil {
+		return err
+	}
+	return &classified{class: class, err: err}
+}
+
+// Class returns the class err is of, or nil if it has none.
+func Class(err error) error {
+	for _, class := range Classes {
+		if errors.Is(err, class) {
+			return class
+		}
+	}
+	return nil
+}
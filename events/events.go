@@ -0,0 +1,102 @@
+// Package events is an in-process bus for lifecycle events, consumed by
+// notifiers and other observers.
+package events
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Type identifies a kind of event.
+type Type string
+
+const (
+	NodeRegistered   Type = "node_registered"
+	NodeDisconnected Type = "node_disconnected"
+	NodeReconnected  Type = "node_reconnected"
+	BackendUnhealthy Type = "backend_unhealthy"
+	BackendRecovered Type = "backend_recovered"
+	KeyExpiring      Type = "key_expiring"
+	KeyRotated       Type = "key_rotated"
+	CertExpiring     Type = "cert_expiring"
+	CertRenewed      Type = "cert_renewed"
+	RoutesChanged    Type = "routes_changed"
+	BackendSwitched  Type = "backend_switched"
+	Shutdown         Type = "shutdown"
+)
+
+// Types lists every event type, for validating configured filters.
+var Types = []Type{NodeRegistered, NodeDisconnected, NodeReconnected, BackendUnhealthy, BackendRecovered, KeyExpiring, KeyRotated, CertExpiring, CertRenewed, RoutesChanged, BackendSwitched, Shutdown}
+
+// Event is something that happened to the node or one of its routes.
+type Event struct {
+	Type     Type              `json:"type"`
+	Time     time.Time         `json:"time"`
+	Hostname string            `json:"hostname"`
+	Route    string            `json:"route,omitempty"`
+	Message  string            `json:"message"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+const subscriberBuffer = 64
+
+// Bus delivers published events to every subscriber. Publishing never
+// blocks: a subscriber that falls behind misses events.
+type Bus struct {
+	hostname string
+
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewBus returns a bus stamping events with the node's hostname.
+func NewBus(hostname string) *Bus {
+	return &Bus{hostname: hostname, subs: map[chan Event]struct{}{}}
+}
+
+// Publish fills in the event's time and hostname and delivers it.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Hostname = b.hostname
+
+	log.WithFields(log.Fields{
+		"event": e.Type,
+		"route": e.Route,
+	}).Debug(e.Message)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			log.WithField("event", e.Type).Warn("Event subscriber is behind, dropping event")
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// and a function that unsubscribes and closes the channel.
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
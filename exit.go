@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/errdefs"
+)
+
+// exitCodes maps each error class to the code tsrouter exits with for it.
+// Errors of no class exit with 1, and a stop on a signal with 128 plus the
+// signal's number, as shells report it.
+var exitCodes = map[error]int{
+	errdefs.ErrConfig:  2,
+	errdefs.ErrAuth:    3,
+	errdefs.ErrAPI:     4,
+	errdefs.ErrTailnet: 5,
+	errdefs.ErrBackend: 6,
+}
+
+func exitCode(err error) int {
+	var sig signalError
+	if errors.As(err, &sig) {
+		if n, ok := sig.sig.(syscall.Signal); ok {
+			return 128 + int(n)
+		}
+	}
+	if code, ok := exitCodes[errdefs.Class(err)]; ok {
+		return code
+	}
+	return 1
+}
+
+// fatalCleanups run when fatal exits, as its os.Exit skips defers.
+var (
+	fatalMu       sync.Mutex
+	fatalCleanups = map[int]func(){}
+	nextCleanup   int
+)
+
+// cleanup has f run if fatal exits, and returns a func running it now
+// instead, to defer.
+func cleanup(f func()) func() {
+	fatalMu.Lock()
+	id := nextCleanup
+	nextCleanup++
+	fatalCleanups[id] = f
+	fatalMu.Unlock()
+	return func() {
+		fatalMu.Lock()
+		delete(fatalCleanups, id)
+		fatalMu.Unlock()
+		f()
+	}
+}
+
+// fatal logs err and exits with the code for its class, taking class when
+// err has none of its own. class may be nil.
+func fatal(class, err error) {
+	if class != nil {
+		err = errdefs.Wrap(class, err)
+	}
+	log.StandardLogger().Log(log.FatalLevel, err)
+	fatalMu.Lock()
+	for _, f := range fatalCleanups {
+		f()
+	}
+	os.Exit(exitCode(err))
+}
+
+// fatalf is fatal with an error from fmt.Errorf.
+func fatalf(class error, format string, a ...interface{}) {
+	fatal(class, fmt.Errorf(format, a...))
+}
+
+// signalError is the cause of a shutdown on a signal.
+type signalError struct{ sig os.Signal }
+
+func (e signalError) Error() string { return fmt.Sprintf("received %v", e.sig) }
+
+// notifySignals is signal.NotifyContext, with a signalError as the cause.
+func notifySignals(ctx context.Context, sigs ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		select {
+		case sig := <-ch:
+			cancel(signalError{sig})
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel(nil)
+	}
+}
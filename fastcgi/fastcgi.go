@@ -0,0 +1,311 @@
+// Package fastcgi is a FastCGI client exposed as an http.Handler, for
+// serving applications behind php-fpm and similar process managers.
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	typeBeginRequest = 1
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+
+	roleResponder = 1
+	requestID     = 1 // one request per connection
+
+	maxContent = 65535
+
+	dialTimeout = 10 * time.Second
+
+	// maxBufferedBody caps request bodies without a Content-Length, which
+	// have to be read in full because FastCGI scripts rely on CONTENT_LENGTH.
+	maxBufferedBody = 32 << 20
+)
+
+// Handler forwards requests to a FastCGI server. Paths with a segment ending
+// in ".php" (or Ext) run that script, with the rest as PATH_INFO; every other
+// path runs Index as a front controller.
+type Handler struct {
+	Network string // "tcp" or "unix"
+	Addr    string
+	Root    string // document root on the FastCGI server
+	Index   string // script for paths that don't name one, e.g. index.php
+	Ext     string // script extension, ".php" when empty
+
+	// Params, when set, adds parameters to each request (such as
+	// REMOTE_USER for the caller's identity).
+	Params func(r *http.Request) map[string]string
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	length := r.ContentLength
+	if length < 0 {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxBufferedBody+1))
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(data) > maxBufferedBody {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, length = io.NopCloser(bytes.NewReader(data)), int64(len(data))
+	}
+
+	conn, err := net.DialTimeout(h.Network, h.Addr, dialTimeout)
+	if err != nil {
+		log.Warnf("Failed to connect to FastCGI server %s: %v", h.Addr, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	go func() {
+		<-r.Context().Done()
+		conn.Close()
+	}()
+
+	if err := h.writeRequest(conn, r, body, length); err != nil {
+		log.Warnf("Failed to send FastCGI request: %v", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	stdout, stdoutW := io.Pipe()
+	var stderr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stdoutW.CloseWithError(readResponse(conn, stdoutW, &stderr))
+	}()
+	defer func() {
+		stdout.Close()
+		wg.Wait()
+		if stderr.Len() > 0 {
+			log.WithField("script", r.URL.Path).Warnf("FastCGI stderr: %s", strings.TrimSpace(stderr.String()))
+		}
+	}()
+
+	if err := copyResponse(w, stdout); err != nil {
+		log.Warnf("Failed to read FastCGI response: %v", err)
+	}
+}
+
+// writeRequest sends the begin record, the CGI parameters and the body.
+func (h *Handler) writeRequest(conn net.Conn, r *http.Request, body io.Reader, length int64) error {
+	bw := bufio.NewWriter(conn)
+	begin := []byte{0, roleResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeRecord(bw, typeBeginRequest, begin); err != nil {
+		return err
+	}
+
+	var params bytes.Buffer
+	for k, v := range h.params(r, length) {
+		writePair(&params, k, v)
+	}
+	if err := writeStream(bw, typeParams, &params); err != nil {
+		return err
+	}
+	if body != nil {
+		if err := writeStream(bw, typeStdin, body); err != nil {
+			return err
+		}
+	} else if err := writeRecord(bw, typeStdin, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (h *Handler) params(r *http.Request, length int64) map[string]string {
+	script, pathInfo := h.split(r.URL.Path)
+	host, port, _ := net.SplitHostPort(r.Host)
+	if host == "" {
+		host = r.Host
+	}
+	remoteHost, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
+
+	p := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "tsrouter",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     h.Root,
+		"DOCUMENT_URI":      script,
+		"SCRIPT_NAME":       script,
+		"SCRIPT_FILENAME":   strings.TrimSuffix(h.Root, "/") + script,
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteHost,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    strconv.FormatInt(length, 10),
+	}
+	if port == "" {
+		p["SERVER_PORT"] = "80"
+	}
+	if r.TLS != nil {
+		p["HTTPS"] = "on"
+		if port == "" {
+			p["SERVER_PORT"] = "443"
+		}
+	}
+	for name, values := range r.Header {
+		// Proxy is never forwarded (httpoxy).
+		if name == "Content-Type" || name == "Content-Length" || name == "Proxy" {
+			continue
+		}
+		p["HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = strings.Join(values, ", ")
+	}
+	if h.Params != nil {
+		for k, v := range h.Params(r) {
+			p[k] = v
+		}
+	}
+	return p
+}
+
+// split resolves a request path to the script to run and its PATH_INFO.
+func (h *Handler) split(path string) (script, pathInfo string) {
+	ext := h.Ext
+	if ext == "" {
+		ext = ".php"
+	}
+	if i := strings.Index(path, ext); i >= 0 {
+		end := i + len(ext)
+		if end == len(path) || path[end] == '/' {
+			return path[:end], path[end:]
+		}
+	}
+	return "/" + strings.TrimPrefix(h.Index, "/"), path
+}
+
+func writeRecord(w io.Writer, typ byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	hdr := []byte{1, typ, 0, requestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(content)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// writeStream sends r as records of typ, terminated by an empty record.
+func writeStream(w io.Writer, typ byte, r io.Reader) error {
+	buf := make([]byte, maxContent)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if werr := writeRecord(w, typ, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return writeRecord(w, typ, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writePair(b *bytes.Buffer, name, value string) {
+	writeLength(b, len(name))
+	writeLength(b, len(value))
+	b.WriteString(name)
+	b.WriteString(value)
+}
+
+func writeLength(b *bytes.Buffer, n int) {
+	if n < 128 {
+		b.WriteByte(byte(n))
+		return
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(n)|1<<31)
+	b.Write(l[:])
+}
+
+// readResponse demultiplexes records until the end of the request, copying
+// stdout to out and stderr to errOut.
+func readResponse(conn net.Conn, out io.Writer, errOut *bytes.Buffer) error {
+	br := bufio.NewReader(conn)
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return fmt.Errorf("failed to read record: %v", err)
+		}
+		length := int(binary.BigEndian.Uint16(hdr[4:]))
+		content := make([]byte, length+int(hdr[6]))
+		if _, err := io.ReadFull(br, content); err != nil {
+			return fmt.Errorf("failed to read record: %v", err)
+		}
+		content = content[:length]
+
+		switch hdr[1] {
+		case typeStdout:
+			if _, err := out.Write(content); err != nil {
+				return err
+			}
+		case typeStderr:
+			errOut.Write(content)
+		case typeEndRequest:
+			return nil
+		}
+	}
+}
+
+// copyResponse parses the CGI response headers, including the Status
+// pseudo-header, and streams the body to w.
+func copyResponse(w http.ResponseWriter, stdout io.Reader) error {
+	br := bufio.NewReader(stdout)
+	hdr, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && !(errors.Is(err, io.EOF) && len(hdr) > 0) {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return fmt.Errorf("invalid response headers: %v", err)
+	}
+
+	status := http.StatusOK
+	if s := hdr.Get("Status"); s != "" {
+		code, err := strconv.Atoi(strings.Fields(s)[0])
+		if err != nil {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return fmt.Errorf("invalid status %q", s)
+		}
+		status = code
+		hdr.Del("Status")
+	} else if hdr.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	for k, v := range hdr {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	_, err = io.Copy(w, br)
+	return err
+}
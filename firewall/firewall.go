@@ -0,0 +1,166 @@
+// Package firewall screens HTTP requests against simple rules, a few
+// built-in attack signatures and lists of caller addresses.
+package firewall
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// Actions a rule can take.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+	Log   = "log"
+)
+
+// signature is a built-in check. It matches if re matches the decoded path
+// or query, or, with header set, that request header.
+type signature struct {
+	re     *regexp.Regexp
+	header string
+}
+
+var signatures = map[string]signature{
+	"traversal": {re: regexp.MustCompile(`(^|[/\\])\.\.([/\\]|$)`)},
+	"dotfiles":  {re: regexp.MustCompile(`(?i)/\.(git|svn|hg|env|htaccess|htpasswd|aws|ssh|docker)(/|$)`)},
+	"sqli":      {re: regexp.MustCompile(`(?i)(\bunion\b.{0,100}\bselect\b|'\s*or\s+'?\d*'?\s*=|\bor\s+1\s*=\s*1\b|;\s*(drop|delete|insert|update)\s|\bsleep\s*\(\s*\d+\s*\)|\bbenchmark\s*\()`)},
+	"xss":       {re: regexp.MustCompile(`(?i)(<\s*script|javascript:|\bon(error|load|mouseover|focus)\s*=|<\s*iframe|<\s*svg[^>]*\bon\w+\s*=)`)},
+	"scanners":  {re: regexp.MustCompile(`(?i)(sqlmap|nikto|nmap|masscan|zgrab|nuclei|acunetix|wpscan|dirbuster|gobuster)`), header: "User-Agent"},
+}
+
+// Signatures lists the built-in signature names, for "all" and error
+// messages.
+var Signatures = []string{"traversal", "dotfiles", "sqli", "xss", "scanners"}
+
+// Firewall is a compiled models.Firewall.
+type Firewall struct {
+	rules      []rule
+	signatures []string
+}
+
+type rule struct {
+	models.FirewallRule
+	path    *regexp.Regexp
+	headers map[string]*regexp.Regexp
+}
+
+// New compiles fw, checking its actions, expressions and signature names.
+func New(fw models.Firewall) (*Firewall, error) {
+	f := &Firewall{}
+	for i, r := range fw.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("rules[%d]", i)
+		}
+		switch r.Action {
+		case Allow, Deny, Log:
+		default:
+			return nil, fmt.Errorf("rule %s: action %q must be one of allow, deny, log", name, r.Action)
+		}
+		c := rule{FirewallRule: r, headers: map[string]*regexp.Regexp{}}
+		c.Name = name
+		if r.Path != "" {
+			re, err := regexp.Compile(r.Path)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: invalid path expression: %v", name, err)
+			}
+			c.path = re
+		}
+		for h, expr := range r.Headers {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: invalid expression for header %s: %v", name, h, err)
+			}
+			c.headers[h] = re
+		}
+		f.rules = append(f.rules, c)
+	}
+
+	for _, s := range fw.Signatures {
+		switch {
+		case s == "all":
+			f.signatures = Signatures
+		case slices.Contains(Signatures, s):
+			if !slices.Contains(f.signatures, s) {
+				f.signatures = append(f.signatures, s)
+			}
+		default:
+			return nil, fmt.Errorf("unknown signature %q, must be one of %s or all", s, strings.Join(Signatures, ", "))
+		}
+	}
+	return f, nil
+}
+
+// Match is the outcome of a check: the rules or signatures that matched
+// (log rules included) and the resulting action, Allow or Deny.
+type Match struct {
+	Action  string
+	Matched []string
+}
+
+// Check runs req through the rules in order. The first allow or deny rule
+// that matches decides; log rules that match on the way are only noted.
+// Requests no rule decides are denied if any signature matches.
+func (f *Firewall) Check(req *http.Request) Match {
+	var m Match
+	for _, r := range f.rules {
+		if !r.matches(req) {
+			continue
+		}
+		m.Matched = append(m.Matched, r.Name)
+		if r.Action != Log {
+			m.Action = r.Action
+			return m
+		}
+	}
+
+	for _, name := range f.signatures {
+		if signatures[name].matches(req) {
+			m.Matched = append(m.Matched, "signature:"+name)
+			m.Action = Deny
+			return m
+		}
+	}
+	m.Action = Allow
+	return m
+}
+
+// matches reports whether every condition set on r holds for req.
+func (r rule) matches(req *http.Request) bool {
+	if len(r.Methods) > 0 && !slices.ContainsFunc(r.Methods, func(m string) bool { return strings.EqualFold(m, req.Method) }) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+	for h, re := range r.headers {
+		if !slices.ContainsFunc(req.Header.Values(h), re.MatchString) {
+			return false
+		}
+	}
+	if r.BodyLargerThan > 0 && req.ContentLength >= 0 && req.ContentLength <= r.BodyLargerThan {
+		return false // bodies of unknown length count as larger
+	}
+	return true
+}
+
+func (s signature) matches(req *http.Request) bool {
+	if s.header != "" {
+		return slices.ContainsFunc(req.Header.Values(s.header), s.re.MatchString)
+	}
+	if s.re.MatchString(req.URL.Path) {
+		return true
+	}
+	query, err := url.QueryUnescape(req.URL.RawQuery)
+	if err != nil {
+		query = req.URL.RawQuery
+	}
+	return s.re.MatchString(query)
+}
@@ -0,0 +1,118 @@
+// Package geoip looks up the country of IP addresses in a MaxMind (GeoIP2
+// or GeoLite2) database, reloading it when the file is replaced.
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkInterval is how often DB looks for an updated database file.
+const checkInterval = time.Minute
+
+// DB is an open country database.
+type DB struct {
+	path string
+
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+	checked time.Time
+}
+
+// Open opens the database at path, a Country or City .mmdb file.
+func Open(path string) (*DB, error) {
+	db := &DB{path: path}
+	if err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Country returns the ISO 3166-1 country code of addr, such as "DE", or ""
+// if the database doesn't know it.
+func (db *DB) Country(addr netip.Addr) string {
+	db.maybeReload()
+
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	db.mu.RLock()
+	err := db.reader.Lookup(addr.AsSlice(), &rec)
+	db.mu.RUnlock()
+	if err != nil {
+		log.WithField("addr", addr).Debugf("GeoIP lookup failed: %v", err)
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.reader.Close()
+}
+
+// maybeReload reopens the database if the file has changed since the last
+// check, keeping the previous one if the new file fails to open.
+func (db *DB) maybeReload() {
+	db.mu.RLock()
+	stale := time.Since(db.checked) > checkInterval
+	db.mu.RUnlock()
+	if !stale {
+		return
+	}
+
+	db.mu.Lock()
+	db.checked = time.Now()
+	mod := db.modTime
+	db.mu.Unlock()
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		log.WithField("geoip_db", db.path).Warnf("Failed to check GeoIP database: %v", err)
+		return
+	}
+	if !fi.ModTime().After(mod) {
+		return
+	}
+	if err := db.reload(); err != nil {
+		log.WithField("geoip_db", db.path).Warnf("Keeping previous GeoIP database: %v", err)
+		return
+	}
+	log.WithField("geoip_db", db.path).Info("Reloaded GeoIP database")
+}
+
+func (db *DB) reload() error {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoIP database: %v", err)
+	}
+	// Read into memory rather than mapped, so replacing the file in place
+	// can't affect lookups in progress.
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoIP database: %v", err)
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoIP database %s: %v", db.path, err)
+	}
+
+	db.mu.Lock()
+	old := db.reader
+	db.reader, db.modTime, db.checked = reader, fi.ModTime(), time.Now()
+	db.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
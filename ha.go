@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/audit"
+	"github.com/whitehawk2/tsrouter/ha"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+)
+
+// haHolderEnv carries the instance's HA lease holder name across restarts,
+// so a restarted instance keeps its lease instead of failing over.
+const haHolderEnv = "TSROUTER_HA_HOLDER"
+
+// takeLease waits until this instance holds the HA lease, then keeps it in
+// the background, calling restart if it's lost. release stops holding it
+// and, with giveUp, gives it up so the standby takes over right away.
+func takeLease(ctx context.Context, cfg *models.Config, restart context.CancelCauseFunc) (release func(giveUp bool), err error) {
+	lease := ha.New(cfg.HALease, haHolder(), cfg.HALeaseTTL)
+	log.WithField("ha_lease", cfg.HALease).Info("Waiting for the HA lease")
+	if err := lease.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	log.Info("Holding the HA lease, starting as the active instance")
+
+	ctx, stop := context.WithCancel(ctx)
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		if err := lease.Hold(ctx); err != nil {
+			log.Error(err)
+			restart(err)
+		}
+	}()
+	return func(giveUp bool) {
+		stop()
+		<-held
+		if giveUp {
+			if err := lease.Release(); err != nil {
+				log.Warn(err)
+			}
+		}
+	}, nil
+}
+
+// haHolder names this instance in the HA lease.
+func haHolder() string {
+	if holder := os.Getenv(haHolderEnv); holder != "" {
+		return holder
+	}
+	host, _ := os.Hostname()
+	b := make([]byte, 3)
+	rand.Read(b)
+	holder := fmt.Sprintf("%s/%d-%x", host, os.Getpid(), b)
+	os.Setenv(haHolderEnv, holder)
+	return holder
+}
+
+// removeStaleNodes deletes the nodes a failed active instance left behind
+// under the hostname, so the node taking over gets the name rather than a
+// numbered one. Nodes seen within the lease TTL are left alone.
+func removeStaleNodes(ctx context.Context, api *tailscaleapi.Client, cfg *models.Config, auditLog *audit.Log) {
+	devices, err := api.ListDevices(ctx)
+	if err != nil {
+		log.Warnf("Failed to look for nodes left by the previous active instance: %v", err)
+		return
+	}
+	for _, d := range devices {
+		if d.Hostname != cfg.Hostname || !d.HasTag(nodeTag) || time.Since(d.LastSeen) < cfg.HALeaseTTL {
+			continue
+		}
+		err := api.DeleteDevice(ctx, d.ID)
+		recordAudit(auditLog, "device.delete", d.ID, map[string]string{"reason": "ha takeover"}, err)
+		if err != nil {
+			log.Warnf("Failed to delete node %s left by the previous active instance: %v", d.Name, err)
+			continue
+		}
+		log.WithField("device", d.ID).Infof("Deleted node %s left by the previous active instance", d.Name)
+	}
+}
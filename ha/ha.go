@@ -0,0 +1,170 @@
+// Package ha elects the active instance of an active/passive pair through
+// a lease kept in a file both instances can reach, e.g. on a shared volume.
+// The holder renews the lease well before it expires; a standby takes it
+// over once it has expired.
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrLost is returned by Hold when the lease is lost, to another instance
+// or because it couldn't be renewed in time.
+var ErrLost = errors.New("lost the HA lease")
+
+// Lease is one instance's view of the lease file.
+type Lease struct {
+	path   string
+	holder string
+	ttl    time.Duration
+
+	expires time.Time // of the lease this instance last wrote
+}
+
+type record struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// New returns the lease in the file at path for the instance holder. A
+// lease lasts ttl without renewal.
+func New(path, holder string, ttl time.Duration) *Lease {
+	return &Lease{path: path, holder: holder, ttl: ttl}
+}
+
+// Acquire waits until this instance holds the lease, or ctx is done. A
+// lease this instance still holds, such as across a restart, is kept.
+func (l *Lease) Acquire(ctx context.Context) error {
+	standingBy := ""
+	for {
+		r, err := l.read()
+		switch {
+		case err != nil:
+			log.Warn(err)
+		case r.Holder == l.holder || time.Now().After(r.Expires):
+			if err := l.write(); err != nil {
+				log.Warn(err)
+				break
+			}
+			// Another standby may have written it at the same time, and
+			// the last write wins, so check who did once it has settled.
+			if err := sleep(ctx, l.ttl/5); err != nil {
+				return err
+			}
+			if r, err := l.read(); err == nil && r.Holder == l.holder {
+				return nil
+			}
+		case r.Holder != standingBy:
+			log.WithField("holder", r.Holder).Infof("Standing by, the HA lease is held until %s", r.Expires.Local().Format(time.TimeOnly))
+			standingBy = r.Holder
+		}
+		if err := sleep(ctx, l.ttl/3); err != nil {
+			return err
+		}
+	}
+}
+
+// Hold renews the lease until ctx is done. It returns an error wrapping
+// ErrLost once another instance has taken it, or once it's about to
+// expire without having been renewed, so the standby can take over.
+func (l *Lease) Hold(ctx context.Context) error {
+	interval := l.ttl / 3
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+		r, err := l.read()
+		if err == nil && r.Holder != l.holder && r.Holder != "" {
+			return fmt.Errorf("%w: taken over by %s", ErrLost, r.Holder)
+		}
+		if err == nil {
+			err = l.write()
+		}
+		if err != nil {
+			if time.Until(l.expires) < interval {
+				return fmt.Errorf("%w: %v", ErrLost, err)
+			}
+			log.Warnf("Failed to renew the HA lease: %v", err)
+		}
+	}
+}
+
+// Release gives the lease up, if this instance holds it, so the standby
+// takes over right away.
+func (l *Lease) Release() error {
+	r, err := l.read()
+	if err != nil || r.Holder != l.holder {
+		return err
+	}
+	if err := os.Remove(l.path); err != nil {
+		return fmt.Errorf("failed to release the HA lease: %v", err)
+	}
+	return nil
+}
+
+// read returns the lease in the file, or a zero one if there's none.
+func (l *Lease) read() (record, error) {
+	var r record
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return r, fmt.Errorf("failed to read the HA lease: %v", err)
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		// Treated as expired, so the next write replaces it.
+		return record{}, nil
+	}
+	return r, nil
+}
+
+// write records this instance as the holder for another ttl. It replaces
+// the file at once, so readers never see part of it.
+func (l *Lease) write() error {
+	expires := time.Now().Add(l.ttl)
+	data, err := json.Marshal(record{Holder: l.holder, Expires: expires})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), "."+filepath.Base(l.path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to write the HA lease: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the HA lease: %v", err)
+	}
+	l.expires = expires
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
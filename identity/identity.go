@@ -0,0 +1,170 @@
+// Package identity renders request headers from a caller's Tailscale
+// identity, for backends that trust a header for single sign-on.
+package identity
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+var funcs = template.FuncMap{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"user": func(login string) string { // the part of a login name before the @
+		name, _, _ := strings.Cut(login, "@")
+		return name
+	},
+}
+
+// sample is what templates are test-run against, so references to fields
+// that don't exist are caught when the config is loaded.
+var sample = &apitype.WhoIsResponse{
+	Node: &tailcfg.Node{
+		ComputedName: "laptop",
+		Tags:         []string{"tag:example"},
+		Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+	},
+	UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"},
+}
+
+// preset is the headers a backend's trusted-header SSO reads, and others
+// it may read that are removed from requests but not set.
+type preset struct {
+	headers map[string]string
+	strip   []string
+}
+
+// Presets render nothing for tagged nodes, whose WhoIs user profile is a
+// shared placeholder rather than a person.
+const (
+	login   = "{{if not .Node.IsTagged}}{{.UserProfile.LoginName}}{{end}}"
+	name    = "{{if not .Node.IsTagged}}{{.UserProfile.DisplayName}}{{end}}"
+	email   = "{{if not .Node.IsTagged}}{{lower .UserProfile.LoginName}}{{end}}"
+	shortID = "{{if not .Node.IsTagged}}{{user .UserProfile.LoginName}}{{end}}"
+)
+
+var presets = map[string]preset{
+	// auth.proxy with header_name = X-WEBAUTH-USER and
+	// headers = Name:X-WEBAUTH-NAME Email:X-WEBAUTH-EMAIL.
+	"grafana": {
+		headers: map[string]string{"X-WEBAUTH-USER": login, "X-WEBAUTH-NAME": name, "X-WEBAUTH-EMAIL": email},
+		strip:   []string{"X-WEBAUTH-GROUPS", "X-WEBAUTH-ROLE", "X-WEBAUTH-LOGIN"},
+	},
+	// ENABLE_REVERSE_PROXY_AUTHENTICATION with the default header names.
+	// Gitea user names can't contain @, so the part of the login before it
+	// is used.
+	"gitea": {
+		headers: map[string]string{"X-WEBAUTH-USER": shortID, "X-WEBAUTH-EMAIL": email, "X-WEBAUTH-FULLNAME": name},
+	},
+	// AUTH_PROXY_HEADER=X-Remote-User.
+	"miniflux": {
+		headers: map[string]string{"X-Remote-User": login},
+	},
+	// The Remote-* headers Authelia and Authentik send, which many apps
+	// accept.
+	"remote-user": {
+		headers: map[string]string{"Remote-User": login, "Remote-Name": name, "Remote-Email": email},
+		strip:   []string{"Remote-Groups"},
+	},
+}
+
+// Presets returns the names of the built-in presets, sorted.
+func Presets() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Headers is a set of compiled header templates.
+type Headers struct {
+	names     []string
+	strip     []string
+	templates map[string]*template.Template
+}
+
+// Parse compiles header templates, such as
+// {"Remote-User": "{{.UserProfile.LoginName}}"}, on top of those of the
+// named preset, if any. They're executed with the caller's
+// apitype.WhoIsResponse and may use join, lower and user.
+func Parse(presetName string, headers map[string]string) (*Headers, error) {
+	h := &Headers{templates: map[string]*template.Template{}}
+	if presetName != "" {
+		p, ok := presets[presetName]
+		if !ok {
+			return nil, fmt.Errorf("unknown SSO preset %q, want one of %s", presetName, strings.Join(Presets(), ", "))
+		}
+		merged := map[string]string{}
+		for name, text := range p.headers {
+			merged[http.CanonicalHeaderKey(name)] = text
+		}
+		for name, text := range headers {
+			merged[http.CanonicalHeaderKey(name)] = text
+		}
+		headers = merged
+		for _, name := range p.strip {
+			h.strip = append(h.strip, http.CanonicalHeaderKey(name))
+		}
+	}
+	for name, text := range headers {
+		canonical := http.CanonicalHeaderKey(name)
+		tmpl, err := template.New(canonical).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %v", name, err)
+		}
+		if err := tmpl.Execute(new(strings.Builder), sample); err != nil {
+			return nil, fmt.Errorf("header %s: %v", name, err)
+		}
+		h.names = append(h.names, canonical)
+		h.templates[canonical] = tmpl
+	}
+	sort.Strings(h.names)
+	return h, nil
+}
+
+// Names returns the header names, sorted.
+func (h *Headers) Names() []string {
+	return h.names
+}
+
+// Apply removes the headers from req, so clients can't supply them, and
+// sets them from who. Without an identity, or when a template fails or
+// renders empty, the header is left unset. Spellings with underscores for
+// hyphens are removed too, since some servers treat them as the same
+// header.
+func (h *Headers) Apply(req *http.Request, who *apitype.WhoIsResponse) error {
+	for name := range req.Header {
+		canonical := http.CanonicalHeaderKey(strings.ReplaceAll(name, "_", "-"))
+		if slices.Contains(h.names, canonical) || slices.Contains(h.strip, canonical) {
+			delete(req.Header, name)
+		}
+	}
+	if who == nil {
+		return nil
+	}
+	var errs []string
+	for _, name := range h.names {
+		var b strings.Builder
+		if err := h.templates[name].Execute(&b, who); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if v := strings.TrimSpace(b.String()); v != "" && !strings.ContainsAny(v, "\r\n") {
+			req.Header.Set(name, v)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to render identity headers: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+)
+
+// keyDescription is the description tsrouter puts on the keys it creates,
+// which is how `keys list` tells them apart from everything else.
+func keyDescription(hostname string) string {
+	desc := authKeyDescPrefix + hostname
+	if len(desc) > 50 { // API limit
+		desc = desc[:50]
+	}
+	return desc
+}
+
+func isTsrouterKey(k models.TailscaleAuthKey) bool {
+	return strings.HasPrefix(k.Description, authKeyDescPrefix)
+}
+
+func keysCommand() *command {
+	return &command{
+		name:    "keys",
+		summary: "Manage auth keys created by tsrouter",
+		examples: []string{
+			"tsrouter keys list --all",
+			"tsrouter keys create --hostname ci --reusable --expiry 24h",
+			"tsrouter keys revoke k123abcCNTRL",
+		},
+		subcommands: []*command{
+			keysListCommand(),
+			keysCreateCommand(),
+			keysRevokeCommand(),
+		},
+	}
+}
+
+func keysListCommand() *command {
+	fs := newFlagSet("keys list")
+	flags := config.BindFlags(fs, config.ScopeAPI)
+	all := fs.Bool("all", false, "Show all keys in the tailnet, not only those created by tsrouter")
+	output := outputFlag(fs)
+
+	return &command{
+		name:    "list",
+		summary: "List auth keys",
+		flags:   fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			api, err := newAPIClient(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			keys, err := api.ListKeys(ctx)
+			if err != nil {
+				return err
+			}
+
+			shown := []models.TailscaleAuthKey{}
+			for _, k := range keys {
+				if *all || isTsrouterKey(k) {
+					shown = append(shown, k)
+				}
+			}
+			if output.json() {
+				return printJSON(shown)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tDESCRIPTION\tCREATED\tEXPIRES\tEPHEMERAL\tREUSABLE\tTAGS")
+			for _, k := range shown {
+				create := k.Capabilities.Devices.Create
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%t\t%s\n",
+					k.ID, k.Description,
+					k.Created.Local().Format(time.DateTime),
+					k.Expires.Local().Format(time.DateTime),
+					create.Ephemeral, create.Reusable,
+					strings.Join(create.Tags, ","))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func keysCreateCommand() *command {
+	fs := newFlagSet("keys create")
+	flags := config.BindFlags(fs, config.ScopeAPI)
+	hostname := fs.String("hostname", "manual", "Hostname recorded in the key description")
+	tags := fs.String("tags", "tag:server", "Comma-separated tags applied to devices registered with the key")
+	expiry := fs.Duration("expiry", authKeyExpiryDays*24*time.Hour, "Key lifetime")
+	ephemeral := fs.Bool("ephemeral", true, "Register devices as ephemeral")
+	reusable := fs.Bool("reusable", false, "Allow the key to register more than one device")
+	preauthorized := fs.Bool("preauthorized", true, "Skip device approval for devices registered with the key")
+	output := outputFlag(fs)
+
+	return &command{
+		name:    "create",
+		summary: "Create an auth key and print its secret",
+		flags:   fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			api, err := newAPIClient(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			auditLog, err := openAuditLog(cfg)
+			if err != nil {
+				return err
+			}
+			defer auditLog.Close()
+
+			key, err := api.CreateAuthKey(ctx, tailscaleapi.KeyOptions{
+				Description:   keyDescription(*hostname),
+				Expiry:        *expiry,
+				Reusable:      *reusable,
+				Ephemeral:     *ephemeral,
+				Preauthorized: *preauthorized,
+				Tags:          splitList(*tags),
+			})
+			keyID := ""
+			if key != nil {
+				keyID = key.ID
+			}
+			recordAudit(auditLog, "key.create", keyID, map[string]string{"hostname": *hostname, "tags": *tags}, err)
+			if err != nil {
+				return err
+			}
+
+			if output.json() {
+				return printJSON(key)
+			}
+			fmt.Fprintf(os.Stderr, "Created key %s (expires %s)\n", key.ID, key.Expires.Local().Format(time.DateTime))
+			fmt.Println(key.Key)
+			return nil
+		},
+	}
+}
+
+func keysRevokeCommand() *command {
+	fs := newFlagSet("keys revoke")
+	flags := config.BindFlags(fs, config.ScopeAPI)
+
+	return &command{
+		name:    "revoke",
+		usage:   "<key-id>...",
+		summary: "Revoke one or more auth keys",
+		flags:   fs,
+		run: func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("at least one key ID is required")
+			}
+
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			api, err := newAPIClient(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			auditLog, err := openAuditLog(cfg)
+			if err != nil {
+				return err
+			}
+			defer auditLog.Close()
+
+			for _, id := range args {
+				err := api.RevokeKey(ctx, id)
+				recordAudit(auditLog, "key.revoke", id, nil, err)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Revoked %s\n", id)
+			}
+			return nil
+		},
+	}
+}
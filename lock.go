@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lockFileName is locked by the instance using a state directory for as
+// long as it runs.
+const lockFileName = "tsrouter.lock"
+
+// errLocked is returned by lockFile when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// lockInstanceDir takes the lock on an instance directory, so a second
+// invocation with the same hostname fails instead of fighting the first
+// over tsnet state. The OS releases the lock when its holder exits, however
+// it exits, so the lock file a crashed instance leaves behind doesn't get
+// in the way; it only records the holder's PID for the error message.
+func lockInstanceDir(dir string) (unlock func(), err error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create instance directory: %v", err)
+	}
+	path := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errLocked) {
+			holder := "another tsrouter"
+			if pid, _ := os.ReadFile(path); len(pid) > 0 {
+				holder += " (pid " + strings.TrimSpace(string(pid)) + ")"
+			}
+			return nil, fmt.Errorf("%s is in use by %s; each instance needs its own hostname or state_dir", dir, holder)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", dir, err)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return func() {
+		f.Truncate(0)
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,82 @@
+// Package logfile provides size- and age-based rotation for log files.
+package logfile
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Options controls rotation and retention of a log file.
+type Options struct {
+	MaxSizeMB      int           // rotate when the file grows past this size
+	RotateInterval time.Duration // also rotate this often; 0 disables
+	MaxBackups     int           // rotated files to keep; 0 keeps all
+	MaxAge         time.Duration // delete rotated files older than this; 0 keeps all
+	Compress       bool          // gzip rotated files
+}
+
+// File is a rotating log file. It's safe for concurrent use.
+type File struct {
+	lj   *lumberjack.Logger
+	stop chan struct{}
+	once sync.Once
+}
+
+// Open opens path for appending, creating its directory if needed.
+func Open(path string, opts Options) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		lj: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    opts.MaxSizeMB,
+			MaxBackups: opts.MaxBackups,
+			// lumberjack counts retention in whole days.
+			MaxAge:    int(math.Ceil(opts.MaxAge.Hours() / 24)),
+			Compress:  opts.Compress,
+			LocalTime: true,
+		},
+		stop: make(chan struct{}),
+	}
+	if opts.RotateInterval > 0 {
+		go f.rotateEvery(opts.RotateInterval)
+	}
+	return f, nil
+}
+
+func (f *File) rotateEvery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			f.lj.Rotate()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	return f.lj.Write(p)
+}
+
+// Rotate closes the current file and starts a new one.
+func (f *File) Rotate() error {
+	return f.lj.Rotate()
+}
+
+func (f *File) Close() error {
+	f.once.Do(func() { close(f.stop) })
+	return f.lj.Close()
+}
+
+var _ io.WriteCloser = (*File)(nil)
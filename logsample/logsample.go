@@ -0,0 +1,85 @@
+// Package logsample keeps repeated log lines, such as the same backend error
+// for every request during an outage, from flooding the log.
+package logsample
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Formatter passes the first Burst lines with the same level, message and
+// route through Next in each Window, drops the rest, and logs a summary of
+// how many were dropped when the window ends.
+type Formatter struct {
+	Next   log.Formatter
+	Window time.Duration
+	Burst  int
+
+	mu   sync.Mutex
+	seen map[key]*repeat
+}
+
+type key struct {
+	level log.Level
+	route string
+	msg   string
+}
+
+type repeat struct {
+	lines   int
+	dropped int
+}
+
+// Format implements log.Formatter. Dropped lines format to nothing, which
+// logrus writes as nothing.
+func (f *Formatter) Format(e *log.Entry) ([]byte, error) {
+	if f.Window <= 0 || e.Level <= log.FatalLevel {
+		return f.Next.Format(e)
+	}
+	k := key{level: e.Level, route: fmt.Sprint(e.Data["route"]), msg: e.Message}
+
+	f.mu.Lock()
+	if f.seen == nil {
+		f.seen = map[key]*repeat{}
+	}
+	r, ok := f.seen[k]
+	if !ok {
+		r = &repeat{}
+		f.seen[k] = r
+		logger, route := e.Logger, e.Data["route"]
+		time.AfterFunc(f.Window, func() { f.summarize(logger, route, k) })
+	}
+	r.lines++
+	drop := r.lines > f.Burst
+	if drop {
+		r.dropped++
+	}
+	f.mu.Unlock()
+
+	if drop {
+		return nil, nil
+	}
+	return f.Next.Format(e)
+}
+
+// summarize ends k's window, logging how many of its lines were dropped.
+// The summary keeps only the route of the lines, as their other fields
+// differ.
+func (f *Formatter) summarize(logger *log.Logger, route interface{}, k key) {
+	f.mu.Lock()
+	r := f.seen[k]
+	delete(f.seen, k)
+	f.mu.Unlock()
+
+	if r == nil || r.dropped == 0 {
+		return
+	}
+	entry := log.NewEntry(logger)
+	if route != nil {
+		entry = entry.WithField("route", route)
+	}
+	entry.Log(k.level, fmt.Sprintf("%s (repeated %d more times in %s)", k.msg, r.dropped, f.Window))
+}
@@ -1,8 +1,7 @@
 package main
 
 // TODO: General:
-//		 - graceful shutdown (close Tailscale node, close listener, etc.), with signal handling (SIGINT, SIGTERM)
-//		 - add Error handling to LSP pinged issues, and to the GetAccessToken function from oauth.go
+//		 - add Error handling to LSP pinged issues
 //		 - Logging overview
 //		 - security, general cleanup, and optimization overview
 //		 - support multiple concurrent reverse proxies instead of making the user run multiple instances of the program
@@ -11,44 +10,181 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
-	"github.com/whitehawk2/tsrouter/models"
 	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/accesslog"
+	"github.com/whitehawk2/tsrouter/admin"
+	"github.com/whitehawk2/tsrouter/audit"
+	"github.com/whitehawk2/tsrouter/certs"
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/controller"
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"github.com/whitehawk2/tsrouter/events"
+	"github.com/whitehawk2/tsrouter/geoip"
+	"github.com/whitehawk2/tsrouter/ha"
+	"github.com/whitehawk2/tsrouter/logfile"
+	"github.com/whitehawk2/tsrouter/logsample"
+	"github.com/whitehawk2/tsrouter/metrics"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/notify"
+	"github.com/whitehawk2/tsrouter/router"
+	"github.com/whitehawk2/tsrouter/stats"
+	"github.com/whitehawk2/tsrouter/statsd"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 )
 
 const (
-	tailscaleAuthURL  = "https://api.tailscale.com/api/v2/oauth/token"
-	tailscaleAPIBase  = "https://api.tailscale.com/api/v2"
 	authKeyExpiryDays = 14 // TODO: Make this configurable
+	authKeyDescPrefix = "tsrouter-"
+	statsDBName       = "stats.db"
+	shutdownTimeout   = 10 * time.Second
 )
 
-func parseFlags() *models.Config {
-	cfg := &models.Config{}
+func rootCommand() *command {
+	serve := serveCommand()
+	root := &command{
+		name:    "tsrouter",
+		summary: "Expose a local service on your tailnet. Runs \"serve\" when no command is given.",
+		flags:   serve.flags,
+		run:     serve.run,
+		subcommands: []*command{
+			serve,
+			validateCommand(),
+			keysCommand(),
+			devicesCommand(),
+			statusCommand(),
+			selftestCommand(),
+			netcheckCommand(),
+			statsCommand(),
+			metricsCommand(),
+			stateCommand(),
+			configCommand(),
+			replayCommand(),
+			completionCommand(),
+		},
+	}
+	root.subcommands = append(root.subcommands, completeCommand(root))
+	return root
+}
+
+func serveCommand() *command {
+	fs := newFlagSet("serve")
+	flags := config.BindFlags(fs, config.ScopeAll)
+	dryRun := fs.Bool("dry-run", false, "Validate config and credentials, then exit without registering a node")
+
+	return &command{
+		name:    "serve",
+		summary: "Register a Tailscale node and proxy its HTTPS traffic to the configured routes",
+		description: `
+Registers an ephemeral node named after --hostname, waits for its TLS
+certificate and MagicDNS name, then proxies https://<hostname>.<tailnet>.ts.net
+to the routes from --config, or to localhost:--target-port.
+
+Every option can also be set in the config file or through a TSROUTER_<OPTION>
+environment variable (e.g. TSROUTER_TARGET_PORT). Flags win over the
+environment, which wins over the file. A .env file next to the binary or in
+the current directory is loaded into the environment first.`,
+		examples: []string{
+			"tsrouter serve --hostname webui --target-port 8080",
+			"tsrouter serve --config tsrouter.yaml --dry-run",
+			"TSROUTER_HOSTNAME=webui tsrouter serve --config tsrouter.yaml",
+		},
+		flags: fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, src, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			if err := config.Validate(cfg, src); err != nil {
+				return err
+			}
+
+			if *dryRun {
+				return preflight(ctx, cfg, preflightOptions{checkCredentials: true})
+			}
+			ctx, restart := context.WithCancelCause(ctx)
+			defer restart(nil)
+			var release func(giveUp bool)
+			if cfg.HALease != "" {
+				if release, err = takeLease(ctx, cfg, restart); err != nil {
+					return err
+				}
+			}
+			if config.IsRemote(flags.Path()) && cfg.ConfigPoll > 0 {
+				go watchRemoteConfig(ctx, flags, cfg.ConfigPoll, restart)
+			}
+			err = serve(ctx, cfg, restart)
+			restarting := restarts(context.Cause(ctx))
+			if release != nil {
+				release(!restarting)
+			}
+			if restarting {
+				return reexec()
+			}
+			return err
+		},
+	}
+}
+
+// restartCauses are the shutdown causes after which serve runs again, to
+// pick up a new config or routes, or to stand by.
+var restartCauses = []error{errConfigChanged, errRoutesPushed, errRoutesApplied, ha.ErrLost}
+
+func restarts(cause error) bool {
+	return slices.ContainsFunc(restartCauses, func(err error) bool { return errors.Is(cause, err) })
+}
 
-	flag.IntVar(&cfg.TargetPort, "target-port", 0, "Local port to forward to")
-	flag.StringVar(&cfg.Hostname, "hostname", "", "Desired Tailscale hostname")
-	flag.StringVar(&cfg.LogLevel, "log-level", "info", "Log level (error, info, debug)")
-	flag.Parse()
+// loadConfig resolves the effective config from the .env file, config file,
+// environment and flags, and applies its log level.
+func loadConfig(flags *config.Flags) (*models.Config, *config.Source, error) {
+	if err := loadEnvConfig(); err != nil {
+		log.Debug(err)
+	}
 
-	if cfg.TargetPort == 0 || cfg.Hostname == "" {
-		flag.Usage()
-		os.Exit(1)
+	cfg, src, err := config.Resolve(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	setupLogging(cfg.LogLevel)
+	if cfg.LogRepeatWindow > 0 {
+		log.SetFormatter(&logsample.Formatter{Next: log.StandardLogger().Formatter, Window: cfg.LogRepeatWindow, Burst: cfg.LogRepeatBurst})
+	}
+	if cfg.LogFile != "" {
+		f, err := logfile.Open(cfg.LogFile, logRotation(cfg))
+		if err != nil {
+			return nil, nil, errdefs.Wrap(errdefs.ErrConfig, fmt.Errorf("failed to open log file: %v", err))
+		}
+		log.SetOutput(f)
+	}
+	for _, path := range src.Migrated {
+		log.Warnf("%s is written for an older config version and was migrated on load; run `tsrouter config migrate %s` to update it", path, path)
 	}
+	return cfg, src, nil
+}
 
-	return cfg
+func logRotation(cfg *models.Config) logfile.Options {
+	return logfile.Options{
+		MaxSizeMB:      cfg.LogMaxSize,
+		RotateInterval: cfg.LogRotateInterval,
+		MaxBackups:     cfg.LogMaxBackups,
+		MaxAge:         cfg.LogMaxAge,
+		Compress:       cfg.LogCompress,
+	}
 }
 
 func setupLogging(level string) {
@@ -90,146 +226,560 @@ func loadEnvConfig() error {
 	return nil
 }
 
-func generateAuthKey(ctx context.Context, client *http.Client, tailnet string) (*models.TailscaleAuthKey, error) {
-	endpoint := fmt.Sprintf("%s/tailnet/%s/keys", tailscaleAPIBase, tailnet)
-	log.WithField("endpoint", endpoint).Debug("Generating new auth key")
-
-	expiry := time.Now().Add(authKeyExpiryDays * 24 * time.Hour)
-
-	reqBody := map[string]interface{}{
-		"capabilities": map[string]interface{}{
-			"devices": map[string]interface{}{
-				"create": map[string]interface{}{
-					"reusable":      false,
-					"ephemeral":     true,
-					"preauthorized": true,
-					"tags":          []string{"tag:server"}, // TODO: make this configurable
-				},
-			},
-		},
-		"expirySeconds": int(expiry.Sub(time.Now()).Seconds()),
+// instanceDir returns the state directory for the configured hostname,
+// under state_dir or the user config directory. Each hostname gets its own
+// so separate instances don't fight over tsnet state.
+func instanceDir(cfg *models.Config) (string, error) {
+	root, err := stateRoot(cfg)
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(root, cfg.Hostname), nil
+}
 
-	jsonBody, err := json.Marshal(reqBody)
+// stateRoot returns the directory holding every instance's state
+// directory: state_dir, or tsrouter in the user config directory.
+func stateRoot(cfg *models.Config) (string, error) {
+	if cfg.StateDir != "" {
+		return cfg.StateDir, nil
+	}
+	userConfigDir, err := os.UserConfigDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal auth key request: %v", err)
+		return "", fmt.Errorf("failed to get user config directory: %v", err)
 	}
+	return filepath.Join(userConfigDir, "tsrouter"), nil
+}
 
+// newAPIClient returns an authenticated API client for the configured
+// tailnet, or for the OAuth client's own tailnet when none is set.
+func newAPIClient(ctx context.Context, cfg *models.Config) (*tailscaleapi.Client, error) {
+	tailnet := cfg.Tailnet
+	if tailnet == "" {
+		tailnet = tailscaleapi.DefaultTailnet
+	}
+	if cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return nil, errdefs.Wrap(errdefs.ErrConfig, fmt.Errorf("OAuth client ID and secret are required (TSROUTER_CLIENT_ID/TS_CLIENT_ID, TSROUTER_CLIENT_SECRET/TS_CLIENT_SECRET)"))
+	}
 	log.WithFields(log.Fields{
-		"endpoint": endpoint,
-		"body":     string(jsonBody),
-	}).Debug("Sending auth key request")
+		"tailnet":   tailnet,
+		"client_id": obscureCredential(cfg.ClientID),
+	}).Debug("Using OAuth client")
 
-	req, err := http.NewRequestWithContext(ctx, "POST",
-		endpoint,
-		strings.NewReader(string(jsonBody)))
+	// Get OAuth token
+	client, err := GetAccessToken(ctx, cfg.ClientID, cfg.ClientSecret, cfg.APITimeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create auth key request: %v", err)
+		return nil, errdefs.Wrap(errdefs.ErrAuth, fmt.Errorf("failed to set up the OAuth client: %v", err))
 	}
+	return tailscaleapi.NewClient(client, tailnet), nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send auth key request: %v", err)
+// createNodeKey generates the auth key the node registers with, recording
+// it in auditLog along with details.
+func createNodeKey(ctx context.Context, api *tailscaleapi.Client, hostname string, auditLog *audit.Log, details map[string]string) (*models.TailscaleAuthKey, error) {
+	key, err := api.CreateAuthKey(ctx, tailscaleapi.KeyOptions{
+		Description:   keyDescription(hostname),
+		Expiry:        authKeyExpiryDays * 24 * time.Hour,
+		Ephemeral:     true,
+		Preauthorized: true,
+		Tags:          []string{nodeTag}, // TODO: make this configurable
+	})
+	keyID := ""
+	if key != nil {
+		keyID = key.ID
 	}
-	defer resp.Body.Close()
-
-	bodyBytes, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		log.WithFields(log.Fields{
-			"status_code": resp.StatusCode,
-			"endpoint":    endpoint,
-			"response":    string(bodyBytes),
-		}).Debug("Auth key request failed")
-		return nil, fmt.Errorf("failed to generate auth key: HTTP %d - %s", resp.StatusCode, string(bodyBytes))
+	fields := map[string]string{"hostname": hostname, "command": "serve"}
+	for k, v := range details {
+		fields[k] = v
 	}
+	recordAudit(auditLog, "key.create", keyID, fields, err)
+	return key, err
+}
 
-	var authKey models.TailscaleAuthKey
-	if err := json.Unmarshal(bodyBytes, &authKey); err != nil {
-		return nil, fmt.Errorf("failed to decode auth key response: %v", err)
+// openAuditLog opens the configured audit log. It returns a nil log, which
+// discards entries, when none is configured.
+func openAuditLog(cfg *models.Config) (*audit.Log, error) {
+	if cfg.AuditLog == "" {
+		return nil, nil
 	}
+	return audit.Open(cfg.AuditLog)
+}
 
-	log.WithFields(log.Fields{
-		"key_id":   authKey.ID,
-		"expires":  authKey.Expires,
-		"endpoint": endpoint,
-		"response": string(bodyBytes),
-	}).Debug("Generated new auth key")
-	return &authKey, nil
+// recordAudit records an action taken by the local user. Failing to write
+// the entry doesn't undo the action, so it's only logged.
+func recordAudit(l *audit.Log, action, target string, details map[string]string, actionErr error) {
+	e := audit.Entry{
+		Actor:   audit.LocalActor(),
+		Action:  action,
+		Target:  target,
+		Details: details,
+	}
+	if actionErr != nil {
+		e.Error = actionErr.Error()
+	}
+	if err := l.Record(e); err != nil {
+		log.Warn(err)
+	}
 }
 
 func main() {
-	cfg := parseFlags()
-	setupLogging(cfg.LogLevel)
-
-	// Load environment variables from .env file
-	if err := loadEnvConfig(); err != nil {
-		log.Debug(err)
+	if err := runCommand(context.Background(), rootCommand(), "tsrouter", os.Args[1:]); err != nil {
+		if !errors.As(err, new(signalError)) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(exitCode(err))
 	}
+}
 
-	// Get tailnet name from environment
-	tailnet := os.Getenv("TS_TAILNET")
-	if tailnet == "" {
-		log.Fatal("TS_TAILNET environment variable is required")
+// serve runs the node until ctx is done or it's stopped. It returns the
+// signal that stopped it, if one did.
+func serve(ctx context.Context, cfg *models.Config, restart context.CancelCauseFunc) error {
+	started := time.Now()
+	// Locked before anything is done through the API, so a second instance
+	// with the same hostname exits without minting a key it can't use.
+	dir, err := instanceDir(cfg)
+	if cfg.MemoryState {
+		// tsnet still wants a directory for its log buffer and certificates.
+		if dir, err = os.MkdirTemp("", "tsrouter-"+cfg.Hostname+"-"); err == nil {
+			tmp := dir
+			defer cleanup(func() { os.RemoveAll(tmp) })()
+		}
+	}
+	if err != nil {
+		fatal(errdefs.ErrConfig, err)
+	}
+	if !cfg.MemoryState {
+		unlock, err := lockInstanceDir(dir)
+		if err != nil {
+			fatal(nil, err)
+		}
+		defer unlock()
 	}
 
-	// Get OAuth token
-	ctx := context.Background()
-	client, _ := GetAccessToken(ctx) // TODO: add error handling
+	api, err := newAPIClient(ctx, cfg)
+	if err != nil {
+		fatal(errdefs.ErrConfig, err)
+	}
+	tailnet := api.Tailnet
 
 	// Test the token with a devices list request
-	testEndpoint := fmt.Sprintf("%s/tailnet/%s/devices", tailscaleAPIBase, tailnet)
-	req, _ := http.NewRequestWithContext(ctx, "GET", testEndpoint, nil)
-	resp, err := client.Do(req)
+	testEndpoint := fmt.Sprintf("%s/tailnet/%s/devices", api.BaseURL, tailnet)
+	err = retryStartup(ctx, cfg, "test the OAuth token", func() error {
+		req, _ := http.NewRequestWithContext(ctx, "GET", testEndpoint, nil)
+		resp, err := api.HTTPClient.Do(req)
+		if err != nil {
+			return tailscaleapi.RequestError("GET", testEndpoint, err)
+		}
+		defer resp.Body.Close()
+		log.WithField("status", resp.StatusCode).Debug("OAuth token test request completed")
+		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return nil
+		}
+		// Only 5xx and 429 are worth retrying; anything else won't pass
+		// without a config change.
+		class := errdefs.ErrConfig
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			class = errdefs.ErrAuth
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			class = errdefs.ErrAPI
+		}
+		excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return errdefs.Wrap(class, fmt.Errorf("GET %s: HTTP %d - %s", testEndpoint, resp.StatusCode, strings.TrimSpace(string(excerpt))))
+	})
 	if err != nil {
-		log.Fatalf("Failed to test OAuth token: %v", err)
+		fatalf(nil, "Failed to test OAuth token: %w", err)
 	}
-	resp.Body.Close()
-	log.WithField("status", resp.StatusCode).Debug("OAuth token test request completed")
 
-	// Generate auth key
-	authKey, err := generateAuthKey(ctx, client, tailnet)
+	auditLog, err := openAuditLog(cfg)
 	if err != nil {
-		log.Fatalf("Failed to generate auth key: %v", err)
+		fatal(errdefs.ErrConfig, err)
+	}
+	defer auditLog.Close()
+	if cfg.HALease != "" {
+		removeStaleNodes(ctx, api, cfg, auditLog)
 	}
 
-	// separate config dirs to avoide conflicting states
-	userConfigDir, err := os.UserConfigDir()
+	// Generate auth key
+	var authKey *models.TailscaleAuthKey
+	err = retryStartup(ctx, cfg, "generate an auth key", func() error {
+		authKey, err = createNodeKey(ctx, api, cfg.Hostname, auditLog, nil)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("failed to get user config directory: %v", err)
+		fatalf(errdefs.ErrAPI, "Failed to generate auth key: %w", err)
+	}
+	log.WithFields(log.Fields{
+		"key_id":  authKey.ID,
+		"expires": authKey.Expires,
+	}).Debug("Generated new auth key")
+
+	if cfg.AdminRoutes {
+		if err := loadAppliedRoutes(cfg, dir); err != nil {
+			fatal(errdefs.ErrConfig, err)
+		}
 	}
-	instanceDir := filepath.Join(userConfigDir, "tsrouter", cfg.Hostname)
 
 	// Create and configure the Tailscale node
 	s := &tsnet.Server{
 		Hostname: cfg.Hostname,
 		AuthKey:  authKey.Key,
-		Dir:      instanceDir,
+		Dir:      dir,
+	}
+	if cfg.MemoryState {
+		s.Store = new(mem.Store)
+		s.Ephemeral = true
+	} else if s.Store, err = encryptedStore(ctx, cfg, dir); err != nil {
+		fatalf(errdefs.ErrConfig, "Failed to open node state: %w", err)
 	}
 
 	log.Debug("Starting Tailscale node...")
 	if err := s.Start(); err != nil {
-		log.Fatalf("Failed to start Tailscale node: %v", err)
+		fatalf(errdefs.ErrTailnet, "Failed to start Tailscale node: %w", err)
+	}
+	lc, err := s.LocalClient()
+	if err != nil {
+		fatalf(errdefs.ErrTailnet, "Failed to get Tailscale local client: %w", err)
 	}
 
-	// Create the reverse proxy
-	targetURL := fmt.Sprintf("http://localhost:%d", cfg.TargetPort)
-	target, err := url.Parse(targetURL)
+	// An agent's routes come from the controller, over the tailnet.
+	var agent *controller.Agent
+	var routesVersion string
+	if cfg.Controller != "" {
+		if _, err := s.Up(ctx); err != nil {
+			fatalf(errdefs.ErrTailnet, "Tailscale node failed to come up: %w", err)
+		}
+		agent = controller.NewAgent(cfg.Controller, s.HTTPClient(), filepath.Join(dir, controllerRoutesName))
+		if routesVersion, err = controllerRoutes(ctx, agent, cfg); err != nil {
+			fatal(errdefs.ErrTailnet, err)
+		}
+		log.WithField("version", routesVersion).Infof("Took %d routes from the controller", len(cfg.Routes))
+	}
+	var configuredTargets map[string]string
+	if cfg.AdminRoutes {
+		if configuredTargets, err = loadSwitchedTargets(cfg, dir); err != nil {
+			fatal(errdefs.ErrConfig, err)
+		}
+	}
+	checkReachability(ctx, api, cfg)
+
+	m := metrics.New(cfg.MetricsWindow)
+	recorders := router.Recorders{m}
+	act := newActivity()
+	if cfg.TTLIdle > 0 {
+		recorders = append(recorders, act)
+	}
+	accessLogs, err := accesslog.OpenRoutes(cfg.AccessLog, cfg.AccessLogFormat, cfg.Routes, logRotation(cfg))
 	if err != nil {
-		log.Fatalf("Failed to parse target URL: %v", err)
+		fatal(errdefs.ErrConfig, err)
+	}
+	if accessLogs != nil {
+		defer accessLogs.Close()
+		recorders = append(recorders, accessLogs)
+	}
+	if cfg.StatsDAddr != "" {
+		sink, err := statsd.Dial(ctx, cfg.StatsDAddr, cfg.StatsDPrefix, cfg.StatsDTags)
+		if err != nil {
+			fatal(errdefs.ErrConfig, err)
+		}
+		recorders = append(recorders, sink)
+	}
+	var store *stats.Store
+	if cfg.Stats {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			fatalf(nil, "Failed to create instance directory: %w", err)
+		}
+		store, err = stats.Open(filepath.Join(dir, statsDBName), cfg.StatsRetention)
+		if err != nil {
+			fatalf(nil, "Failed to open stats store: %w", err)
+		}
+		defer store.Close()
+		recorders = append(recorders, store)
+	}
+
+	var bans *router.Bans
+	if cfg.BanAuthFailures > 0 || cfg.BanClientErrors > 0 {
+		bans = router.NewBans(router.BanOptions{
+			AuthFailures: cfg.BanAuthFailures,
+			ClientErrors: cfg.BanClientErrors,
+			Window:       cfg.BanWindow,
+			Duration:     cfg.BanDuration,
+		})
+		recorders = append(recorders, bans)
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	bus := events.NewBus(cfg.Hostname)
+	if len(cfg.Webhooks) > 0 {
+		hooks := notify.StartWebhooks(bus, cfg.Webhooks)
+		defer hooks.Close(shutdownTimeout)
+	}
+
+	var capture *router.Capture
+	if cfg.CaptureSize > 0 {
+		capture = router.NewCapture(cfg.CaptureSize, cfg.CaptureBodyLimit)
+	}
+
+	logLevel := admin.NewLogLevel(log.GetLevel(), cfg.LogLevelRevert)
+	toggle := make(chan os.Signal, 1)
+	notifyLogToggle(toggle)
+	go func() {
+		for range toggle {
+			logLevel.Toggle()
+		}
+	}()
+
+	health := router.NewHealth(cfg.Routes, bus, s.Dial)
+	var switches *router.Switches
+	if cfg.AdminRoutes && cfg.AdminAddr != "" {
+		var mu sync.Mutex
+		switches = router.NewSwitches(bus)
+		switches.OnSwitch = func(route, from, to string) {
+			for _, r := range cfg.Routes {
+				if r.Name == route {
+					r.Target = to
+					health.Retarget(r)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err := saveSwitchedTarget(dir, configuredTargets, route, to); err != nil {
+				log.Warn(err)
+			}
+		}
+	}
+	certSel := &certs.Selector{Fallback: lc.GetCertificate}
+	var adm *admin.Server
+	if cfg.AdminAddr != "" {
+		var backendsHealthy func() bool
+		if cfg.HealthCheckInterval > 0 {
+			backendsHealthy = health.AllHealthy
+		}
+		adm = admin.New(backendsHealthy, auditLog)
+		adm.Handle("/loglevel", logLevel)
+		adm.Handle("GET /metrics", m)
+		adm.HandleStatus(instanceStatus(cfg, started, health, switches, m, lc, certSel))
+		adm.HandleNetcheck(instanceNetcheck(lc))
+		if store != nil {
+			adm.HandleUsage(store.Usage)
+			adm.HandleTraffic(store.StatusBreakdown)
+		}
+		if bans != nil {
+			adm.HandleBans(bans)
+		}
+		if capture != nil {
+			adm.HandleCaptures(capture)
+		}
+		if cfg.AdminRoutes {
+			adm.HandleRoutes(applyRoutes(cfg, dir, bus, restart))
+			adm.HandleSwitches(switches)
+		}
+		adm.HandleEvents(bus)
+		if err := adm.Start(cfg.AdminAddr); err != nil {
+			fatal(errdefs.ErrConfig, err)
+		}
+	}
 
-	// Get a listener on the Tailscale network
-	ln, err := s.ListenTLS("tcp", ":443")
+	// Get listeners on the Tailscale network
+	acmeCert, err := certificates(ctx, cfg, dir, s, certSel, bus)
+	if err != nil {
+		fatalf(errdefs.ErrConfig, "Failed to set up certificates: %w", err)
+	}
+	m.Add(metrics.NewTailnet(lc, certSel))
+	lo := listenOptionsFrom(cfg)
+	procs := &router.Processes{}
+	opts := router.Options{
+		WhoIs:       lc.WhoIs,
+		Recorder:    recorders,
+		Capture:     capture,
+		TailnetDial: s.Dial,
+		Processes:   procs,
+		Bans:        bans,
+		Audit:       auditLog,
+		Switches:    switches,
+
+		ClientWriteTimeout: cfg.ClientWriteTimeout,
+		ClientMinRate:      cfg.ClientMinRate,
+	}
+	if cfg.GeoIPDB != "" {
+		if opts.GeoIP, err = geoip.Open(cfg.GeoIPDB); err != nil {
+			fatal(errdefs.ErrConfig, err)
+		}
+		defer opts.GeoIP.Close()
+	}
+	if cfg.ACLGrants {
+		opts.GrantCapability = tailcfg.PeerCapability(cfg.ACLCapability)
+		for _, r := range cfg.Routes {
+			if r.Protocol == "tcp" {
+				log.WithField("route", r.Name).Warn("acl_grants doesn't apply to tcp routes, use the policy file's ACLs for their port")
+			}
+		}
+	}
+	if cfg.DNSCacheTTL > 0 {
+		opts.Dial = router.NewCachingDialer(cfg.DNSCacheTTL).DialContext
+	}
+	if adm != nil {
+		adm.Handle("GET /auth", router.ForwardAuth(opts))
+	}
+	ports, err := listenPorts(s, certSel.GetCertificate, lo, cfg.Routes, opts)
 	if err != nil {
-		log.Fatalf("Failed to create Tailscale listener: %v", err)
+		fatalf(errdefs.ErrTailnet, "Failed to create Tailscale listeners: %w", err)
+	}
+	if cfg.LocalAddr != "" {
+		local, err := listenLocal(cfg.LocalAddr, cfg.LocalProxyProtocol, cfg.LocalForwardedFor, ports)
+		if err != nil {
+			fatal(errdefs.ErrConfig, err)
+		}
+		ports = append(ports, local)
 	}
-	log.Infof("Service available at %s.%s -> localhost:%d", cfg.Hostname, tailnet, cfg.TargetPort)
-	if err := http.Serve(ln, proxy); err != nil {
-		log.Fatalf("Failed to serve proxy: %v", err)
+	if acmeCert != nil && cfg.TLSACMEChallenge == "http-01" {
+		serveChallenges(acmeCert, ports)
+	}
+	if cfg.TTLIdle > 0 {
+		for _, p := range ports {
+			p.ln = act.listener(p.ln)
+		}
+	}
+	if cfg.ControllerPort != 0 {
+		ctl := controller.New(cfg.ControllerDir)
+		p, err := listenController(s, certSel.GetCertificate, lo, cfg.ControllerPort, ctl, lc.WhoIs)
+		if err != nil {
+			fatal(errdefs.ErrTailnet, err)
+		}
+		ports = append(ports, p)
+		if adm != nil {
+			adm.HandleAgents(ctl)
+		}
 	}
 	defer s.Close()
+
+	// Wait for the node to come up on the tailnet and for its certificate
+	// and DNS name before telling anyone we're ready.
+	if _, err := s.Up(ctx); err != nil {
+		fatalf(errdefs.ErrTailnet, "Tailscale node failed to come up: %w", err)
+	}
+	domain, err := waitReady(ctx, s)
+	if err != nil {
+		fatalf(errdefs.ErrTailnet, "Node not ready: %w", err)
+	}
+
+	if err := serveHTTP3(s, lo, ports); err != nil {
+		fatal(errdefs.ErrTailnet, err)
+	}
+	logNodeAddrs(s, cfg.ListenIP)
+	for _, r := range cfg.Routes {
+		log.Infof("Service available at %s -> %s", serviceURL(domain, r), r.Target)
+	}
+	bus.Publish(events.Event{
+		Type:    events.NodeRegistered,
+		Message: fmt.Sprintf("Node registered as %s", domain),
+		Fields:  map[string]string{"domain": domain},
+	})
+
+	ctx, stop := notifySignals(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, expire := context.WithCancelCause(ctx)
+	defer expire(nil)
+	if cfg.TTL > 0 || cfg.TTLIdle > 0 {
+		act.touch()
+		go watchTTL(ctx, cfg.TTL, cfg.TTLIdle, act, expire)
+	}
+
+	if cfg.HealthCheckInterval > 0 {
+		go health.Run(ctx, cfg.HealthCheckInterval)
+	}
+	if cfg.HeartbeatURL != "" {
+		go notify.Heartbeat(ctx, cfg.HeartbeatURL, cfg.HeartbeatInterval, health.AllHealthy)
+	}
+	go watchKeyExpiry(ctx, lc, bus, cfg.KeyExpiryWarning)
+	if cfg.CertCheckInterval > 0 {
+		go watchTailscaleCert(ctx, lc, domain, certSel, bus, cfg.CertCheckInterval, cfg.CertExpiryWarning)
+	}
+	go watchNodeState(ctx, lc, bus, func(ctx context.Context) (*models.TailscaleAuthKey, error) {
+		return createNodeKey(ctx, api, cfg.Hostname, auditLog, map[string]string{"reason": "reconnect"})
+	}, func(ctx context.Context, id string) error {
+		err := api.RevokeKey(ctx, id)
+		recordAudit(auditLog, "key.revoke", id, map[string]string{"hostname": cfg.Hostname, "reason": "reconnect failed"}, err)
+		return err
+	})
+	if agent != nil {
+		go watchController(ctx, agent, cfg, routesVersion, bus, restart)
+	}
+	if cfg.SLOLatency > 0 || cfg.SLOErrorRatio > 0 {
+		go m.WatchSLO(ctx, metrics.SLO{Latency: cfg.SLOLatency, ErrorRatio: cfg.SLOErrorRatio})
+	}
+	if cfg.MetricsPush != "" {
+		pusher, err := metrics.NewPusher(m, cfg.MetricsPush, cfg.MetricsPushFormat, cfg.Hostname)
+		if err != nil {
+			fatal(errdefs.ErrConfig, err)
+		}
+		pushed := make(chan struct{})
+		go func() {
+			defer close(pushed)
+			pusher.Run(ctx, cfg.MetricsPushInterval)
+		}()
+		// Wait for the last push before exiting.
+		defer func() { <-pushed }()
+	}
+
+	go func() {
+		<-ctx.Done()
+		msg := "Node shutting down"
+		if cause := context.Cause(ctx); errors.Is(cause, errExpired) || restarts(cause) || errors.As(cause, new(signalError)) {
+			msg = fmt.Sprintf("Node shutting down, %v", cause)
+		}
+		log.Info(msg)
+		sdNotify("STOPPING=1")
+		bus.Publish(events.Event{Type: events.Shutdown, Message: msg})
+		if adm != nil {
+			adm.SetReady(false)
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		for _, p := range ports {
+			if err := p.srv.Shutdown(shutdownCtx); err != nil {
+				log.Warnf("Failed to drain connections on %s: %v", p.name, err)
+			}
+			if p.h3 != nil {
+				p.h3.Shutdown(shutdownCtx)
+			}
+		}
+		procs.Close()
+		if adm != nil {
+			adm.Shutdown(shutdownCtx)
+		}
+	}()
+
+	if adm != nil {
+		adm.SetReady(true)
+	}
+	sdNotify("READY=1")
+	errc := make(chan error, len(ports))
+	for _, p := range ports {
+		go func(p *nodePort) {
+			err := p.srv.Serve(p.ln)
+			if err == http.ErrServerClosed {
+				err = nil
+			} else if err != nil {
+				err = fmt.Errorf("%s: %v", p.name, err)
+			}
+			errc <- err
+		}(p)
+	}
+	if acmeCert != nil {
+		// Started once the ports serve, to answer HTTP-01 challenges.
+		go acmeCert.Renew(ctx)
+	}
+	for range ports {
+		if err := <-errc; err != nil {
+			fatalf(errdefs.ErrTailnet, "Failed to serve proxy: %w", err)
+		}
+	}
+	if errors.Is(context.Cause(ctx), errExpired) {
+		destroyNode(api, s, lc, auditLog, dir)
+	}
+	var sig signalError
+	if errors.As(context.Cause(ctx), &sig) {
+		return sig
+	}
+	return nil
 }
@@ -0,0 +1,293 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DashboardOptions shapes the generated dashboard and alert rules.
+type DashboardOptions struct {
+	Title  string
+	Job    string   // job label the instance is scraped or pushed as
+	Routes []string // route names, one dashboard row and set of alerts each
+
+	Window     time.Duration // rate and ratio window
+	Latency    time.Duration // p99 latency alert threshold
+	ErrorRatio float64       // 5xx ratio alert threshold
+	CertExpiry time.Duration // certificate expiry alert threshold
+}
+
+// The parts of the Grafana dashboard model the generated dashboard uses.
+type (
+	grafanaDashboard struct {
+		UID           string            `json:"uid"`
+		Title         string            `json:"title"`
+		Tags          []string          `json:"tags"`
+		Timezone      string            `json:"timezone"`
+		SchemaVersion int               `json:"schemaVersion"`
+		Refresh       string            `json:"refresh"`
+		Time          grafanaTimeRange  `json:"time"`
+		Templating    grafanaTemplating `json:"templating"`
+		Panels        []grafanaPanel    `json:"panels"`
+	}
+	grafanaTimeRange struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	grafanaTemplating struct {
+		List []grafanaVariable `json:"list"`
+	}
+	grafanaVariable struct {
+		Name  string `json:"name"`
+		Label string `json:"label"`
+		Type  string `json:"type"`
+		Query string `json:"query"`
+	}
+	grafanaPanel struct {
+		ID          int                `json:"id"`
+		Type        string             `json:"type"`
+		Title       string             `json:"title"`
+		GridPos     grafanaGridPos     `json:"gridPos"`
+		Datasource  *grafanaDatasource `json:"datasource,omitempty"`
+		Targets     []grafanaTarget    `json:"targets,omitempty"`
+		FieldConfig *grafanaFieldConf  `json:"fieldConfig,omitempty"`
+		Collapsed   *bool              `json:"collapsed,omitempty"`
+	}
+	grafanaGridPos struct {
+		H int `json:"h"`
+		W int `json:"w"`
+		X int `json:"x"`
+		Y int `json:"y"`
+	}
+	grafanaDatasource struct {
+		Type string `json:"type"`
+		UID  string `json:"uid"`
+	}
+	grafanaTarget struct {
+		RefID        string `json:"refId"`
+		Expr         string `json:"expr"`
+		LegendFormat string `json:"legendFormat"`
+	}
+	grafanaFieldConf struct {
+		Defaults grafanaFieldDefaults `json:"defaults"`
+	}
+	grafanaFieldDefaults struct {
+		Unit string `json:"unit"`
+	}
+)
+
+// Dashboard returns the JSON of a Grafana dashboard of tsrouter's metrics:
+// an overview of every route's traffic, errors and bandwidth, a row per route with its traffic, errors and
+// latency, and the node's Tailscale connectivity and certificates.
+func Dashboard(opts DashboardOptions) ([]byte, error) {
+	d := grafanaDashboard{
+		UID:           dashboardUID(opts.Job),
+		Title:         opts.Title,
+		Tags:          []string{"tsrouter"},
+		Timezone:      "browser",
+		SchemaVersion: 39,
+		Refresh:       "30s",
+		Time:          grafanaTimeRange{From: "now-6h", To: "now"},
+		Templating: grafanaTemplating{List: []grafanaVariable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+		}},
+	}
+
+	y := 0
+	id := 0
+	row := func(title string) {
+		id++
+		collapsed := false
+		d.Panels = append(d.Panels, grafanaPanel{ID: id, Type: "row", Title: title, Collapsed: &collapsed, GridPos: grafanaGridPos{H: 1, W: 24, Y: y}})
+		y++
+	}
+	panels := func(ps ...grafanaPanel) {
+		w := 24 / len(ps)
+		for i, p := range ps {
+			id++
+			p.ID = id
+			p.GridPos = grafanaGridPos{H: 8, W: w, X: i * w, Y: y}
+			p.Datasource = &grafanaDatasource{Type: "prometheus", UID: "${datasource}"}
+			d.Panels = append(d.Panels, p)
+		}
+		y += 8
+	}
+
+	job := selector(opts.Job, "")
+	w := promDuration(opts.Window)
+	row("Overview")
+	panels(
+		timeseries("Requests per second", "reqps",
+			target(fmt.Sprintf("sum by (route) (rate(tsrouter_requests_total%s[%s]))", job, w), "{{route}}")),
+		timeseries("5xx error ratio", "percentunit",
+			target(fmt.Sprintf("sum by (route) (rate(tsrouter_request_errors_total%s[%s])) / sum by (route) (rate(tsrouter_requests_total%s[%s]))", job, w, job, w), "{{route}}")),
+		timeseries("Bandwidth", "Bps",
+			target(fmt.Sprintf("sum by (route) (rate(tsrouter_request_bytes_total%s[%s]) + rate(tsrouter_response_bytes_total%s[%s]))", job, w, job, w), "{{route}}")),
+	)
+
+	for _, route := range opts.Routes {
+		sel := selector(opts.Job, route)
+		row("Route " + route)
+		panels(
+			timeseries("Traffic", "reqps",
+				target(fmt.Sprintf("sum(rate(tsrouter_requests_total%s[%s]))", sel, w), "requests"),
+				target(fmt.Sprintf("sum(rate(tsrouter_request_errors_total%s[%s]))", sel, w), "5xx"),
+				target(fmt.Sprintf("sum(rate(tsrouter_requests_aborted_total%s[%s]))", sel, w), "aborted")),
+			timeseries("Latency", "s",
+				target(quantileExpr("0.5", sel, w), "p50"),
+				target(quantileExpr("0.95", sel, w), "p95"),
+				target(quantileExpr("0.99", sel, w), "p99")),
+			timeseries("5xx error ratio", "percentunit",
+				target(errorRatioExpr(sel, w), "5xx")),
+		)
+	}
+
+	row("Tailnet")
+	panels(
+		timeseries("Peers", "short",
+			target(fmt.Sprintf("sum by (state) (tsrouter_tailnet_peers%s)", job), "{{state}}")),
+		timeseries("Active peers by path", "short",
+			target(fmt.Sprintf("sum by (path) (tsrouter_tailnet_active_peer_paths%s)", job), "{{path}}")),
+		timeseries("Certificate expiry", "s",
+			target(fmt.Sprintf("tsrouter_certificate_expiry_timestamp_seconds%s - time()", job), "{{name}}")),
+	)
+	return json.MarshalIndent(d, "", "  ")
+}
+
+func timeseries(title, unit string, targets ...grafanaTarget) grafanaPanel {
+	for i := range targets {
+		targets[i].RefID = string(rune('A' + i))
+	}
+	return grafanaPanel{
+		Type:        "timeseries",
+		Title:       title,
+		Targets:     targets,
+		FieldConfig: &grafanaFieldConf{Defaults: grafanaFieldDefaults{Unit: unit}},
+	}
+}
+
+func target(expr, legend string) grafanaTarget {
+	return grafanaTarget{Expr: expr, LegendFormat: legend}
+}
+
+// The Prometheus rule file format.
+type (
+	ruleFile struct {
+		Groups []ruleGroup `yaml:"groups"`
+	}
+	ruleGroup struct {
+		Name  string      `yaml:"name"`
+		Rules []alertRule `yaml:"rules"`
+	}
+	alertRule struct {
+		Alert       string            `yaml:"alert"`
+		Expr        string            `yaml:"expr"`
+		For         string            `yaml:"for"`
+		Labels      map[string]string `yaml:"labels"`
+		Annotations map[string]string `yaml:"annotations"`
+	}
+)
+
+// AlertRules returns a Prometheus rule file alerting on the instance going
+// away, each route's error ratio and p99 latency exceeding the thresholds,
+// and a certificate close to expiring.
+func AlertRules(opts DashboardOptions) ([]byte, error) {
+	job := selector(opts.Job, "")
+	w := promDuration(opts.Window)
+	rules := []alertRule{{
+		Alert:       "TsrouterDown",
+		Expr:        fmt.Sprintf("up%s == 0", job),
+		For:         "5m",
+		Labels:      map[string]string{"severity": "critical"},
+		Annotations: map[string]string{"summary": "tsrouter on {{ $labels.instance }} is down"},
+	}}
+	for _, route := range opts.Routes {
+		sel := selector(opts.Job, route)
+		rules = append(rules, alertRule{
+			Alert: "TsrouterRouteErrors",
+			// Only with traffic, so one failed request on an idle route
+			// doesn't page anyone.
+			Expr:   fmt.Sprintf("(%s) > %s and sum(rate(tsrouter_requests_total%s[%s])) > 0.1", errorRatioExpr(sel, w), formatFloat(opts.ErrorRatio), sel, w),
+			For:    w,
+			Labels: map[string]string{"severity": "warning", "route": route},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("Route %s answers more than %s%% of requests with 5xx errors", route, formatFloat(opts.ErrorRatio*100)),
+			},
+		}, alertRule{
+			Alert:  "TsrouterRouteLatency",
+			Expr:   fmt.Sprintf("%s > %s", quantileExpr("0.99", sel, w), formatFloat(opts.Latency.Seconds())),
+			For:    w,
+			Labels: map[string]string{"severity": "warning", "route": route},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("Route %s p99 latency is over %s", route, opts.Latency),
+			},
+		})
+	}
+	rules = append(rules, alertRule{
+		Alert:       "TsrouterCertificateExpiring",
+		Expr:        fmt.Sprintf("tsrouter_certificate_expiry_timestamp_seconds%s - time() < %d", job, int64(opts.CertExpiry.Seconds())),
+		For:         "1h",
+		Labels:      map[string]string{"severity": "warning"},
+		Annotations: map[string]string{"summary": "Certificate {{ $labels.name }} expires in {{ $value | humanizeDuration }}, renewal may be failing"},
+	})
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(ruleFile{Groups: []ruleGroup{{Name: "tsrouter", Rules: rules}}}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), enc.Close()
+}
+
+func quantileExpr(q, sel, w string) string {
+	return fmt.Sprintf("histogram_quantile(%s, sum by (le) (rate(tsrouter_request_duration_seconds_bucket%s[%s])))", q, sel, w)
+}
+
+func errorRatioExpr(sel, w string) string {
+	return fmt.Sprintf("sum(rate(tsrouter_request_errors_total%s[%s])) / sum(rate(tsrouter_requests_total%s[%s]))", sel, w, sel, w)
+}
+
+// selector returns the label matchers for job and route, either of which
+// may be empty.
+func selector(job, route string) string {
+	var ms []string
+	if job != "" {
+		ms = append(ms, "job="+strconv.Quote(job))
+	}
+	if route != "" {
+		ms = append(ms, "route="+strconv.Quote(route))
+	}
+	if len(ms) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(ms, ",") + "}"
+}
+
+// promDuration formats d as a PromQL duration, which has no fractions or
+// mixed units like Go's.
+func promDuration(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute && d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", max(int64(d/time.Second), 1))
+}
+
+func dashboardUID(job string) string {
+	uid := "tsrouter"
+	if job != "" && job != "tsrouter" {
+		uid += "-" + job
+	}
+	if len(uid) > 40 { // Grafana's limit
+		uid = uid[:40]
+	}
+	return uid
+}
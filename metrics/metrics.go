@@ -0,0 +1,504 @@
+// Package metrics tracks per-route request latency and errors, both as
+// running totals for Prometheus and over a sliding window for status
+// reporting and SLO warnings.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+// slots is the number of intervals the sliding window is split into; the
+// window advances one slot at a time.
+const slots = 10
+
+// minSLORequests keeps SLO warnings from firing on a handful of requests.
+const minSLORequests = 10
+
+// bounds are the upper bounds, in seconds, of the latency histogram buckets:
+// exponential from 1ms to a bit over a minute, fine enough to estimate
+// percentiles from.
+var bounds = func() []float64 {
+	var b []float64
+	for v := 0.001; v < 60; v *= 1.25 {
+		b = append(b, v)
+	}
+	return append(b, 60)
+}()
+
+// sizeBounds are the upper bounds, in bytes, of the request and response
+// size histogram buckets: powers of 4 from 64 bytes to 1 GiB.
+var sizeBounds = func() []float64 {
+	var b []float64
+	for v := 64.0; v <= 1<<30; v *= 4 {
+		b = append(b, v)
+	}
+	return b
+}()
+
+// Metrics implements router.Recorder.
+type Metrics struct {
+	window time.Duration
+	slot   time.Duration
+
+	mu         sync.Mutex
+	routes     map[string]*route
+	collectors []Collector
+}
+
+type route struct {
+	total   histogram
+	aborted uint64
+	slow    uint64
+	phases  map[string]*histogram // backend timing phase -> latency
+	conns   map[string]uint64     // "new" or "reused" -> backend requests
+	bytes   map[string]*byteCount // by status class
+	sizeIn  sizes
+	sizeOut sizes
+	slots   [slots]histogram
+	slotAt  [slots]int64 // slot number each entry belongs to
+}
+
+type byteCount struct{ in, out uint64 }
+
+// sizes is a histogram of body sizes, over sizeBounds.
+type sizes struct {
+	counts []uint64 // per bucket, plus one for +Inf
+	sum    uint64
+}
+
+func (h *sizes) observe(n int64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(sizeBounds)+1)
+	}
+	h.counts[sort.SearchFloat64s(sizeBounds, float64(n))]++
+	h.sum += uint64(n)
+}
+
+func (h sizes) copy() sizes {
+	h.counts = append([]uint64(nil), h.counts...)
+	return h
+}
+
+type histogram struct {
+	counts   []uint64 // per bucket, plus one for +Inf
+	sum      float64
+	requests uint64
+	errors   uint64
+}
+
+func (h *histogram) observe(seconds float64, failed bool) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(bounds)+1)
+	}
+	h.counts[sort.SearchFloat64s(bounds, seconds)]++
+	h.sum += seconds
+	h.requests++
+	if failed {
+		h.errors++
+	}
+}
+
+func (h *histogram) merge(o *histogram) {
+	if o.counts == nil {
+		return
+	}
+	if h.counts == nil {
+		h.counts = make([]uint64, len(bounds)+1)
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.sum += o.sum
+	h.requests += o.requests
+	h.errors += o.errors
+}
+
+// quantile estimates the q-th quantile by interpolating within the bucket
+// it falls in.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.requests == 0 {
+		return 0
+	}
+	rank := q * float64(h.requests)
+	var seen float64
+	for i, c := range h.counts {
+		if seen+float64(c) < rank {
+			seen += float64(c)
+			continue
+		}
+		if i == len(bounds) {
+			return seconds(bounds[len(bounds)-1])
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = bounds[i-1]
+		}
+		frac := (rank - seen) / float64(c)
+		return seconds(lower + (bounds[i]-lower)*frac)
+	}
+	return seconds(bounds[len(bounds)-1])
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// New returns Metrics with percentiles and error ratios computed over the
+// given window.
+func New(window time.Duration) *Metrics {
+	slot := window / slots
+	if slot < time.Second {
+		slot = time.Second
+	}
+	return &Metrics{window: window, slot: slot, routes: map[string]*route{}}
+}
+
+// Window returns the length of the sliding window.
+func (m *Metrics) Window() time.Duration {
+	return m.window
+}
+
+// Record implements router.Recorder. Server errors (5xx) count against the
+// error ratio.
+func (m *Metrics) Record(rec *router.Record) {
+	at := rec.Time.Add(rec.Duration).UnixNano() / int64(m.slot)
+	s := rec.Duration.Seconds()
+	failed := rec.Status >= 500
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.routes[rec.Route]
+	if r == nil {
+		r = &route{bytes: map[string]*byteCount{}, phases: map[string]*histogram{}, conns: map[string]uint64{}}
+		m.routes[rec.Route] = r
+	}
+	r.total.observe(s, failed)
+	if rec.Aborted {
+		r.aborted++
+	}
+	if rec.Slow {
+		r.slow++
+	}
+	if t := rec.Timing; t.Backend {
+		observe := func(phase string, d time.Duration) {
+			h := r.phases[phase]
+			if h == nil {
+				h = &histogram{}
+				r.phases[phase] = h
+			}
+			h.observe(d.Seconds(), false)
+		}
+		observe("dial", t.Dial)
+		observe("ttfb", t.TTFB)
+		if t.Reused {
+			r.conns["reused"]++
+		} else {
+			r.conns["new"]++
+			if t.DNS > 0 {
+				observe("dns", t.DNS)
+			}
+			observe("connect", t.Connect)
+			if t.TLS > 0 {
+				observe("tls", t.TLS)
+			}
+		}
+	}
+	class := statusClass(rec.Status)
+	b := r.bytes[class]
+	if b == nil {
+		b = &byteCount{}
+		r.bytes[class] = b
+	}
+	b.in += uint64(max(rec.BytesIn, 0))
+	b.out += uint64(max(rec.BytesOut, 0))
+	r.sizeIn.observe(max(rec.BytesIn, 0))
+	r.sizeOut.observe(max(rec.BytesOut, 0))
+	i := at % slots
+	if r.slotAt[i] != at {
+		r.slots[i] = histogram{}
+		r.slotAt[i] = at
+	}
+	r.slots[i].observe(s, failed)
+}
+
+// RouteStats summarizes a route over the sliding window.
+type RouteStats struct {
+	Route      string        `json:"route"`
+	Requests   uint64        `json:"requests"`
+	Errors     uint64        `json:"errors"`
+	ErrorRatio float64       `json:"error_ratio"`
+	P50        time.Duration `json:"p50"`
+	P95        time.Duration `json:"p95"`
+	P99        time.Duration `json:"p99"`
+}
+
+// Snapshot returns window stats for every route that has served requests,
+// sorted by route name.
+func (m *Metrics) Snapshot() []RouteStats {
+	now := time.Now().UnixNano() / int64(m.slot)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]RouteStats, 0, len(m.routes))
+	for name, r := range m.routes {
+		var h histogram
+		for i := range r.slots {
+			if now-r.slotAt[i] < slots {
+				h.merge(&r.slots[i])
+			}
+		}
+		st := RouteStats{
+			Route:    name,
+			Requests: h.requests,
+			Errors:   h.errors,
+			P50:      h.quantile(0.50),
+			P95:      h.quantile(0.95),
+			P99:      h.quantile(0.99),
+		}
+		if h.requests > 0 {
+			st.ErrorRatio = float64(h.errors) / float64(h.requests)
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Route < out[j].Route })
+	return out
+}
+
+// SLO holds the thresholds WatchSLO warns about. Zero fields are ignored.
+type SLO struct {
+	Latency    time.Duration // p99 over the window
+	ErrorRatio float64
+}
+
+// WatchSLO logs a warning when a route's window stats exceed the SLO, and
+// again when it's back within it, until ctx is done.
+func (m *Metrics) WatchSLO(ctx context.Context, slo SLO) {
+	burning := map[string]bool{}
+	t := time.NewTicker(m.slot)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		for _, st := range m.Snapshot() {
+			var reasons []string
+			if st.Requests >= minSLORequests {
+				if slo.Latency > 0 && st.P99 > slo.Latency {
+					reasons = append(reasons, fmt.Sprintf("p99 latency %s exceeds %s", st.P99.Round(time.Millisecond), slo.Latency))
+				}
+				if slo.ErrorRatio > 0 && st.ErrorRatio > slo.ErrorRatio {
+					reasons = append(reasons, fmt.Sprintf("error ratio %.2f%% exceeds %.2f%%", st.ErrorRatio*100, slo.ErrorRatio*100))
+				}
+			}
+
+			entry := log.WithFields(log.Fields{"route": st.Route, "window": m.window})
+			switch {
+			case len(reasons) > 0 && !burning[st.Route]:
+				for _, r := range reasons {
+					entry.Warnf("SLO burn: %s", r)
+				}
+			case len(reasons) == 0 && burning[st.Route]:
+				entry.Info("Route back within SLO")
+			}
+			burning[st.Route] = len(reasons) > 0
+		}
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", textContentType)
+	m.WriteText(r.Context(), w)
+}
+
+const textContentType = "text/plain; version=0.0.4"
+
+// WriteText writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteText(ctx context.Context, w io.Writer) {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.routes))
+	totals := map[string]histogram{}
+	aborted, slow := map[string]uint64{}, map[string]uint64{}
+	phases := map[string]map[string]histogram{}
+	conns := map[string]map[string]uint64{}
+	bytes := map[string]map[string]byteCount{}
+	sizesIn, sizesOut := map[string]sizes{}, map[string]sizes{}
+	for name, r := range m.routes {
+		names = append(names, name)
+		var h histogram
+		h.merge(&r.total)
+		totals[name] = h
+		aborted[name] = r.aborted
+		slow[name] = r.slow
+		phases[name] = map[string]histogram{}
+		for phase, ph := range r.phases {
+			var h histogram
+			h.merge(ph)
+			phases[name][phase] = h
+		}
+		conns[name] = maps.Clone(r.conns)
+		bytes[name] = map[string]byteCount{}
+		for class, b := range r.bytes {
+			bytes[name][class] = *b
+		}
+		sizesIn[name], sizesOut[name] = r.sizeIn.copy(), r.sizeOut.copy()
+	}
+	collectors := m.collectors
+	m.mu.Unlock()
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP tsrouter_requests_total Requests served, per route.")
+	fmt.Fprintln(w, "# TYPE tsrouter_requests_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "tsrouter_requests_total{route=%q} %d\n", name, totals[name].requests)
+	}
+	fmt.Fprintln(w, "# HELP tsrouter_request_errors_total Requests answered with a 5xx status, per route.")
+	fmt.Fprintln(w, "# TYPE tsrouter_request_errors_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "tsrouter_request_errors_total{route=%q} %d\n", name, totals[name].errors)
+	}
+	fmt.Fprintln(w, "# HELP tsrouter_requests_aborted_total Requests the client abandoned before the response was complete, per route.")
+	fmt.Fprintln(w, "# TYPE tsrouter_requests_aborted_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "tsrouter_requests_aborted_total{route=%q} %d\n", name, aborted[name])
+	}
+	fmt.Fprintln(w, "# HELP tsrouter_slow_requests_total Requests that took longer than the route's slow_request_threshold, per route.")
+	fmt.Fprintln(w, "# TYPE tsrouter_slow_requests_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "tsrouter_slow_requests_total{route=%q} %d\n", name, slow[name])
+	}
+
+	fmt.Fprintln(w, "# HELP tsrouter_request_duration_seconds Request latency, per route.")
+	fmt.Fprintln(w, "# TYPE tsrouter_request_duration_seconds histogram")
+	for _, name := range names {
+		h := totals[name]
+		var cum uint64
+		for i, c := range h.counts {
+			cum += c
+			le := "+Inf"
+			if i < len(bounds) {
+				le = formatFloat(bounds[i])
+			}
+			fmt.Fprintf(w, "tsrouter_request_duration_seconds_bucket{route=%q,le=%q} %d\n", name, le, cum)
+		}
+		fmt.Fprintf(w, "tsrouter_request_duration_seconds_sum{route=%q} %s\n", name, formatFloat(h.sum))
+		fmt.Fprintf(w, "tsrouter_request_duration_seconds_count{route=%q} %d\n", name, h.requests)
+	}
+
+	for _, c := range []struct {
+		name, help string
+		bytes      func(byteCount) uint64
+	}{
+		{"tsrouter_request_bytes_total", "Request body bytes received, per route and response status class.", func(b byteCount) uint64 { return b.in }},
+		{"tsrouter_response_bytes_total", "Response body bytes sent, per route and response status class.", func(b byteCount) uint64 { return b.out }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+		for _, name := range names {
+			classes := make([]string, 0, len(bytes[name]))
+			for class := range bytes[name] {
+				classes = append(classes, class)
+			}
+			sort.Strings(classes)
+			for _, class := range classes {
+				fmt.Fprintf(w, "%s{route=%q,status_class=%q} %d\n", c.name, name, class, c.bytes(bytes[name][class]))
+			}
+		}
+	}
+	for _, c := range []struct {
+		name, help string
+		sizes      map[string]sizes
+	}{
+		{"tsrouter_request_size_bytes", "Request body sizes, per route.", sizesIn},
+		{"tsrouter_response_size_bytes", "Response body sizes, per route.", sizesOut},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE %s histogram\n", c.name)
+		for _, name := range names {
+			h := c.sizes[name]
+			var cum uint64
+			for i, n := range h.counts {
+				cum += n
+				le := "+Inf"
+				if i < len(sizeBounds) {
+					le = strconv.FormatInt(int64(sizeBounds[i]), 10)
+				}
+				fmt.Fprintf(w, "%s_bucket{route=%q,le=%q} %d\n", c.name, name, le, cum)
+			}
+			fmt.Fprintf(w, "%s_sum{route=%q} %d\n", c.name, name, h.sum)
+			fmt.Fprintf(w, "%s_count{route=%q} %d\n", c.name, name, cum)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP tsrouter_backend_requests_total Requests sent to HTTP backends, per route and whether the connection was new or reused.")
+	fmt.Fprintln(w, "# TYPE tsrouter_backend_requests_total counter")
+	for _, name := range names {
+		for _, conn := range []string{"new", "reused"} {
+			fmt.Fprintf(w, "tsrouter_backend_requests_total{route=%q,connection=%q} %d\n", name, conn, conns[name][conn])
+		}
+	}
+	fmt.Fprintln(w, "# HELP tsrouter_backend_phase_seconds Time spent in each phase of backend requests, per route: dial (getting a connection), dns, connect and tls (new connections only) and ttfb.")
+	fmt.Fprintln(w, "# TYPE tsrouter_backend_phase_seconds histogram")
+	for _, name := range names {
+		for _, phase := range []string{"dial", "dns", "connect", "tls", "ttfb"} {
+			h, ok := phases[name][phase]
+			if !ok {
+				continue
+			}
+			var cum uint64
+			for i, c := range h.counts {
+				cum += c
+				le := "+Inf"
+				if i < len(bounds) {
+					le = formatFloat(bounds[i])
+				}
+				fmt.Fprintf(w, "tsrouter_backend_phase_seconds_bucket{route=%q,phase=%q,le=%q} %d\n", name, phase, le, cum)
+			}
+			fmt.Fprintf(w, "tsrouter_backend_phase_seconds_sum{route=%q,phase=%q} %s\n", name, phase, formatFloat(h.sum))
+			fmt.Fprintf(w, "tsrouter_backend_phase_seconds_count{route=%q,phase=%q} %d\n", name, phase, h.requests)
+		}
+	}
+
+	window := m.Snapshot()
+	fmt.Fprintf(w, "# HELP tsrouter_window_latency_seconds Latency percentiles over the last %s, per route.\n", m.window)
+	fmt.Fprintln(w, "# TYPE tsrouter_window_latency_seconds gauge")
+	for _, st := range window {
+		for _, q := range []struct {
+			q string
+			d time.Duration
+		}{{"0.5", st.P50}, {"0.95", st.P95}, {"0.99", st.P99}} {
+			fmt.Fprintf(w, "tsrouter_window_latency_seconds{route=%q,quantile=%q} %s\n", st.Route, q.q, formatFloat(q.d.Seconds()))
+		}
+	}
+	fmt.Fprintf(w, "# HELP tsrouter_window_error_ratio Share of 5xx responses over the last %s, per route.\n", m.window)
+	fmt.Fprintln(w, "# TYPE tsrouter_window_error_ratio gauge")
+	for _, st := range window {
+		fmt.Fprintf(w, "tsrouter_window_error_ratio{route=%q} %s\n", st.Route, formatFloat(st.ErrorRatio))
+	}
+
+	for _, c := range collectors {
+		c.WriteMetrics(ctx, w)
+	}
+}
+
+func statusClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+func formatFloat(f float64) string {
+	return fmt.Sprintf("%g", f)
+}
@@ -0,0 +1,316 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// family is a metric family read back from the Prometheus text format, so
+// a push carries the collectors' metrics too, whatever wrote them.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+type sample struct {
+	name   string // with a histogram's _bucket, _sum or _count suffix
+	labels map[string]string
+	value  float64
+}
+
+// parseText reads the families written by WriteText, in order.
+func parseText(r io.Reader) []*family {
+	var fams []*family
+	byName := map[string]*family{}
+	get := func(name string) *family {
+		f, ok := byName[name]
+		if !ok {
+			f = &family{name: name, typ: "untyped"}
+			byName[name] = f
+			fams = append(fams, f)
+		}
+		return f
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) == 4 && fields[1] == "HELP" {
+				get(fields[2]).help = fields[3]
+			} else if len(fields) == 4 && fields[1] == "TYPE" {
+				get(fields[2]).typ = fields[3]
+			}
+			continue
+		}
+		s, ok := parseSample(line)
+		if !ok {
+			continue
+		}
+		name := s.name
+		if _, ok := byName[name]; !ok {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if f, ok := byName[strings.TrimSuffix(name, suffix)]; ok && f.typ == "histogram" {
+					name = f.name
+					break
+				}
+			}
+		}
+		f := get(name)
+		f.samples = append(f.samples, s)
+	}
+	return fams
+}
+
+func parseSample(line string) (sample, bool) {
+	s := sample{labels: map[string]string{}}
+	i := strings.IndexAny(line, "{ ")
+	if i < 0 {
+		return s, false
+	}
+	s.name, line = line[:i], line[i:]
+	if line[0] == '{' {
+		line = line[1:]
+		for {
+			line = strings.TrimLeft(line, ", ")
+			if strings.HasPrefix(line, "}") {
+				line = line[1:]
+				break
+			}
+			eq := strings.IndexByte(line, '=')
+			if eq < 0 {
+				return s, false
+			}
+			key := line[:eq]
+			quoted, err := strconv.QuotedPrefix(line[eq+1:])
+			if err != nil {
+				return s, false
+			}
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return s, false
+			}
+			s.labels[key] = value
+			line = line[eq+1+len(quoted):]
+		}
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return s, false
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, false
+	}
+	s.value = v
+	return s, true
+}
+
+// The OTLP/HTTP JSON encoding of an ExportMetricsServiceRequest, as far as
+// tsrouter needs it.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberPoint `json:"dataPoints"`
+		AggregationTemporality int               `json:"aggregationTemporality"`
+		IsMonotonic            bool              `json:"isMonotonic"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberPoint `json:"dataPoints"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+		AggregationTemporality int                  `json:"aggregationTemporality"`
+	}
+	otlpNumberPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          float64         `json:"asDouble"`
+	}
+	otlpHistogramPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+)
+
+// temporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE: counters
+// are running totals since started.
+const temporalityCumulative = 2
+
+// otlpMetrics converts families to an OTLP request. Counters become
+// monotonic sums, histograms keep their buckets, and everything else is a
+// gauge.
+func otlpMetrics(fams []*family, instance string, started, now time.Time) otlpRequest {
+	start, ts := nanos(started), nanos(now)
+	var out []otlpMetric
+	for _, f := range fams {
+		if len(f.samples) == 0 {
+			continue
+		}
+		m := otlpMetric{Name: f.name, Description: f.help}
+		switch f.typ {
+		case "counter":
+			m.Sum = &otlpSum{AggregationTemporality: temporalityCumulative, IsMonotonic: true}
+			for _, s := range f.samples {
+				m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberPoint{Attributes: attributes(s.labels), StartTimeUnixNano: start, TimeUnixNano: ts, AsDouble: s.value})
+			}
+		case "histogram":
+			m.Histogram = &otlpHistogram{AggregationTemporality: temporalityCumulative, DataPoints: histogramPoints(f, start, ts)}
+		default:
+			m.Gauge = &otlpGauge{}
+			for _, s := range f.samples {
+				m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberPoint{Attributes: attributes(s.labels), TimeUnixNano: ts, AsDouble: s.value})
+			}
+		}
+		out = append(out, m)
+	}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: attributes(map[string]string{
+			"service.name":        "tsrouter",
+			"service.instance.id": instance,
+		})},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "tsrouter"}, Metrics: out}},
+	}}}
+}
+
+// histogramPoints groups a histogram's samples by their labels other than
+// le, turning the cumulative Prometheus buckets into OTLP's per-bucket
+// counts.
+func histogramPoints(f *family, start, ts string) []otlpHistogramPoint {
+	type series struct {
+		labels  map[string]string
+		buckets map[float64]float64
+		sum     float64
+		count   float64
+	}
+	var order []string
+	all := map[string]*series{}
+	for _, s := range f.samples {
+		labels := map[string]string{}
+		for k, v := range s.labels {
+			if k != "le" {
+				labels[k] = v
+			}
+		}
+		id := seriesID(labels)
+		se, ok := all[id]
+		if !ok {
+			se = &series{labels: labels, buckets: map[float64]float64{}}
+			all[id] = se
+			order = append(order, id)
+		}
+		switch strings.TrimPrefix(s.name, f.name) {
+		case "_bucket":
+			if le, err := strconv.ParseFloat(s.labels["le"], 64); err == nil {
+				se.buckets[le] = s.value
+			}
+		case "_sum":
+			se.sum = s.value
+		case "_count":
+			se.count = s.value
+		}
+	}
+
+	var points []otlpHistogramPoint
+	for _, id := range order {
+		se := all[id]
+		bounds := make([]float64, 0, len(se.buckets))
+		for le := range se.buckets {
+			if !math.IsInf(le, 1) {
+				bounds = append(bounds, le)
+			}
+		}
+		sort.Float64s(bounds)
+		counts := make([]string, 0, len(bounds)+1)
+		var prev float64
+		for _, le := range bounds {
+			counts = append(counts, strconv.FormatUint(uint64(se.buckets[le]-prev), 10))
+			prev = se.buckets[le]
+		}
+		counts = append(counts, strconv.FormatUint(uint64(se.count-prev), 10))
+		points = append(points, otlpHistogramPoint{
+			Attributes:        attributes(se.labels),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      ts,
+			Count:             strconv.FormatUint(uint64(se.count), 10),
+			Sum:               se.sum,
+			BucketCounts:      counts,
+			ExplicitBounds:    bounds,
+		})
+	}
+	return points
+}
+
+func seriesID(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + strconv.Quote(labels[k]) + ",")
+	}
+	return b.String()
+}
+
+func attributes(labels map[string]string) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(labels))
+	for k, v := range labels {
+		attrs = append(attrs, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
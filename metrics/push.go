@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PushFormats lists the supported push formats.
+var PushFormats = []string{"pushgateway", "otlp"}
+
+const pushTimeout = 10 * time.Second
+
+// Pusher sends the metrics to a Prometheus Pushgateway or an OTLP/HTTP
+// receiver, for nodes nothing can scrape.
+type Pusher struct {
+	m        *Metrics
+	url      string
+	format   string
+	instance string
+	started  time.Time
+	client   *http.Client
+}
+
+// NewPusher pushes m to endpoint in format, one of PushFormats, labelled
+// with instance. The job path of a Pushgateway, /metrics/job/tsrouter/
+// instance/<instance>, and the /v1/metrics path of an OTLP receiver are
+// added to endpoint unless it has a path of its own.
+func NewPusher(m *Metrics, endpoint, format, instance string) (*Pusher, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid metrics push URL %q: want http(s)://host[:port][/path]", endpoint)
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		switch format {
+		case "pushgateway":
+			u.Path = "/metrics/job/tsrouter/instance/" + url.PathEscape(instance)
+		case "otlp":
+			u.Path = "/v1/metrics"
+		}
+	}
+	switch format {
+	case "pushgateway", "otlp":
+	default:
+		return nil, fmt.Errorf("unknown metrics push format %q (want one of %s)", format, strings.Join(PushFormats, ", "))
+	}
+	return &Pusher{
+		m:        m,
+		url:      u.String(),
+		format:   format,
+		instance: instance,
+		started:  time.Now(),
+		client:   &http.Client{Timeout: pushTimeout},
+	}, nil
+}
+
+// Run pushes every interval until ctx is done, then once more so the last
+// counts aren't lost.
+func (p *Pusher) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	failing := false
+	push := func(ctx context.Context) {
+		err := p.Push(ctx)
+		switch {
+		case err != nil && !failing:
+			log.Warnf("Failed to push metrics: %v", err)
+		case err != nil:
+			log.Debugf("Failed to push metrics: %v", err)
+		case failing:
+			log.Info("Pushing metrics again")
+		}
+		failing = err != nil
+	}
+	for {
+		select {
+		case <-t.C:
+			push(ctx)
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+			push(ctx)
+			cancel()
+			return
+		}
+	}
+}
+
+// Push sends the current metrics once.
+func (p *Pusher) Push(ctx context.Context) error {
+	var text bytes.Buffer
+	p.m.WriteText(ctx, &text)
+
+	method, contentType, body := http.MethodPut, textContentType, io.Reader(&text)
+	if p.format == "otlp" {
+		data, err := json.Marshal(otlpMetrics(parseText(&text), p.instance, p.started, time.Now()))
+		if err != nil {
+			return err
+		}
+		method, contentType, body = http.MethodPost, "application/json", bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s answered HTTP %d: %s", p.url, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
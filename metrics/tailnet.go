@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/certs"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/types/key"
+)
+
+// Collector writes additional metrics after the per-route ones.
+type Collector interface {
+	WriteMetrics(ctx context.Context, w io.Writer)
+}
+
+// Add registers c to be written by ServeHTTP.
+func (m *Metrics) Add(c Collector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+// Tailnet reports on the node's Tailscale layer: tailscaled's own metrics
+// (bytes and packets by path, DERP or direct), peers and how they're
+// connected, WireGuard handshakes and served certificates.
+type Tailnet struct {
+	lc    *tailscale.LocalClient
+	certs *certs.Selector
+
+	mu         sync.Mutex
+	handshakes map[key.NodePublic]time.Time
+	count      uint64
+}
+
+// NewTailnet returns a collector for the node behind lc and the
+// certificates served through sel, which may be nil.
+func NewTailnet(lc *tailscale.LocalClient, sel *certs.Selector) *Tailnet {
+	return &Tailnet{lc: lc, certs: sel, handshakes: map[key.NodePublic]time.Time{}}
+}
+
+// WriteMetrics implements Collector. Handshakes are counted from each
+// peer's last handshake time, so ones that happen in quick succession
+// between two scrapes count once.
+func (t *Tailnet) WriteMetrics(ctx context.Context, w io.Writer) {
+	if um, err := t.lc.UserMetrics(ctx); err == nil {
+		w.Write(um)
+	}
+
+	if st, err := t.lc.Status(ctx); err == nil {
+		var online, active, direct, relayed int
+		t.mu.Lock()
+		for _, p := range st.Peer {
+			if !p.LastHandshake.IsZero() && p.LastHandshake.After(t.handshakes[p.PublicKey]) {
+				t.handshakes[p.PublicKey] = p.LastHandshake
+				t.count++
+			}
+			if !p.Online {
+				continue
+			}
+			online++
+			if !p.Active {
+				continue
+			}
+			active++
+			if p.CurAddr != "" {
+				direct++
+			} else if p.Relay != "" {
+				relayed++
+			}
+		}
+		handshakes := t.count
+		t.mu.Unlock()
+
+		fmt.Fprintln(w, "# HELP tsrouter_tailnet_peers Peers connected to the control plane, and those that exchanged traffic with the node in the last couple of minutes.")
+		fmt.Fprintln(w, "# TYPE tsrouter_tailnet_peers gauge")
+		fmt.Fprintf(w, "tsrouter_tailnet_peers{state=\"online\"} %d\n", online)
+		fmt.Fprintf(w, "tsrouter_tailnet_peers{state=\"active\"} %d\n", active)
+		fmt.Fprintln(w, "# HELP tsrouter_tailnet_active_peer_paths Active peers by how they're connected: directly or through a DERP relay.")
+		fmt.Fprintln(w, "# TYPE tsrouter_tailnet_active_peer_paths gauge")
+		fmt.Fprintf(w, "tsrouter_tailnet_active_peer_paths{path=\"direct\"} %d\n", direct)
+		fmt.Fprintf(w, "tsrouter_tailnet_active_peer_paths{path=\"derp\"} %d\n", relayed)
+		fmt.Fprintln(w, "# HELP tsrouter_tailnet_handshakes_total WireGuard handshakes completed with peers.")
+		fmt.Fprintln(w, "# TYPE tsrouter_tailnet_handshakes_total counter")
+		fmt.Fprintf(w, "tsrouter_tailnet_handshakes_total %d\n", handshakes)
+	}
+
+	if t.certs == nil {
+		return
+	}
+	stats := t.certs.Stats()
+	fmt.Fprintln(w, "# HELP tsrouter_certificate_expiry_timestamp_seconds When each served certificate expires.")
+	fmt.Fprintln(w, "# TYPE tsrouter_certificate_expiry_timestamp_seconds gauge")
+	for _, c := range stats {
+		fmt.Fprintf(w, "tsrouter_certificate_expiry_timestamp_seconds{name=%q} %d\n", c.Name, c.NotAfter.Unix())
+	}
+	fmt.Fprintln(w, "# HELP tsrouter_certificate_renewals_total Times a renewed certificate replaced the one served.")
+	fmt.Fprintln(w, "# TYPE tsrouter_certificate_renewals_total counter")
+	for _, c := range stats {
+		fmt.Fprintf(w, "tsrouter_certificate_renewals_total{name=%q} %d\n", c.Name, c.Renewals)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/errdefs"
+)
+
+func configCommand() *command {
+	return &command{
+		name:    "config",
+		summary: "Maintain config files",
+		examples: []string{
+			"tsrouter config migrate tsrouter.yaml conf.d/*.yaml",
+			"tsrouter config migrate --check tsrouter.yaml",
+		},
+		subcommands: []*command{
+			configMigrateCommand(),
+		},
+	}
+}
+
+func configMigrateCommand() *command {
+	fs := newFlagSet("config migrate")
+	path := fs.String("config", "", "Config file to migrate, when no files are given (default: $TSROUTER_CONFIG)")
+	check := fs.Bool("check", false, "Only report files that need migrating, and fail if any do")
+
+	return &command{
+		name:    "migrate",
+		usage:   "[file...]",
+		summary: "Rewrite config files for the current config version",
+		description: fmt.Sprintf(`
+Config files declare the schema they're written for with a top-level
+version key, %d for this tsrouter. Files for an older version, or without
+one, still load: they're upgraded in memory, with a warning. migrate
+upgrades the files themselves and sets their version. Included files
+aren't followed, so list them too.
+
+A file that only lacks the version gets it added at the top and is
+otherwise left as it is. One that needs upgrading is written out anew,
+which loses its comments, so the original is kept with .bak added.`, config.Version),
+		flags: fs,
+		run: func(ctx context.Context, args []string) error {
+			files := args
+			if len(files) == 0 {
+				p := (&config.Flags{ConfigPath: *path}).Path()
+				if p == "" {
+					return fmt.Errorf("a config file is required")
+				}
+				files = []string{p}
+			}
+
+			pending := 0
+			for _, file := range files {
+				if config.IsRemote(file) {
+					return fmt.Errorf("%s: only local files can be migrated", file)
+				}
+				m, err := config.MigrateFile(file)
+				if err != nil {
+					return errdefs.Wrap(errdefs.ErrConfig, err)
+				}
+				switch {
+				case m.Data == nil:
+					fmt.Printf("%s: already at version %d\n", file, config.Version)
+				case *check && m.Reencoded:
+					pending++
+					fmt.Printf("%s: version %d, needs migrating to %d\n", file, m.From, config.Version)
+				case *check:
+					pending++
+					fmt.Printf("%s: no version, needs version %d\n", file, config.Version)
+				default:
+					if err := writeMigrated(file, m); err != nil {
+						return err
+					}
+					if m.Reencoded {
+						fmt.Printf("%s: migrated from version %d to %d\n", file, m.From, config.Version)
+					} else {
+						fmt.Printf("%s: set version %d\n", file, config.Version)
+					}
+				}
+			}
+			if pending > 0 {
+				return errdefs.Wrap(errdefs.ErrConfig, fmt.Errorf("%d of %d files need migrating", pending, len(files)))
+			}
+			return nil
+		},
+	}
+}
+
+// writeMigrated replaces file with its migrated content, keeping its mode,
+// and keeps the original alongside when the migration loses its comments.
+func writeMigrated(file string, m *config.Migration) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if m.Reencoded {
+		orig, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(file+".bak", orig, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to back up %s: %v", file, err)
+		}
+		log.Infof("Kept the original of %s as %s.bak", file, file)
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, m.Data, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %v", file, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package mock
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fixtures serves files named after request paths: GET /users/42 is
+// answered with users/42.json, users/42.get.json for GET only, or
+// users/42.404.json to answer with a status other than 200. The extension
+// sets the content type, and / or a directory is answered by its index
+// file, such as index.json.
+type fixtures struct {
+	root string
+}
+
+// fixture is a file matching a request path.
+type fixture struct {
+	name   string
+	method string // empty for any method
+	status int    // 0 for 200
+	ext    string
+}
+
+func (f *fixtures) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dir, candidates := f.locate(r.URL.Path)
+
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	var specific, generic []fixture
+	for _, c := range candidates {
+		switch c.method {
+		case method:
+			specific = append(specific, c)
+		case "":
+			generic = append(generic, c)
+		}
+	}
+	if len(specific) == 0 && len(generic) == 0 {
+		if allow := methods(candidates); len(allow) > 0 {
+			methodNotAllowed(w, r, allow)
+			return
+		}
+		notFound(w, r)
+		return
+	}
+
+	// The method's own fixtures win over ones for any method, unless only
+	// those have the status the client prefers.
+	c, ok := withStatus(append(specific, generic...), preferredStatus(r))
+	if !ok && len(specific) > 0 {
+		c = lowest(specific)
+	} else if !ok {
+		c = lowest(generic)
+	}
+	body, err := os.ReadFile(filepath.Join(dir, c.name))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	contentType := mime.TypeByExtension("." + c.ext)
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(c.statusCode())
+	w.Write(body)
+}
+
+// locate returns the fixtures for a request path and the directory they
+// are in. A directory's index fixtures win over the ones named after it,
+// so /users may be users/index.json or users.json.
+func (f *fixtures) locate(urlPath string) (string, []fixture) {
+	name := filepath.Join(f.root, filepath.FromSlash(path.Clean("/"+urlPath)))
+	if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+		if found := find(name, "index"); len(found) > 0 || name == f.root {
+			return name, found
+		}
+	}
+	dir := filepath.Dir(name)
+	return dir, find(dir, filepath.Base(name))
+}
+
+// find lists the fixtures in dir for base: a file named base itself, or
+// base.[method.][status.]ext.
+func find(dir, base string) []fixture {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var found []fixture
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if name == base {
+			found = append(found, fixture{name: name, ext: strings.TrimPrefix(filepath.Ext(name), ".")})
+			continue
+		}
+		rest, ok := strings.CutPrefix(name, base+".")
+		if !ok {
+			continue
+		}
+		if c, ok := parseFixture(rest); ok {
+			c.name = name
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// parseFixture parses the [method.][status.]ext after a fixture's base
+// name. Anything else, like users.old.json for users, isn't a fixture.
+func parseFixture(rest string) (fixture, bool) {
+	parts := strings.Split(rest, ".")
+	c := fixture{ext: parts[len(parts)-1]}
+	for _, p := range parts[:len(parts)-1] {
+		if status, err := strconv.Atoi(p); err == nil && len(p) == 3 && status >= 100 && c.status == 0 {
+			c.status = status
+		} else if m := strings.ToUpper(p); isMethod(m) && c.method == "" && c.status == 0 {
+			c.method = m
+		} else {
+			return c, false
+		}
+	}
+	return c, true
+}
+
+func isMethod(m string) bool {
+	switch m {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func (c fixture) statusCode() int {
+	if c.status == 0 {
+		return http.StatusOK
+	}
+	return c.status
+}
+
+func withStatus(cs []fixture, status int) (fixture, bool) {
+	for _, c := range cs {
+		if c.statusCode() == status {
+			return c, true
+		}
+	}
+	return fixture{}, false
+}
+
+// lowest returns the fixture with the lowest status, usually the 200 one.
+func lowest(cs []fixture) fixture {
+	best := cs[0]
+	for _, c := range cs[1:] {
+		if c.statusCode() < best.statusCode() {
+			best = c
+		}
+	}
+	return best
+}
+
+// methods returns the methods fixtures are limited to, for Allow.
+func methods(cs []fixture) []string {
+	var ms []string
+	for _, c := range cs {
+		if c.method != "" && !slices.Contains(ms, c.method) {
+			ms = append(ms, c.method)
+		}
+	}
+	slices.Sort(ms)
+	return ms
+}
@@ -0,0 +1,61 @@
+// Package mock serves canned responses in place of a backend, from a
+// directory of fixture files or the examples of an OpenAPI document, for
+// demoing an API before it exists.
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// New returns a handler serving the fixtures in the directory at path, or
+// the examples of the OpenAPI 3 document at path if it is a .json, .yaml
+// or .yml file.
+func New(path string) (http.Handler, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &fixtures{root: path}, nil
+	}
+	return loadSpec(path)
+}
+
+// preferCode matches the status a client asks for with Prefer: code=404,
+// the convention of other mock servers, to try responses other than the
+// default one.
+var preferCode = regexp.MustCompile(`(?:^|[\s,;])code=(\d{3})\b`)
+
+func preferredStatus(r *http.Request) int {
+	m := preferCode.FindStringSubmatch(r.Header.Get("Prefer"))
+	if m == nil {
+		return 0
+	}
+	status, _ := strconv.Atoi(m[1])
+	return status
+}
+
+// notFound answers a request there is no canned response for.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, fmt.Sprintf("no mock response for %s %s", r.Method, r.URL.Path))
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// methodNotAllowed answers a request for a path only other methods have
+// responses for.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allow []string) {
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("no mock response for %s %s, only %s", r.Method, r.URL.Path, strings.Join(allow, ", ")))
+}
@@ -0,0 +1,446 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxRefs bounds chains of references, which may be circular.
+const maxRefs = 8
+
+// spec serves the responses of an OpenAPI 3 document: for each operation,
+// its lowest 2xx response, or the one the client prefers, with the
+// response's example, or one generated from its schema.
+type spec struct {
+	base string // path of the first server URL, e.g. /api/v1
+	ops  []*operation
+}
+
+type operation struct {
+	method    string
+	segments  []string // {param} segments match any value
+	literals  int      // segments that aren't parameters, for precedence
+	responses map[int]response
+	status    int // the default response
+}
+
+type response struct {
+	contentType string
+	body        []byte
+}
+
+func loadSpec(name string) (*spec, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var raw any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI document %s: %v", name, err)
+	}
+	doc, _ := stringKeys(raw).(map[string]any)
+	if _, ok := doc["openapi"]; !ok {
+		return nil, fmt.Errorf("%s is not an OpenAPI 3 document: no openapi version", name)
+	}
+	paths, _ := doc["paths"].(map[string]any)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s has no paths", name)
+	}
+
+	s := &spec{}
+	if servers, _ := doc["servers"].([]any); len(servers) > 0 {
+		if server, _ := servers[0].(map[string]any); server != nil {
+			if raw, _ := server["url"].(string); raw != "" {
+				if u, err := url.Parse(raw); err == nil {
+					s.base = strings.TrimSuffix(u.Path, "/")
+				}
+			}
+		}
+	}
+	r := resolver{doc: doc}
+	for p, item := range paths {
+		item, _ := r.resolve(item).(map[string]any)
+		for method, op := range item {
+			method = strings.ToUpper(method)
+			if !isMethod(method) {
+				continue // parameters, summary and the like
+			}
+			op, _ := op.(map[string]any)
+			o, err := r.operation(method, p, op)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s %s: %v", name, method, p, err)
+			}
+			if o != nil {
+				s.ops = append(s.ops, o)
+			}
+		}
+	}
+	// Literal segments take precedence over parameters, so /users/me
+	// wins over /users/{id}.
+	sort.SliceStable(s.ops, func(i, j int) bool { return s.ops[i].literals > s.ops[j].literals })
+	return s, nil
+}
+
+func (s *spec) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + r.URL.Path)
+	if s.base != "" {
+		if rest, ok := strings.CutPrefix(p, s.base); ok && (rest == "" || rest[0] == '/') {
+			p = rest
+		}
+	}
+	segments := split(p)
+
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	var allow []string
+	for _, o := range s.ops {
+		if !o.matches(segments) {
+			continue
+		}
+		if o.method != method {
+			if !slices.Contains(allow, o.method) {
+				allow = append(allow, o.method)
+			}
+			continue
+		}
+		status := o.status
+		if preferred := preferredStatus(r); preferred != 0 {
+			if _, ok := o.responses[preferred]; ok {
+				status = preferred
+			}
+		}
+		resp := o.responses[status]
+		if resp.body != nil {
+			w.Header().Set("Content-Type", resp.contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(resp.body)))
+		}
+		w.WriteHeader(status)
+		w.Write(resp.body)
+		return
+	}
+	if len(allow) > 0 {
+		slices.Sort(allow)
+		methodNotAllowed(w, r, allow)
+		return
+	}
+	notFound(w, r)
+}
+
+func (o *operation) matches(segments []string) bool {
+	if len(segments) != len(o.segments) {
+		return false
+	}
+	for i, s := range o.segments {
+		if !isParam(s) && s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func split(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func isParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// stringKeys turns the maps YAML decodes non-string keys into, like the
+// unquoted 200 of a response, into maps with string keys, as in JSON.
+func stringKeys(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = stringKeys(e)
+		}
+		return v
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = stringKeys(e)
+		}
+		return v
+	}
+	return v
+}
+
+// resolver resolves local references, #/components/schemas/User and the
+// like, within a document.
+type resolver struct {
+	doc map[string]any
+}
+
+// resolve follows v's $ref, if it has one, to what it refers to.
+func (r resolver) resolve(v any) any {
+	for range maxRefs {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return v
+		}
+		v = r.lookup(ref)
+	}
+	return nil
+}
+
+func (r resolver) lookup(ref string) any {
+	pointer, ok := strings.CutPrefix(ref, "#/")
+	if !ok {
+		return nil // references to other documents aren't followed
+	}
+	var v any = r.doc
+	for _, key := range strings.Split(pointer, "/") {
+		key = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// operation prepares an operation's responses, or returns nil if it has
+// none with a numeric status.
+func (r resolver) operation(method, p string, op map[string]any) (*operation, error) {
+	responses, _ := op["responses"].(map[string]any)
+	o := &operation{method: method, segments: split(p), responses: map[int]response{}}
+	for _, s := range o.segments {
+		if !isParam(s) {
+			o.literals++
+		}
+	}
+	add := func(code string, status int) error {
+		resp, _ := r.resolve(responses[code]).(map[string]any)
+		prepared, err := r.response(resp)
+		if err != nil {
+			return fmt.Errorf("response %s: %v", code, err)
+		}
+		o.responses[status] = prepared
+		return nil
+	}
+	for code := range responses {
+		status, err := strconv.Atoi(code)
+		if len(code) == 3 && strings.HasSuffix(strings.ToUpper(code), "XX") && code[0] >= '1' && code[0] <= '5' {
+			status, err = int(code[0]-'0')*100, nil
+		}
+		if err != nil {
+			continue
+		}
+		if err := add(code, status); err != nil {
+			return nil, err
+		}
+	}
+	// default usually describes errors, so it's only served when it's all
+	// there is.
+	if _, ok := responses["default"]; ok && len(o.responses) == 0 {
+		if err := add("default", http.StatusOK); err != nil {
+			return nil, err
+		}
+	}
+	if len(o.responses) == 0 {
+		return nil, nil
+	}
+
+	var statuses []int
+	for status := range o.responses {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	o.status = statuses[0]
+	for _, status := range statuses {
+		if status/100 == 2 {
+			o.status = status
+			break
+		}
+	}
+	return o, nil
+}
+
+// response renders a response's example for its preferred content type,
+// JSON if it has one.
+func (r resolver) response(resp map[string]any) (response, error) {
+	content, _ := resp["content"].(map[string]any)
+	if len(content) == 0 {
+		return response{}, nil
+	}
+	types := make([]string, 0, len(content))
+	for t := range content {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	contentType := types[0]
+	for _, t := range types {
+		if isJSON(t) {
+			contentType = t
+			break
+		}
+	}
+	media, _ := r.resolve(content[contentType]).(map[string]any)
+
+	example, ok := media["example"]
+	if !ok {
+		if examples, _ := media["examples"].(map[string]any); len(examples) > 0 {
+			names := make([]string, 0, len(examples))
+			for name := range examples {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			if ex, _ := r.resolve(examples[names[0]]).(map[string]any); ex != nil {
+				example, ok = ex["value"]
+			}
+		}
+	}
+	if !ok {
+		example = r.generate(media["schema"], nil)
+	}
+
+	if s, ok := example.(string); ok && !isJSON(contentType) {
+		return response{contentType: contentType, body: []byte(s)}, nil
+	}
+	body, err := json.MarshalIndent(example, "", "  ")
+	if err != nil {
+		return response{}, err
+	}
+	if !isJSON(contentType) {
+		contentType = "application/json"
+	}
+	return response{contentType: contentType, body: append(body, '\n')}, nil
+}
+
+func isJSON(contentType string) bool {
+	return contentType == "application/json" || strings.HasSuffix(contentType, "+json")
+}
+
+// generate makes up a value matching schema, from its examples, defaults
+// and enums where it has them and placeholders of its type otherwise.
+// A schema referring to itself, like a tree's nodes, is left out where it
+// recurs; seen holds the references being generated.
+func (r resolver) generate(schema any, seen []string) any {
+	if m, ok := schema.(map[string]any); ok {
+		if ref, ok := m["$ref"].(string); ok {
+			if slices.Contains(seen, ref) {
+				return nil
+			}
+			seen = append(slices.Clip(seen), ref)
+		}
+	}
+	s, _ := r.resolve(schema).(map[string]any)
+	if s == nil {
+		return nil
+	}
+	if v, ok := s["example"]; ok {
+		return v
+	}
+	if examples, _ := s["examples"].([]any); len(examples) > 0 {
+		return examples[0]
+	}
+	if v, ok := s["default"]; ok {
+		return v
+	}
+	if v, ok := s["const"]; ok {
+		return v
+	}
+	if enum, _ := s["enum"].([]any); len(enum) > 0 {
+		return enum[0]
+	}
+	if all, _ := s["allOf"].([]any); len(all) > 0 {
+		merged := map[string]any{}
+		for _, sub := range all {
+			if m, ok := r.generate(sub, seen).(map[string]any); ok {
+				for k, v := range m {
+					merged[k] = v
+				}
+			}
+		}
+		return merged
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		if alts, _ := s[key].([]any); len(alts) > 0 {
+			return r.generate(alts[0], seen)
+		}
+	}
+
+	switch schemaType(s) {
+	case "object":
+		obj := map[string]any{}
+		props, _ := s["properties"].(map[string]any)
+		for name, prop := range props {
+			if v := r.generate(prop, seen); v != nil {
+				obj[name] = v
+			}
+		}
+		return obj
+	case "array":
+		if v := r.generate(s["items"], seen); v != nil {
+			return []any{v}
+		}
+		return []any{}
+	case "string":
+		switch s["format"] {
+		case "date-time":
+			return "2024-01-01T00:00:00Z"
+		case "date":
+			return "2024-01-01"
+		case "uuid":
+			return "00000000-0000-0000-0000-000000000000"
+		case "email":
+			return "user@example.com"
+		case "uri", "url":
+			return "https://example.com/"
+		}
+		return "string"
+	case "integer", "number":
+		if v, ok := s["minimum"]; ok {
+			return v
+		}
+		return 0
+	case "boolean":
+		return false
+	}
+	return nil
+}
+
+// schemaType returns a schema's type, the first non-null one of a 3.1
+// type list, or object if it only has properties.
+func schemaType(s map[string]any) string {
+	switch t := s["type"].(type) {
+	case string:
+		return t
+	case []any:
+		for _, t := range t {
+			if t, ok := t.(string); ok && t != "null" {
+				return t
+			}
+		}
+	}
+	if _, ok := s["properties"]; ok {
+		return "object"
+	}
+	return ""
+}
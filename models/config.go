@@ -1,7 +1,391 @@
 package models
 
+import "time"
+
+// Config holds every tsrouter option. Scalar fields tagged with yaml are
+// also settable through TSROUTER_<KEY> environment variables and --<key>
+// flags (see the config package); env lists additional legacy variables.
 type Config struct {
-	TargetPort int
-	Hostname   string
-	LogLevel   string
-}
\ No newline at end of file
+	Hostname     string   `yaml:"hostname" usage:"Desired Tailscale hostname"`
+	TargetPort   int      `yaml:"target_port" usage:"Local port to forward to"`
+	LogLevel     string   `yaml:"log_level" default:"info" scope:"api" usage:"Log level (error, info, debug)"`
+	Tailnet      string   `yaml:"tailnet" env:"TS_TAILNET" scope:"api" usage:"Tailnet name, as shown in the DNS section of the admin console (default: the OAuth client's tailnet)"`
+	ClientID     string   `yaml:"client_id" env:"TS_CLIENT_ID" scope:"api" usage:"Tailscale OAuth client ID"`
+	ClientSecret string   `yaml:"client_secret" env:"TS_CLIENT_SECRET" scope:"api" usage:"Tailscale OAuth client secret"`
+	Routes       []Route  `yaml:"routes"`
+	Ports        []string `yaml:"ports" usage:"Extra port mappings, e.g. 8443->9090,2222(tcp)->22"`
+	ListenIP     string   `yaml:"listen_ip" default:"both" usage:"Node addresses to listen on (both, ipv4, ipv6)"`
+	LocalAddr    string   `yaml:"local_addr" usage:"Also serve the main port's routes over plain HTTP on this local address, e.g. 127.0.0.1:8088"`
+	HTTP2        bool     `yaml:"http2" default:"true" usage:"Negotiate HTTP/2 on https ports"`
+	HTTP3        bool     `yaml:"http3" usage:"Also serve https ports over QUIC/HTTP-3 (experimental)"`
+
+	Mock string `yaml:"mock" usage:"Answer with mock responses from this directory of fixtures or OpenAPI document instead of a backend, as a single catch-all route"`
+
+	LocalProxyProtocol bool `yaml:"local_proxy_protocol" usage:"Expect a PROXY protocol header on local_addr connections, from a load balancer in front, and use the client address it carries"`
+	LocalForwardedFor  bool `yaml:"local_forwarded_for" usage:"Take the client address of local_addr requests from the X-Forwarded-For header set by the proxy in front, such as tailscale funnel"`
+
+	ConfigPoll time.Duration `yaml:"config_poll" usage:"How often to check a remote --config for changes, restarting with the new config when it changes (0 disables)"`
+
+	Controller     string `yaml:"controller" usage:"Take routes from the tsrouter controller at this URL, e.g. https://tsrouter-ctl.example.ts.net:8443, instead of the config"`
+	ControllerPort int    `yaml:"controller_port" usage:"Serve the controller API to agents on this tailnet port (0 disables)"`
+	ControllerDir  string `yaml:"controller_dir" usage:"Directory of routes files for the controller to serve, one per agent named after its hostname, e.g. web.yaml"`
+
+	HALease    string        `yaml:"ha_lease" usage:"Lease file shared by an active/passive pair, e.g. on a shared volume: only the instance holding it registers the node and serves"`
+	HALeaseTTL time.Duration `yaml:"ha_lease_ttl" default:"15s" usage:"How long the HA lease lasts without renewal, and so how soon a standby takes over"`
+
+	FailFast     bool `yaml:"fail_fast" usage:"Exit on the first failure at startup, even one that might pass, such as the Tailscale API being unreachable"`
+	RetryForever bool `yaml:"retry_forever" usage:"Keep retrying failures at startup that might pass, such as the Tailscale API being unreachable, instead of giving up"`
+
+	StartupAttempts   int           `yaml:"startup_attempts" default:"5" usage:"How many times to try a startup step failing in a way that might pass before giving up"`
+	StartupBackoffMax time.Duration `yaml:"startup_backoff_max" default:"30s" usage:"Longest wait between startup attempts, which starts at 1s and doubles"`
+
+	DNSCacheTTL time.Duration `yaml:"dns_cache_ttl" default:"30s" usage:"How long resolved target hostnames are cached (0 resolves on every connection)"`
+
+	ClientWriteTimeout time.Duration `yaml:"client_write_timeout" default:"1m" usage:"Drop clients that accept no response data for this long, cancelling their backend requests (0 disables)"`
+	ClientMinRate      int           `yaml:"client_min_rate" usage:"Drop clients taking responses slower than this many bytes per second, once they've been waited on for 10s (0 disables)"`
+
+	StateDir        string `yaml:"state_dir" usage:"Directory holding node state, one subdirectory per hostname (default: tsrouter in the user config directory)"`
+	StatePassphrase string `yaml:"state_passphrase" usage:"Encrypt the node state on disk with this passphrase"`
+	StateKeyCommand string `yaml:"state_key_command" usage:"Command printing the state passphrase, e.g. a lookup in the OS keychain"`
+
+	MemoryState bool `yaml:"memory_state" usage:"Keep node state in memory only, for throwaway runs: the node is new on every start. tsnet's log buffer and certificates still go to a temporary directory, removed on exit"`
+
+	TTL     time.Duration `yaml:"ttl" usage:"Shut down, delete the node and remove its state after running this long, for previews (0 disables)"`
+	TTLIdle time.Duration `yaml:"ttl_idle" usage:"Likewise after this long without requests (0 disables)"`
+
+	TLSCertFile      string   `yaml:"tls_cert_file" usage:"PEM certificate to present for the names it covers, instead of the Tailscale certificate"`
+	TLSKeyFile       string   `yaml:"tls_key_file" usage:"PEM private key for tls_cert_file"`
+	TLSACMEDomains   []string `yaml:"tls_acme_domains" usage:"Custom domains to get a certificate for over ACME"`
+	TLSACMEChallenge string   `yaml:"tls_acme_challenge" default:"dns-01" usage:"ACME challenge to answer: dns-01, through tls_acme_dns_hook, or http-01, served on local_addr with public port 80 forwarded to it"`
+	TLSACMEEmail     string   `yaml:"tls_acme_email" usage:"Contact email for the ACME account"`
+	TLSACMEDNSHook   string   `yaml:"tls_acme_dns_hook" usage:"Command run as '<hook> present|cleanup <record> <value>' to publish DNS-01 TXT records"`
+	TLSACMEDirectory string   `yaml:"tls_acme_directory" default:"https://acme-v02.api.letsencrypt.org/directory" usage:"ACME directory URL"`
+	TLSShortNames    bool     `yaml:"tls_short_names" usage:"Also serve TLS for the node's short hostname and IP addresses, with a certificate from a local CA that clients must trust"`
+
+	ACLGrants     bool   `yaml:"acl_grants" usage:"Only let callers through to the routes an app capability grant in the tailnet policy file gives them"`
+	ACLCapability string `yaml:"acl_capability" default:"github.com/whitehawk2/tsrouter" usage:"App capability name the grants for acl_grants use"`
+
+	Profile         string `yaml:"profile" scope:"api" usage:"Credentials profile to use from the credentials file"`
+	CredentialsFile string `yaml:"credentials_file" scope:"api" usage:"Credentials file with named profiles (default: tsrouter/credentials in the user config directory)"`
+
+	APITimeout time.Duration `yaml:"api_timeout" default:"30s" scope:"api" usage:"Give up on a Tailscale API call (including the OAuth token fetch) after this long"`
+
+	LogLevelRevert time.Duration `yaml:"log_level_revert" default:"15m" usage:"How long a runtime log level change (SIGUSR1 or admin API) lasts (0 keeps it)"`
+
+	AuditLog string `yaml:"audit_log" scope:"api" usage:"Append admin API calls and key and device changes to this file (JSON Lines)"`
+
+	LogFile           string        `yaml:"log_file" usage:"Write application logs to this file instead of stderr"`
+	LogMaxSize        int           `yaml:"log_max_size" default:"100" usage:"Rotate log files when they grow past this many megabytes"`
+	LogRotateInterval time.Duration `yaml:"log_rotate_interval" usage:"Also rotate log files this often, e.g. 24h (0 disables)"`
+	LogMaxBackups     int           `yaml:"log_max_backups" default:"7" usage:"Number of rotated log files to keep (0 keeps all)"`
+	LogMaxAge         time.Duration `yaml:"log_max_age" usage:"Delete rotated log files older than this (0 keeps all)"`
+	LogCompress       bool          `yaml:"log_compress" usage:"Gzip rotated log files"`
+
+	LogRepeatWindow time.Duration `yaml:"log_repeat_window" default:"10s" usage:"Collapse identical log lines repeated within this window into a summary (0 disables)"`
+	LogRepeatBurst  int           `yaml:"log_repeat_burst" default:"5" usage:"Identical log lines written per log_repeat_window before the rest are only counted"`
+
+	AccessLog       string `yaml:"access_log" usage:"Write access logs to this file, or to stdout/stderr"`
+	AccessLogFormat string `yaml:"access_log_format" default:"combined" usage:"Access log format (combined, common, json)"`
+
+	HealthCheckInterval time.Duration `yaml:"health_check_interval" default:"30s" usage:"How often backends are probed (0 disables)"`
+	KeyExpiryWarning    time.Duration `yaml:"key_expiry_warning" default:"72h" usage:"Emit a key_expiring event this long before the node key expires"`
+	CertCheckInterval   time.Duration `yaml:"cert_check_interval" default:"12h" usage:"How often to have the node's Tailscale certificate renewed if it's due and check its expiry (0 disables)"`
+	CertExpiryWarning   time.Duration `yaml:"cert_expiry_warning" default:"336h" usage:"Emit a cert_expiring event this long before the node's Tailscale certificate expires"`
+	Webhooks            []Webhook     `yaml:"webhooks"`
+	HeartbeatURL        string        `yaml:"heartbeat_url" usage:"Ping this URL periodically while every backend is healthy (push monitors like healthchecks.io)"`
+	HeartbeatInterval   time.Duration `yaml:"heartbeat_interval" default:"1m" usage:"How often to ping heartbeat_url"`
+
+	AdminAddr        string `yaml:"admin_addr" usage:"Serve /healthz and /readyz on this address, e.g. 127.0.0.1:9180 (off by default)"`
+	CaptureSize      int    `yaml:"capture_size" usage:"Keep this many recent requests and responses for inspection on the admin API (0 disables)"`
+	CaptureBodyLimit int    `yaml:"capture_body_limit" default:"4096" usage:"Bytes of each captured request and response body to keep"`
+	AdminRoutes      bool   `yaml:"admin_routes" usage:"Let PUT /routes on the admin API replace the routes, kept in the state directory across restarts"`
+
+	MetricsWindow time.Duration `yaml:"metrics_window" default:"5m" usage:"Sliding window for latency percentiles and error ratios"`
+	SLOLatency    time.Duration `yaml:"slo_latency" usage:"Warn when a route's p99 latency over metrics_window exceeds this (0 disables)"`
+	SLOErrorRatio float64       `yaml:"slo_error_ratio" usage:"Warn when a route's share of 5xx responses over metrics_window exceeds this, e.g. 0.01 (0 disables)"`
+
+	MetricsPush         string        `yaml:"metrics_push" usage:"Push metrics to this Pushgateway or OTLP/HTTP receiver URL, for nodes that can't be scraped"`
+	MetricsPushFormat   string        `yaml:"metrics_push_format" default:"pushgateway" usage:"Metrics push format (pushgateway, otlp)"`
+	MetricsPushInterval time.Duration `yaml:"metrics_push_interval" default:"30s" usage:"How often to push metrics"`
+
+	StatsDAddr   string `yaml:"statsd_addr" usage:"Send request metrics to a StatsD agent at this host:port (UDP) or unix:///path"`
+	StatsDPrefix string `yaml:"statsd_prefix" default:"tsrouter" usage:"Prefix of StatsD metric names"`
+	StatsDTags   bool   `yaml:"statsd_tags" usage:"Tag StatsD metrics with the route DogStatsD-style instead of putting it in their names"`
+
+	BanAuthFailures int           `yaml:"ban_auth_failures" usage:"Ban a client after this many 401 and 403 responses within ban_window (0 disables)"`
+	BanClientErrors int           `yaml:"ban_client_errors" usage:"Ban a client after this many 4xx responses within ban_window (0 disables)"`
+	BanWindow       time.Duration `yaml:"ban_window" default:"10m" usage:"Window failures are counted in for bans"`
+	BanDuration     time.Duration `yaml:"ban_duration" default:"1h" usage:"How long a banned client is turned away"`
+
+	GeoIPDB string `yaml:"geoip_db" usage:"MaxMind country database (.mmdb) for public_ips country lists, reloaded when the file changes"`
+
+	Stats          bool          `yaml:"stats" usage:"Persist request records and counters to stats.db in the instance directory"`
+	StatsRetention time.Duration `yaml:"stats_retention" default:"720h" usage:"How long individual request records are kept in the stats database"`
+}
+
+// Route maps a path prefix on one of the node's ports to a backend URL. TCP
+// routes forward whole connections, so their target is a host:port and the
+// path is unused.
+type Route struct {
+	Name     string `yaml:"name"`
+	Path     string `yaml:"path"`
+	Target   string `yaml:"target"`
+	Port     int    `yaml:"port"`     // 443 by default
+	Protocol string `yaml:"protocol"` // https (default), http or tcp
+
+	// ViaTailnet dials the target through the node, so it can be another
+	// tailnet host (http://nas:8080) rather than a local one.
+	ViaTailnet bool `yaml:"via_tailnet"`
+
+	// Mutual TLS toward https backends: a client certificate to present and
+	// a CA to verify the backend with instead of the system roots.
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	CACert     string `yaml:"ca_cert"`
+
+	// Overrides for the TLS handshake with https backends: the SNI name
+	// (also used to verify the certificate) and the ALPN protocols offered.
+	TLSServerName string   `yaml:"tls_server_name"`
+	TLSALPN       []string `yaml:"tls_alpn"`
+
+	// FastCGI targets (fastcgi://host:port or fastcgi+unix:///path): the
+	// document root on the FastCGI server, and the script that handles paths
+	// not naming one (index.php by default).
+	Root  string `yaml:"root"`
+	Index string `yaml:"index"`
+
+	// GRPCWeb translates gRPC-Web requests from browsers into gRPC, which
+	// is sent to the backend over HTTP/2.
+	GRPCWeb bool `yaml:"grpc_web"`
+
+	// Coalesce collapses identical concurrent GET requests into a single
+	// backend request.
+	Coalesce bool `yaml:"coalesce"`
+
+	// SlowRequestThreshold logs requests taking longer than this, with a
+	// breakdown of where the time went, and counts them.
+	SlowRequestThreshold time.Duration `yaml:"slow_request_threshold"`
+
+	// MaxRequestDuration cancels requests still running after this long,
+	// answering 504 if the backend hadn't answered yet. WebSocket and
+	// other upgraded connections, and event streams, aren't capped.
+	MaxRequestDuration time.Duration `yaml:"max_request_duration"`
+
+	Cache Cache `yaml:"cache"`
+
+	WebDAV WebDAV `yaml:"webdav"`
+
+	OnDemand OnDemand `yaml:"on_demand"`
+
+	Schedule Schedule `yaml:"schedule"`
+
+	Posture Posture `yaml:"posture"`
+
+	Strict Strict `yaml:"strict"`
+
+	Firewall Firewall `yaml:"firewall"`
+
+	PublicIPs IPFilter `yaml:"public_ips"`
+
+	SignIn SignIn `yaml:"sign_in"`
+
+	// IdentityHeaders maps request header names to templates rendered
+	// from the caller's WhoIs response, such as
+	// "{{.UserProfile.LoginName}}", for backends with trusted-header SSO.
+	IdentityHeaders map[string]string `yaml:"identity_headers"`
+
+	// SSOPreset sets the identity headers a well-known app expects:
+	// grafana, gitea, miniflux or remote-user. IdentityHeaders add to or
+	// override them.
+	SSOPreset string `yaml:"sso_preset"`
+
+	RewriteBody RewriteBody `yaml:"rewrite_body"`
+
+	Subpath Subpath `yaml:"subpath"`
+
+	Cookies Cookies `yaml:"cookies"`
+
+	WebhookRelay WebhookRelay `yaml:"webhook_relay"`
+
+	Sniff Sniff `yaml:"sniff"`
+
+	// TCP applies to the backend connections of tcp routes. Connections with
+	// the tailnet, which go through the node's userspace network stack,
+	// don't take it: the client's, and the backend's for via_tailnet.
+	TCP TCPOptions `yaml:"tcp"`
+
+	Log RouteLog `yaml:"log"`
+}
+
+// RouteLog gives a route logging of its own, so a busy route doesn't drown
+// out the others: the level of its log lines, where its access log goes and
+// the share of its requests written there.
+type RouteLog struct {
+	Level      string  `yaml:"level"`       // error, info or debug; log_level by default
+	AccessLog  string  `yaml:"access_log"`  // file, stdout, stderr or off; access_log by default
+	SampleRate float64 `yaml:"sample_rate"` // share of requests logged, all when 0; 5xx always are
+}
+
+// Sniff sends the connections of a tcp route to a target picked by the
+// protocol the client starts speaking, so one port can serve several.
+// Connections matching none, or whose client sends nothing within Timeout,
+// go to the route's target.
+type Sniff struct {
+	HTTP    string        `yaml:"http"` // host:port targets
+	TLS     string        `yaml:"tls"`
+	SSH     string        `yaml:"ssh"`
+	Timeout time.Duration `yaml:"timeout"` // 1s by default
+}
+
+// TCPOptions tune the backend connections of a tcp route, for
+// latency-sensitive protocols such as VNC or game servers.
+type TCPOptions struct {
+	Nagle       bool          `yaml:"nagle"`       // coalesce small writes; off by default (TCP_NODELAY)
+	KeepAlive   time.Duration `yaml:"keepalive"`   // idle time before keepalive probes, and between them; 15s by default, negative disables
+	ReadBuffer  int           `yaml:"read_buffer"` // socket buffer sizes in bytes; the OS's by default
+	WriteBuffer int           `yaml:"write_buffer"`
+}
+
+// WebhookRelay makes a route a relay for webhooks from services such as GitHub
+// or Stripe, which have no Tailscale identity: only POST requests signed
+// with the shared secret are passed on, each delivery once.
+type WebhookRelay struct {
+	Provider     string        `yaml:"provider"` // github, stripe or standard (Standard Webhooks)
+	SecretFile   string        `yaml:"secret_file"`
+	ReplayWindow time.Duration `yaml:"replay_window"` // 5m by default
+	MaxBody      int64         `yaml:"max_body"`      // 5 MiB by default
+}
+
+// Cookies rewrites the attributes of cookies set by a proxied backend, for
+// backends that think they live at localhost.
+type Cookies struct {
+	Domain   map[string]string `yaml:"domain"` // backend domain -> domain for clients; "" removes it
+	Path     map[string]string `yaml:"path"`   // backend path prefix -> prefix for clients
+	Secure   bool              `yaml:"secure"` // mark cookies Secure
+	SameSite string            `yaml:"same_site"`
+}
+
+// Subpath mounts a backend that only works at / under the route's path: the
+// prefix is stripped from requests, and redirects and root-relative links
+// in HTML are moved under it.
+type Subpath struct {
+	Enabled  bool `yaml:"enabled"`
+	BaseHref bool `yaml:"base_href"` // add <base href="/prefix/"> to HTML pages too
+}
+
+// RewriteBody replaces strings in proxied response bodies, such as
+// absolute links to the address the backend thinks it lives at.
+type RewriteBody struct {
+	Replace      []Replacement `yaml:"replace"`
+	ContentTypes []string      `yaml:"content_types"` // text/html and application/json by default
+	MaxBytes     int64         `yaml:"max_bytes"`     // of each body to rewrite, 10 MiB by default
+}
+
+// Replacement replaces every occurrence of Find with With.
+type Replacement struct {
+	Find string `yaml:"find"`
+	With string `yaml:"with"`
+}
+
+// SignIn shows callers the Tailscale identity they're using and asks them
+// to continue before a route's first request, starting a session held in
+// a signed cookie. Each sign-in is audited.
+type SignIn struct {
+	Enabled bool          `yaml:"enabled"`
+	Session time.Duration `yaml:"session"` // 12h by default
+}
+
+// IPFilter limits callers without a Tailscale identity, such as Funnel
+// traffic, by their address: CIDRs or single addresses, and ISO country
+// codes looked up in geoip_db. Deny and DenyCountries are checked first;
+// if either allow list is set, callers must match one of them.
+type IPFilter struct {
+	Allow          []string `yaml:"allow"`
+	Deny           []string `yaml:"deny"`
+	AllowCountries []string `yaml:"allow_countries"`
+	DenyCountries  []string `yaml:"deny_countries"`
+}
+
+// Firewall screens a route's requests before they're proxied. Rules are
+// tried in order and the first allow or deny rule that matches decides;
+// log rules only log. Requests no rule decides are denied if one of the
+// built-in Signatures matches (traversal, dotfiles, sqli, xss, scanners,
+// or all).
+type Firewall struct {
+	Rules      []FirewallRule `yaml:"rules"`
+	Signatures []string       `yaml:"signatures"`
+}
+
+// FirewallRule matches requests meeting all of its conditions; one without
+// conditions matches every request. Path and Headers values are regular
+// expressions.
+type FirewallRule struct {
+	Name           string            `yaml:"name"`
+	Action         string            `yaml:"action"` // allow, deny or log
+	Methods        []string          `yaml:"methods"`
+	Path           string            `yaml:"path"`
+	Headers        map[string]string `yaml:"headers"`
+	BodyLargerThan int64             `yaml:"body_larger_than"` // bytes; bodies of unknown length count as larger
+}
+
+// Strict rejects requests that old backends could misread, such as paths
+// with encoded slashes or headers with underscores, and normalizes the path
+// of the rest, for routes exposed to untrusted clients over Funnel.
+type Strict struct {
+	Enabled        bool `yaml:"enabled"`
+	MaxHeaders     int  `yaml:"max_headers"`      // 100 by default
+	MaxHeaderBytes int  `yaml:"max_header_bytes"` // 16 KiB by default
+}
+
+// Posture rejects requests from nodes whose key has expired (with
+// RejectExpired) or that lack any of RequireTags. DeniedPage, an HTML
+// file, is the body of the 403 if set.
+type Posture struct {
+	RejectExpired bool     `yaml:"reject_expired"`
+	RequireTags   []string `yaml:"require_tags"`
+	DeniedPage    string   `yaml:"denied_page"`
+}
+
+// Schedule limits a route to weekly windows such as "Mon-Fri 16:00-21:00".
+// Outside them requests get a 503, with ClosedPage (an HTML file) as the
+// body if set.
+type Schedule struct {
+	Windows    []string `yaml:"windows"`
+	Timezone   string   `yaml:"timezone"` // IANA name, local time by default
+	ClosedPage string   `yaml:"closed_page"`
+}
+
+// OnDemand starts a route's backend with Command on the first request and
+// stops it again after IdleTimeout without requests, for rarely used
+// services.
+type OnDemand struct {
+	Command      []string      `yaml:"command"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`  // 0 keeps it running once started
+	StartTimeout time.Duration `yaml:"start_timeout"` // how long to wait for it to listen, 30s by default
+}
+
+// WebDAV serves a file:// target's directory over WebDAV instead of as
+// static files. The share is read-only except to Writers: Tailscale login
+// names or tags (tag:ci), or "*" for everyone.
+type WebDAV struct {
+	Enabled bool     `yaml:"enabled"`
+	Writers []string `yaml:"writers"`
+}
+
+// Cache keeps a route's GET responses in memory, as a shared HTTP cache
+// honoring the backend's Cache-Control. The durations apply when the backend
+// doesn't set max-age, stale-while-revalidate or stale-if-error itself.
+type Cache struct {
+	Enabled              bool          `yaml:"enabled"`
+	TTL                  time.Duration `yaml:"ttl"`                    // 0 caches only responses with an explicit lifetime
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate"` // serve stale while refreshing in the background
+	StaleIfError         time.Duration `yaml:"stale_if_error"`         // serve stale when the backend fails
+	MaxEntries           int           `yaml:"max_entries"`            // 1000 by default
+}
+
+// Webhook receives lifecycle events.
+type Webhook struct {
+	URL    string   `yaml:"url"`
+	Format string   `yaml:"format"` // json (default), slack or discord
+	Events []string `yaml:"events"` // empty means every event
+}
@@ -3,9 +3,26 @@ package models
 import "time"
 
 type TailscaleAuthKey struct {
-	ID        string    `json:"id"`
-	Key       string    `json:"key"`
-	Created   time.Time `json:"created"`
-	Expires   time.Time `json:"expires"`
-	Ephemeral bool      `json:"ephemeral"`
-}
\ No newline at end of file
+	ID           string              `json:"id"`
+	Key          string              `json:"key,omitempty"`
+	Description  string              `json:"description,omitempty"`
+	Created      time.Time           `json:"created"`
+	Expires      time.Time           `json:"expires"`
+	Revoked      *time.Time          `json:"revoked,omitempty"`
+	Invalid      bool                `json:"invalid,omitempty"`
+	Ephemeral    bool                `json:"ephemeral"`
+	Capabilities AuthKeyCapabilities `json:"capabilities"`
+}
+
+type AuthKeyCapabilities struct {
+	Devices struct {
+		Create AuthKeyCreateCapabilities `json:"create"`
+	} `json:"devices"`
+}
+
+type AuthKeyCreateCapabilities struct {
+	Reusable      bool     `json:"reusable"`
+	Ephemeral     bool     `json:"ephemeral"`
+	Preauthorized bool     `json:"preauthorized"`
+	Tags          []string `json:"tags,omitempty"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+type TailscaleDevice struct {
+	ID                string    `json:"id"`
+	NodeID            string    `json:"nodeId"`
+	Name              string    `json:"name"`
+	Hostname          string    `json:"hostname"`
+	Addresses         []string  `json:"addresses"`
+	OS                string    `json:"os"`
+	User              string    `json:"user"`
+	Tags              []string  `json:"tags,omitempty"`
+	Authorized        bool      `json:"authorized"`
+	KeyExpiryDisabled bool      `json:"keyExpiryDisabled"`
+	Created           time.Time `json:"created"`
+	Expires           time.Time `json:"expires"`
+	LastSeen          time.Time `json:"lastSeen"`
+}
+
+func (d TailscaleDevice) HasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package models
+
+// TailscalePolicy is the part of the tailnet policy file tsrouter reads to
+// work out who can reach its node.
+type TailscalePolicy struct {
+	ACLs   []PolicyACL   `json:"acls"`
+	Grants []PolicyGrant `json:"grants"`
+}
+
+// PolicyACL is a legacy ACL rule. Dst entries are host:ports, e.g.
+// "tag:server:443" or "*:*".
+type PolicyACL struct {
+	Action string   `json:"action"`
+	Src    []string `json:"src"`
+	Dst    []string `json:"dst"`
+}
+
+// PolicyGrant is a grant. IP lists port ranges with an optional protocol,
+// e.g. "443" or "tcp:8000-8100"; App grants carry no network access.
+type PolicyGrant struct {
+	Src []string `json:"src"`
+	Dst []string `json:"dst"`
+	IP  []string `json:"ip"`
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/admin"
+	"github.com/whitehawk2/tsrouter/adminclient"
+	"github.com/whitehawk2/tsrouter/config"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/portmapper"
+)
+
+// netcheckTimeout covers the STUN, DERP and port mapping probes, which
+// take a few seconds on a healthy network.
+const netcheckTimeout = 30 * time.Second
+
+func netcheckCommand() *command {
+	fs := newFlagSet("netcheck")
+	flags := config.BindFlags(fs, config.ScopeAll)
+	output := outputFlag(fs)
+
+	return &command{
+		name:    "netcheck",
+		summary: "Diagnose the network connectivity of a running instance",
+		description: `
+Asks a running instance (admin_addr must be set) to probe its network the
+way tailscaled does: whether UDP gets through, its public addresses, the
+kind of NAT it's behind, and the latency to every DERP relay region. Use it
+to find out why peers end up relayed, and slow, rather than connected
+directly.`,
+		examples: []string{
+			"tsrouter netcheck --config tsrouter.yaml",
+			"tsrouter netcheck --admin-addr 127.0.0.1:9180 --output json",
+		},
+		flags: fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			if cfg.AdminAddr == "" {
+				return fmt.Errorf("admin_addr is required to query a running instance")
+			}
+
+			nc, err := fetchNetcheck(ctx, cfg.AdminAddr)
+			if err != nil {
+				return err
+			}
+			if output.json() {
+				return printJSON(nc)
+			}
+
+			fmt.Printf("UDP:          %t\n", nc.UDP)
+			fmt.Printf("IPv4:         %s\n", orNone(nc.IPv4))
+			fmt.Printf("IPv6:         %s\n", orNone(nc.IPv6))
+			fmt.Printf("NAT:          %s\n", nc.NAT)
+			fmt.Printf("Port mapping: %s\n", orNone(strings.Join(nc.PortMapping, ", ")))
+			fmt.Printf("Home DERP:    %s\n", orNone(nc.HomeDERP))
+			fmt.Printf("Nearest DERP: %s\n\n", orNone(nc.NearestDERP))
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "DERP\tREGION\tLATENCY")
+			for _, d := range nc.DERP {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", d.Code, d.Name, formatLatency(d.Latency))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+func fetchNetcheck(ctx context.Context, adminAddr string) (*admin.Netcheck, error) {
+	ctx, cancel := context.WithTimeout(ctx, netcheckTimeout)
+	defer cancel()
+
+	nc, err := adminclient.NewClient(adminAddr).Netcheck(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("netcheck failed: %v", err)
+	}
+	return nc, nil
+}
+
+// instanceNetcheck runs a netcheck report against the DERP map of the
+// serving node, alongside the home DERP region the node settled on.
+func instanceNetcheck(lc *tailscale.LocalClient) func(ctx context.Context) (*admin.Netcheck, error) {
+	return func(ctx context.Context) (*admin.Netcheck, error) {
+		ctx, cancel := context.WithTimeout(ctx, netcheckTimeout)
+		defer cancel()
+
+		dm, err := lc.CurrentDERPMap(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get DERP map: %v", err)
+		}
+		if dm == nil || len(dm.Regions) == 0 {
+			return nil, fmt.Errorf("node has no DERP map yet")
+		}
+
+		logf := log.Debugf
+		netMon, err := netmon.New(logf)
+		if err != nil {
+			return nil, err
+		}
+		defer netMon.Close()
+		pm := portmapper.NewClient(logf, netMon, nil, nil, nil)
+		defer pm.Close()
+
+		c := &netcheck.Client{NetMon: netMon, PortMapper: pm, Logf: logf}
+		if err := c.Standalone(ctx, ""); err != nil {
+			log.Debugf("netcheck: UDP test failure: %v", err)
+		}
+		report, err := c.GetReport(ctx, dm, nil)
+		if err != nil {
+			return nil, fmt.Errorf("netcheck failed: %v", err)
+		}
+
+		nc := &admin.Netcheck{
+			Time: report.Now,
+			UDP:  report.UDP,
+			NAT:  natType(report),
+		}
+		if report.GlobalV4.IsValid() {
+			nc.IPv4 = report.GlobalV4.String()
+		}
+		if report.GlobalV6.IsValid() {
+			nc.IPv6 = report.GlobalV6.String()
+		}
+		for name, v := range map[string]bool{
+			"UPnP":    report.UPnP.EqualBool(true),
+			"NAT-PMP": report.PMP.EqualBool(true),
+			"PCP":     report.PCP.EqualBool(true),
+		} {
+			if v {
+				nc.PortMapping = append(nc.PortMapping, name)
+			}
+		}
+		sort.Strings(nc.PortMapping)
+		if st, err := lc.StatusWithoutPeers(ctx); err == nil && st.Self != nil {
+			nc.HomeDERP = st.Self.Relay
+		}
+		if r := dm.Regions[report.PreferredDERP]; r != nil {
+			nc.NearestDERP = r.RegionCode
+		}
+
+		for id, r := range dm.Regions {
+			nc.DERP = append(nc.DERP, admin.DERP{
+				ID:      id,
+				Code:    r.RegionCode,
+				Name:    r.RegionName,
+				Latency: report.RegionLatency[id],
+			})
+		}
+		// Fastest first, unreachable regions last.
+		sort.Slice(nc.DERP, func(i, j int) bool {
+			a, b := nc.DERP[i].Latency, nc.DERP[j].Latency
+			if (a == 0) != (b == 0) {
+				return b == 0
+			}
+			if a == b {
+				return nc.DERP[i].ID < nc.DERP[j].ID
+			}
+			return a < b
+		})
+		return nc, nil
+	}
+}
+
+// natType describes the NAT in front of the node in terms of whether peers
+// can reach it directly.
+func natType(r *netcheck.Report) string {
+	switch {
+	case !r.UDP:
+		return "UDP blocked, peers are relayed through DERP"
+	case r.MappingVariesByDestIP.EqualBool(true):
+		return "hard (endpoint-dependent mapping), direct connections may fail"
+	case r.MappingVariesByDestIP.EqualBool(false):
+		return "easy (endpoint-independent mapping)"
+	}
+	return "unknown"
+}
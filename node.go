@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/events"
+	"github.com/whitehawk2/tsrouter/models"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/tsnet"
+)
+
+const (
+	keyExpiryCheckInterval = time.Hour
+	nodeStateCheckInterval = 15 * time.Second
+	// nodeReauthInterval spaces out the fresh keys a node that can't log
+	// in is given, doubling after each up to nodeReauthMaxInterval.
+	nodeReauthInterval    = time.Minute
+	nodeReauthMaxInterval = time.Hour
+	// nodeReauthAttempts is how many keys a node gets before tsrouter stops
+	// logging it in, as an admin may have removed it on purpose.
+	nodeReauthAttempts = 8
+)
+
+// logNodeAddrs prints the node's Tailscale addresses, marking those the
+// listeners aren't bound to.
+func logNodeAddrs(s *tsnet.Server, listenIP string) {
+	ip4, ip6 := s.TailscaleIPs()
+	for _, a := range []struct {
+		family string
+		ip     netip.Addr
+	}{{"ipv4", ip4}, {"ipv6", ip6}} {
+		if !a.ip.IsValid() {
+			continue
+		}
+		if listenIP == "both" || listenIP == a.family {
+			log.Infof("Listening on %s", a.ip)
+		} else {
+			log.Infof("Node address %s (not listening, listen_ip is %s)", a.ip, listenIP)
+		}
+	}
+}
+
+// watchKeyExpiry publishes a KeyExpiring event once the node key is within
+// warnBefore of expiring, and again if it's renewed and later nears expiry.
+// A renewal publishes a KeyRotated event. Tagged nodes usually have key
+// expiry disabled, in which case this is a no-op.
+func watchKeyExpiry(ctx context.Context, lc *tailscale.LocalClient, bus *events.Bus, warnBefore time.Duration) {
+	var warned, last time.Time
+	t := time.NewTicker(keyExpiryCheckInterval)
+	defer t.Stop()
+
+	for {
+		st, err := lc.Status(ctx)
+		if err != nil {
+			log.Debugf("Failed to get node status: %v", err)
+		} else if st.Self != nil && st.Self.KeyExpiry != nil {
+			expiry := *st.Self.KeyExpiry
+			if !last.IsZero() && !expiry.Equal(last) {
+				bus.Publish(events.Event{
+					Type:    events.KeyRotated,
+					Message: fmt.Sprintf("Node key renewed, it now expires %s", expiry.Format(time.RFC3339)),
+					Fields:  map[string]string{"expires": expiry.Format(time.RFC3339)},
+				})
+			}
+			last = expiry
+			if left := time.Until(expiry); left < warnBefore && !expiry.Equal(warned) {
+				warned = expiry
+				bus.Publish(events.Event{
+					Type:    events.KeyExpiring,
+					Message: fmt.Sprintf("Node key expires in %s (%s)", left.Round(time.Minute), expiry.Format(time.RFC3339)),
+					Fields:  map[string]string{"expires": expiry.Format(time.RFC3339)},
+				})
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// watchNodeState brings the node back when it drops out of Running at
+// runtime. A stopped node is started again. A node that needs to log in,
+// because its key expired or it was removed from the tailnet, logs in with
+// a fresh key from newKey, backing off between attempts and giving up after
+// nodeReauthAttempts. Keys a login failed with are revoked with revokeKey.
+// Dropping out and coming back publish NodeDisconnected and NodeReconnected
+// events.
+func watchNodeState(ctx context.Context, lc *tailscale.LocalClient, bus *events.Bus, newKey func(context.Context) (*models.TailscaleAuthKey, error), revokeKey func(context.Context, string) error) {
+	var down string
+	var reauthed time.Time
+	var attempts int
+	var gaveUp bool
+	wait := nodeReauthInterval
+	pending := "" // the last key logged in with, until the node runs
+	t := time.NewTicker(nodeStateCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		st, err := lc.Status(ctx)
+		if err != nil {
+			log.Debugf("Failed to get node status: %v", err)
+			continue
+		}
+		switch state := st.BackendState; state {
+		case ipn.Running.String():
+			if down != "" {
+				down = ""
+				log.Info("Node reconnected to the tailnet")
+				bus.Publish(events.Event{Type: events.NodeReconnected, Message: "Node reconnected to the tailnet"})
+			}
+			pending, attempts, gaveUp, wait = "", 0, false, nodeReauthInterval
+		case ipn.Stopped.String(), ipn.NeedsLogin.String():
+			if down == "" {
+				down = state
+				msg := fmt.Sprintf("Node disconnected from the tailnet (%s), reconnecting", state)
+				log.Warn(msg)
+				bus.Publish(events.Event{Type: events.NodeDisconnected, Message: msg, Fields: map[string]string{"state": state}})
+			}
+			if state == ipn.Stopped.String() {
+				if err := reconnectNode(ctx, lc, ""); err != nil {
+					log.Warnf("Failed to reconnect the node: %v", err)
+				}
+				continue
+			}
+			if gaveUp || time.Since(reauthed) < wait {
+				continue
+			}
+			// Still not running, so the last key didn't get the node in.
+			if pending != "" {
+				revokeNodeKey(ctx, revokeKey, pending)
+				pending = ""
+			}
+			if attempts == nodeReauthAttempts {
+				gaveUp = true
+				log.Errorf("Node still can't log in after %d attempts, giving up; restart tsrouter to try again", attempts)
+				continue
+			}
+			attempts++
+			reauthed = time.Now()
+			wait = min(wait*2, nodeReauthMaxInterval)
+			key, err := newKey(ctx)
+			if err != nil {
+				log.Warnf("Failed to reconnect the node: %v", err)
+				continue
+			}
+			if err := reconnectNode(ctx, lc, key.Key); err != nil {
+				log.Warnf("Failed to reconnect the node: %v", err)
+				revokeNodeKey(ctx, revokeKey, key.ID)
+				continue
+			}
+			pending = key.ID
+		}
+	}
+}
+
+// reconnectNode starts the node again, logging in with authKey if it's
+// set, as it is for a node that needs to log in.
+func reconnectNode(ctx context.Context, lc *tailscale.LocalClient, authKey string) error {
+	if authKey == "" {
+		_, err := lc.EditPrefs(ctx, &ipn.MaskedPrefs{Prefs: ipn.Prefs{WantRunning: true}, WantRunningSet: true})
+		return err
+	}
+	if err := lc.Start(ctx, ipn.Options{AuthKey: authKey}); err != nil {
+		return err
+	}
+	// As in tsnet, starting with a key can still leave it to be told to log
+	// in.
+	if st, err := lc.Status(ctx); err == nil && st.BackendState == ipn.NeedsLogin.String() {
+		return lc.StartLoginInteractive(ctx)
+	}
+	return nil
+}
+
+// revokeNodeKey revokes a key a login failed with, so unused keys don't
+// pile up in the tailnet. Failing to is only logged, as the key expires on
+// its own.
+func revokeNodeKey(ctx context.Context, revokeKey func(context.Context, string) error, id string) {
+	if err := revokeKey(ctx, id); err != nil {
+		log.Warnf("Failed to revoke unused auth key %s: %v", id, err)
+	}
+}
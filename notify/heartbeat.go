@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Heartbeat pings url every interval for as long as healthy returns true,
+// until ctx is done. It's meant for push monitors (healthchecks.io, Uptime
+// Kuma and the like) that alert when pings stop arriving, so nothing is
+// sent while unhealthy.
+func Heartbeat(ctx context.Context, url string, interval time.Duration, healthy func() bool) {
+	client := &http.Client{Timeout: sendTimeout}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if healthy() {
+			if err := ping(ctx, client, url); err != nil {
+				log.WithField("url", url).Warnf("Failed to send heartbeat: %v", err)
+			} else {
+				log.WithField("url", url).Debug("Sent heartbeat")
+			}
+		} else {
+			log.Debug("Skipping heartbeat, backends unhealthy")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func ping(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "tsrouter")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Package notify sends lifecycle events to external services.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/events"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// Formats lists the supported webhook payload formats.
+var Formats = []string{"json", "slack", "discord"}
+
+const (
+	sendTimeout = 10 * time.Second
+	maxAttempts = 3
+)
+
+// Webhooks posts events to the configured webhooks as they're published.
+type Webhooks struct {
+	hooks  []models.Webhook
+	client *http.Client
+	cancel func()
+	wg     sync.WaitGroup
+}
+
+// StartWebhooks subscribes to bus and delivers matching events to hooks
+// until Close is called.
+func StartWebhooks(bus *events.Bus, hooks []models.Webhook) *Webhooks {
+	ch, cancel := bus.Subscribe()
+	w := &Webhooks{
+		hooks:  hooks,
+		client: &http.Client{Timeout: sendTimeout},
+		cancel: cancel,
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for e := range ch {
+			for _, h := range w.hooks {
+				if wants(h, e.Type) {
+					w.send(h, e)
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// Close stops receiving events and waits up to timeout for queued events
+// (such as the shutdown notification) to be delivered.
+func (w *Webhooks) Close(timeout time.Duration) {
+	w.cancel()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warn("Timed out delivering webhook notifications")
+	}
+}
+
+func wants(h models.Webhook, t events.Type) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, want := range h.Events {
+		if want == string(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Webhooks) send(h models.Webhook, e events.Event) {
+	body, err := json.Marshal(payload(h.Format, e))
+	if err != nil {
+		log.Warnf("Failed to encode webhook payload: %v", err)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := w.post(h.URL, body)
+		if err == nil {
+			log.WithFields(log.Fields{"event": e.Type, "url": h.URL}).Debug("Delivered webhook")
+			return
+		}
+		if attempt == maxAttempts {
+			log.WithFields(log.Fields{"event": e.Type, "url": h.URL}).Warnf("Failed to deliver webhook: %v", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *Webhooks) post(url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tsrouter")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// payload shapes an event for the webhook's format. Slack and Discord get a
+// single human-readable message; "json" gets the event as is.
+func payload(format string, e events.Event) interface{} {
+	text := fmt.Sprintf("[%s] %s", e.Hostname, e.Message)
+	switch format {
+	case "slack":
+		return map[string]string{"text": text}
+	case "discord":
+		return map[string]string{"content": text}
+	}
+	return e
+}
@@ -2,32 +2,25 @@ package main
 
 import (
 	"context"
-	"log"
 	"net/http"
-	"os"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
-func GetAccessToken(ctx context.Context) (*http.Client, error) {
-	err := godotenv.Load()
-	if err != nil {
-		log.Println("No .env file found, using system environment variables.")
-	}
-
-	clientID := os.Getenv("TS_CLIENT_ID")
-	clientSecret := os.Getenv("TS_CLIENT_SECRET")
-	tailnet := os.Getenv("TS_TAILNET")
-	if tailnet == "" {
-		tailnet = "example"
-	}
-
+// GetAccessToken returns an HTTP client that authenticates with an OAuth
+// token for the client credentials. Each request, including fetching the
+// token, fails after timeout.
+func GetAccessToken(ctx context.Context, clientID, clientSecret string, timeout time.Duration) (*http.Client, error) {
 	oauthConfig := &clientcredentials.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
-		TokenURL:     "https://api.tailscale.com/api/v2/oauth/token",
+		TokenURL:     tailscaleapi.TokenURL,
 	}
-	client := oauthConfig.Client(context.Background())
+	ctx = context.WithValue(context.WithoutCancel(ctx), oauth2.HTTPClient, &http.Client{Timeout: timeout})
+	client := oauthConfig.Client(ctx)
+	client.Timeout = timeout
 	return client, nil
 }
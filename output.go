@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// outputFormat is the --output flag of commands that print data: a table
+// for people, or JSON for scripts.
+type outputFormat string
+
+func (o *outputFormat) String() string { return string(*o) }
+
+func (o *outputFormat) Set(s string) error {
+	switch s {
+	case "table", "json":
+		*o = outputFormat(s)
+		return nil
+	}
+	return fmt.Errorf("must be table or json")
+}
+
+func (o *outputFormat) json() bool { return *o == "json" }
+
+func outputFlag(fs *flag.FlagSet) *outputFormat {
+	o := outputFormat("table")
+	fs.Var(&o, "output", "Output format: table or json")
+	return &o
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
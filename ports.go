@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/certs"
+	"github.com/whitehawk2/tsrouter/events"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/proxyproto"
+	"github.com/whitehawk2/tsrouter/router"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tsnet"
+)
+
+// portServer is what serves one node port: an http.Server for http and
+// https ports, a router.TCPProxy for tcp ones.
+type portServer interface {
+	Serve(ln net.Listener) error
+	Shutdown(ctx context.Context) error
+}
+
+type nodePort struct {
+	name     string // for messages, e.g. "port 443"
+	port     int
+	protocol string
+	ln       net.Listener
+	srv      portServer
+	handler  http.Handler  // nil on tcp ports
+	h3       *http3.Server // set on https ports when HTTP/3 is enabled
+}
+
+type getCertFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// certificates adds the custom certificates, from files, ACME or the local
+// CA, to sel, the https ports' selector, for the names they cover. The ACME
+// certificate, if any, is returned, for serving HTTP-01 challenges. New
+// certificates are published on bus.
+func certificates(ctx context.Context, cfg *models.Config, dir string, s *tsnet.Server, sel *certs.Selector, bus *events.Bus) (*certs.ACMECert, error) {
+	if cfg.TLSCertFile != "" {
+		fc, err := certs.LoadFile(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		fc.OnReload = certRenewed(bus, "Reloaded rotated certificate")
+		sel.Custom = append(sel.Custom, fc)
+		log.WithField("names", fc.Certificate().Leaf.DNSNames).Info("Using custom certificate")
+	}
+	var ac *certs.ACMECert
+	if len(cfg.TLSACMEDomains) > 0 {
+		var err error
+		ac, err = certs.NewACME(ctx, certs.ACMEOptions{
+			Domains:   cfg.TLSACMEDomains,
+			Email:     cfg.TLSACMEEmail,
+			Directory: cfg.TLSACMEDirectory,
+			Challenge: cfg.TLSACMEChallenge,
+			Hook:      cfg.TLSACMEDNSHook,
+			CacheDir:  filepath.Join(dir, "acme"),
+			OnIssue:   certRenewed(bus, "Issued certificate over ACME"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		sel.Custom = append(sel.Custom, ac)
+	}
+	if cfg.TLSShortNames {
+		local, err := certs.NewLocal(filepath.Join(dir, "local-ca"), cfg.Hostname, func() ([]string, []net.IP) { return shortNames(s) })
+		if err != nil {
+			return nil, err
+		}
+		sel.Custom = append(sel.Custom, local)
+		log.WithField("ca", local.CAFile()).Info("Serving the short hostname and IP addresses with a local certificate, clients must trust its CA")
+	}
+	return ac, nil
+}
+
+// shortNames returns the names the local certificate covers: the node's
+// short hostname, the first label of its MagicDNS name, and its Tailscale
+// IP addresses.
+func shortNames(s *tsnet.Server) ([]string, []net.IP) {
+	var names []string
+	if domains := s.CertDomains(); len(domains) > 0 {
+		names = append(names, strings.SplitN(domains[0], ".", 2)[0])
+	}
+	var ips []net.IP
+	ip4, ip6 := s.TailscaleIPs()
+	for _, ip := range []netip.Addr{ip4, ip6} {
+		if ip.IsValid() {
+			ips = append(ips, ip.AsSlice())
+		}
+	}
+	return names, ips
+}
+
+// certRenewed returns a callback publishing a CertRenewed event for a new
+// certificate.
+func certRenewed(bus *events.Bus, msg string) func(*x509.Certificate) {
+	return func(leaf *x509.Certificate) {
+		bus.Publish(events.Event{
+			Type:    events.CertRenewed,
+			Message: fmt.Sprintf("%s for %s", msg, strings.Join(leaf.DNSNames, ", ")),
+			Fields: map[string]string{
+				"names":   strings.Join(leaf.DNSNames, ","),
+				"expires": leaf.NotAfter.Format(time.RFC3339),
+			},
+		})
+	}
+}
+
+// watchTailscaleCert asks for the node's Tailscale certificate for domain
+// every interval, which has it renewed once it's due rather than on the
+// first handshake after, and records it in sel. A renewal is published on
+// bus, and so is a CertExpiring event once it's within warnBefore of
+// expiring.
+func watchTailscaleCert(ctx context.Context, lc *tailscale.LocalClient, domain string, sel *certs.Selector, bus *events.Bus, interval, warnBefore time.Duration) {
+	var last, warned time.Time
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		leaf, err := tailscaleCert(ctx, lc, domain, sel)
+		if err != nil {
+			log.WithField("domain", domain).Warnf("Failed to check the TLS certificate: %v", err)
+		} else {
+			if !last.IsZero() && leaf.NotAfter.After(last) {
+				log.WithField("domain", domain).Info("TLS certificate renewed")
+				certRenewed(bus, "Renewed Tailscale certificate")(leaf)
+			}
+			last = leaf.NotAfter
+			if left := time.Until(leaf.NotAfter); left < warnBefore && !leaf.NotAfter.Equal(warned) {
+				warned = leaf.NotAfter
+				msg := fmt.Sprintf("TLS certificate for %s expires in %s (%s)", domain, left.Round(time.Minute), leaf.NotAfter.Format(time.RFC3339))
+				log.Warn(msg)
+				bus.Publish(events.Event{
+					Type:    events.CertExpiring,
+					Message: msg,
+					Fields:  map[string]string{"names": strings.Join(leaf.DNSNames, ","), "expires": leaf.NotAfter.Format(time.RFC3339)},
+				})
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func tailscaleCert(ctx context.Context, lc *tailscale.LocalClient, domain string, sel *certs.Selector) (*x509.Certificate, error) {
+	certPEM, keyPEM, err := lc.CertPair(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	sel.Observe(&cert)
+	return leaf, nil
+}
+
+// serveChallenges makes the HTTP ports answer the ACME HTTP-01 challenges
+// of ac.
+func serveChallenges(ac *certs.ACMECert, ports []*nodePort) {
+	for _, p := range ports {
+		if srv, ok := p.srv.(*http.Server); ok && p.handler != nil {
+			srv.Handler = ac.HandleChallenges(srv.Handler)
+		}
+	}
+}
+
+// listenOptions are the node-wide settings applied to every port.
+type listenOptions struct {
+	listenIP string // both, ipv4 or ipv6
+	http2    bool
+	http3    bool
+}
+
+func listenOptionsFrom(cfg *models.Config) listenOptions {
+	return listenOptions{listenIP: cfg.ListenIP, http2: cfg.HTTP2, http3: cfg.HTTP3}
+}
+
+// network is the network tsnet listens on for the listen_ip setting.
+func (o listenOptions) network(base string) string {
+	switch o.listenIP {
+	case "ipv4":
+		return base + "4"
+	case "ipv6":
+		return base + "6"
+	}
+	return base
+}
+
+// listenPorts opens a tailnet listener for every port the routes use, each
+// served by its own handler built from the routes on that port. HTTPS ports
+// present the certificates from getCert and negotiate HTTP/2 unless it's
+// disabled.
+func listenPorts(s *tsnet.Server, getCert getCertFunc, lo listenOptions, routes []models.Route, opts router.Options) ([]*nodePort, error) {
+	byPort := map[int][]models.Route{}
+	for _, r := range routes {
+		byPort[r.Port] = append(byPort[r.Port], r)
+	}
+	ports := make([]int, 0, len(byPort))
+	for port := range byPort {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	var out []*nodePort
+	for _, port := range ports {
+		rs := byPort[port]
+		p := &nodePort{name: fmt.Sprintf("port %d", port), port: port, protocol: rs[0].Protocol}
+
+		ln, err := s.Listen(lo.network("tcp"), fmt.Sprintf(":%d", port))
+		if err != nil {
+			closePorts(out)
+			return nil, fmt.Errorf("failed to listen on port %d: %v", port, err)
+		}
+		if p.protocol == "https" {
+			tlsConfig := &tls.Config{
+				GetCertificate: getCert,
+				NextProtos:     []string{"http/1.1"},
+			}
+			if lo.http2 {
+				tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+			}
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		p.ln = ln
+		out = append(out, p)
+
+		if p.protocol == "tcp" {
+			p.srv = router.NewTCPProxy(rs[0], opts.DialerFor(rs[0]))
+			continue
+		}
+		handler, err := router.New(rs, opts)
+		if err != nil {
+			closePorts(out)
+			return nil, err
+		}
+		p.handler = handler
+		srv := &http.Server{Handler: handler}
+		if !lo.http2 {
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		if p.protocol == "https" && lo.http3 {
+			p.h3 = &http3.Server{
+				Port:      port,
+				Handler:   handler,
+				TLSConfig: http3.ConfigureTLSConfig(&tls.Config{GetCertificate: getCert}),
+			}
+			srv.Handler = advertiseHTTP3(p.h3, handler)
+		}
+		p.srv = srv
+	}
+	return out, nil
+}
+
+// advertiseHTTP3 adds the Alt-Svc header that tells clients HTTP/3 is
+// available on the same port.
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveHTTP3 starts the QUIC listeners of every port with HTTP/3 enabled.
+// tsnet only hands out UDP sockets for a specific address, so it has to run
+// once the node has its Tailscale IPs.
+func serveHTTP3(s *tsnet.Server, lo listenOptions, ports []*nodePort) error {
+	ip4, ip6 := s.TailscaleIPs()
+	var ips []netip.Addr
+	if lo.listenIP != "ipv6" && ip4.IsValid() {
+		ips = append(ips, ip4)
+	}
+	if lo.listenIP != "ipv4" && ip6.IsValid() {
+		ips = append(ips, ip6)
+	}
+
+	for _, p := range ports {
+		if p.h3 == nil {
+			continue
+		}
+		for _, ip := range ips {
+			pc, err := s.ListenPacket(lo.network("udp"), netip.AddrPortFrom(ip, uint16(p.port)).String())
+			if err != nil {
+				return fmt.Errorf("failed to listen for HTTP/3 on port %d: %v", p.port, err)
+			}
+			go func(p *nodePort) {
+				if err := p.h3.Serve(pc); err != nil && err != http.ErrServerClosed {
+					log.Warnf("HTTP/3 on port %d stopped: %v", p.port, err)
+				}
+			}(p)
+		}
+		log.Infof("HTTP/3 enabled on port %d (experimental)", p.port)
+	}
+	return nil
+}
+
+// listenLocal serves the routes of the main tailnet port (443, or else the
+// first HTTP port) on a local address as well, over plain HTTP, so the exact
+// proxied configuration can be tested without going through Tailscale.
+// Requests arriving there have no Tailscale identity. With proxyProtocol,
+// the client address comes from a PROXY protocol header, and with
+// forwardedFor from X-Forwarded-For; neither is trusted for an identity,
+// even if it's a tailnet address.
+func listenLocal(addr string, proxyProtocol, forwardedFor bool, ports []*nodePort) (*nodePort, error) {
+	var main *nodePort
+	for _, p := range ports {
+		if p.handler != nil && (main == nil || p.port == 443) {
+			main = p
+		}
+	}
+	if main == nil {
+		return nil, fmt.Errorf("local_addr needs an http or https route to serve")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on local address %s: %v", addr, err)
+	}
+	handler := main.handler
+	if forwardedFor {
+		handler = router.ForwardedFor(handler)
+	}
+	srv := &http.Server{Handler: handler}
+	if proxyProtocol {
+		ln = &proxyproto.Listener{Listener: ln}
+		srv.ConnContext = func(ctx context.Context, _ net.Conn) context.Context { return router.WithoutIdentity(ctx) }
+	}
+	log.Infof("Also serving %s routes at http://%s", main.name, ln.Addr())
+	return &nodePort{
+		name:     "local address " + addr,
+		protocol: "http",
+		ln:       ln,
+		srv:      srv,
+		handler:  handler,
+	}, nil
+}
+
+func closePorts(ports []*nodePort) {
+	for _, p := range ports {
+		p.ln.Close()
+	}
+}
+
+// serviceURL is how a route is reached on the tailnet.
+func serviceURL(domain string, r models.Route) string {
+	host := domain
+	if !(r.Protocol == "https" && r.Port == 443) && !(r.Protocol == "http" && r.Port == 80) {
+		host = net.JoinHostPort(domain, fmt.Sprint(r.Port))
+	}
+	if r.Protocol == "tcp" {
+		return "tcp://" + host
+	}
+	return r.Protocol + "://" + host + r.Path
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+)
+
+// nodeTag is the tag serve's auth keys give the node.
+const nodeTag = "tag:server"
+
+// checkReachability logs who the tailnet policy lets reach each of the
+// node's ports, warning about ports nobody can reach and ports open to
+// everyone. It's advisory: a policy that can't be read is only logged.
+func checkReachability(ctx context.Context, api *tailscaleapi.Client, cfg *models.Config) {
+	policy, err := api.GetPolicy(ctx)
+	if err != nil {
+		log.Infof("Skipping the reachability check, the OAuth client needs the policy_file:read scope for it: %v", err)
+		return
+	}
+
+	routes := map[int][]string{}
+	for _, r := range cfg.Routes {
+		routes[r.Port] = append(routes[r.Port], r.Name)
+	}
+	ports := make([]int, 0, len(routes))
+	for port := range routes {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	for _, port := range ports {
+		entry := log.WithFields(log.Fields{"port": port, "routes": strings.Join(routes[port], ",")})
+		srcs := reachableFrom(policy, []string{nodeTag}, port)
+		switch {
+		case len(srcs) == 0:
+			entry.Warnf("Port %d is unreachable: no ACL rule or grant lets anyone reach %s on it", port, nodeTag)
+		case slices.Contains(srcs, "*"):
+			entry.Warnf("Port %d is open to everyone: the policy lets src \"*\" reach it", port)
+		default:
+			entry.Infof("Port %d is reachable from %s", port, strings.Join(srcs, ", "))
+		}
+	}
+}
+
+// reachableFrom returns the sources of every accept rule and grant whose
+// destination covers port on a node with tags, sorted and deduplicated.
+// Destinations named by IP or host alias aren't resolved, since the node's
+// address isn't known until it's registered.
+func reachableFrom(p *models.TailscalePolicy, tags []string, port int) []string {
+	covers := func(host string) bool {
+		return host == "*" || slices.Contains(tags, host)
+	}
+
+	var srcs []string
+	for _, acl := range p.ACLs {
+		if acl.Action != "accept" {
+			continue
+		}
+		for _, dst := range acl.Dst {
+			i := strings.LastIndex(dst, ":")
+			if i < 0 || !covers(dst[:i]) || !portsCover(dst[i+1:], port) {
+				continue
+			}
+			srcs = append(srcs, acl.Src...)
+			break
+		}
+	}
+	for _, g := range p.Grants {
+		if !slices.ContainsFunc(g.Dst, covers) {
+			continue
+		}
+		if slices.ContainsFunc(g.IP, func(ip string) bool {
+			if proto, ports, ok := strings.Cut(ip, ":"); ok {
+				if proto != "tcp" && proto != "6" {
+					return false
+				}
+				ip = ports
+			}
+			return portsCover(ip, port)
+		}) {
+			srcs = append(srcs, g.Src...)
+		}
+	}
+	sort.Strings(srcs)
+	return slices.Compact(srcs)
+}
+
+// portsCover reports whether a policy port list such as "*", "443" or
+// "80,8000-8100" includes port.
+func portsCover(spec string, port int) bool {
+	for _, part := range strings.Split(spec, ",") {
+		if part == "*" {
+			return true
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 == nil && err2 == nil && from <= port && port <= to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"tailscale.com/tsnet"
+)
+
+const (
+	readinessTimeout = 2 * time.Minute
+	magicDNSAddr     = "100.100.100.100:53"
+)
+
+// waitReady blocks until the node's TLS certificate has been issued and its
+// MagicDNS name resolves, so the first real request doesn't stall on either.
+// It returns the node's fully qualified domain name.
+func waitReady(ctx context.Context, s *tsnet.Server) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	domains := s.CertDomains()
+	if len(domains) == 0 {
+		return "", fmt.Errorf("node has no certificate domains, are MagicDNS and HTTPS enabled for the tailnet?")
+	}
+	domain := domains[0]
+
+	lc, err := s.LocalClient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get local client: %v", err)
+	}
+
+	log.WithField("domain", domain).Info("Provisioning TLS certificate...")
+	start := time.Now()
+	if _, _, err := lc.CertPair(ctx, domain); err != nil {
+		return "", fmt.Errorf("failed to provision certificate for %s: %v", domain, err)
+	}
+	log.WithFields(log.Fields{
+		"domain":   domain,
+		"duration": time.Since(start).Round(time.Millisecond),
+	}).Debug("TLS certificate ready")
+
+	if err := waitMagicDNS(ctx, s, domain); err != nil {
+		// MagicDNS may lag behind the control plane or be disabled for some
+		// clients; a missing record shouldn't keep the service from serving.
+		log.WithField("domain", domain).Warnf("MagicDNS name not resolvable yet: %v", err)
+	}
+
+	return domain, nil
+}
+
+// waitMagicDNS polls the tailnet's resolver (reached through the node itself)
+// until domain resolves.
+func waitMagicDNS(ctx context.Context, s *tsnet.Server, domain string) error {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return s.Dial(ctx, network, magicDNSAddr)
+		},
+	}
+
+	backoff := 250 * time.Millisecond
+	for {
+		addrs, err := resolver.LookupHost(ctx, domain)
+		if err == nil && len(addrs) > 0 {
+			log.WithFields(log.Fields{
+				"domain": domain,
+				"addrs":  strings.Join(addrs, ","),
+			}).Debug("MagicDNS name resolved")
+			return nil
+		}
+
+		log.WithField("domain", domain).Debugf("MagicDNS lookup not ready: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// sdNotify sends a state notification to systemd when running under a
+// Type=notify unit. It's a no-op otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Debugf("failed to connect to systemd notify socket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Debugf("failed to notify systemd: %v", err)
+	}
+}
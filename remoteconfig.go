@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/config"
+)
+
+// errConfigChanged is the cause of the shutdown when a polled remote
+// config changes.
+var errConfigChanged = errors.New("remote config changed")
+
+// watchRemoteConfig checks the remote config every interval until ctx is
+// done, and calls restart once it has changed to one that's verified and
+// valid. Changes that aren't are logged and the current config kept.
+func watchRemoteConfig(ctx context.Context, flags *config.Flags, interval time.Duration, restart context.CancelCauseFunc) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		changed, err := config.CheckRemote(ctx, flags)
+		if err != nil {
+			log.Warnf("Failed to check remote config: %v", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		cfg, src, err := config.Resolve(flags)
+		if err == nil {
+			err = config.Validate(cfg, src)
+		}
+		if err != nil {
+			log.Warnf("Remote config changed but is invalid, keeping the current one: %v", err)
+			continue
+		}
+		log.Info("Remote config changed, restarting")
+		restart(errConfigChanged)
+		return
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/adminclient"
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+const replayTimeout = 30 * time.Second
+
+func replayCommand() *command {
+	fs := newFlagSet("replay")
+	flags := config.BindFlags(fs, config.ScopeAll)
+	target := fs.String("target", "", "Send to this backend URL instead of the captured route's target")
+	file := fs.String("file", "", "Read the capture from this file (as saved from /captures/<id>) instead of the admin API")
+
+	return &command{
+		name:    "replay",
+		usage:   "<capture-id>",
+		summary: "Re-send a captured request to its backend",
+		description: `
+Fetches a request recorded by a running instance (capture_size must be set,
+along with admin_addr) and sends it to the route's backend directly,
+bypassing the node. The response status goes to stderr and its body to
+stdout.
+
+Redacted headers are left out, and truncated bodies are sent truncated, so
+the replay may not be identical to the original request.`,
+		examples: []string{
+			"tsrouter replay --config tsrouter.yaml 42",
+			"tsrouter replay --target http://localhost:9091 --file capture.json",
+		},
+		flags: fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+
+			var e *router.Exchange
+			switch {
+			case *file != "":
+				e, err = readCapture(*file)
+			case len(args) == 1:
+				if cfg.AdminAddr == "" {
+					return fmt.Errorf("admin_addr is required to fetch captures, or use --file")
+				}
+				e, err = fetchCapture(ctx, cfg.AdminAddr, args[0])
+			default:
+				return fmt.Errorf("expected a capture ID or --file")
+			}
+			if err != nil {
+				return err
+			}
+
+			base := *target
+			if base == "" {
+				for _, r := range cfg.Routes {
+					if r.Name == e.Route {
+						base = r.Target
+					}
+				}
+				if base == "" {
+					return fmt.Errorf("route %q is not in the config, use --target", e.Route)
+				}
+			}
+			return replay(ctx, base, e)
+		},
+	}
+}
+
+func readCapture(path string) (*router.Exchange, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture: %v", err)
+	}
+	var e router.Exchange
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("failed to parse capture: %v", err)
+	}
+	return &e, nil
+}
+
+func fetchCapture(ctx context.Context, adminAddr, id string) (*router.Exchange, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capture ID %q", id)
+	}
+	ctx, cancel := context.WithTimeout(ctx, replayTimeout)
+	defer cancel()
+
+	e, err := adminclient.NewClient(adminAddr).Capture(ctx, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch capture %s: %v", id, err)
+	}
+	return e, nil
+}
+
+func replay(ctx context.Context, base string, e *router.Exchange) error {
+	ctx, cancel := context.WithTimeout(ctx, replayTimeout)
+	defer cancel()
+
+	if e.Request.BodyTruncated {
+		fmt.Fprintln(os.Stderr, "Warning: captured request body was truncated")
+	}
+	url := strings.TrimSuffix(base, "/") + e.Request.URI
+	req, err := http.NewRequestWithContext(ctx, e.Request.Method, url, bytes.NewReader(e.Request.Body))
+	if err != nil {
+		return err
+	}
+	for name, values := range e.Request.Header {
+		if len(values) == 1 && values[0] == router.Redacted {
+			continue
+		}
+		req.Header[name] = values
+	}
+	req.Header.Del("Content-Length")
+	req.Host = e.Request.Host
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to replay request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Fprintf(os.Stderr, "%s %s -> %s (originally %d)\n", e.Request.Method, url, resp.Status, e.Response.Status)
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
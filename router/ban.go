@@ -0,0 +1,199 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// banSweepInterval is how often clients without recent failures are
+// forgotten.
+const banSweepInterval = time.Minute
+
+// BanOptions configures Bans. A zero threshold disables that kind of ban.
+type BanOptions struct {
+	AuthFailures int // 401 and 403 responses within Window
+	ClientErrors int // 4xx responses within Window
+	Window       time.Duration
+	Duration     time.Duration
+}
+
+// Bans temporarily bans clients that collect too many failed responses, as
+// fail2ban does. Clients are tailnet nodes, or addresses for callers
+// without a Tailscale identity. It's a Recorder, for counting failures,
+// and blocks banned clients on every route through Options.Bans.
+type Bans struct {
+	opts BanOptions
+
+	mu      sync.Mutex
+	clients map[string]*banClient
+	swept   time.Time
+}
+
+type banClient struct {
+	auth, errors []time.Time // within the window, oldest first
+	until        time.Time
+	reason       string
+}
+
+// Ban is a client banned until Until.
+type Ban struct {
+	Client string    `json:"client"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// NewBans returns an empty ban list.
+func NewBans(opts BanOptions) *Bans {
+	return &Bans{opts: opts, clients: map[string]*banClient{}}
+}
+
+// clientKey names the client behind a request: "node:<name>" for tailnet
+// callers, "ip:<address>" for the rest.
+func clientKey(node, remoteAddr string) string {
+	if node != "" {
+		return "node:" + node
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+func requestClientKey(req *http.Request) string {
+	var node string
+	if who := IdentityFromContext(req.Context()); who != nil && who.Node != nil {
+		node = who.Node.ComputedName
+	}
+	return clientKey(node, req.RemoteAddr)
+}
+
+// Record implements Recorder, counting the failures of clients that aren't
+// already banned.
+func (b *Bans) Record(rec *Record) {
+	auth := rec.Status == http.StatusUnauthorized || rec.Status == http.StatusForbidden
+	clientErr := rec.Status >= 400 && rec.Status < 500 && rec.Status != statusClientClosed
+	if !clientErr {
+		return
+	}
+	key := clientKey(rec.Node, rec.RemoteAddr)
+	now := rec.Time.Add(rec.Duration)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(now)
+	c := b.clients[key]
+	if c == nil {
+		c = &banClient{}
+		b.clients[key] = c
+	}
+	if now.Before(c.until) {
+		return
+	}
+
+	if auth && b.opts.AuthFailures > 0 {
+		c.auth = recent(append(c.auth, now), now.Add(-b.opts.Window), b.opts.AuthFailures)
+		if len(c.auth) >= b.opts.AuthFailures {
+			b.ban(key, c, now, fmt.Sprintf("%d authentication failures within %s", len(c.auth), b.opts.Window))
+			return
+		}
+	}
+	if b.opts.ClientErrors > 0 {
+		c.errors = recent(append(c.errors, now), now.Add(-b.opts.Window), b.opts.ClientErrors)
+		if len(c.errors) >= b.opts.ClientErrors {
+			b.ban(key, c, now, fmt.Sprintf("%d client errors within %s", len(c.errors), b.opts.Window))
+		}
+	}
+}
+
+// recent drops the times before cutoff, and the oldest beyond max.
+func recent(times []time.Time, cutoff time.Time, max int) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return !times[i].Before(cutoff) })
+	times = times[i:]
+	if len(times) > max {
+		times = times[len(times)-max:]
+	}
+	return times
+}
+
+// ban bans a client. b.mu must be held.
+func (b *Bans) ban(key string, c *banClient, now time.Time, reason string) {
+	c.until, c.reason = now.Add(b.opts.Duration), reason
+	c.auth, c.errors = nil, nil
+	log.WithFields(log.Fields{"client": key, "until": c.until.Format(time.RFC3339)}).Warnf("Banned client: %s", reason)
+}
+
+// sweep forgets clients that are neither banned nor have failures within
+// the window. b.mu must be held.
+func (b *Bans) sweep(now time.Time) {
+	if now.Sub(b.swept) < banSweepInterval {
+		return
+	}
+	b.swept = now
+	cutoff := now.Add(-b.opts.Window)
+	for key, c := range b.clients {
+		if now.Before(c.until) {
+			continue
+		}
+		if (len(c.auth) == 0 || c.auth[len(c.auth)-1].Before(cutoff)) && (len(c.errors) == 0 || c.errors[len(c.errors)-1].Before(cutoff)) {
+			delete(b.clients, key)
+		}
+	}
+}
+
+// bannedUntil returns when the client's ban ends, or the zero time if it
+// isn't banned.
+func (b *Bans) bannedUntil(key string) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.clients[key]; c != nil && time.Now().Before(c.until) {
+		return c.until
+	}
+	return time.Time{}
+}
+
+// List returns the current bans, those ending soonest first.
+func (b *Bans) List() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	bans := []Ban{}
+	for key, c := range b.clients {
+		if now.Before(c.until) {
+			bans = append(bans, Ban{Client: key, Reason: c.reason, Until: c.until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Unban lifts a client's ban and forgets its failures. It reports whether
+// the client was banned.
+func (b *Bans) Unban(client string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.clients[client]
+	delete(b.clients, client)
+	return c != nil && time.Now().Before(c.until)
+}
+
+// banned answers requests from banned clients with a 429 and passes the
+// rest to next.
+func banned(b *Bans, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		until := b.bannedUntil(requestClientKey(req))
+		if until.IsZero() {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		http.Error(w, "Too many failed requests, try again later", http.StatusTooManyRequests)
+	})
+}
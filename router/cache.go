@@ -0,0 +1,297 @@
+package router
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// cacheableStatus lists the responses stored when the backend allows it.
+var cacheableStatus = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMovedPermanently: true, http.StatusPermanentRedirect: true,
+	http.StatusNotFound: true, http.StatusGone: true,
+}
+
+// cache serves GET and HEAD requests from memory while responses are fresh.
+// Past that, stale entries are served while one background request
+// refreshes them (stale-while-revalidate), or in place of a failed backend
+// response (stale-if-error).
+type cache struct {
+	next    http.Handler
+	opts    models.Cache
+	headers []string // identity headers, which responses are cached per value of
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key        string
+	status     int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	fresh      time.Duration
+	swr        time.Duration
+	sie        time.Duration
+	vary       map[string]string // request header -> value the entry was stored for
+	refreshing bool
+}
+
+func newCache(next http.Handler, opts models.Cache, identityHeaders []string) http.Handler {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 1000
+	}
+	return &cache{next: next, opts: opts, headers: identityHeaders, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (c *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	key := r.Host + r.URL.RequestURI()
+	for _, h := range c.headers {
+		key += "\n" + r.Header.Get(h)
+	}
+	noCache := strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+
+	e := c.lookup(key, r)
+	if e == nil || noCache {
+		c.fetch(w, r, key)
+		return
+	}
+
+	age := time.Since(e.stored)
+	switch {
+	case age < e.fresh:
+		c.serve(w, r, e, "HIT")
+	case age < e.fresh+e.swr:
+		c.serve(w, r, e, "STALE")
+		c.revalidate(r, key, e)
+	case age < e.fresh+e.sie:
+		// Buffered, so an error can still be swapped for the stale entry.
+		// Bodies too large to buffer are streamed to w instead, uncached.
+		w.Header().Set("X-Cache", "MISS")
+		buf := &bufferWriter{header: http.Header{}, dst: w}
+		c.next.ServeHTTP(buf, r)
+		if buf.overflow && buf.status < 500 {
+			return
+		}
+		if buf.status >= 500 {
+			log.WithField("path", r.URL.Path).Debugf("Backend returned %d, serving stale response", buf.status)
+			c.serve(w, r, e, "STALE")
+			return
+		}
+		// A HEAD response has no body, so it mustn't be stored for GETs.
+		if r.Method != http.MethodHead {
+			c.store(key, r, buf.status, buf.header, buf.body.Bytes())
+		}
+		buf.copyTo(w)
+	default:
+		c.fetch(w, r, key)
+	}
+}
+
+// fetch forwards a request, storing the response if it's cacheable.
+func (c *cache) fetch(w http.ResponseWriter, r *http.Request, key string) {
+	w.Header().Set("X-Cache", "MISS")
+	if r.Method == http.MethodHead {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	tee := &teeWriter{ResponseWriter: w}
+	c.next.ServeHTTP(tee, r)
+	if !tee.overflow && r.Context().Err() == nil {
+		tee.header.Del("X-Cache")
+		c.store(key, r, tee.status, tee.header, tee.body.Bytes())
+	}
+}
+
+// revalidate refreshes an entry in the background, once at a time.
+func (c *cache) revalidate(r *http.Request, key string, e *cacheEntry) {
+	c.mu.Lock()
+	if e.refreshing {
+		c.mu.Unlock()
+		return
+	}
+	e.refreshing = true
+	c.mu.Unlock()
+
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.Method = http.MethodGet
+	// The client's validators are for its own copy; a 304 to them has
+	// nothing to store.
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	go func() {
+		buf := &bufferWriter{header: http.Header{}}
+		c.next.ServeHTTP(buf, req)
+		if buf.status >= 500 || buf.overflow || !c.store(key, req, buf.status, buf.header, buf.body.Bytes()) {
+			// Left as it was, so the next stale hit tries again.
+			c.mu.Lock()
+			e.refreshing = false
+			c.mu.Unlock()
+		}
+	}()
+}
+
+func (c *cache) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry, state string) {
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	w.Header().Set("X-Cache", state)
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+func (c *cache) lookup(key string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	for h, v := range e.vary {
+		if r.Header.Get(h) != v {
+			return nil
+		}
+	}
+	if time.Since(e.stored) >= e.fresh+max(e.swr, e.sie) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// store keeps a response if its status and headers allow a shared cache to,
+// and reports whether it did.
+func (c *cache) store(key string, r *http.Request, status int, header http.Header, body []byte) bool {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" {
+		return false
+	}
+	e := &cacheEntry{
+		key:    key,
+		status: status,
+		header: header,
+		body:   bytes.Clone(body),
+		stored: time.Now(),
+		fresh:  c.opts.TTL,
+		swr:    c.opts.StaleWhileRevalidate,
+		sie:    c.opts.StaleIfError,
+	}
+	maxAge, sMaxAge := -1, -1
+	for _, d := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(d)), "=")
+		secs, _ := strconv.Atoi(strings.Trim(value, `"`))
+		switch name {
+		case "no-store", "no-cache", "private":
+			return false
+		case "max-age":
+			maxAge = secs
+		case "s-maxage":
+			sMaxAge = secs
+		case "stale-while-revalidate":
+			e.swr = time.Duration(secs) * time.Second
+		case "stale-if-error":
+			e.sie = time.Duration(secs) * time.Second
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge >= 0 {
+		e.fresh = time.Duration(maxAge) * time.Second
+	}
+	if e.fresh <= 0 {
+		return false
+	}
+	for _, v := range header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			h = strings.TrimSpace(h)
+			if h == "*" {
+				return false
+			}
+			if e.vary == nil {
+				e.vary = map[string]string{}
+			}
+			e.vary[h] = r.Header.Get(h)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.opts.MaxEntries {
+		old := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, old.key)
+	}
+	return true
+}
+
+// bufferWriter holds a whole response instead of sending it, up to
+// maxCoalescedBody. Past that it sets overflow and, unless the response is
+// an error, streams it to dst, or drops it if dst is nil.
+type bufferWriter struct {
+	dst      http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *bufferWriter) Header() http.Header { return w.header }
+
+func (w *bufferWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	stream := w.dst != nil && w.status < 500
+	if !w.overflow && w.body.Len()+len(p) > maxCoalescedBody {
+		w.overflow = true
+		if stream {
+			w.copyTo(w.dst)
+		}
+		w.body.Reset()
+	}
+	if !w.overflow {
+		return w.body.Write(p)
+	}
+	if stream {
+		return w.dst.Write(p)
+	}
+	return len(p), nil
+}
+
+func (w *bufferWriter) copyTo(dst http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+	for k, v := range w.header {
+		dst.Header()[k] = v
+	}
+	dst.WriteHeader(w.status)
+	dst.Write(w.body.Bytes())
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// get sends a request to h and returns the response and its body.
+func get(t *testing.T, h http.Handler, method string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	r := httptest.NewRequest(method, "http://example.com/page", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestCacheStaleIfErrorDoesNotStoreHEAD(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			io.WriteString(w, "content")
+		}
+	})
+	c := newCache(backend, models.Cache{TTL: 100 * time.Millisecond, StaleIfError: time.Hour}, nil)
+
+	get(t, c, http.MethodGet, nil)
+	time.Sleep(150 * time.Millisecond)
+	get(t, c, http.MethodHead, nil)
+	if _, body := get(t, c, http.MethodGet, nil); body != "content" {
+		t.Errorf("GET after HEAD got body %q, want %q", body, "content")
+	}
+}
+
+func TestCacheRevalidatesAgainAfterUnstoredResponse(t *testing.T) {
+	var gets atomic.Int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		n := gets.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		if n == 2 {
+			// Not storable, so the entry stays stale.
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		io.WriteString(w, "content")
+	})
+	c := newCache(backend, models.Cache{TTL: 50 * time.Millisecond, StaleWhileRevalidate: time.Hour}, nil)
+	conditional := http.Header{"If-None-Match": {`"v1"`}}
+
+	get(t, c, http.MethodGet, nil)
+	time.Sleep(60 * time.Millisecond)
+	for want := int32(2); want <= 3; want++ {
+		if resp, _ := get(t, c, http.MethodGet, conditional); resp.Header.Get("X-Cache") != "STALE" {
+			t.Fatalf("X-Cache = %q, want STALE", resp.Header.Get("X-Cache"))
+		}
+		deadline := time.Now().Add(time.Second)
+		for (gets.Load() < want || refreshing(c)) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := gets.Load(); got != want {
+			t.Fatalf("backend GETs = %d, want %d", got, want)
+		}
+	}
+}
+
+// refreshing reports whether any entry of c is being revalidated.
+func refreshing(h http.Handler) bool {
+	c := h.(*cache)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries {
+		if el.Value.(*cacheEntry).refreshing {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCacheStaleIfErrorStreamsLargeResponses(t *testing.T) {
+	large := strings.Repeat("x", maxCoalescedBody+1)
+	var n atomic.Int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1) == 1 {
+			io.WriteString(w, "small")
+			return
+		}
+		io.WriteString(w, large[:maxCoalescedBody])
+		io.WriteString(w, large[maxCoalescedBody:])
+	})
+	c := newCache(backend, models.Cache{TTL: 50 * time.Millisecond, StaleIfError: time.Hour}, nil)
+
+	get(t, c, http.MethodGet, nil)
+	time.Sleep(60 * time.Millisecond)
+	if _, body := get(t, c, http.MethodGet, nil); body != large {
+		t.Errorf("got %d bytes, want %d", len(body), len(large))
+	}
+	if resp, _ := get(t, c, http.MethodGet, nil); resp.Header.Get("X-Cache") == "HIT" {
+		t.Error("response over the buffer limit was cached")
+	}
+}
@@ -0,0 +1,236 @@
+package router
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// Redacted replaces the value of headers and query parameters that look
+// like credentials in captured requests.
+const Redacted = "[redacted]"
+
+// Capture keeps the most recent requests and their responses in a ring
+// buffer for debugging. Bodies are truncated and credentials redacted
+// before anything is stored.
+type Capture struct {
+	bodyLimit int
+
+	mu     sync.Mutex
+	buf    []*Exchange
+	nextID uint64
+}
+
+// Exchange is a captured request and response.
+type Exchange struct {
+	ID       uint64           `json:"id"`
+	Time     time.Time        `json:"time"`
+	Route    string           `json:"route"`
+	User     string           `json:"user,omitempty"`
+	Duration time.Duration    `json:"duration"`
+	Timing   *Timing          `json:"timing,omitempty"` // the backend part only; nil without a backend request
+	Request  CapturedRequest  `json:"request"`
+	Response CapturedResponse `json:"response"`
+}
+
+type CapturedRequest struct {
+	Method        string      `json:"method"`
+	Host          string      `json:"host"`
+	URI           string      `json:"uri"` // path and query
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+type CapturedResponse struct {
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+// NewCapture returns a Capture holding up to size exchanges, with bodies
+// cut off after bodyLimit bytes.
+func NewCapture(size, bodyLimit int) *Capture {
+	return &Capture{bodyLimit: bodyLimit, buf: make([]*Exchange, 0, size)}
+}
+
+func (c *Capture) add(e *Exchange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	e.ID = c.nextID
+	if len(c.buf) < cap(c.buf) {
+		c.buf = append(c.buf, e)
+		return
+	}
+	copy(c.buf, c.buf[1:])
+	c.buf[len(c.buf)-1] = e
+}
+
+// List returns the captured exchanges, oldest first.
+func (c *Capture) List() []*Exchange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Exchange(nil), c.buf...)
+}
+
+// Get returns the exchange with the given ID, or nil if it's no longer
+// buffered.
+func (c *Capture) Get(id uint64) *Exchange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.buf {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// capture wraps next so every exchange is recorded in c. It returns next
+// unchanged when c is nil.
+func capture(c *Capture, route models.Route, next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &Exchange{
+			Time:  start,
+			Route: route.Name,
+			Request: CapturedRequest{
+				Method: r.Method,
+				Host:   r.Host,
+				URI:    redactURI(r.URL),
+				Header: redactHeader(r.Header),
+			},
+		}
+		if who := IdentityFromContext(r.Context()); who != nil && who.UserProfile != nil {
+			e.User = who.UserProfile.LoginName
+		}
+
+		reqBody := &limitedBuffer{limit: c.bodyLimit}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+		cw := &captureWriter{ResponseWriter: w, body: limitedBuffer{limit: c.bodyLimit}}
+
+		next.ServeHTTP(cw, r)
+
+		e.Duration = time.Since(start)
+		if tm := timingFromContext(r.Context()); tm != nil {
+			if t := tm.get(); t.Backend {
+				e.Timing = &t
+			}
+		}
+		e.Request.Body, e.Request.BodyTruncated = reqBody.Bytes(), reqBody.truncated
+		e.Response = CapturedResponse{
+			Status:        cw.status(),
+			Header:        redactHeader(w.Header()),
+			Body:          cw.body.Bytes(),
+			BodyTruncated: cw.body.truncated,
+		}
+		c.add(e)
+	})
+}
+
+// sensitive reports whether a header or parameter name looks like it
+// carries a credential.
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"auth", "cookie", "token", "secret", "password", "key", "session"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for name := range out {
+		if sensitive(name) {
+			out[name] = []string{Redacted}
+		}
+	}
+	return out
+}
+
+func redactURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	q := u.Query()
+	for name := range q {
+		if sensitive(name) {
+			q[name] = []string{Redacted}
+		}
+	}
+	return u.Path + "?" + q.Encode()
+}
+
+// limitedBuffer keeps the first limit bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// captureWriter copies the start of the response body; like statusWriter,
+// it keeps flushing and hijacking working through Unwrap.
+type captureWriter struct {
+	http.ResponseWriter
+	code int
+	body limitedBuffer
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *captureWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
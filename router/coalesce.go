@@ -0,0 +1,134 @@
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxCoalescedBody caps the response shared between coalesced requests.
+// Larger responses are streamed to the first caller only, and the others
+// repeat the request themselves.
+const maxCoalescedBody = 1 << 20
+
+// coalesceHeaders are the request headers a response may vary on; requests
+// are only collapsed when they all match.
+var coalesceHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "Range"}
+
+// coalescer collapses identical concurrent GET and HEAD requests into one
+// backend request, whose response is copied to every waiting caller.
+type coalescer struct {
+	next    http.Handler
+	headers []string // coalesceHeaders plus the route's identity headers
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done   chan struct{}
+	ok     bool // complete and small enough to share
+	status int
+	header http.Header
+	body   []byte
+}
+
+func coalesce(next http.Handler, identityHeaders []string) http.Handler {
+	headers := append(append([]string(nil), coalesceHeaders...), identityHeaders...)
+	return &coalescer{next: next, headers: headers, calls: map[string]*call{}}
+}
+
+func (c *coalescer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	key := coalesceKey(r, c.headers)
+
+	c.mu.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-cl.done:
+		case <-r.Context().Done():
+			return
+		}
+		if !cl.ok {
+			c.next.ServeHTTP(w, r)
+			return
+		}
+		for k, v := range cl.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(cl.status)
+		w.Write(cl.body)
+		return
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	rec := &teeWriter{ResponseWriter: w}
+	c.next.ServeHTTP(rec, r)
+
+	cl.status, cl.header, cl.body = rec.status, rec.header, rec.body.Bytes()
+	if cl.status == 0 {
+		cl.status = http.StatusOK
+	}
+	// A response cut short by the first caller going away isn't shared.
+	cl.ok = !rec.overflow && r.Context().Err() == nil
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(cl.done)
+}
+
+func coalesceKey(r *http.Request, headers []string) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.Host)
+	b.WriteString(r.URL.RequestURI())
+	for _, h := range headers {
+		b.WriteByte('\n')
+		b.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// teeWriter writes through to the caller while keeping a copy of the
+// response, up to maxCoalescedBody.
+type teeWriter struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *teeWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if w.body.Len()+len(p) > maxCoalescedBody {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *teeWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
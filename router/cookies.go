@@ -0,0 +1,95 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// rewriteCookies makes proxy rewrite the attributes of cookies the backend
+// sets, per the route's cookies, and, for subpath routes, move their paths
+// under prefix.
+func rewriteCookies(proxy *httputil.ReverseProxy, c models.Cookies, prefix string) {
+	// Longest first, so the most specific path mapping wins.
+	var paths []string
+	for p := range c.Path {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool { return len(paths[i]) > len(paths[j]) })
+
+	modifyResponse(proxy, func(resp *http.Response) error {
+		cookies := resp.Header.Values("Set-Cookie")
+		if len(cookies) == 0 {
+			return nil
+		}
+		resp.Header.Del("Set-Cookie")
+		for _, v := range cookies {
+			resp.Header.Add("Set-Cookie", rewriteCookie(v, c, paths, prefix))
+		}
+		return nil
+	})
+}
+
+// rewriteCookie rewrites one Set-Cookie value, keeping attributes it
+// doesn't change as they were.
+func rewriteCookie(v string, c models.Cookies, paths []string, prefix string) string {
+	parts := strings.Split(v, ";")
+	out := []string{parts[0]}
+	secure, sameSite := false, ""
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			if to, ok := mapDomain(c.Domain, value); ok {
+				if to == "" {
+					continue
+				}
+				part = " Domain=" + to
+			}
+		case "path":
+			to := value
+			for _, from := range paths {
+				if rest, ok := strings.CutPrefix(value, from); ok {
+					to = c.Path[from] + rest
+					break
+				}
+			}
+			if prefix != "" && strings.HasPrefix(to, "/") {
+				to = prefix + to
+			}
+			part = " Path=" + to
+		case "secure":
+			secure = true
+		case "samesite":
+			if c.SameSite != "" {
+				continue
+			}
+			sameSite = strings.ToLower(value)
+		}
+		out = append(out, part)
+	}
+	if c.SameSite != "" {
+		sameSite = strings.ToLower(c.SameSite)
+		out = append(out, " SameSite="+strings.ToUpper(sameSite[:1])+sameSite[1:])
+	}
+	// Browsers refuse SameSite=None cookies that aren't Secure.
+	if !secure && (c.Secure || sameSite == "none") {
+		out = append(out, " Secure")
+	}
+	return strings.Join(out, ";")
+}
+
+// mapDomain looks a cookie's domain up in domains, ignoring case and a
+// leading dot.
+func mapDomain(domains map[string]string, domain string) (string, bool) {
+	domain = strings.TrimPrefix(strings.ToLower(domain), ".")
+	for from, to := range domains {
+		if strings.TrimPrefix(strings.ToLower(from), ".") == domain {
+			return to, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,99 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// errMaxDuration is the cause of a request's context being cancelled when
+// it runs past its route's max_request_duration.
+var errMaxDuration = errors.New("request exceeded max_request_duration")
+
+// tooLong reports whether req was cancelled for running past its route's
+// max_request_duration.
+func tooLong(req *http.Request) bool {
+	return errors.Is(context.Cause(req.Context()), errMaxDuration)
+}
+
+// capDuration cancels requests still running after the route's
+// max_request_duration, which cancels the backend request, and answers
+// them with 504 if the backend hadn't answered yet. A response already
+// under way is cut off. Upgraded connections and event streams are meant
+// to stay open, so the cap is lifted once the backend answers with one:
+// the proxy hijacks the connection for an upgrade.
+func capDuration(route models.Route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithCancelCause(req.Context())
+		defer cancel(nil)
+		timer := time.AfterFunc(route.MaxRequestDuration, func() { cancel(errMaxDuration) })
+		defer timer.Stop()
+
+		cw := &cappedWriter{ResponseWriter: w, timer: timer}
+		defer func() {
+			if !errors.Is(context.Cause(ctx), errMaxDuration) {
+				return
+			}
+			if cw.hijacked {
+				return
+			}
+			entry := routeLog(route).WithFields(log.Fields{"path": req.URL.Path})
+			if cw.answered {
+				entry.Warnf("Request cut off after max_request_duration of %s", route.MaxRequestDuration)
+				return
+			}
+			entry.Warnf("Request ran past max_request_duration of %s, cancelled it", route.MaxRequestDuration)
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}()
+		next.ServeHTTP(cw, req.WithContext(ctx))
+	})
+}
+
+// cappedWriter notes whether the backend answered, and lifts the cap for
+// the responses meant to stay open.
+type cappedWriter struct {
+	http.ResponseWriter
+	timer    *time.Timer
+	answered bool
+	hijacked bool
+}
+
+func (w *cappedWriter) WriteHeader(code int) {
+	if code == http.StatusSwitchingProtocols || isEventStream(w.Header().Get("Content-Type")) {
+		w.timer.Stop()
+	}
+	if code >= 200 {
+		w.answered = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cappedWriter) Write(b []byte) (int, error) {
+	if !w.answered {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cappedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.timer.Stop()
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	w.hijacked = err == nil
+	return conn, rw, err
+}
+
+func (w *cappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func isEventStream(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "text/event-stream"
+}
@@ -0,0 +1,189 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/errdefs"
+)
+
+// fallbackDelay is how long the preferred address family gets before the
+// other one is tried in parallel (Happy Eyeballs, RFC 8305).
+const fallbackDelay = 300 * time.Millisecond
+
+// DialFunc opens a connection to a backend.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// CachingDialer dials hostname targets using cached DNS results, racing
+// their IPv6 and IPv4 addresses. Entries live for the TTL and are dropped as
+// soon as none of their addresses can be reached, so a backend that moved
+// is re-resolved on the next dial.
+type CachingDialer struct {
+	ttl    time.Duration
+	dialer net.Dialer
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func NewCachingDialer(ttl time.Duration) *CachingDialer {
+	return &CachingDialer{
+		ttl:     ttl,
+		dialer:  net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		entries: map[string]dnsEntry{},
+	}
+}
+
+// DialContext implements DialFunc. Its errors are of class
+// errdefs.ErrBackend.
+func (d *CachingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, errdefs.Wrap(errdefs.ErrBackend, err)
+	}
+	return conn, nil
+}
+
+func (d *CachingDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil || host == "localhost" {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, cached, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialParallel(ctx, network, port, ips)
+	if err == nil || ctx.Err() != nil {
+		return conn, err
+	}
+	d.forget(host)
+	if !cached {
+		return nil, err
+	}
+	// The cached addresses may be stale; try once more with fresh ones.
+	if ips, _, err = d.lookup(ctx, host); err != nil {
+		return nil, err
+	}
+	return d.dialParallel(ctx, network, port, ips)
+}
+
+func (d *CachingDialer) lookup(ctx context.Context, host string) (ips []net.IP, cached bool, err error) {
+	d.mu.Lock()
+	e, ok := d.entries[host]
+	d.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ips, true, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, false, err
+	}
+	ips = make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	d.mu.Lock()
+	d.entries[host] = dnsEntry{ips: ips, expires: time.Now().Add(d.ttl)}
+	d.mu.Unlock()
+	return ips, false, nil
+}
+
+func (d *CachingDialer) forget(host string) {
+	d.mu.Lock()
+	delete(d.entries, host)
+	d.mu.Unlock()
+}
+
+// dialParallel tries the addresses of the first address's family in order,
+// starting on the other family after fallbackDelay or as soon as the first
+// family runs out, and returns the first connection established.
+func (d *CachingDialer) dialParallel(ctx context.Context, network, port string, ips []net.IP) (net.Conn, error) {
+	var primary, fallback []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primary = append(primary, ip)
+		} else {
+			fallback = append(fallback, ip)
+		}
+	}
+	if len(fallback) == 0 {
+		return d.dialSerial(ctx, network, port, primary)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	dial := func(ips []net.IP) {
+		conn, err := d.dialSerial(ctx, network, port, ips)
+		results <- result{conn, err}
+	}
+
+	go dial(primary)
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	started, pending := false, 1
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !started {
+				started = true
+				pending++
+				go dial(fallback)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// Close the loser if it connects after all.
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !started {
+				started = true
+				pending++
+				go dial(fallback)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+func (d *CachingDialer) dialSerial(ctx context.Context, network, port string, ips []net.IP) (net.Conn, error) {
+	err := errors.New("no addresses")
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
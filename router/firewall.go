@@ -0,0 +1,36 @@
+package router
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/firewall"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// screened passes requests to next unless the route's firewall denies
+// them, and logs every rule or signature that matched.
+func screened(r models.Route, next http.Handler) (http.Handler, error) {
+	fw, err := firewall.New(r.Firewall)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m := fw.Check(req)
+		if len(m.Matched) > 0 {
+			routeLog(r).WithFields(log.Fields{
+				"method":      req.Method,
+				"path":        req.URL.Path,
+				"remote_addr": req.RemoteAddr,
+				"matched":     strings.Join(m.Matched, ","),
+				"action":      m.Action,
+			}).Info("Firewall rule matched")
+		}
+		if m.Action == firewall.Deny {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	}), nil
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// IdentityHeaders returns the headers describing who: the user (for
+// untagged nodes), and the node's name and tags.
+func IdentityHeaders(who *apitype.WhoIsResponse) http.Header {
+	h := http.Header{}
+	if who.Node != nil {
+		h.Set("Tailscale-Node-Name", who.Node.ComputedName)
+		if len(who.Node.Tags) > 0 {
+			h.Set("Tailscale-Node-Tags", strings.Join(who.Node.Tags, ","))
+			return h // tagged nodes act as themselves, not as a user
+		}
+	}
+	if u := who.UserProfile; u != nil {
+		h.Set("Tailscale-User-Login", u.LoginName)
+		h.Set("Tailscale-User-Name", u.DisplayName)
+		if u.ProfilePicURL != "" {
+			h.Set("Tailscale-User-Profile-Pic", u.ProfilePicURL)
+		}
+	}
+	return h
+}
+
+// ForwardAuth answers forward-auth requests from another reverse proxy
+// (Traefik's forwardAuth, nginx's auth_request): 200 with the identity
+// headers when the original client is a tailnet peer, 401 when it isn't.
+// With opts.GrantCapability set, the peer must also be granted the route
+// named by ?route=, or the forwarded host, for the forwarded method (403).
+//
+// The client address comes from X-Real-IP or the last X-Forwarded-For
+// entry, which the calling proxy sets, so this must only be reachable by
+// that proxy.
+func ForwardAuth(opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		addr := forwardedClient(req)
+		if addr == "" || opts.WhoIs == nil {
+			http.Error(w, "no client address forwarded", http.StatusUnauthorized)
+			return
+		}
+		who, err := opts.WhoIs(req.Context(), addr)
+		if err != nil || who == nil || who.Node == nil {
+			log.WithField("client", addr).Debugf("Forward auth: not a tailnet peer: %v", err)
+			http.Error(w, "not a tailnet peer", http.StatusUnauthorized)
+			return
+		}
+
+		if opts.GrantCapability != "" {
+			route := req.URL.Query().Get("route")
+			if route == "" {
+				route = req.Header.Get("X-Forwarded-Host")
+			}
+			method := req.Header.Get("X-Forwarded-Method")
+			if method == "" {
+				method = req.Header.Get("X-Original-Method")
+			}
+			if method == "" {
+				method = http.MethodGet
+			}
+			if !grantAllows(who, opts.GrantCapability, route, method) {
+				http.Error(w, "not granted by the tailnet policy", http.StatusForbidden)
+				return
+			}
+		}
+
+		for k, v := range IdentityHeaders(who) {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// forwardedClient returns the original client's IP as forwarded by the
+// calling proxy.
+func forwardedClient(req *http.Request) string {
+	if ip := strings.TrimSpace(req.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	xff := req.Header.Values("X-Forwarded-For")
+	if len(xff) == 0 {
+		return ""
+	}
+	last := xff[len(xff)-1]
+	if i := strings.LastIndex(last, ","); i >= 0 {
+		last = last[i+1:]
+	}
+	last = strings.TrimSpace(last)
+	if host, _, err := net.SplitHostPort(last); err == nil {
+		return host
+	}
+	return last
+}
@@ -0,0 +1,45 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ForwardedFor takes the client address of requests from the last
+// X-Forwarded-For entry, which the proxy in front of next set, such as
+// tailscale funnel forwarding to local_addr. The entry is removed, as the
+// backend's X-Forwarded-For gets the address again from the new
+// RemoteAddr. Like PROXY protocol addresses, it's the proxy's word, so it's
+// never used for a Tailscale identity.
+func ForwardedFor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(WithoutIdentity(r.Context()))
+		xff := r.Header.Values("X-Forwarded-For")
+		if len(xff) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rest, last := "", xff[len(xff)-1]
+		if i := strings.LastIndex(last, ","); i >= 0 {
+			rest, last = strings.TrimSpace(last[:i]), last[i+1:]
+		}
+		addr, err := netip.ParseAddr(strings.TrimSpace(last))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, port, _ := net.SplitHostPort(r.RemoteAddr)
+		r.RemoteAddr = net.JoinHostPort(addr.Unmap().String(), port)
+		r.Header = r.Header.Clone()
+		r.Header.Del("X-Forwarded-For")
+		for _, v := range xff[:len(xff)-1] {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if rest != "" {
+			r.Header.Add("X-Forwarded-For", rest)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
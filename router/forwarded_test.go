@@ -0,0 +1,83 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+func TestForwardedForFiltersOnClientAddress(t *testing.T) {
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+	}))
+	defer be.Close()
+	h, err := New([]models.Route{{
+		Name:      "public",
+		Path:      "/",
+		Target:    be.URL,
+		PublicIPs: models.IPFilter{Allow: []string{"203.0.113.0/24"}, Deny: []string{"203.0.113.66"}},
+	}}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As local_addr is served behind tailscale funnel: every connection
+	// comes from loopback, with the client in X-Forwarded-For.
+	srv := httptest.NewServer(ForwardedFor(h))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		xff  []string
+		want int
+	}{
+		{[]string{"203.0.113.5"}, http.StatusOK},
+		{[]string{"203.0.113.66"}, http.StatusForbidden},
+		{[]string{"198.51.100.1"}, http.StatusForbidden},
+		// Only the entry the proxy added counts, not the client's own.
+		{[]string{"203.0.113.5, 198.51.100.1"}, http.StatusForbidden},
+		{[]string{"198.51.100.1", "203.0.113.5"}, http.StatusOK},
+		{nil, http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		for _, v := range tc.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("X-Forwarded-For %q: status %d, want %d", tc.xff, resp.StatusCode, tc.want)
+		}
+		if tc.want == http.StatusOK {
+			if got, want := resp.Header.Get("X-Seen-Forwarded-For"), "203.0.113.5"; got != want && got != "198.51.100.1, "+want {
+				t.Errorf("X-Forwarded-For %q: backend got X-Forwarded-For %q", tc.xff, got)
+			}
+		}
+	}
+}
+
+func TestForwardedForLooksUpClientCountry(t *testing.T) {
+	countries := map[string]string{"203.0.113.5": "DE", "198.51.100.1": "US"}
+	lookup := func(addr netip.Addr) string { return countries[addr.String()] }
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h, err := publicIPFiltered(models.Route{Name: "public", PublicIPs: models.IPFilter{AllowCountries: []string{"DE"}}}, lookup, ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = ForwardedFor(h)
+
+	for xff, want := range map[string]int{"203.0.113.5": http.StatusOK, "198.51.100.1": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "127.0.0.1:40000"
+		req.Header.Set("X-Forwarded-For", xff)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("X-Forwarded-For %s: status %d, want %d", xff, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package router
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Grant is the value of a tsrouter app capability in the tailnet policy
+// file, e.g.
+//
+//	"grants": [{
+//		"src": ["group:eng"],
+//		"dst": ["tag:tsrouter"],
+//		"app": {"github.com/whitehawk2/tsrouter": [{"routes": ["grafana"], "methods": ["GET"]}]}
+//	}]
+//
+// Routes lists route names, or "*" for all of them; empty Methods allows
+// every method.
+type Grant struct {
+	Routes  []string `json:"routes"`
+	Methods []string `json:"methods"`
+}
+
+// allows reports whether g lets method through to route.
+func (g Grant) allows(route, method string) bool {
+	if !slices.Contains(g.Routes, "*") && !slices.Contains(g.Routes, route) {
+		return false
+	}
+	return len(g.Methods) == 0 || slices.ContainsFunc(g.Methods, func(m string) bool {
+		return m == "*" || strings.EqualFold(m, method)
+	})
+}
+
+// granted lets a request through only if one of the grants the tailnet
+// policy gives its caller for capability allows it. Requests without a
+// Tailscale identity are refused.
+func granted(r models.Route, capability tailcfg.PeerCapability, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		who := IdentityFromContext(req.Context())
+		if who == nil {
+			http.Error(w, "Forbidden: no Tailscale identity", http.StatusForbidden)
+			return
+		}
+		if !grantAllows(who, capability, r.Name, req.Method) {
+			http.Error(w, "Forbidden: not granted by the tailnet policy", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// grantAllows reports whether one of who's grants for capability lets
+// method through to route.
+func grantAllows(who *apitype.WhoIsResponse, capability tailcfg.PeerCapability, route, method string) bool {
+	grants, err := tailcfg.UnmarshalCapJSON[Grant](who.CapMap, capability)
+	if err != nil {
+		log.WithField("route", route).Warnf("Invalid %s grant in the tailnet policy: %v", capability, err)
+	}
+	return slices.ContainsFunc(grants, func(g Grant) bool { return g.allows(route, method) })
+}
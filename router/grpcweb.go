@@ -0,0 +1,141 @@
+package router
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	grpcWebType     = "application/grpc-web"
+	grpcWebTextType = "application/grpc-web-text"
+	grpcTrailerFlag = 0x80
+)
+
+// grpcWeb translates gRPC-Web requests from browsers into native gRPC for
+// next, and the responses back, moving the gRPC trailers into the body as
+// gRPC-Web expects. Other requests pass through unchanged.
+func grpcWeb(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ct := r.Header.Get("Content-Type")
+		if !strings.HasPrefix(ct, grpcWebType) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		text := strings.HasPrefix(ct, grpcWebTextType)
+		suffix := strings.TrimPrefix(strings.TrimPrefix(ct, grpcWebTextType), grpcWebType)
+		r.Header.Set("Content-Type", "application/grpc"+suffix)
+		r.Header.Set("TE", "trailers")
+		r.Header.Del("X-Grpc-Web")
+		if text {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{base64.NewDecoder(base64.StdEncoding, r.Body), r.Body}
+			r.ContentLength = -1
+			r.Header.Del("Content-Length")
+		}
+
+		gw := &grpcWebWriter{ResponseWriter: w, text: text, header: http.Header{}}
+		if text {
+			gw.contentType = grpcWebTextType + suffix
+		} else {
+			gw.contentType = grpcWebType + suffix
+		}
+		next.ServeHTTP(gw, r)
+		gw.finish()
+	})
+}
+
+// grpcWebWriter buffers the backend's header so the keys set after the
+// status line (the trailers) can be told apart and written as a trailer
+// frame at the end of the body.
+type grpcWebWriter struct {
+	http.ResponseWriter
+	text        bool
+	contentType string
+	header      http.Header
+	sent        map[string]bool // header keys at WriteHeader time
+}
+
+func (w *grpcWebWriter) Header() http.Header { return w.header }
+
+func (w *grpcWebWriter) WriteHeader(code int) {
+	if w.sent != nil {
+		return
+	}
+	w.sent = map[string]bool{}
+	announced := w.header.Values("Trailer")
+	out := w.ResponseWriter.Header()
+	for k, v := range w.header {
+		w.sent[k] = true
+		if k == "Trailer" || k == "Content-Length" {
+			continue
+		}
+		out[k] = v
+	}
+	out.Set("Content-Type", w.contentType)
+	// Browsers can only read the headers CORS exposes.
+	out.Set("Access-Control-Expose-Headers", "grpc-status, grpc-message")
+	for _, t := range announced {
+		for _, k := range strings.Split(t, ",") {
+			delete(w.sent, http.CanonicalHeaderKey(strings.TrimSpace(k)))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *grpcWebWriter) Write(p []byte) (int, error) {
+	if w.sent == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.text {
+		if _, err := io.WriteString(w.ResponseWriter, base64.StdEncoding.EncodeToString(p)); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *grpcWebWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *grpcWebWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// finish writes the trailers the backend sent after the body as a
+// length-prefixed gRPC-Web trailer frame.
+func (w *grpcWebWriter) finish() {
+	if w.sent == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	var keys []string
+	for k := range w.header {
+		if !w.sent[k] && k != "Trailer" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	slices.Sort(keys)
+
+	var trailers bytes.Buffer
+	for _, k := range keys {
+		name := strings.ToLower(strings.TrimPrefix(k, http.TrailerPrefix))
+		for _, v := range w.header[k] {
+			fmt.Fprintf(&trailers, "%s: %s\r\n", name, v)
+		}
+	}
+	frame := make([]byte, 5, 5+trailers.Len())
+	frame[0] = grpcTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(trailers.Len()))
+	w.Write(append(frame, trailers.Bytes()...))
+}
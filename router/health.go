@@ -0,0 +1,195 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/events"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+const healthDialTimeout = 5 * time.Second
+
+// Health tracks whether each route's backend accepts connections, and
+// publishes an event whenever one goes down or comes back.
+type Health struct {
+	bus *events.Bus
+
+	mu      sync.RWMutex
+	targets map[string]target // route name -> address to dial
+	healthy map[string]bool
+	checked bool
+}
+
+// NewHealth tracks the backends of routes. via_tailnet targets are probed
+// with tailnetDial; on_demand backends, which are down while idle, aren't
+// probed.
+func NewHealth(routes []models.Route, bus *events.Bus, tailnetDial DialFunc) *Health {
+	h := &Health{
+		bus:     bus,
+		targets: map[string]target{},
+		healthy: map[string]bool{},
+	}
+	for _, r := range routes {
+		if len(r.OnDemand.Command) > 0 {
+			continue
+		}
+		if network, addr, err := TargetAddr(r); err == nil {
+			t := target{network: network, addr: addr}
+			if r.ViaTailnet {
+				t.dial = tailnetDial
+			}
+			h.targets[r.Name] = t
+			h.healthy[r.Name] = true
+		}
+	}
+	return h
+}
+
+type target struct {
+	network, addr string
+	dial          DialFunc
+}
+
+// TargetAddr returns the network ("tcp" or "unix") and address to dial for
+// a route's target.
+func TargetAddr(r models.Route) (network, addr string, err error) {
+	if r.Protocol == "tcp" {
+		return "tcp", r.Target, nil
+	}
+	u, err := url.Parse(r.Target)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme == "fastcgi+unix" {
+		return "unix", u.Path, nil
+	}
+	if u.Port() != "" {
+		return "tcp", u.Host, nil
+	}
+	switch u.Scheme {
+	case "http":
+		return "tcp", net.JoinHostPort(u.Hostname(), "80"), nil
+	case "https":
+		return "tcp", net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+	return "", "", fmt.Errorf("no port for scheme %q", u.Scheme)
+}
+
+// Run checks every backend each interval until ctx is done.
+func (h *Health) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		h.CheckAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Retarget probes r's target for its route from now on, after its
+// backend was switched.
+func (h *Health) Retarget(r models.Route) {
+	network, addr, err := TargetAddr(r)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t, ok := h.targets[r.Name]; ok {
+		t.network, t.addr = network, addr
+		h.targets[r.Name] = t
+	}
+}
+
+// CheckAll probes every backend once.
+func (h *Health) CheckAll(ctx context.Context) {
+	h.mu.RLock()
+	targets := make(map[string]target, len(h.targets))
+	for name, t := range h.targets {
+		targets[name] = t
+	}
+	h.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for name, t := range targets {
+		wg.Add(1)
+		go func(name string, t target) {
+			defer wg.Done()
+			h.check(ctx, name, t)
+		}(name, t)
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	h.checked = true
+	h.mu.Unlock()
+}
+
+func (h *Health) check(ctx context.Context, name string, t target) {
+	ctx, cancel := context.WithTimeout(ctx, healthDialTimeout)
+	defer cancel()
+
+	addr, dial := t.addr, t.dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	conn, err := dial(ctx, t.network, addr)
+	if err == nil {
+		conn.Close()
+	}
+	ok := err == nil
+
+	h.mu.Lock()
+	was := h.healthy[name]
+	h.healthy[name] = ok
+	h.mu.Unlock()
+
+	switch {
+	case was && !ok:
+		h.bus.Publish(events.Event{
+			Type:    events.BackendUnhealthy,
+			Route:   name,
+			Message: fmt.Sprintf("Backend %s for route %s is unreachable: %v", addr, name, err),
+			Fields:  map[string]string{"target": addr, "error": err.Error()},
+		})
+	case !was && ok:
+		h.bus.Publish(events.Event{
+			Type:    events.BackendRecovered,
+			Route:   name,
+			Message: fmt.Sprintf("Backend %s for route %s is reachable again", addr, name),
+			Fields:  map[string]string{"target": addr},
+		})
+	}
+}
+
+// Healthy reports whether a route's backend passed its last check.
+func (h *Health) Healthy(route string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.healthy[route]
+}
+
+// AllHealthy reports whether every backend has been checked at least once
+// and passed its last check.
+func (h *Health) AllHealthy() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.checked {
+		return false
+	}
+	for _, ok := range h.healthy {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
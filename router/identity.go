@@ -0,0 +1,19 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/whitehawk2/tsrouter/identity"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// withIdentityHeaders sets the route's identity_headers on requests from
+// the caller's identity, replacing any the client sent.
+func withIdentityHeaders(r models.Route, headers *identity.Headers, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := headers.Apply(req, IdentityFromContext(req.Context())); err != nil {
+			routeLog(r).Debug(err)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/firewall"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// publicIPFiltered limits requests without a Tailscale identity to the
+// route's public_ips: callers in a deny list are refused, and with an allow
+// list set only callers in one get through. Country lists are checked with
+// the country func, a GeoIP lookup. The client address is RemoteAddr, the
+// forwarded one behind ForwardedFor or a PROXY protocol listener. Tailnet
+// callers aren't affected.
+func publicIPFiltered(r models.Route, country func(netip.Addr) string, next http.Handler) (http.Handler, error) {
+	allow, err := firewall.ParsePrefixes(r.PublicIPs.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := firewall.ParsePrefixes(r.PublicIPs.Deny)
+	if err != nil {
+		return nil, err
+	}
+	countries := len(r.PublicIPs.AllowCountries) > 0 || len(r.PublicIPs.DenyCountries) > 0
+	if countries && country == nil {
+		return nil, errors.New("country lists need geoip_db")
+	}
+	contains := func(list []netip.Prefix, addr netip.Addr) bool {
+		for _, p := range list {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	inCountries := func(list []string, country string) bool {
+		return country != "" && slices.ContainsFunc(list, func(c string) bool { return strings.EqualFold(c, country) })
+	}
+	hasAllow := len(allow) > 0 || len(r.PublicIPs.AllowCountries) > 0
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if IdentityFromContext(req.Context()) != nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		addr, err := netip.ParseAddr(host)
+		addr = addr.Unmap()
+		var cc string
+		if err == nil && countries {
+			cc = country(addr)
+		}
+		denied := err != nil || contains(deny, addr) || inCountries(r.PublicIPs.DenyCountries, cc)
+		if !denied && hasAllow {
+			denied = !contains(allow, addr) && !inCountries(r.PublicIPs.AllowCountries, cc)
+		}
+		if denied {
+			routeLog(r).WithFields(log.Fields{"remote_addr": req.RemoteAddr, "country": cc}).Debug("Denied by public_ips")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	}), nil
+}
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// rewriteLocations makes proxy turn redirects to the backend's own address,
+// such as http://localhost:3000/login, or to the host the client asked for
+// but with another scheme or port, into root-relative ones, which clients
+// resolve against the URL they used.
+func rewriteLocations(proxy *httputil.ReverseProxy, target *url.URL) {
+	modifyResponse(proxy, func(resp *http.Response) error {
+		if resp.StatusCode < 300 || resp.StatusCode > 399 {
+			return nil
+		}
+		loc, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || (loc.Scheme != "http" && loc.Scheme != "https") ||
+			(!sameBackend(loc, target) && !strings.EqualFold(loc.Hostname(), hostname(resp.Request.Host))) {
+			return nil
+		}
+		rel := &url.URL{Path: loc.Path, RawPath: loc.RawPath, RawQuery: loc.RawQuery, Fragment: loc.Fragment}
+		if rel.Path == "" {
+			rel.Path = "/"
+		}
+		resp.Header.Set("Location", rel.String())
+		return nil
+	})
+}
+
+// sameBackend reports whether u points at target, treating the loopback
+// names as one host.
+func sameBackend(u, target *url.URL) bool {
+	if strings.EqualFold(u.Host, target.Host) {
+		return true
+	}
+	return isLoopback(u.Hostname()) && isLoopback(target.Hostname()) && port(u) == port(target)
+}
+
+// hostname returns host without its port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func port(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,229 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+const (
+	defaultStartTimeout = 30 * time.Second
+	stopTimeout         = 10 * time.Second // before an interrupted backend is killed
+	startPollInterval   = 100 * time.Millisecond
+)
+
+// Processes runs the backends of on_demand routes. Close stops them all.
+// The zero value is ready to use.
+type Processes struct {
+	mu    sync.Mutex
+	procs []*process
+}
+
+// Close stops every running backend and waits for them to exit.
+func (ps *Processes) Close() {
+	ps.mu.Lock()
+	procs := ps.procs
+	ps.mu.Unlock()
+	for _, p := range procs {
+		p.stop("tsrouter is shutting down", false)
+	}
+}
+
+// onDemand wraps next so that the route's backend is started before the
+// first request is forwarded, and stopped after its idle timeout.
+func (ps *Processes) onDemand(r models.Route, dial DialFunc, next http.Handler) (http.Handler, error) {
+	network, addr, err := TargetAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	p := &process{route: r, network: network, addr: addr, dial: dial}
+	if ps != nil {
+		ps.mu.Lock()
+		ps.procs = append(ps.procs, p)
+		ps.mu.Unlock()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := p.acquire(req.Context()); err != nil {
+			if req.Context().Err() != nil {
+				w.WriteHeader(statusClientClosed)
+				return
+			}
+			routeLog(r).Warnf("Backend failed to start: %v", err)
+			http.Error(w, "backend failed to start", http.StatusServiceUnavailable)
+			return
+		}
+		defer p.release()
+		next.ServeHTTP(w, req)
+	}), nil
+}
+
+// process is one on-demand backend. It's running while cmd is set, and
+// ready (or failed to start, with startErr) once ready is closed.
+type process struct {
+	route         models.Route
+	network, addr string
+	dial          DialFunc
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	cancel   context.CancelFunc
+	exited   chan struct{}
+	ready    chan struct{}
+	startErr error
+	inflight int
+	idle     *time.Timer
+}
+
+func (p *process) entry() *log.Entry {
+	return routeLog(p.route)
+}
+
+// acquire starts the backend if needed and waits for it to accept
+// connections. Every successful acquire must be followed by release.
+func (p *process) acquire(ctx context.Context) error {
+	p.mu.Lock()
+	if p.cmd == nil {
+		p.start()
+	}
+	ready := p.ready
+	p.inflight++
+	if p.idle != nil {
+		p.idle.Stop()
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		p.release()
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	err := p.startErr
+	p.mu.Unlock()
+	if err != nil {
+		p.release()
+	}
+	return err
+}
+
+func (p *process) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inflight--
+	if timeout := p.route.OnDemand.IdleTimeout; p.inflight == 0 && timeout > 0 && p.cmd != nil {
+		p.idle = time.AfterFunc(timeout, func() {
+			p.stop(fmt.Sprintf("no requests for %s", timeout), true)
+		})
+	}
+}
+
+// start runs the command and waits in the background for it to listen.
+// p.mu must be held.
+func (p *process) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	args := p.route.OnDemand.Command
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = stopTimeout
+
+	ready := make(chan struct{})
+	exited := make(chan struct{})
+	p.cmd, p.cancel, p.ready, p.exited, p.startErr = cmd, cancel, ready, exited, nil
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		p.cmd, p.startErr = nil, errdefs.Wrap(errdefs.ErrBackend, err)
+		close(ready)
+		close(exited)
+		return
+	}
+	p.entry().WithField("pid", cmd.Process.Pid).Info("Started backend")
+
+	go func() {
+		err := cmd.Wait()
+		p.mu.Lock()
+		if p.cmd == cmd {
+			p.cmd = nil
+		}
+		p.mu.Unlock()
+		close(exited)
+		if ctx.Err() == nil {
+			p.entry().Warnf("Backend exited: %v", err)
+		}
+	}()
+	go func() {
+		err := p.waitListening(ctx, exited)
+		p.mu.Lock()
+		p.startErr = errdefs.Wrap(errdefs.ErrBackend, err)
+		p.mu.Unlock()
+		close(ready)
+		if err != nil {
+			p.stop("it failed to start", false)
+		}
+	}()
+}
+
+// waitListening polls the target until it accepts a connection.
+func (p *process) waitListening(ctx context.Context, exited <-chan struct{}) error {
+	timeout := p.route.OnDemand.StartTimeout
+	if timeout <= 0 {
+		timeout = defaultStartTimeout
+	}
+	deadline := time.After(timeout)
+	for {
+		dctx, cancel := context.WithTimeout(ctx, startPollInterval*5)
+		conn, err := p.dial(dctx, p.network, p.addr)
+		cancel()
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-exited:
+			return errors.New("backend exited before listening")
+		case <-deadline:
+			return fmt.Errorf("backend not listening on %s after %s", p.addr, timeout)
+		case <-time.After(startPollInterval):
+		}
+	}
+}
+
+// stop interrupts the backend, kills it if it hasn't exited after
+// stopTimeout, and waits for it. With ifIdle, a backend that got a request
+// in the meantime is left running.
+func (p *process) stop(reason string, ifIdle bool) {
+	p.mu.Lock()
+	if ifIdle && p.inflight > 0 {
+		p.mu.Unlock()
+		return
+	}
+	cmd, cancel, exited := p.cmd, p.cancel, p.exited
+	p.cmd = nil
+	if p.idle != nil {
+		p.idle.Stop()
+	}
+	p.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+	p.entry().Infof("Stopping backend, %s", reason)
+	cancel()
+	<-exited
+}
@@ -0,0 +1,66 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// postureChecked passes requests to next only from nodes meeting the
+// route's posture, and answers the rest with a 403 and the denied page.
+func postureChecked(r models.Route, next http.Handler) (http.Handler, error) {
+	var page []byte
+	if r.Posture.DeniedPage != "" {
+		var err error
+		if page, err = os.ReadFile(r.Posture.DeniedPage); err != nil {
+			return nil, fmt.Errorf("failed to read denied page: %v", err)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reason := postureProblem(r.Posture, IdentityFromContext(req.Context()))
+		if reason == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		routeLog(r).WithFields(log.Fields{"remote_addr": req.RemoteAddr}).Debugf("Denied by posture check: %s", reason)
+
+		w.Header().Set("Cache-Control", "no-store")
+		if page != nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write(page)
+			return
+		}
+		http.Error(w, "Forbidden: "+reason, http.StatusForbidden)
+	}), nil
+}
+
+// postureProblem returns why the caller's node doesn't meet p, or "" if it
+// does.
+func postureProblem(p models.Posture, who *apitype.WhoIsResponse) string {
+	if who == nil || who.Node == nil {
+		return "no Tailscale identity"
+	}
+	n := who.Node
+	if p.RejectExpired && (n.Expired || !n.KeyExpiry.IsZero() && n.KeyExpiry.Before(time.Now())) {
+		return "node key expired"
+	}
+	var missing []string
+	for _, tag := range p.RequireTags {
+		if !slices.Contains(n.Tags, tag) {
+			missing = append(missing, tag)
+		}
+	}
+	if len(missing) > 0 {
+		return "node lacks " + strings.Join(missing, ", ")
+	}
+	return ""
+}
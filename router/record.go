@@ -0,0 +1,192 @@
+package router
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Record describes one completed request.
+type Record struct {
+	Time       time.Time
+	Route      string
+	Method     string
+	Host       string
+	Path       string
+	Query      string
+	Proto      string
+	Status     int
+	BytesIn    int64
+	BytesOut   int64
+	Duration   time.Duration
+	RemoteAddr string
+	User       string // Tailscale login name, empty if unknown
+	Node       string // Tailscale node name, empty if unknown
+	UserAgent  string
+	Referer    string
+	Aborted    bool // the client went away before the response was complete
+	Timing     Timing
+	Slow       bool // took longer than the route's slow_request_threshold
+}
+
+// Recorder consumes request records. It's called on the request path, so
+// implementations should return quickly.
+type Recorder interface {
+	Record(rec *Record)
+}
+
+// Recorders fans a record out to several recorders.
+type Recorders []Recorder
+
+func (rs Recorders) Record(rec *Record) {
+	for _, r := range rs {
+		r.Record(rec)
+	}
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the Tailscale identity of the request's peer,
+// or nil if it's unknown (e.g. Funnel traffic).
+func IdentityFromContext(ctx context.Context) *apitype.WhoIsResponse {
+	who, _ := ctx.Value(identityKey{}).(*apitype.WhoIsResponse)
+	return who
+}
+
+type noIdentityKey struct{}
+
+// WithoutIdentity marks ctx, a connection's, as one whose requests get no
+// Tailscale identity, even from a tailnet address. That's for addresses
+// the client claims, as in a PROXY protocol header.
+func WithoutIdentity(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noIdentityKey{}, true)
+}
+
+// instrument resolves the caller's identity, then measures the request and
+// hands the result to the recorder.
+func instrument(route models.Route, opts Options, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		tm := &timing{}
+
+		var who *apitype.WhoIsResponse
+		if opts.WhoIs != nil && r.Context().Value(noIdentityKey{}) == nil {
+			var err error
+			if who, err = opts.WhoIs(r.Context(), r.RemoteAddr); err != nil {
+				log.WithField("remote_addr", r.RemoteAddr).Debugf("WhoIs failed: %v", err)
+			}
+		}
+		whoIs := time.Since(start)
+		ctx := tm.withTrace(r.Context())
+		if who != nil {
+			ctx = context.WithValue(ctx, identityKey{}, who)
+		}
+		r = r.WithContext(ctx)
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r)
+
+		duration := time.Since(start)
+		t := tm.get()
+		t.WhoIs = whoIs
+		slow := route.SlowRequestThreshold > 0 && duration > route.SlowRequestThreshold
+		if t.Backend {
+			logTiming(route, r, t)
+		}
+		if slow {
+			logSlow(route, r, sw.status(), duration, t)
+		}
+		if opts.Recorder == nil {
+			return
+		}
+		rec := &Record{
+			Time:       start,
+			Route:      route.Name,
+			Method:     r.Method,
+			Host:       r.Host,
+			Path:       r.URL.Path,
+			Query:      r.URL.RawQuery,
+			Proto:      r.Proto,
+			Status:     sw.status(),
+			BytesIn:    body.n,
+			BytesOut:   sw.bytes,
+			Duration:   duration,
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+			Referer:    r.Referer(),
+			Aborted:    r.Context().Err() != nil,
+			Timing:     t,
+			Slow:       slow,
+		}
+		if who != nil {
+			if who.UserProfile != nil {
+				rec.User = who.UserProfile.LoginName
+			}
+			if who.Node != nil {
+				rec.Node = who.Node.ComputedName
+			}
+		}
+		opts.Recorder.Record(rec)
+	})
+}
+
+// statusWriter captures the response status and size. It exposes the
+// wrapped writer through Unwrap so http.ResponseController (and with it
+// flushing and hijacking for WebSockets) keeps working.
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// defaultRewriteTypes and defaultRewriteMaxBytes apply when a route's
+// rewrite_body leaves them out.
+var defaultRewriteTypes = []string{"text/html", "application/json"}
+
+const defaultRewriteMaxBytes = 10 << 20
+
+// rewriteBodies makes proxy replace strings in response bodies as they
+// stream to the client, per the route's rewrite_body.
+func rewriteBodies(proxy *httputil.ReverseProxy, rw models.RewriteBody) {
+	types := rw.ContentTypes
+	if len(types) == 0 {
+		types = defaultRewriteTypes
+	}
+	limit := rw.MaxBytes
+	if limit <= 0 {
+		limit = defaultRewriteMaxBytes
+	}
+	var finds, withs []string
+	for _, r := range rw.Replace {
+		finds = append(finds, r.Find)
+		withs = append(withs, r.With)
+	}
+	replaceInBodies(proxy, types, limit, finds, withs)
+}
+
+// replaceInBodies makes proxy replace finds[i] with withs[i] in the first
+// limit bytes of responses of the given types; where several match at the
+// same place, the first wins. Requests are sent without Accept-Encoding,
+// so backends answer uncompressed; responses that are compressed anyway,
+// of other types or declared larger than the limit are passed on
+// unchanged. Calls for the same proxy apply one after the other.
+func replaceInBodies(proxy *httputil.ReverseProxy, types []string, limit int64, finds, withs []string) {
+	rw := &bodyRewriter{limit: limit}
+	for i := range finds {
+		rw.finds = append(rw.finds, []byte(finds[i]))
+		rw.withs = append(rw.withs, []byte(withs[i]))
+		rw.keep = max(rw.keep, len(finds[i])-1)
+	}
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Del("Accept-Encoding")
+	}
+	modifyResponse(proxy, func(resp *http.Response) error {
+		if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+			resp.StatusCode == http.StatusNotModified || resp.ContentLength > limit {
+			return nil
+		}
+		if ce := resp.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+			return nil
+		}
+		if !matchesType(resp.Header.Get("Content-Type"), types) {
+			return nil
+		}
+		b := *rw
+		b.src, b.chunk = resp.Body, make([]byte, 32<<10)
+		resp.Body = &b
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			resp.Header.Set("ETag", "W/"+etag)
+		}
+		return nil
+	})
+}
+
+// modifyResponse adds f to the proxy's ModifyResponse, after any already
+// set.
+func modifyResponse(proxy *httputil.ReverseProxy, f func(*http.Response) error) {
+	prev := proxy.ModifyResponse
+	if prev == nil {
+		proxy.ModifyResponse = f
+		return
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if err := prev(resp); err != nil {
+			return err
+		}
+		return f(resp)
+	}
+}
+
+// matchesType reports whether the media type of contentType is one of
+// types, which may end in /* to match a whole family.
+func matchesType(contentType string, types []string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mt || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyRewriter replaces finds with withs in the first limit bytes of src.
+// It holds back the last keep bytes of what it has read, so matches split
+// across reads are still found; the rest of the body is passed through.
+type bodyRewriter struct {
+	src          io.ReadCloser
+	finds, withs [][]byte
+	keep         int
+	limit        int64 // bytes left to rewrite
+
+	chunk []byte
+	in    []byte // read but not rewritten yet
+	out   []byte // rewritten but not returned yet
+	err   error
+}
+
+func (b *bodyRewriter) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.limit <= 0 {
+			return b.src.Read(p)
+		}
+		n, err := b.src.Read(b.chunk)
+		b.limit -= int64(n)
+		b.in = append(b.in, b.chunk[:n]...)
+		b.err = err
+		b.rewrite(err != nil || b.limit <= 0)
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+// rewrite moves b.in to b.out, replacing matches that start before the
+// held-back tail, or anywhere if final.
+func (b *bodyRewriter) rewrite(final bool) {
+	cut := len(b.in)
+	if !final {
+		cut -= b.keep
+	}
+	i := 0
+	for i < cut {
+		at, which := -1, 0
+		for j, f := range b.finds {
+			if k := bytes.Index(b.in[i:], f); k >= 0 && (at < 0 || k < at) {
+				at, which = k, j
+			}
+		}
+		if at < 0 || i+at >= cut {
+			b.out = append(b.out, b.in[i:cut]...)
+			i = cut
+			break
+		}
+		b.out = append(b.out, b.in[i:i+at]...)
+		b.out = append(b.out, b.withs[which]...)
+		i += at + len(b.finds[which])
+	}
+	b.in = append(b.in[:0], b.in[i:]...)
+}
+
+func (b *bodyRewriter) Close() error {
+	return b.src.Close()
+}
@@ -0,0 +1,41 @@
+package router
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// levelLoggers holds a logger per route log level, sharing the standard
+// logger's output, formatter and hooks.
+var levelLoggers sync.Map // log.Level -> *log.Logger
+
+// routeLog returns an entry for the route's log lines. A route with its own
+// log.level logs at that level, whatever the global one is.
+func routeLog(r models.Route) *log.Entry {
+	level, err := log.ParseLevel(strings.ToLower(r.Log.Level))
+	if r.Log.Level == "" || err != nil {
+		return log.WithField("route", r.Name)
+	}
+	if l, ok := levelLoggers.Load(level); ok {
+		return l.(*log.Logger).WithField("route", r.Name)
+	}
+	std := log.StandardLogger()
+	l, _ := levelLoggers.LoadOrStore(level, &log.Logger{
+		Out:          stdOut{},
+		Formatter:    std.Formatter,
+		Hooks:        std.Hooks,
+		Level:        level,
+		ExitFunc:     std.ExitFunc,
+		ReportCaller: std.ReportCaller,
+	})
+	return l.(*log.Logger).WithField("route", r.Name)
+}
+
+// stdOut writes to wherever the standard logger currently does, so route
+// loggers follow log_file.
+type stdOut struct{}
+
+func (stdOut) Write(p []byte) (int, error) { return log.StandardLogger().Out.Write(p) }
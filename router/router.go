@@ -0,0 +1,270 @@
+// Package router builds the HTTP handler that serves a node's routes.
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/audit"
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"github.com/whitehawk2/tsrouter/fastcgi"
+	"github.com/whitehawk2/tsrouter/geoip"
+	"github.com/whitehawk2/tsrouter/identity"
+	"github.com/whitehawk2/tsrouter/mock"
+	"github.com/whitehawk2/tsrouter/models"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Options carries the dependencies the router needs from the node.
+type Options struct {
+	// WhoIs resolves the Tailscale identity behind a remote address. It may
+	// be nil, in which case requests carry no identity.
+	WhoIs func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+	// Recorder receives a Record for every completed request. It may be nil.
+	Recorder Recorder
+
+	// Capture, when set, keeps recent requests and responses for debugging.
+	Capture *Capture
+
+	// Dial connects to backends; nil uses a plain net.Dialer.
+	Dial DialFunc
+
+	// TailnetDial connects to via_tailnet targets through the node.
+	TailnetDial DialFunc
+
+	// Processes runs the backends of on_demand routes. If nil, they're
+	// still started on demand, but not stopped on shutdown.
+	Processes *Processes
+
+	// GrantCapability, when set, limits every HTTP route to callers the
+	// tailnet policy grants it to with this app capability.
+	GrantCapability tailcfg.PeerCapability
+
+	// GeoIP looks up the countries for public_ips country lists.
+	GeoIP *geoip.DB
+
+	// Bans, when set, turns away banned clients on every route. It must
+	// also be among the recorders to count failures.
+	Bans *Bans
+
+	// Audit records sign-ins to routes with sign_in. It may be nil.
+	Audit *audit.Log
+
+	// Switches, when set, lets the routes' backends be switched while
+	// serving.
+	Switches *Switches
+
+	// ClientWriteTimeout drops clients that accept no response data for
+	// this long, and ClientMinRate those taking responses slower than
+	// this many bytes per second. Zero disables either.
+	ClientWriteTimeout time.Duration
+	ClientMinRate      int
+}
+
+// DialerFor returns the dialer for a route's backend: through the tailnet
+// for via_tailnet routes, or opts.Dial.
+func (opts Options) DialerFor(r models.Route) DialFunc {
+	if r.ViaTailnet {
+		return opts.TailnetDial
+	}
+	return opts.Dial
+}
+
+// New returns a handler dispatching requests to the route with the longest
+// matching path prefix. Its errors are of class errdefs.ErrConfig.
+func New(routes []models.Route, opts Options) (http.Handler, error) {
+	h, err := newMux(routes, opts)
+	if err != nil {
+		return nil, errdefs.Wrap(errdefs.ErrConfig, err)
+	}
+	return h, nil
+}
+
+func newMux(routes []models.Route, opts Options) (http.Handler, error) {
+	mux := http.NewServeMux()
+	for _, r := range routes {
+		target, err := url.Parse(r.Target)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: failed to parse target URL: %v", r.Name, err)
+		}
+
+		backend, err := newBackend(r, target, opts.DialerFor(r))
+		if err == nil {
+			backend = opts.Switches.wrap(r, target, opts.DialerFor(r), backend)
+		}
+		if err == nil && len(r.OnDemand.Command) > 0 {
+			backend, err = opts.Processes.onDemand(r, opts.DialerFor(r), backend)
+		}
+		if err == nil && r.WebhookRelay.Provider != "" {
+			backend, err = webhookRelay(r, backend)
+		}
+		if r.MaxRequestDuration > 0 {
+			backend = capDuration(r, backend)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %v", r.Name, err)
+		}
+		headers, err := identity.Parse(r.SSOPreset, r.IdentityHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: identity_headers: %v", r.Name, err)
+		}
+		if r.Coalesce {
+			backend = coalesce(backend, headers.Names())
+		}
+		if r.Cache.Enabled {
+			backend = newCache(backend, r.Cache, headers.Names())
+		}
+		if len(r.IdentityHeaders) > 0 || r.SSOPreset != "" {
+			backend = withIdentityHeaders(r, headers, backend)
+		}
+		if len(r.Schedule.Windows) > 0 {
+			if backend, err = scheduled(r, backend); err != nil {
+				return nil, fmt.Errorf("route %q: %v", r.Name, err)
+			}
+		}
+		if r.Posture.RejectExpired || len(r.Posture.RequireTags) > 0 {
+			if backend, err = postureChecked(r, backend); err != nil {
+				return nil, fmt.Errorf("route %q: %v", r.Name, err)
+			}
+		}
+		if r.SignIn.Enabled {
+			backend = signIn(r, opts.Audit, backend)
+		}
+		// Webhooks are authorized by their signature.
+		if opts.GrantCapability != "" && r.WebhookRelay.Provider == "" {
+			backend = granted(r, opts.GrantCapability, backend)
+		}
+		if pf := r.PublicIPs; len(pf.Allow) > 0 || len(pf.Deny) > 0 || len(pf.AllowCountries) > 0 || len(pf.DenyCountries) > 0 {
+			var country func(netip.Addr) string
+			if opts.GeoIP != nil {
+				country = opts.GeoIP.Country
+			}
+			if backend, err = publicIPFiltered(r, country, backend); err != nil {
+				return nil, fmt.Errorf("route %q: public_ips: %v", r.Name, err)
+			}
+		}
+		if len(r.Firewall.Rules) > 0 || len(r.Firewall.Signatures) > 0 {
+			if backend, err = screened(r, backend); err != nil {
+				return nil, fmt.Errorf("route %q: %v", r.Name, err)
+			}
+		}
+		if r.Strict.Enabled {
+			backend = strict(r, backend)
+		}
+		if opts.Bans != nil {
+			backend = banned(opts.Bans, backend)
+		}
+		pattern := r.Path
+		if !strings.HasSuffix(pattern, "/") {
+			pattern += "/"
+		}
+		mux.Handle(pattern, guardSlowClients(r, opts, instrument(r, opts, capture(opts.Capture, r, backend))))
+
+		routeLog(r).WithFields(log.Fields{
+			"path":   pattern,
+			"target": target.String(),
+		}).Debug("Registered route")
+	}
+	return mux, nil
+}
+
+// newBackend returns the handler forwarding a route's requests to its
+// target: a reverse proxy (translating gRPC-Web if enabled), a FastCGI
+// client for fastcgi targets, or a file or WebDAV server for file targets.
+func newBackend(r models.Route, target *url.URL, dial DialFunc) (http.Handler, error) {
+	switch target.Scheme {
+	case "file":
+		if r.WebDAV.Enabled {
+			return newWebDAV(r, target.Path), nil
+		}
+		return http.StripPrefix(staticPrefix(r.Path), static(target.Path)), nil
+	case "mock":
+		h, err := mock.New(target.Path)
+		if err != nil {
+			return nil, err
+		}
+		return http.StripPrefix(staticPrefix(r.Path), h), nil
+	case "fastcgi", "fastcgi+unix":
+		network, addr, err := TargetAddr(r)
+		if err != nil {
+			return nil, err
+		}
+		return &fastcgi.Handler{
+			Network: network,
+			Addr:    addr,
+			Root:    r.Root,
+			Index:   r.Index,
+			Params:  fastcgiParams,
+		}, nil
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var err error
+	if proxy.Transport, err = transport(r, dial); err != nil {
+		return nil, err
+	}
+	proxy.ErrorHandler = proxyError(r)
+	if !r.GRPCWeb {
+		rewriteLocations(proxy, target)
+	}
+	if len(r.RewriteBody.Replace) > 0 && !r.GRPCWeb {
+		rewriteBodies(proxy, r.RewriteBody)
+	}
+	if r.Subpath.Enabled && !r.GRPCWeb {
+		mountSubpath(proxy, r)
+	}
+	if c := r.Cookies; len(c.Domain) > 0 || len(c.Path) > 0 || c.Secure || c.SameSite != "" || r.Subpath.Enabled {
+		prefix := ""
+		if r.Subpath.Enabled {
+			prefix = staticPrefix(r.Path)
+		}
+		rewriteCookies(proxy, r.Cookies, prefix)
+	}
+	if r.GRPCWeb {
+		return grpcWeb(proxy), nil
+	}
+	return proxy, nil
+}
+
+// statusClientClosed is recorded for requests the client abandoned before
+// the backend answered, as nginx does, so they don't count as 5xx errors.
+const statusClientClosed = 499
+
+// proxyError answers a request whose backend failed. The incoming request's
+// context is passed to the backend request, so a client disconnect cancels
+// it right away; that isn't the backend's fault and is only logged at debug.
+func proxyError(route models.Route) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		entry := routeLog(route).WithFields(log.Fields{"path": req.URL.Path})
+		if tooLong(req) {
+			return // capDuration answers
+		}
+		if errors.Is(err, context.Canceled) && req.Context().Err() != nil {
+			entry.Debug("Client went away, cancelled backend request")
+			w.WriteHeader(statusClientClosed)
+			return
+		}
+		entry.Warnf("Backend request failed: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// fastcgiParams passes the caller's Tailscale login to FastCGI scripts as
+// REMOTE_USER, the CGI equivalent of the identity headers.
+func fastcgiParams(req *http.Request) map[string]string {
+	who := IdentityFromContext(req.Context())
+	if who == nil || who.UserProfile == nil {
+		return nil
+	}
+	return map[string]string{"REMOTE_USER": who.UserProfile.LoginName}
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+type recorderFunc func(*Record)
+
+func (f recorderFunc) Record(rec *Record) { f(rec) }
+
+func TestClientDisconnectCancelsBackend(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer be.Close()
+
+	records := make(chan *Record, 1)
+	h, err := New([]models.Route{{Name: "web", Path: "/", Target: be.URL}}, Options{
+		Recorder: recorderFunc(func(rec *Record) { records <- rec }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/report", nil)
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatal("request succeeded, want it cancelled")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend request wasn't cancelled")
+	}
+	select {
+	case rec := <-records:
+		if rec.Status != statusClientClosed {
+			t.Errorf("recorded status %d, want %d", rec.Status, statusClientClosed)
+		}
+		if !rec.Aborted {
+			t.Error("recorded Aborted = false, want true")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request wasn't recorded")
+	}
+	if strings.Contains(logs.String(), "Backend request failed") {
+		t.Errorf("client disconnect logged as a backend failure:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/schedule"
+)
+
+// scheduled passes requests to next only within the route's schedule, and
+// answers the rest with a 503 and the closed page.
+func scheduled(r models.Route, next http.Handler) (http.Handler, error) {
+	sched, err := schedule.Parse(r.Schedule.Windows, r.Schedule.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	var page []byte
+	if r.Schedule.ClosedPage != "" {
+		if page, err = os.ReadFile(r.Schedule.ClosedPage); err != nil {
+			return nil, fmt.Errorf("failed to read closed page: %v", err)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		if sched.Open(now) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		opens := sched.NextOpen(now)
+		if !opens.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(opens.Sub(now).Seconds())+1))
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if page != nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(page)
+			return
+		}
+		msg := "This service is closed right now."
+		if !opens.IsZero() {
+			msg = fmt.Sprintf("This service is closed right now. It opens again %s.", opens.Format("Mon 15:04 MST"))
+		}
+		http.Error(w, msg, http.StatusServiceUnavailable)
+	}), nil
+}
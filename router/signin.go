@@ -0,0 +1,174 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/audit"
+	"github.com/whitehawk2/tsrouter/models"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+const (
+	defaultSessionDuration = 12 * time.Hour
+	signInFormMaxAge       = 10 * time.Minute
+
+	// signInPath is where the sign-in form posts to, below the route's path.
+	signInPath = ".tsrouter/sign-in"
+)
+
+var cookieUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+var signInPage = template.Must(template.New("sign-in").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width">
+<title>Continue to {{.Route}}</title>
+<style>body{font-family:system-ui,sans-serif;max-width:32em;margin:4em auto;padding:0 1em;color:#222}
+dt{font-weight:600;margin-top:.6em}dd{margin:0}button{margin-top:1.5em;font-size:1em;padding:.5em 1.5em}</style>
+</head><body>
+<h1>Continue to {{.Route}}?</h1>
+<p>You're accessing this service as:</p>
+<dl>
+{{with .User}}<dt>User</dt><dd>{{.}}</dd>{{end}}
+<dt>Device</dt><dd>{{.Node}}{{with .OS}} ({{.}}){{end}}</dd>
+{{with .Tags}}<dt>Tags</dt><dd>{{.}}</dd>{{end}}
+{{with .Addresses}}<dt>Addresses</dt><dd>{{.}}</dd>{{end}}
+</dl>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="next" value="{{.Next}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Continue</button>
+</form>
+</body></html>
+`))
+
+// signIn puts an interstitial page in front of a route: callers see the
+// Tailscale identity they're using and must click continue, which is
+// audited and starts a session held in a signed cookie. Sessions are bound
+// to the caller's node and end when tsrouter restarts.
+func signIn(r models.Route, auditLog *audit.Log, next http.Handler) http.Handler {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	duration := r.SignIn.Session
+	if duration <= 0 {
+		duration = defaultSessionDuration
+	}
+	prefix := r.Path
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	cookieName := "tsrouter_session_" + cookieUnsafe.ReplaceAllString(r.Name, "_")
+	sign := func(parts ...string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(strings.Join(parts, "\n")))
+		return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	// valid checks a value of the form "<unix expiry>.<signature>" signed
+	// over purpose, the node and the expiry.
+	valid := func(value, purpose, node string) bool {
+		exp, sig, ok := strings.Cut(value, ".")
+		t, err := strconv.ParseInt(exp, 10, 64)
+		return ok && err == nil && time.Now().Unix() < t && hmac.Equal([]byte(sig), []byte(sign(purpose, node, exp)))
+	}
+	issue := func(purpose, node string, d time.Duration) string {
+		exp := strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+		return exp + "." + sign(purpose, node, exp)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		who := IdentityFromContext(req.Context())
+		if who == nil || who.Node == nil {
+			http.Error(w, "Forbidden: no Tailscale identity", http.StatusForbidden)
+			return
+		}
+		node := string(who.Node.StableID)
+		if c, err := req.Cookie(cookieName); err == nil && valid(c.Value, "session", node) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		if req.URL.Path == prefix+signInPath && req.Method == http.MethodPost {
+			dest := req.PostFormValue("next")
+			if !strings.HasPrefix(dest, "/") || strings.HasPrefix(dest, "//") || strings.HasPrefix(dest, "/\\") {
+				dest = prefix
+			}
+			if !valid(req.PostFormValue("token"), "form", node) {
+				http.Redirect(w, req, dest, http.StatusSeeOther) // show a fresh form
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieName,
+				Value:    issue("session", node, duration),
+				Path:     prefix,
+				MaxAge:   int(duration.Seconds()),
+				HttpOnly: true,
+				Secure:   req.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			recordSignIn(auditLog, r, who, duration)
+			http.Redirect(w, req, dest, http.StatusSeeOther)
+			return
+		}
+
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(w, "Forbidden: sign in first", http.StatusForbidden)
+			return
+		}
+		page := struct {
+			Route, User, Node, OS, Tags, Addresses, Action, Next, Token string
+		}{
+			Route:  r.Name,
+			Node:   who.Node.ComputedName,
+			Tags:   strings.Join(who.Node.Tags, ", "),
+			Action: prefix + signInPath,
+			Next:   req.URL.RequestURI(),
+			Token:  issue("form", node, signInFormMaxAge),
+		}
+		if who.UserProfile != nil {
+			page.User = who.UserProfile.LoginName
+			if dn := who.UserProfile.DisplayName; dn != "" && dn != page.User {
+				page.User = dn + " (" + page.User + ")"
+			}
+		}
+		if who.Node.Hostinfo.Valid() {
+			page.OS = who.Node.Hostinfo.OS()
+		}
+		var addrs []string
+		for _, a := range who.Node.Addresses {
+			addrs = append(addrs, a.Addr().String())
+		}
+		page.Addresses = strings.Join(addrs, ", ")
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := signInPage.Execute(w, page); err != nil {
+			routeLog(r).Warnf("Failed to render sign-in page: %v", err)
+		}
+	})
+}
+
+func recordSignIn(l *audit.Log, r models.Route, who *apitype.WhoIsResponse, session time.Duration) {
+	actor := who.Node.ComputedName
+	if who.UserProfile != nil {
+		actor = who.UserProfile.LoginName
+	}
+	err := l.Record(audit.Entry{
+		Actor:   actor,
+		Action:  "session.start",
+		Target:  r.Name,
+		Details: map[string]string{"node": who.Node.ComputedName, "session": session.String()},
+	})
+	if err != nil {
+		log.Warn(err)
+	}
+}
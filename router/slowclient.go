@@ -0,0 +1,105 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// slowClientGrace is how long a response may wait on its client in all
+// before the client's rate is held against opts.ClientMinRate, so a
+// congested moment doesn't get it dropped.
+const slowClientGrace = 10 * time.Second
+
+// errSlowClient fails the writes of a response whose client takes it too
+// slowly, which aborts the response and with it the backend request.
+var errSlowClient = errors.New("client too slow")
+
+// guardSlowClients drops clients that stall or take a response too slowly,
+// as opts.ClientWriteTimeout and opts.ClientMinRate say, so they don't
+// keep the backend request, and what the backend holds for it, going.
+// Only the time spent waiting on the client counts, not on the backend.
+func guardSlowClients(route models.Route, opts Options, next http.Handler) http.Handler {
+	if opts.ClientWriteTimeout <= 0 && opts.ClientMinRate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := &slowClientWriter{ResponseWriter: w, route: route, opts: opts, req: req}
+		if opts.ClientWriteTimeout > 0 {
+			// The deadline is left on keep-alive connections otherwise.
+			defer http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		}
+		next.ServeHTTP(sw, req)
+	})
+}
+
+type slowClientWriter struct {
+	http.ResponseWriter
+	route models.Route
+	opts  Options
+	req   *http.Request
+
+	bytes   int64
+	waited  time.Duration // in Write and Flush
+	dropped bool
+}
+
+func (w *slowClientWriter) Write(b []byte) (int, error) {
+	if w.dropped {
+		return 0, errSlowClient
+	}
+	start := w.deadline()
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, w.check(start, err)
+}
+
+func (w *slowClientWriter) FlushError() error {
+	if w.dropped {
+		return errSlowClient
+	}
+	start := w.deadline()
+	return w.check(start, http.NewResponseController(w.ResponseWriter).Flush())
+}
+
+func (w *slowClientWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// deadline sets the write deadline for the next write, and returns when
+// it started.
+func (w *slowClientWriter) deadline() time.Time {
+	now := time.Now()
+	if w.opts.ClientWriteTimeout > 0 {
+		http.NewResponseController(w.ResponseWriter).SetWriteDeadline(now.Add(w.opts.ClientWriteTimeout))
+	}
+	return now
+}
+
+// check accounts for a write that started at start and failed with err,
+// and reports the client stalling or falling below the minimum rate.
+func (w *slowClientWriter) check(start time.Time, err error) error {
+	took := time.Since(start)
+	w.waited += took
+	var reason string
+	switch {
+	case err != nil && w.opts.ClientWriteTimeout > 0 && took >= w.opts.ClientWriteTimeout:
+		reason = fmt.Sprintf("accepted nothing for %s", w.opts.ClientWriteTimeout)
+	case err != nil:
+		return err
+	case w.opts.ClientMinRate > 0 && w.waited >= slowClientGrace && float64(w.bytes)/w.waited.Seconds() < float64(w.opts.ClientMinRate):
+		reason = fmt.Sprintf("took %d bytes in %s, under %d bytes/s", w.bytes, w.waited.Round(time.Millisecond), w.opts.ClientMinRate)
+	default:
+		return nil
+	}
+	w.dropped = true
+	routeLog(w.route).WithFields(log.Fields{
+		"path":   w.req.URL.Path,
+		"client": w.req.RemoteAddr,
+	}).Warnf("Dropping slow client, it %s", reason)
+	return errSlowClient
+}
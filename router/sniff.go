@@ -0,0 +1,68 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+const defaultSniffTimeout = time.Second
+
+// httpPrefixes are how HTTP/1 requests and the HTTP/2 preface start, cut
+// to the bytes sniffed.
+var httpPrefixes = [][]byte{
+	[]byte("GET "), []byte("HEAD"), []byte("POST"), []byte("PUT "), []byte("DELE"),
+	[]byte("OPTI"), []byte("PATC"), []byte("CONN"), []byte("TRAC"), []byte("PRI "),
+}
+
+// sniff reads the first bytes the client sends on conn and picks the
+// target of the route's sniff settings for the protocol they start, or
+// the route's target if none matches or the client sends nothing within
+// the timeout, as with protocols where the server speaks first. It
+// returns the protocol detected and a connection that replays the bytes
+// read.
+func sniff(conn net.Conn, r models.Route) (net.Conn, string, string) {
+	timeout := r.Sniff.Timeout
+	if timeout <= 0 {
+		timeout = defaultSniffTimeout
+	}
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	head, _ := br.Peek(4)
+	conn.SetReadDeadline(time.Time{})
+	pc := &peekedConn{Conn: conn, r: br}
+
+	switch {
+	case r.Sniff.TLS != "" && len(head) >= 2 && head[0] == 0x16 && head[1] == 0x03:
+		return pc, "tls", r.Sniff.TLS
+	case r.Sniff.SSH != "" && bytes.Equal(head, []byte("SSH-")):
+		return pc, "ssh", r.Sniff.SSH
+	case r.Sniff.HTTP != "" && len(head) == 4:
+		for _, p := range httpPrefixes {
+			if bytes.Equal(head, p) {
+				return pc, "http", r.Sniff.HTTP
+			}
+		}
+	}
+	return pc, "tcp", r.Target
+}
+
+// peekedConn reads through the buffered reader that sniffed conn.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// static serves files from a local directory. Every file gets an ETag and
+// Last-Modified, so conditional requests are answered with 304 Not Modified.
+func static(root string) http.Handler {
+	files := http.FileServer(http.Dir(root))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Join(root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		fi, err := os.Stat(name)
+		if err == nil && fi.IsDir() {
+			fi, err = os.Stat(filepath.Join(name, "index.html"))
+		}
+		if err == nil {
+			w.Header().Set("Etag", etag(fi))
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// etag derives a validator from a file's modification time and size, which
+// change whenever the file is replaced, without reading its contents.
+func etag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// staticPrefix is the request path prefix stripped before looking up files,
+// so /docs/a.html on a /docs route serves a.html from the directory.
+func staticPrefix(routePath string) string {
+	return strings.TrimSuffix(routePath, "/")
+}
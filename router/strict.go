@@ -0,0 +1,96 @@
+package router
+
+import (
+	"net/http"
+	"net/textproto"
+	"path"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+const (
+	defaultMaxHeaders     = 100
+	defaultMaxHeaderBytes = 16 << 10
+)
+
+// connectionTokens are the Connection header values strict routes accept.
+// Anything else names a header to strip, which lets clients remove headers
+// tsrouter adds, such as X-Forwarded-For, before they reach the backend.
+var connectionTokens = []string{"close", "keep-alive", "upgrade", "te"}
+
+// strict rejects requests that an old backend could read differently from
+// tsrouter, and forwards the rest with a normalized path.
+//
+// Go's parser already refuses ambiguous framing (several differing or
+// invalid Content-Length headers, transfer codings other than chunked),
+// gives Transfer-Encoding precedence over Content-Length, and frames each
+// request anew for the backend; strict covers what's left to interpretation.
+func strict(r models.Route, next http.Handler) http.Handler {
+	maxHeaders := r.Strict.MaxHeaders
+	if maxHeaders <= 0 {
+		maxHeaders = defaultMaxHeaders
+	}
+	maxBytes := r.Strict.MaxHeaderBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxHeaderBytes
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		code, reason := http.StatusOK, ""
+		reject := func(c int, msg string) {
+			if reason == "" {
+				code, reason = c, msg
+			}
+		}
+
+		n, size := 0, 0
+		for name, values := range req.Header {
+			n += len(values)
+			for _, v := range values {
+				size += len(name) + len(v) + 4 // ": " and CRLF
+			}
+			if strings.Contains(name, "_") {
+				reject(http.StatusBadRequest, "header names must not contain underscores")
+			}
+		}
+		if n > maxHeaders || size > maxBytes {
+			reject(http.StatusRequestHeaderFieldsTooLarge, "too many or too large headers")
+		}
+
+		for _, v := range req.Header.Values("Connection") {
+			for _, token := range strings.Split(v, ",") {
+				token = strings.ToLower(textproto.TrimString(token))
+				if token != "" && !slices.Contains(connectionTokens, token) {
+					reject(http.StatusBadRequest, "Connection header must not name other headers")
+				}
+			}
+		}
+
+		if (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.ContentLength != 0 || len(req.TransferEncoding) > 0) {
+			reject(http.StatusBadRequest, req.Method+" requests must not have a body")
+		}
+
+		raw := strings.ToLower(req.URL.EscapedPath())
+		if strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c") || strings.ContainsAny(req.URL.Path, "\\\x00") {
+			reject(http.StatusBadRequest, "path must not contain encoded slashes, backslashes or NUL bytes")
+		}
+
+		if reason != "" {
+			routeLog(r).WithFields(log.Fields{"remote_addr": req.RemoteAddr}).Debugf("Rejected by strict checks: %s", reason)
+			http.Error(w, reason, code)
+			return
+		}
+
+		// Resolve dot segments and repeated slashes, and re-encode the path
+		// canonically, so the backend sees the path tsrouter routed on.
+		clean := path.Clean(req.URL.Path)
+		if strings.HasSuffix(req.URL.Path, "/") && clean != "/" {
+			clean += "/"
+		}
+		req.URL.Path, req.URL.RawPath = clean, ""
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// mountSubpath makes proxy serve a backend that expects to live at / under
+// the route's path: the prefix is stripped from requests and sent as
+// X-Forwarded-Prefix, redirects to root-relative URLs are moved under it,
+// and so are root-relative href, src and action attributes in HTML, with a
+// <base href> added if the route asks for one. Cookie paths are moved by
+// rewriteCookies.
+func mountSubpath(proxy *httputil.ReverseProxy, r models.Route) {
+	prefix := staticPrefix(r.Path)
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+		if req.URL.Path == "" {
+			req.URL.Path = "/"
+		}
+		if rp, ok := strings.CutPrefix(req.URL.RawPath, prefix); ok && rp != "" {
+			req.URL.RawPath = rp
+		} else {
+			req.URL.RawPath = ""
+		}
+		director(req)
+		req.Header.Set("X-Forwarded-Prefix", prefix)
+	}
+
+	modifyResponse(proxy, func(resp *http.Response) error {
+		if loc := resp.Header.Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+			resp.Header.Set("Location", prefix+loc)
+		}
+		return nil
+	})
+
+	var finds, withs []string
+	if r.Subpath.BaseHref {
+		finds = append(finds, "<head>", "<HEAD>")
+		withs = append(withs, `<head><base href="`+prefix+`/">`, `<HEAD><base href="`+prefix+`/">`)
+	}
+	for _, attr := range []string{"href", "src", "action"} {
+		for _, q := range []string{`"`, `'`} {
+			// Protocol-relative URLs are listed first so they win, and are
+			// left alone.
+			finds = append(finds, attr+"="+q+"//", attr+"="+q+"/")
+			withs = append(withs, attr+"="+q+"//", attr+"="+q+prefix+"/")
+		}
+	}
+	replaceInBodies(proxy, []string{"text/html"}, defaultRewriteMaxBytes, finds, withs)
+}
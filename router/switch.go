@@ -0,0 +1,301 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/events"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+const (
+	switchProbeTimeout  = 5 * time.Second
+	switchProbeInterval = 5 * time.Second
+
+	// switchMinRequests is how many requests the new backend must have had
+	// while watched before its error ratio counts against it.
+	switchMinRequests = 10
+)
+
+var (
+	// ErrNoRoute is returned by Switch for a route that doesn't exist or
+	// can't be switched.
+	ErrNoRoute = errors.New("no switchable route")
+	// ErrSwitching is returned by Switch while the route is being switched
+	// already.
+	ErrSwitching = errors.New("route is being switched already")
+)
+
+// Switches moves routes to another backend while they keep serving, for
+// blue/green deployments: the new backend is probed first, then requests
+// go to it, and it's watched for a while, going back to the old one if it
+// fails. Requests in flight finish on the backend they started on. Routes
+// with http and https targets can be switched, except on_demand ones.
+type Switches struct {
+	bus *events.Bus
+
+	// OnSwitch, when set, is called once a route was switched and kept its
+	// new backend.
+	OnSwitch func(route, from, to string)
+
+	mu     sync.Mutex
+	routes map[string]*switchable
+}
+
+// NewSwitches returns switches publishing BackendSwitched events on bus.
+func NewSwitches(bus *events.Bus) *Switches {
+	return &Switches{bus: bus, routes: map[string]*switchable{}}
+}
+
+// SwitchOptions tune a switch.
+type SwitchOptions struct {
+	// ProbePath is requested from the new backend before switching, and
+	// every few seconds while it's watched, and must be answered without
+	// a 5xx status. It defaults to the root of the target.
+	ProbePath string
+
+	// Watch is how long the new backend is watched after the switch.
+	// It's rolled back if a probe fails or most of its requests fail
+	// within that time. Zero doesn't watch.
+	Watch time.Duration
+}
+
+// SwitchResult is the outcome of a switch.
+type SwitchResult struct {
+	Route      string `json:"route"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Switched   bool   `json:"switched"`    // To serves the route now
+	RolledBack bool   `json:"rolled_back"` // it did, until it failed while watched
+	Error      string `json:"error,omitempty"`
+	Requests   int64  `json:"requests"` // served by To while watched
+	Errors     int64  `json:"errors"`   // of those, with a 5xx status
+}
+
+type switchable struct {
+	route   models.Route
+	dial    DialFunc
+	current atomic.Pointer[switchBackend]
+	busy    atomic.Bool
+}
+
+// switchBackend is one of the backends a route switches between.
+type switchBackend struct {
+	target  string
+	handler http.Handler
+	client  *http.Client // for probes, through the same transport; nil for the route's own
+
+	watched          atomic.Bool
+	requests, errors atomic.Int64
+}
+
+// isSwitchable reports whether a route's backend can be switched.
+func isSwitchable(r models.Route, target *url.URL) bool {
+	return (target.Scheme == "http" || target.Scheme == "https") && len(r.OnDemand.Command) == 0
+}
+
+// wrap makes backend, r's, switchable if r can be switched.
+func (s *Switches) wrap(r models.Route, target *url.URL, dial DialFunc, backend http.Handler) http.Handler {
+	if s == nil || !isSwitchable(r, target) {
+		return backend
+	}
+	sw := &switchable{route: r, dial: dial}
+	sw.current.Store(&switchBackend{target: r.Target, handler: backend})
+	s.mu.Lock()
+	s.routes[r.Name] = sw
+	s.mu.Unlock()
+	return sw
+}
+
+func (sw *switchable) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b := sw.current.Load()
+	if !b.watched.Load() {
+		b.handler.ServeHTTP(w, req)
+		return
+	}
+	rw := &statusWriter{ResponseWriter: w}
+	b.handler.ServeHTTP(rw, req)
+	b.requests.Add(1)
+	if rw.status() >= 500 {
+		b.errors.Add(1)
+	}
+}
+
+// Target returns the target serving a route, or "" if it can't be
+// switched.
+func (s *Switches) Target(route string) string {
+	if sw := s.lookup(route); sw != nil {
+		return sw.current.Load().target
+	}
+	return ""
+}
+
+func (s *Switches) lookup(route string) *switchable {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.routes[route]
+}
+
+// Switch moves route to target, as described on Switches, and returns the
+// outcome. It returns an error, and leaves the route alone, if the route
+// can't be switched or target is invalid; a target failing its probe, or
+// rolled back, is reported in the result.
+func (s *Switches) Switch(ctx context.Context, route, target string, opts SwitchOptions) (SwitchResult, error) {
+	sw := s.lookup(route)
+	if sw == nil {
+		return SwitchResult{}, fmt.Errorf("%w %q", ErrNoRoute, route)
+	}
+	if !sw.busy.CompareAndSwap(false, true) {
+		return SwitchResult{}, ErrSwitching
+	}
+	defer sw.busy.Store(false)
+
+	old := sw.current.Load()
+	res := SwitchResult{Route: route, From: old.target, To: target}
+	if target == old.target {
+		res.Switched = true
+		return res, nil
+	}
+	next, err := sw.backend(target)
+	if err != nil {
+		return SwitchResult{}, err
+	}
+	entry := routeLog(sw.route).WithFields(log.Fields{"from": old.target, "to": target})
+	if err := next.probe(ctx, opts.ProbePath); err != nil {
+		res.Error = fmt.Sprintf("probe failed: %v", err)
+		entry.Warnf("Not switching backend, %s", res.Error)
+		return res, nil
+	}
+
+	next.watched.Store(opts.Watch > 0)
+	sw.current.Store(next)
+	res.Switched = true
+	entry.Info("Switched backend")
+	s.publish(route, old.target, target, false)
+
+	if opts.Watch > 0 {
+		// The outcome shouldn't depend on the caller staying around.
+		err := next.watch(context.WithoutCancel(ctx), opts)
+		next.watched.Store(false)
+		res.Requests, res.Errors = next.requests.Load(), next.errors.Load()
+		if err != nil {
+			sw.current.Store(old)
+			res.Switched, res.RolledBack, res.Error = false, true, err.Error()
+			entry.Warnf("Rolled backend back: %v", err)
+			s.publish(route, target, old.target, true)
+		}
+	}
+	if res.Switched && s.OnSwitch != nil {
+		s.OnSwitch(route, old.target, target)
+	}
+	return res, nil
+}
+
+// backend builds the route's backend for target.
+func (sw *switchable) backend(target string) (*switchBackend, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid target %q: must be an http:// or https:// URL", target)
+	}
+	r := sw.route
+	r.Target = target
+	h, err := newBackend(r, u, sw.dial)
+	if err != nil {
+		return nil, err
+	}
+	t, err := transport(r, sw.dial)
+	if err != nil {
+		return nil, err
+	}
+	return &switchBackend{target: target, handler: h, client: probeClient(t)}, nil
+}
+
+func probeClient(t http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: t,
+		Timeout:   switchProbeTimeout,
+		// A redirect, say to a sign-in page, is an answer too.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// probe requests path from the backend.
+func (b *switchBackend) probe(ctx context.Context, path string) error {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(b.target, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "tsrouter-switch")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s answered %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+// watch checks the backend every few seconds and once opts.Watch has
+// passed, returning why it failed if it did.
+func (b *switchBackend) watch(ctx context.Context, opts SwitchOptions) error {
+	deadline := time.NewTimer(opts.Watch)
+	defer deadline.Stop()
+	t := time.NewTicker(switchProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			return b.check(ctx, opts.ProbePath)
+		case <-t.C:
+			if err := b.check(ctx, opts.ProbePath); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// check probes the backend and reports most of its requests failing.
+func (b *switchBackend) check(ctx context.Context, path string) error {
+	if err := b.probe(ctx, path); err != nil {
+		return fmt.Errorf("probe failed while watched: %v", err)
+	}
+	n, failed := b.requests.Load(), b.errors.Load()
+	if n >= switchMinRequests && failed*2 > n {
+		return fmt.Errorf("%d of %d requests failed while watched", failed, n)
+	}
+	return nil
+}
+
+func (s *Switches) publish(route, from, to string, rolledBack bool) {
+	msg := fmt.Sprintf("Route %s switched from %s to %s", route, from, to)
+	if rolledBack {
+		msg = fmt.Sprintf("Route %s rolled back from %s to %s", route, from, to)
+	}
+	s.bus.Publish(events.Event{
+		Type:    events.BackendSwitched,
+		Route:   route,
+		Message: msg,
+		Fields:  map[string]string{"from": from, "to": to, "rolled_back": fmt.Sprint(rolledBack)},
+	})
+}
@@ -0,0 +1,192 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+const tcpDialTimeout = 10 * time.Second
+
+// TCPProxy forwards every connection accepted on a node port to a route's
+// host:port target.
+type TCPProxy struct {
+	route models.Route
+	dial  DialFunc
+
+	untunable sync.Map // sides logged as taking no tcp options
+
+	mu      sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]struct{}
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// NewTCPProxy returns a proxy for route, connecting to the target with
+// dial, or a plain net.Dialer if it's nil.
+func NewTCPProxy(route models.Route, dial DialFunc) *TCPProxy {
+	if dial == nil {
+		d := &net.Dialer{}
+		dial = d.DialContext
+	}
+	return &TCPProxy{route: route, dial: dial, conns: map[net.Conn]struct{}{}}
+}
+
+// Serve accepts connections on ln until it's closed by Shutdown.
+func (p *TCPProxy) Serve(ln net.Listener) error {
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if p.closed() {
+				return nil
+			}
+			return err
+		}
+		p.track(conn, true)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.track(conn, false)
+			p.forward(conn)
+		}()
+	}
+}
+
+func (p *TCPProxy) forward(conn net.Conn) {
+	defer conn.Close()
+	entry := routeLog(p.route).WithFields(log.Fields{"remote_addr": conn.RemoteAddr().String()})
+
+	p.tune(conn, "client")
+	target := p.route.Target
+	if s := p.route.Sniff; s.HTTP != "" || s.TLS != "" || s.SSH != "" {
+		var proto string
+		conn, proto, target = sniff(conn, p.route)
+		entry = entry.WithField("protocol", proto)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tcpDialTimeout)
+	backend, err := p.dial(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		entry.Warnf("Failed to connect to %s: %v", target, err)
+		return
+	}
+	defer backend.Close()
+	p.tune(backend, "backend")
+	p.track(backend, true)
+	defer p.track(backend, false)
+
+	entry.Debug("Forwarding TCP connection")
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		if _, err := io.Copy(dst, src); err != nil {
+			// A reset or failed side ends the other direction too, instead
+			// of leaving it open until the peer notices.
+			conn.Close()
+			backend.Close()
+		} else if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(backend, conn)
+	go pipe(conn, backend)
+	<-done
+	<-done
+}
+
+// tcpTunable is a connection taking the route's tcp options, such as a
+// *net.TCPConn. Connections through the tailnet, served by the node's
+// userspace network stack, aren't.
+type tcpTunable interface {
+	SetNoDelay(bool) error
+	SetKeepAliveConfig(net.KeepAliveConfig) error
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}
+
+// tune applies the route's tcp options to c, the side of the connection
+// named by side.
+func (p *TCPProxy) tune(c net.Conn, side string) {
+	o := p.route.TCP
+	if o == (models.TCPOptions{}) {
+		return
+	}
+	tc, ok := c.(tcpTunable)
+	if !ok {
+		if _, logged := p.untunable.LoadOrStore(side, true); !logged {
+			routeLog(p.route).Infof("The tcp options don't apply to the %s side of this route, which goes through the tailnet", side)
+		}
+		return
+	}
+	var errs []error
+	errs = append(errs, tc.SetNoDelay(!o.Nagle))
+	if o.KeepAlive != 0 {
+		ka := net.KeepAliveConfig{Enable: o.KeepAlive > 0, Idle: o.KeepAlive, Interval: o.KeepAlive}
+		errs = append(errs, tc.SetKeepAliveConfig(ka))
+	}
+	if o.ReadBuffer > 0 {
+		errs = append(errs, tc.SetReadBuffer(o.ReadBuffer))
+	}
+	if o.WriteBuffer > 0 {
+		errs = append(errs, tc.SetWriteBuffer(o.WriteBuffer))
+	}
+	if err := errors.Join(errs...); err != nil {
+		routeLog(p.route).Warnf("Failed to apply the tcp options to the %s connection: %v", side, err)
+	}
+}
+
+func (p *TCPProxy) track(c net.Conn, add bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if add {
+		p.conns[c] = struct{}{}
+	} else {
+		delete(p.conns, c)
+	}
+}
+
+func (p *TCPProxy) closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+// Shutdown stops accepting connections and waits for open ones to finish
+// until ctx is done, then closes whatever is left.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closing = true
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		for c := range p.conns {
+			c.Close()
+		}
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
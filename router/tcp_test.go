@@ -0,0 +1,60 @@
+package router
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+func TestTCPClientResetClosesBackend(t *testing.T) {
+	be, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+	closed := make(chan error, 1)
+	go func() {
+		conn, err := be.Accept()
+		if err != nil {
+			closed <- err
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewTCPProxy(models.Route{Name: "db", Protocol: "tcp", Target: be.Addr().String()}, nil)
+	go p.Serve(ln)
+	defer p.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// Close with a reset instead of a FIN, as a client that went away does.
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend connection still open after the client reset")
+	}
+}
@@ -0,0 +1,134 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// Timing breaks a request's duration down into the Tailscale and backend
+// parts. Backend timings are zero for targets not reached over HTTP, such
+// as FastCGI or files, and for requests answered before reaching one.
+// DNS, Connect and TLS are zero too when a pooled connection was reused.
+type Timing struct {
+	WhoIs   time.Duration `json:"whois,omitempty"` // resolving the caller's Tailscale identity
+	Dial    time.Duration `json:"dial"`            // getting a backend connection, from the pool or dialed
+	DNS     time.Duration `json:"dns"`             // looking up the backend's name, part of Dial
+	Connect time.Duration `json:"connect"`         // the TCP connect, part of Dial
+	TLS     time.Duration `json:"tls"`             // the TLS handshake with https backends, part of Dial
+	TTFB    time.Duration `json:"ttfb"`            // from having the connection to the backend's first response byte
+	Backend bool          `json:"backend"`         // the request reached a backend over HTTP
+	Reused  bool          `json:"reused"`          // on a pooled connection
+}
+
+// timing collects a Timing from the client trace of backend requests.
+type timing struct {
+	mu                                         sync.Mutex
+	t                                          Timing
+	getConn, gotConn, dns, connect, tlsStarted time.Time
+}
+
+func (tm *timing) trace() *httptrace.ClientTrace {
+	// since returns the time from *start, and clears it. Callers hold mu.
+	since := func(start *time.Time) time.Duration {
+		if start.IsZero() {
+			return 0
+		}
+		d := time.Since(*start)
+		*start = time.Time{}
+		return d
+	}
+	locked := func(f func()) {
+		tm.mu.Lock()
+		defer tm.mu.Unlock()
+		f()
+	}
+	return &httptrace.ClientTrace{
+		GetConn:  func(string) { locked(func() { tm.getConn = time.Now() }) },
+		DNSStart: func(httptrace.DNSStartInfo) { locked(func() { tm.dns = time.Now() }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { locked(func() { tm.t.DNS += since(&tm.dns) }) },
+		ConnectStart: func(string, string) {
+			locked(func() { tm.connect = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			locked(func() { tm.t.Connect += since(&tm.connect) })
+		},
+		TLSHandshakeStart: func() { locked(func() { tm.tlsStarted = time.Now() }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			locked(func() { tm.t.TLS += since(&tm.tlsStarted) })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			locked(func() {
+				tm.t.Dial += since(&tm.getConn)
+				tm.t.Backend = true
+				tm.t.Reused = info.Reused
+				tm.gotConn = time.Now()
+			})
+		},
+		GotFirstResponseByte: func() {
+			locked(func() { tm.t.TTFB += since(&tm.gotConn) })
+		},
+	}
+}
+
+type timingKey struct{}
+
+// withTrace traces the backend requests made with ctx into tm.
+func (tm *timing) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(context.WithValue(ctx, timingKey{}, tm), tm.trace())
+}
+
+// timingFromContext returns the timing instrument is collecting for the
+// request, or nil.
+func timingFromContext(ctx context.Context) *timing {
+	tm, _ := ctx.Value(timingKey{}).(*timing)
+	return tm
+}
+
+func (tm *timing) get() Timing {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.t
+}
+
+// logSlow logs a request that took longer than the route's
+// slow_request_threshold, with where the time went: a slow WhoIs points at
+// tailscaled, a slow dial at the network to the backend, and a slow TTFB
+// at the backend itself.
+func logSlow(route models.Route, r *http.Request, status int, total time.Duration, t Timing) {
+	fields := log.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"status": status,
+		"whois":  t.WhoIs.Round(time.Microsecond).String(),
+		"total":  total.Round(time.Microsecond).String(),
+	}
+	if t.Backend {
+		fields["dial"] = t.Dial.Round(time.Microsecond).String()
+		fields["ttfb"] = t.TTFB.Round(time.Microsecond).String()
+	}
+	routeLog(route).WithFields(fields).Warnf("Slow request, over %s", route.SlowRequestThreshold)
+}
+
+// logTiming logs the backend part of a request's timing at debug level.
+func logTiming(route models.Route, r *http.Request, t Timing) {
+	entry := routeLog(route)
+	if !entry.Logger.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	entry.WithFields(log.Fields{
+		"path":    r.URL.Path,
+		"reused":  t.Reused,
+		"dial":    t.Dial.Round(time.Microsecond).String(),
+		"dns":     t.DNS.Round(time.Microsecond).String(),
+		"connect": t.Connect.Round(time.Microsecond).String(),
+		"tls":     t.TLS.Round(time.Microsecond).String(),
+		"ttfb":    t.TTFB.Round(time.Microsecond).String(),
+	}).Debug("Backend request timing")
+}
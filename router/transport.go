@@ -0,0 +1,94 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/whitehawk2/tsrouter/certs"
+	"github.com/whitehawk2/tsrouter/models"
+	"golang.org/x/net/http2"
+)
+
+// transport returns the round tripper for a route's backend: the default
+// one, unless backends are dialed through dial, or the route changes the TLS
+// handshake (client certificate, CA, SNI or ALPN), or needs HTTP/2 for gRPC.
+func transport(r models.Route, dial DialFunc) (http.RoundTripper, error) {
+	if r.ClientCert == "" && r.CACert == "" && r.TLSServerName == "" && len(r.TLSALPN) == 0 && !r.GRPCWeb && dial == nil {
+		return http.DefaultTransport, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: r.TLSServerName, NextProtos: r.TLSALPN}
+	if r.ClientCert != "" {
+		cert, err := certs.LoadFile(r.ClientCert, r.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		// Looked up per handshake, so rotated files are picked up.
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.Certificate(), nil
+		}
+	}
+	if r.CACert != "" {
+		pem, err := os.ReadFile(r.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", r.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if r.GRPCWeb {
+		return grpcTransport(r.Target, tlsConfig, dial), nil
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	if len(r.TLSALPN) > 0 && !slices.Contains(r.TLSALPN, "h2") {
+		// Otherwise h2 is added to the offered protocols.
+		t.ForceAttemptHTTP2 = false
+	}
+	if dial != nil {
+		t.DialContext = dial
+	}
+	return t, nil
+}
+
+// grpcTransport speaks HTTP/2 to the backend, as gRPC requires: over TLS for
+// https targets, and in cleartext (h2c) for http ones.
+func grpcTransport(target string, tlsConfig *tls.Config, dial DialFunc) http.RoundTripper {
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	t := &http2.Transport{TLSClientConfig: tlsConfig}
+	if strings.HasPrefix(target, "http://") {
+		t.AllowHTTP = true
+		t.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+		return t
+	}
+	t.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+	return t
+}
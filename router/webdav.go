@@ -0,0 +1,59 @@
+package router
+
+import (
+	"net/http"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+	"golang.org/x/net/webdav"
+)
+
+// davReadMethods are the WebDAV methods that don't modify the share.
+var davReadMethods = []string{"GET", "HEAD", "OPTIONS", "PROPFIND"}
+
+// newWebDAV serves a local directory over WebDAV. Only callers listed in
+// the route's writers may modify it.
+func newWebDAV(r models.Route, root string) http.Handler {
+	dav := &webdav.Handler{
+		Prefix:     staticPrefix(r.Path),
+		FileSystem: webdav.Dir(root),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				routeLog(r).WithFields(log.Fields{"method": req.Method, "path": req.URL.Path}).Debugf("WebDAV: %v", err)
+			}
+		},
+	}
+	writers := r.WebDAV.Writers
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !slices.Contains(davReadMethods, req.Method) && !canWrite(writers, req) {
+			http.Error(w, "Forbidden: read-only share", http.StatusForbidden)
+			return
+		}
+		dav.ServeHTTP(w, req)
+	})
+}
+
+// canWrite reports whether the caller's login name or one of its node's
+// tags is among writers; "*" allows everyone.
+func canWrite(writers []string, req *http.Request) bool {
+	if slices.Contains(writers, "*") {
+		return true
+	}
+	who := IdentityFromContext(req.Context())
+	if who == nil {
+		return false
+	}
+	if who.UserProfile != nil && slices.Contains(writers, who.UserProfile.LoginName) {
+		return true
+	}
+	if who.Node != nil {
+		for _, tag := range who.Node.Tags {
+			if slices.Contains(writers, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package router
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+const (
+	defaultReplayWindow   = 5 * time.Minute
+	defaultWebhookMaxBody = 5 << 20
+
+	// untimedSeenFor is how long the IDs of deliveries without a signed
+	// timestamp, GitHub's, are remembered, as only that stops a captured
+	// one from being replayed. At most maxSeenDeliveries are kept.
+	untimedSeenFor    = 30 * 24 * time.Hour
+	maxSeenDeliveries = 100_000
+)
+
+// errReplayed is returned for signed deliveries that were already relayed,
+// or whose timestamp is too old.
+var errReplayed = errors.New("replayed delivery")
+
+// webhookRelay passes on only POST requests signed with the route's
+// webhook secret the way its provider signs them, and each delivery only
+// once.
+func webhookRelay(r models.Route, next http.Handler) (http.Handler, error) {
+	secret, err := os.ReadFile(r.WebhookRelay.SecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook secret: %v", err)
+	}
+	key := bytes.TrimSpace(secret)
+	if r.WebhookRelay.Provider == "standard" {
+		// Standard Webhooks secrets are base64, with a whsec_ prefix.
+		if key, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(string(key), "whsec_")); err != nil {
+			return nil, fmt.Errorf("webhook secret isn't a base64 Standard Webhooks secret: %v", err)
+		}
+	}
+	window := r.WebhookRelay.ReplayWindow
+	if window <= 0 {
+		window = defaultReplayWindow
+	}
+	maxBody := r.WebhookRelay.MaxBody
+	if maxBody <= 0 {
+		maxBody = defaultWebhookMaxBody
+	}
+	seenFor := window
+	if r.WebhookRelay.Provider == "github" {
+		seenFor = max(window, untimedSeenFor)
+	}
+	seen := &deliveries{ttl: seenFor, max: maxSeenDeliveries, ids: map[string]time.Time{}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBody))
+		if err != nil {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		now := time.Now()
+		id, err := verifyWebhook(r.WebhookRelay.Provider, key, req.Header, body, now, window)
+		if err == nil && !seen.add(id, now) {
+			err = errReplayed
+		}
+		if err != nil {
+			routeLog(r).WithFields(log.Fields{"remote_addr": req.RemoteAddr}).Warnf("Rejected webhook: %v", err)
+			if errors.Is(err, errReplayed) {
+				http.Error(w, "Conflict: "+err.Error(), http.StatusConflict)
+			} else {
+				http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			}
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		if sw.status() >= 500 {
+			// Not delivered, so the provider's retry, which keeps the ID,
+			// must get through.
+			seen.forget(id)
+		}
+	}), nil
+}
+
+// verifyWebhook checks the signature of a delivery and returns its ID.
+func verifyWebhook(provider string, key []byte, h http.Header, body []byte, now time.Time, window time.Duration) (string, error) {
+	switch provider {
+	case "github":
+		sig, ok := strings.CutPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok {
+			return "", errors.New("missing X-Hub-Signature-256")
+		}
+		id := h.Get("X-GitHub-Delivery")
+		if id == "" {
+			return "", errors.New("missing X-GitHub-Delivery")
+		}
+		if !validHex(key, body, sig) {
+			return "", errors.New("invalid signature")
+		}
+		return id, nil
+
+	case "stripe":
+		var ts string
+		var sigs []string
+		for _, kv := range strings.Split(h.Get("Stripe-Signature"), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			switch k {
+			case "t":
+				ts = v
+			case "v1":
+				sigs = append(sigs, v)
+			}
+		}
+		if ts == "" || len(sigs) == 0 {
+			return "", errors.New("missing or malformed Stripe-Signature")
+		}
+		if err := checkTimestamp(ts, now, window); err != nil {
+			return "", err
+		}
+		signed := append([]byte(ts+"."), body...)
+		for _, sig := range sigs {
+			if validHex(key, signed, sig) {
+				return ts + "." + sig, nil
+			}
+		}
+		return "", errors.New("invalid signature")
+
+	case "standard":
+		id, ts := h.Get("Webhook-Id"), h.Get("Webhook-Timestamp")
+		if id == "" || ts == "" {
+			return "", errors.New("missing webhook-id or webhook-timestamp")
+		}
+		if err := checkTimestamp(ts, now, window); err != nil {
+			return "", err
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(id + "." + ts + "."))
+		mac.Write(body)
+		want := mac.Sum(nil)
+		for _, sig := range strings.Fields(h.Get("Webhook-Signature")) {
+			v, b64, _ := strings.Cut(sig, ",")
+			got, err := base64.StdEncoding.DecodeString(b64)
+			if v == "v1" && err == nil && hmac.Equal(got, want) {
+				return id, nil
+			}
+		}
+		return "", errors.New("invalid signature")
+	}
+	return "", fmt.Errorf("unknown webhook provider %q", provider)
+}
+
+// validHex reports whether sig is the hex HMAC-SHA256 of msg under key.
+func validHex(key, msg []byte, sig string) bool {
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// checkTimestamp checks that the Unix time ts is within window of now.
+func checkTimestamp(ts string, now time.Time, window time.Duration) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", ts)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > window || d < -window {
+		return fmt.Errorf("%w: timestamp is %v off", errReplayed, d.Round(time.Second))
+	}
+	return nil
+}
+
+// deliveries remembers the IDs of relayed deliveries for ttl, up to max of
+// them. An ID is recorded before the delivery is relayed, so concurrent
+// repeats are refused, and forgotten if the backend failed.
+type deliveries struct {
+	ttl time.Duration
+	max int
+
+	mu    sync.Mutex
+	ids   map[string]time.Time
+	order []seenDelivery // oldest first; forgotten IDs stay until they expire
+}
+
+type seenDelivery struct {
+	id string
+	at time.Time
+}
+
+// add records id, reporting false if it was already seen.
+func (d *deliveries) add(id string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.drop(func() bool { return now.Sub(d.order[0].at) > d.ttl })
+	if _, ok := d.ids[id]; ok {
+		return false
+	}
+	d.drop(func() bool { return len(d.ids) >= d.max })
+	d.ids[id] = now
+	d.order = append(d.order, seenDelivery{id, now})
+	return true
+}
+
+// drop removes the oldest IDs while more returns true. d.mu must be held.
+func (d *deliveries) drop(more func() bool) {
+	for len(d.order) > 0 && more() {
+		old := d.order[0]
+		d.order = d.order[1:]
+		if at, ok := d.ids[old.id]; ok && at.Equal(old.at) {
+			delete(d.ids, old.id)
+		}
+	}
+}
+
+// forget removes id, so its delivery can be relayed again.
+func (d *deliveries) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.ids, id)
+}
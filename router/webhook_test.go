@@ -0,0 +1,109 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+func TestWebhookRelayAcceptsRetryAfterBackendFailure(t *testing.T) {
+	key := []byte("secret")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("whsec_"+base64.StdEncoding.EncodeToString(key)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK}
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	})
+	route := models.Route{Name: "hook", WebhookRelay: models.WebhookRelay{Provider: "standard", SecretFile: secretFile}}
+	h, err := webhookRelay(route, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"type":"ping"}`
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("msg_1." + ts + "." + body))
+	sig := "v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	// The provider's retries resend the same delivery.
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusConflict} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Webhook-Id", "msg_1")
+		r.Header.Set("Webhook-Timestamp", ts)
+		r.Header.Set("Webhook-Signature", sig)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Fatalf("status = %d, want %d", w.Code, want)
+		}
+	}
+}
+
+func TestWebhookRelayRefusesGitHubReplayAfterWindow(t *testing.T) {
+	key := []byte("secret")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	window := 10 * time.Millisecond
+	route := models.Route{Name: "hook", WebhookRelay: models.WebhookRelay{Provider: "github", SecretFile: secretFile, ReplayWindow: window}}
+	h, err := webhookRelay(route, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"zen":"Keep it logically awesome."}`
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	// GitHub deliveries carry no timestamp, so a captured one is refused
+	// for its ID long after the replay window.
+	for i, want := range []int{http.StatusOK, http.StatusConflict} {
+		if i > 0 {
+			time.Sleep(2 * window)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		r.Header.Set("X-Hub-Signature-256", sig)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Fatalf("delivery %d: status = %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
+
+func TestDeliveriesBounded(t *testing.T) {
+	d := &deliveries{ttl: time.Hour, max: 2, ids: map[string]time.Time{}}
+	now := time.Now()
+	for _, id := range []string{"a", "b", "c"} {
+		if !d.add(id, now) {
+			t.Fatalf("add(%s) = false for a new ID", id)
+		}
+	}
+	if len(d.ids) != 2 || !d.add("a", now) {
+		t.Errorf("the oldest ID wasn't dropped at the limit: %v", d.ids)
+	}
+	if d.add("c", now) {
+		t.Error("add(c) = true for a remembered ID")
+	}
+	if !d.add("c", now.Add(2*time.Hour)) {
+		t.Error("add(c) = false after its ttl")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/admin"
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/events"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// appliedRoutesName is the file in the instance directory keeping the
+// routes applied through the admin API.
+const appliedRoutesName = "admin-routes.json"
+
+// switchedTargetsName is the file in the instance directory keeping the
+// targets routes were switched to through the admin API.
+const switchedTargetsName = "switched-targets.json"
+
+// errRoutesApplied is the cause of the shutdown when routes are applied
+// through the admin API.
+var errRoutesApplied = errors.New("routes applied through the admin API")
+
+// routeless returns a copy of cfg without routes, for decoding others onto.
+func routeless(cfg *models.Config) models.Config {
+	next := *cfg
+	next.Routes, next.Ports, next.TargetPort, next.Mock = nil, nil, 0, ""
+	return next
+}
+
+// loadAppliedRoutes replaces cfg's routes with the ones last applied
+// through the admin API, if any.
+func loadAppliedRoutes(cfg *models.Config, dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, appliedRoutesName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the routes applied through the admin API: %v", err)
+	}
+	next := routeless(cfg)
+	if err := config.DecodeRoutes(&next, data); err != nil {
+		return fmt.Errorf("the routes applied through the admin API are invalid: %v", err)
+	}
+	*cfg = next
+	log.Infof("Using the %d routes applied through the admin API, instead of the config's", len(cfg.Routes))
+	return nil
+}
+
+// applyRoutes returns the admin API's PUT /routes. Routes that differ from
+// cfg's are kept in dir, published on bus, and restart is called to serve
+// them.
+func applyRoutes(cfg *models.Config, dir string, bus *events.Bus, restart context.CancelCauseFunc) admin.ApplyRoutesFunc {
+	var mu sync.Mutex
+	return func(ext string, data []byte, dryRun bool) (admin.RoutesPlan, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		doc, err := config.ParseRoutes(ext, data)
+		if err != nil {
+			return admin.RoutesPlan{}, err
+		}
+		next := routeless(cfg)
+		if err := config.DecodeRoutes(&next, doc); err != nil {
+			return admin.RoutesPlan{}, err
+		}
+		plan := planRoutes(cfg.Routes, next.Routes)
+		if dryRun || reflect.DeepEqual(cfg.Routes, next.Routes) {
+			return plan, nil
+		}
+
+		path := filepath.Join(dir, appliedRoutesName)
+		if err := os.WriteFile(path+".tmp", doc, 0o600); err != nil {
+			return admin.RoutesPlan{}, fmt.Errorf("failed to save routes: %v", err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return admin.RoutesPlan{}, fmt.Errorf("failed to save routes: %v", err)
+		}
+		// The routes applied say which targets they want.
+		if err := os.Remove(filepath.Join(dir, switchedTargetsName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Failed to forget switched targets: %v", err)
+		}
+		plan.Applied = true
+		publishRoutesChanged(bus, plan, "admin_api")
+		log.Info("Routes applied through the admin API, restarting")
+		restart(errRoutesApplied)
+		return plan, nil
+	}
+}
+
+// publishRoutesChanged publishes a RoutesChanged event for routes changed
+// as planned, from source (admin_api or controller).
+func publishRoutesChanged(bus *events.Bus, plan admin.RoutesPlan, source string) {
+	bus.Publish(events.Event{
+		Type:    events.RoutesChanged,
+		Message: fmt.Sprintf("Routes changed from %s: %d added, %d changed, %d removed", source, len(plan.Added), len(plan.Changed), len(plan.Removed)),
+		Fields: map[string]string{
+			"source":  source,
+			"added":   strings.Join(plan.Added, ","),
+			"changed": strings.Join(plan.Changed, ","),
+			"removed": strings.Join(plan.Removed, ","),
+		},
+	})
+}
+
+// planRoutes compares the routes running with the desired ones, by name.
+func planRoutes(current, desired []models.Route) admin.RoutesPlan {
+	plan := admin.RoutesPlan{Added: []string{}, Changed: []string{}, Removed: []string{}, Unchanged: []string{}}
+	running := map[string]models.Route{}
+	for _, r := range current {
+		running[r.Name] = r
+	}
+	for _, r := range desired {
+		old, ok := running[r.Name]
+		switch {
+		case !ok:
+			plan.Added = append(plan.Added, r.Name)
+		case reflect.DeepEqual(old, r):
+			plan.Unchanged = append(plan.Unchanged, r.Name)
+		default:
+			plan.Changed = append(plan.Changed, r.Name)
+		}
+		delete(running, r.Name)
+	}
+	for _, r := range current {
+		if _, ok := running[r.Name]; ok {
+			plan.Removed = append(plan.Removed, r.Name)
+		}
+	}
+	return plan
+}
+
+// switchedTarget is a route's switch, kept while the route's configured
+// target is still From.
+type switchedTarget struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// loadSwitchedTargets moves cfg's routes to the targets they were last
+// switched to through the admin API, and returns the targets they're
+// configured with. A switch is dropped once the config changes the route's
+// target, since the config then says where it should go.
+func loadSwitchedTargets(cfg *models.Config, dir string) (map[string]string, error) {
+	configured := map[string]string{}
+	for _, r := range cfg.Routes {
+		configured[r.Name] = r.Target
+	}
+	data, err := os.ReadFile(filepath.Join(dir, switchedTargetsName))
+	if errors.Is(err, os.ErrNotExist) {
+		return configured, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read switched targets: %v", err)
+	}
+	var switched map[string]switchedTarget
+	if err := json.Unmarshal(data, &switched); err != nil {
+		return nil, fmt.Errorf("failed to parse switched targets: %v", err)
+	}
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		if st, ok := switched[r.Name]; ok && st.From == r.Target {
+			log.WithFields(log.Fields{"route": r.Name, "target": st.To}).Info("Using the target the route was switched to through the admin API")
+			r.Target = st.To
+		}
+	}
+	return configured, nil
+}
+
+// saveSwitchedTarget records in dir that route, configured with the
+// target in configured, was switched to target.
+func saveSwitchedTarget(dir string, configured map[string]string, route, target string) error {
+	path := filepath.Join(dir, switchedTargetsName)
+	switched := map[string]switchedTarget{}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &switched)
+	}
+	for name, st := range switched {
+		if configured[name] != st.From {
+			delete(switched, name)
+		}
+	}
+	if target == configured[route] {
+		delete(switched, route)
+	} else {
+		switched[route] = switchedTarget{From: configured[route], To: target}
+	}
+
+	data, err := json.MarshalIndent(switched, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return fmt.Errorf("failed to save switched targets: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save switched targets: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Package schedule parses weekly availability windows such as
+// "Mon-Fri 16:00-21:00".
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Schedule is a set of weekly windows in one time zone.
+type Schedule struct {
+	windows []window
+	loc     *time.Location
+}
+
+// window is open from start to end (minutes since midnight) on days. A
+// window whose end isn't after its start runs past midnight into the next
+// day.
+type window struct {
+	days       [7]bool
+	start, end int
+}
+
+// Parse parses windows of the form "[days] HH:MM-HH:MM", where days is a
+// comma-separated list of day names and ranges ("Mon-Fri,Sun") and
+// defaults to every day. tz is an IANA zone name; empty means local time.
+func Parse(windows []string, tz string) (*Schedule, error) {
+	loc := time.Local
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", tz)
+		}
+	}
+	s := &Schedule{loc: loc}
+	for _, w := range windows {
+		pw, err := parseWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", w, err)
+		}
+		s.windows = append(s.windows, pw)
+	}
+	return s, nil
+}
+
+func parseWindow(s string) (window, error) {
+	var w window
+	fields := strings.Fields(s)
+	var days, hours string
+	switch len(fields) {
+	case 1:
+		hours = fields[0]
+		for d := range w.days {
+			w.days[d] = true
+		}
+	case 2:
+		days, hours = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("want [days] HH:MM-HH:MM")
+	}
+
+	for _, part := range strings.Split(days, ",") {
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := dayNames[strings.ToLower(from)]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = dayNames[strings.ToLower(to)]; !ok {
+				return w, fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(hours, "-")
+	if !ok {
+		return w, fmt.Errorf("want a time range like 16:00-21:00")
+	}
+	var err error
+	if w.start, err = parseClock(start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return w, err
+	}
+	if w.start == w.end || w.start == 24*60 {
+		return w, fmt.Errorf("window is empty")
+	}
+	return w, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight. 24:00 is allowed as
+// the end of a day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hh < 0 || mm < 0 || mm > 59 || hh > 24 || (hh == 24 && mm != 0) {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return hh*60 + mm, nil
+}
+
+// Open reports whether t falls in one of the windows.
+func (s *Schedule) Open(t time.Time) bool {
+	t = t.In(s.loc)
+	day := t.Weekday()
+	prev := (day + 6) % 7
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[day] && m >= w.start && m < w.end {
+				return true
+			}
+		} else if (w.days[day] && m >= w.start) || (w.days[prev] && m < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns when the schedule next opens after t, or the zero time
+// if it never does.
+func (s *Schedule) NextOpen(t time.Time) time.Time {
+	next := t.In(s.loc).Truncate(time.Minute)
+	for i := 0; i < 8*24*60; i++ {
+		next = next.Add(time.Minute)
+		if s.Open(next) {
+			return next
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tsnet"
+)
+
+// selftestSuffix is added to the probe node's hostname.
+const selftestSuffix = "-selftest"
+
+// selftestCheck is the outcome of reaching one route through the tailnet.
+type selftestCheck struct {
+	Route    string        `json:"route"`
+	URL      string        `json:"url"`
+	Status   int           `json:"status,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Passed   bool          `json:"passed"`
+}
+
+func selftestCommand() *command {
+	fs := newFlagSet("selftest")
+	flags := config.BindFlags(fs, config.ScopeAll)
+	path := fs.String("path", "", "Only check the route serving this path, e.g. /healthz")
+	tag := fs.String("tag", nodeTag, "Tag of the probe node, which the tailnet policy must let reach the node")
+	timeout := fs.Duration("timeout", 2*time.Minute, "Give up after this long, including bringing up the probe node")
+	insecure := fs.Bool("insecure", false, "Don't verify the node's certificate, for custom self-signed ones")
+	output := outputFlag(fs)
+
+	return &command{
+		name:    "selftest",
+		summary: "Check a running instance is reachable end to end through the tailnet",
+		description: `
+Joins the tailnet as a second, ephemeral node named after the configured
+hostname with -selftest added, then sends a request to every route of the
+running instance over the tailnet, the way a user would: HTTPS through its
+certificate, the proxy and on to the backend. tcp routes are checked by
+connecting. A route passes when it answers without a 5xx status. Exits with
+code 6 when a check fails, for health checks and deploy pipelines, and
+removes the probe node when done.`,
+		examples: []string{
+			"tsrouter selftest --config tsrouter.yaml",
+			"tsrouter selftest --config tsrouter.yaml --path /healthz --output json",
+		},
+		flags: fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(ctx, *timeout)
+			defer cancel()
+
+			routes := cfg.Routes
+			if *path != "" {
+				// The longest matching prefix, as the router picks.
+				routes = nil
+				best := -1
+				for _, r := range cfg.Routes {
+					prefix := strings.TrimSuffix(r.Path, "/")
+					if r.Protocol != "tcp" && strings.HasPrefix(*path, prefix) && len(prefix) > best {
+						routes, best = []models.Route{r}, len(prefix)
+					}
+				}
+				if routes == nil {
+					return errdefs.Wrap(errdefs.ErrConfig, fmt.Errorf("no route serves %s", *path))
+				}
+			}
+
+			s, err := startProbeNode(ctx, cfg, *tag)
+			if err != nil {
+				return err
+			}
+			defer stopProbeNode(s)
+			st, err := s.Up(ctx)
+			if err != nil {
+				return errdefs.Wrap(errdefs.ErrTailnet, fmt.Errorf("probe node failed to come up: %v", err))
+			}
+			host := cfg.Hostname
+			if st.CurrentTailnet != nil && st.CurrentTailnet.MagicDNSSuffix != "" {
+				host += "." + st.CurrentTailnet.MagicDNSSuffix
+			}
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext:     s.Dial,
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure},
+				},
+				// A redirect, say to a sign-in page, is an answer too.
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}
+
+			var checks []selftestCheck
+			failed := 0
+			for _, r := range routes {
+				var c selftestCheck
+				if r.Protocol == "tcp" {
+					c = checkTCPRoute(ctx, s, r, host)
+				} else {
+					c = checkHTTPRoute(ctx, client, r, host, *path)
+				}
+				if !c.Passed {
+					failed++
+				}
+				checks = append(checks, c)
+			}
+
+			if output.json() {
+				if err := printJSON(checks); err != nil {
+					return err
+				}
+			} else {
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "RESULT\tROUTE\tURL\tSTATUS\tTIME")
+				for _, c := range checks {
+					result, status := "PASS", "-"
+					if !c.Passed {
+						result = "FAIL"
+					}
+					if c.Status != 0 {
+						status = strconv.Itoa(c.Status)
+					}
+					if c.Error != "" {
+						status = c.Error
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result, c.Route, c.URL, status, formatLatency(c.Duration))
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			if failed > 0 {
+				return errdefs.Wrap(errdefs.ErrBackend, fmt.Errorf("%d of %d routes failed the self-test", failed, len(checks)))
+			}
+			return nil
+		},
+	}
+}
+
+// startProbeNode starts an ephemeral node, with in-memory state, to reach
+// the instance from.
+func startProbeNode(ctx context.Context, cfg *models.Config, tag string) (*tsnet.Server, error) {
+	api, err := newAPIClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := openAuditLog(cfg)
+	if err != nil {
+		return nil, errdefs.Wrap(errdefs.ErrConfig, err)
+	}
+	defer auditLog.Close()
+
+	hostname := cfg.Hostname + selftestSuffix
+	key, err := api.CreateAuthKey(ctx, tailscaleapi.KeyOptions{
+		Description:   keyDescription(hostname),
+		Expiry:        time.Hour,
+		Ephemeral:     true,
+		Preauthorized: true,
+		Tags:          []string{tag},
+	})
+	keyID := ""
+	if key != nil {
+		keyID = key.ID
+	}
+	recordAudit(auditLog, "key.create", keyID, map[string]string{"hostname": hostname, "command": "selftest"}, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the probe node's auth key: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "tsrouter-"+hostname+"-")
+	if err != nil {
+		return nil, err
+	}
+	s := &tsnet.Server{
+		Hostname:  hostname,
+		AuthKey:   key.Key,
+		Dir:       dir,
+		Store:     new(mem.Store),
+		Ephemeral: true,
+	}
+	log.WithField("hostname", hostname).Debug("Starting probe node...")
+	if err := s.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, errdefs.Wrap(errdefs.ErrTailnet, fmt.Errorf("failed to start probe node: %v", err))
+	}
+	return s, nil
+}
+
+// stopProbeNode logs the probe node out, which removes an ephemeral node
+// from the tailnet right away rather than once it's been offline a while.
+func stopProbeNode(s *tsnet.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if lc, err := s.LocalClient(); err == nil {
+		if err := lc.Logout(ctx); err != nil {
+			log.Debugf("Failed to log the probe node out: %v", err)
+		}
+	}
+	s.Close()
+	os.RemoveAll(s.Dir)
+}
+
+func checkHTTPRoute(ctx context.Context, client *http.Client, r models.Route, host, path string) selftestCheck {
+	if path == "" {
+		path = r.Path
+	}
+	scheme := r.Protocol
+	if (scheme == "https" && r.Port != 443) || (scheme == "http" && r.Port != 80) {
+		host = net.JoinHostPort(host, strconv.Itoa(r.Port))
+	}
+	c := selftestCheck{Route: r.Name, URL: scheme + "://" + host + path}
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	req.Header.Set("User-Agent", "tsrouter-selftest")
+	resp, err := client.Do(req)
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	c.Duration = time.Since(start)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	c.Status = resp.StatusCode
+	c.Passed = resp.StatusCode < 500
+	return c
+}
+
+func checkTCPRoute(ctx context.Context, s *tsnet.Server, r models.Route, host string) selftestCheck {
+	addr := net.JoinHostPort(host, strconv.Itoa(r.Port))
+	c := selftestCheck{Route: r.Name, URL: "tcp://" + addr}
+	start := time.Now()
+	conn, err := s.Dial(ctx, "tcp", addr)
+	c.Duration = time.Since(start)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	conn.Close()
+	c.Passed = true
+	return c
+}
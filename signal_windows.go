@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// notifyLogToggle is a no-op on Windows, which has no SIGUSR1; use the admin
+// API instead.
+func notifyLogToggle(ch chan<- os.Signal) {}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// transient reports whether err might pass on its own, like the Tailscale
+// API or the tailnet being unreachable, unlike a config or credentials
+// problem.
+func transient(err error) bool {
+	return errors.Is(err, errdefs.ErrAPI) || errors.Is(err, errdefs.ErrTailnet)
+}
+
+// retryStartup runs step, described by what, until it succeeds, fails in a
+// way that won't pass, or the startup policy gives up, backing off between
+// attempts. It returns step's last error.
+func retryStartup(ctx context.Context, cfg *models.Config, what string, step func() error) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := step()
+		if err == nil || !transient(err) || cfg.FailFast {
+			return err
+		}
+		if !cfg.RetryForever && attempt >= cfg.StartupAttempts {
+			return fmt.Errorf("%w (gave up after %d attempts: %s, or raise startup_attempts or set retry_forever to wait longer)", err, attempt, startupHint(err))
+		}
+		n := strconv.Itoa(attempt)
+		if !cfg.RetryForever {
+			n += " of " + strconv.Itoa(cfg.StartupAttempts)
+		}
+		log.Warnf("Failed to %s (attempt %s), retrying in %s: %v", what, n, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, cfg.StartupBackoffMax)
+	}
+}
+
+// startupHint says what to check when a startup step keeps failing with
+// err.
+func startupHint(err error) string {
+	if errors.Is(err, errdefs.ErrTailnet) {
+		return "check that this host can reach the Tailscale coordination server and DERP relays"
+	}
+	return "check that this host can reach api.tailscale.com, and https://status.tailscale.com for an outage"
+}
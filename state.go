@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/statestore"
+	"tailscale.com/ipn"
+)
+
+func stateCommand() *command {
+	return &command{
+		name:    "state",
+		summary: "Move a node's state between machines",
+		description: `
+A node's state (its Tailscale identity, certificates and stats) lives in
+the instance directory of its hostname. Exporting it and importing it on
+another host lets the service move without registering a new node, so it
+keeps its name and addresses.`,
+		examples: []string{
+			"tsrouter state export --hostname webui webui.tar.gz",
+			"tsrouter state import --hostname webui --state-dir /var/lib/tsrouter webui.tar.gz",
+		},
+		subcommands: []*command{
+			stateExportCommand(),
+			stateImportCommand(),
+		},
+	}
+}
+
+func stateExportCommand() *command {
+	fs := newFlagSet("state export")
+	flags := config.BindFlags(fs, config.ScopeAll)
+
+	return &command{
+		name:    "export",
+		usage:   "[file]",
+		summary: "Write the instance directory to a gzipped tar bundle (stdout by default)",
+		flags:   fs,
+		run: func(ctx context.Context, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("at most one file can be given")
+			}
+			dir, err := stateDir(flags)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(dir); err != nil {
+				return fmt.Errorf("no state to export: %v", err)
+			}
+			unlock, err := lockInstanceDir(dir)
+			if err != nil {
+				return fmt.Errorf("stop the instance before exporting its state: %v", err)
+			}
+			defer unlock()
+
+			out := os.Stdout
+			if len(args) == 1 && args[0] != "-" {
+				f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+			if err := exportState(dir, out); err != nil {
+				return err
+			}
+			log.Warn("The bundle holds the node's private keys, keep it as safe as the instance directory")
+			return nil
+		},
+	}
+}
+
+func stateImportCommand() *command {
+	fs := newFlagSet("state import")
+	flags := config.BindFlags(fs, config.ScopeAll)
+	force := fs.Bool("force", false, "Replace existing state for the hostname")
+
+	return &command{
+		name:    "import",
+		usage:   "<file>",
+		summary: "Restore an instance directory from a bundle written by export",
+		flags:   fs,
+		run: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("a bundle file is required (- reads stdin)")
+			}
+			dir, err := stateDir(flags)
+			if err != nil {
+				return err
+			}
+			if entries, err := os.ReadDir(dir); err == nil {
+				unlock, err := lockInstanceDir(dir)
+				if err != nil {
+					return err
+				}
+				unlock()
+				if len(entries) > 0 && !*force {
+					return fmt.Errorf("%s already holds state, use --force to replace it", dir)
+				}
+			}
+
+			in := os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+			if err := importState(in, dir); err != nil {
+				return err
+			}
+			log.Infof("Imported state into %s", dir)
+			return nil
+		},
+	}
+}
+
+func stateDir(flags *config.Flags) (string, error) {
+	cfg, _, err := loadConfig(flags)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Hostname == "" {
+		return "", fmt.Errorf("hostname is required")
+	}
+	return instanceDir(cfg)
+}
+
+// exportState writes the regular files under dir to w as a gzipped tar,
+// with paths relative to dir.
+func exportState(dir string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() && !d.IsDir() {
+			return nil // sockets and the like
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." || rel == lockFileName {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export state: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// importState unpacks a bundle next to dir and then swaps it into place,
+// so a bad bundle leaves the existing state alone.
+func importState(r io.Reader, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+".import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := unpackState(r, tmp); err != nil {
+		return fmt.Errorf("failed to import state: %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+func unpackState(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("bundle entry %q is outside the instance directory", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("bundle entry %q is not a file or directory", hdr.Name)
+		}
+	}
+}
+
+// encryptedStore opens the encrypted node state when a state passphrase or
+// key command is configured. It returns nil otherwise, leaving tsnet to
+// keep its plaintext state file.
+func encryptedStore(ctx context.Context, cfg *models.Config, dir string) (ipn.StateStore, error) {
+	passphrase := []byte(cfg.StatePassphrase)
+	if cfg.StateKeyCommand != "" {
+		args := strings.Fields(cfg.StateKeyCommand)
+		var stderr strings.Builder
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("state_key_command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		passphrase = []byte(strings.TrimRight(string(out), "\r\n"))
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("state_key_command printed no passphrase")
+		}
+	}
+	if len(passphrase) == 0 {
+		if _, err := os.Stat(filepath.Join(dir, statestore.FileName)); err == nil {
+			return nil, fmt.Errorf("node state in %s is encrypted: state_passphrase or state_key_command is required", dir)
+		}
+		return nil, nil
+	}
+	store, err := statestore.Open(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Node state is encrypted at rest")
+	return store, nil
+}
@@ -0,0 +1,179 @@
+// Package statestore keeps tsnet node state encrypted at rest.
+package statestore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"tailscale.com/ipn"
+)
+
+// FileName is the encrypted state file in the instance directory, next to
+// (and replacing) tsnet's plaintext tailscaled.state.
+const FileName = "tailscaled.state.enc"
+
+const plaintextName = "tailscaled.state"
+
+// scrypt parameters, as recommended for interactive logins. Deriving the
+// key takes well under a second and happens once per start.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// file is the on-disk format: the state map, JSON encoded and sealed with
+// AES-256-GCM under a key derived from the passphrase and Salt.
+type file struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Encrypted is an ipn.StateStore holding the state in memory and writing
+// it to disk encrypted on every change.
+type Encrypted struct {
+	path string
+	salt []byte
+	aead cipher.AEAD
+
+	mu    sync.Mutex
+	state map[ipn.StateKey][]byte
+}
+
+// Open opens the encrypted state in dir with passphrase, creating it if
+// needed. Plaintext state left by an earlier unencrypted run is moved into
+// the encrypted file and deleted.
+func Open(dir string, passphrase []byte) (*Encrypted, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("state passphrase is empty")
+	}
+	s := &Encrypted{path: filepath.Join(dir, FileName), state: map[ipn.StateKey][]byte{}}
+
+	data, err := os.ReadFile(s.path)
+	switch {
+	case err == nil:
+		var f file
+		if err := json.Unmarshal(data, &f); err != nil || f.Version != 1 {
+			return nil, fmt.Errorf("%s is not a tsrouter state file", s.path)
+		}
+		if err := s.init(passphrase, f.Salt); err != nil {
+			return nil, err
+		}
+		plain, err := s.aead.Open(nil, f.Nonce, f.Data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: wrong passphrase or corrupted file", s.path)
+		}
+		if err := json.Unmarshal(plain, &s.state); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", s.path, err)
+		}
+		return s, nil
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := s.init(passphrase, salt); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	plainPath := filepath.Join(dir, plaintextName)
+	plain, err := os.ReadFile(plainPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(plain, &s.state); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", plainPath, err)
+		}
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	if plain != nil {
+		if err := os.Remove(plainPath); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Encrypted) init(passphrase, salt []byte) error {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	s.aead, err = cipher.NewGCM(block)
+	s.salt = salt
+	return err
+}
+
+// ReadState implements ipn.StateStore.
+func (s *Encrypted) ReadState(id ipn.StateKey) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bs, ok := s.state[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bs, nil
+}
+
+// WriteState implements ipn.StateStore.
+func (s *Encrypted) WriteState(id ipn.StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state[id] = append([]byte(nil), bs...)
+	return s.save()
+}
+
+// save seals the state with a fresh nonce and replaces the file
+// atomically, so a crash never leaves half a file behind.
+func (s *Encrypted) save() error {
+	plain, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data, err := json.Marshal(file{
+		Version: 1,
+		Salt:    s.salt,
+		Nonce:   nonce,
+		Data:    s.aead.Seal(nil, nonce, plain, nil),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/stats"
+)
+
+func statsCommand() *command {
+	fs := newFlagSet("stats")
+	flags := config.BindFlags(fs, config.ScopeAll)
+	since := fs.Duration("since", 24*time.Hour, "Only include requests from this far back")
+	top := fs.Int("top", 10, "Number of paths to show")
+	route := fs.String("route", "", "Only show usage of this route")
+	output := outputFlag(fs)
+
+	return &command{
+		name:    "stats",
+		summary: "Show usage recorded by an instance running with stats enabled",
+		description: `
+Reads the stats database in the instance directory of --hostname. The
+instance must be running (or have run) with --stats. Top paths come from
+individual request records, which are kept for --stats-retention; the status
+and usage tables come from daily counters, which are kept forever. Usage
+breaks requests and bytes down by Tailscale user and the node they came from;
+anonymous requests, e.g. over Funnel, have no node.`,
+		examples: []string{
+			"tsrouter stats --hostname webui",
+			"tsrouter stats --config tsrouter.yaml --since 168h --top 20",
+			"tsrouter stats --hostname webui --since 720h --route grafana",
+		},
+		flags: fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			if cfg.Hostname == "" {
+				return fmt.Errorf("hostname is required")
+			}
+
+			dir, err := instanceDir(cfg)
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(dir, statsDBName)
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("no stats database for %s (is stats enabled?): %v", cfg.Hostname, err)
+			}
+
+			store, err := stats.OpenReadOnly(path)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			from := time.Now().Add(-*since)
+			paths, err := store.TopPaths(ctx, from, *top)
+			if err != nil {
+				return err
+			}
+			statuses, err := store.StatusBreakdown(ctx, from)
+			if err != nil {
+				return err
+			}
+			users, err := store.UserUsage(ctx, from)
+			if err != nil {
+				return err
+			}
+			usage, err := store.Usage(ctx, from, *route)
+			if err != nil {
+				return err
+			}
+
+			if output.json() {
+				return printJSON(map[string]interface{}{
+					"since":    from,
+					"paths":    paths,
+					"statuses": statuses,
+					"users":    users,
+					"usage":    usage,
+				})
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ROUTE\tPATH\tREQUESTS\tAVG MS")
+			for _, p := range paths {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%.1f\n", p.Route, p.Path, p.Requests, p.AvgMs)
+			}
+			fmt.Fprintln(w, "\nROUTE\tSTATUS\tREQUESTS\tBYTES IN\tBYTES OUT")
+			for _, c := range statuses {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", c.Route, c.Key, c.Requests, c.BytesIn, c.BytesOut)
+			}
+			fmt.Fprintln(w, "\nROUTE\tUSER\tNODE\tREQUESTS\tBYTES IN\tBYTES OUT")
+			for _, u := range usage {
+				node := u.Node
+				if node == "" {
+					node = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", u.Route, u.User, node, u.Requests, u.BytesIn, u.BytesOut)
+			}
+			return w.Flush()
+		},
+	}
+}
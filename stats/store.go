@@ -0,0 +1,379 @@
+// Package stats persists request records and aggregated counters in a
+// SQLite database, so usage survives restarts and can be queried later.
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/router"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	queueSize     = 1024
+	batchSize     = 128
+	flushInterval = time.Second
+	pruneInterval = time.Hour
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS requests (
+	ts          INTEGER NOT NULL, -- unix milliseconds
+	route       TEXT NOT NULL,
+	method      TEXT NOT NULL,
+	path        TEXT NOT NULL,
+	status      INTEGER NOT NULL,
+	bytes_in    INTEGER NOT NULL,
+	bytes_out   INTEGER NOT NULL,
+	duration_ms REAL NOT NULL,
+	user        TEXT NOT NULL,
+	node        TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS requests_ts ON requests (ts);
+
+CREATE TABLE IF NOT EXISTS counters (
+	day          TEXT NOT NULL, -- YYYY-MM-DD, UTC
+	route        TEXT NOT NULL,
+	status_class TEXT NOT NULL, -- 2xx, 4xx, ...
+	user         TEXT NOT NULL,
+	requests     INTEGER NOT NULL,
+	bytes_in     INTEGER NOT NULL,
+	bytes_out    INTEGER NOT NULL,
+	PRIMARY KEY (day, route, status_class, user)
+);
+
+CREATE TABLE IF NOT EXISTS usage (
+	day       TEXT NOT NULL, -- YYYY-MM-DD, UTC
+	route     TEXT NOT NULL,
+	user      TEXT NOT NULL,
+	node      TEXT NOT NULL, -- empty for anonymous requests
+	requests  INTEGER NOT NULL,
+	bytes_in  INTEGER NOT NULL,
+	bytes_out INTEGER NOT NULL,
+	PRIMARY KEY (day, route, user, node)
+);
+`
+
+// Store writes records asynchronously in batches, so recording never adds
+// latency to the request path. Records are dropped if the queue is full.
+type Store struct {
+	db        *sql.DB
+	retention time.Duration
+	queue     chan *router.Record
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Open opens (creating if needed) the database at path. Individual request
+// records older than retention are pruned; counters are kept forever. A zero
+// retention keeps everything.
+func Open(path string, retention time.Duration) (*Store, error) {
+	// WAL lets `tsrouter stats` read while the server writes.
+	db, err := openDB(path, "", "journal_mode(WAL)", "busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create stats schema: %v", err)
+	}
+
+	s := &Store{
+		db:        db,
+		retention: retention,
+		queue:     make(chan *router.Record, queueSize),
+		done:      make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.loop()
+	return s, nil
+}
+
+// OpenReadOnly opens an existing database for queries, e.g. while the
+// serving instance keeps writing to it.
+func OpenReadOnly(path string) (*Store, error) {
+	db, err := openDB(path, "ro", "busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// openDB opens the database at path in mode ("" or "ro"). The pragmas go
+// in the DSN, so that every connection of the pool gets them.
+func openDB(path, mode string, pragmas ...string) (*sql.DB, error) {
+	q := url.Values{"_pragma": pragmas}
+	if mode != "" {
+		q.Set("mode", mode)
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stats database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open stats database: %v", err)
+	}
+	return db, nil
+}
+
+// Record implements router.Recorder.
+func (s *Store) Record(rec *router.Record) {
+	select {
+	case s.queue <- rec:
+	default:
+		log.Debug("Stats queue full, dropping record")
+	}
+}
+
+// Close flushes pending records and closes the database.
+func (s *Store) Close() error {
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+	}
+	return s.db.Close()
+}
+
+func (s *Store) loop() {
+	defer s.wg.Done()
+
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	var batch []*router.Record
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.write(batch); err != nil {
+			log.Warnf("Failed to write stats: %v", err)
+		}
+		batch = batch[:0]
+	}
+
+	s.prune()
+	for {
+		select {
+		case rec := <-s.queue:
+			batch = append(batch, rec)
+			if len(batch) >= batchSize {
+				write()
+			}
+		case <-flush.C:
+			write()
+		case <-prune.C:
+			s.prune()
+		case <-s.done:
+			for {
+				select {
+				case rec := <-s.queue:
+					batch = append(batch, rec)
+				default:
+					write()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Store) write(batch []*router.Record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(`INSERT INTO requests
+		(ts, route, method, path, status, bytes_in, bytes_out, duration_ms, user, node)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	count, err := tx.Prepare(`INSERT INTO counters
+		(day, route, status_class, user, requests, bytes_in, bytes_out)
+		VALUES (?, ?, ?, ?, 1, ?, ?)
+		ON CONFLICT (day, route, status_class, user) DO UPDATE SET
+			requests = requests + 1,
+			bytes_in = bytes_in + excluded.bytes_in,
+			bytes_out = bytes_out + excluded.bytes_out`)
+	if err != nil {
+		return err
+	}
+	defer count.Close()
+
+	use, err := tx.Prepare(`INSERT INTO usage
+		(day, route, user, node, requests, bytes_in, bytes_out)
+		VALUES (?, ?, ?, ?, 1, ?, ?)
+		ON CONFLICT (day, route, user, node) DO UPDATE SET
+			requests = requests + 1,
+			bytes_in = bytes_in + excluded.bytes_in,
+			bytes_out = bytes_out + excluded.bytes_out`)
+	if err != nil {
+		return err
+	}
+	defer use.Close()
+
+	for _, rec := range batch {
+		user := userKey(rec)
+		if _, err := insert.Exec(rec.Time.UnixMilli(), rec.Route, rec.Method, rec.Path, rec.Status,
+			rec.BytesIn, rec.BytesOut, float64(rec.Duration)/float64(time.Millisecond), user, rec.Node); err != nil {
+			return err
+		}
+		if _, err := count.Exec(rec.Time.UTC().Format(time.DateOnly), rec.Route, statusClass(rec.Status),
+			user, rec.BytesIn, rec.BytesOut); err != nil {
+			return err
+		}
+		if _, err := use.Exec(rec.Time.UTC().Format(time.DateOnly), rec.Route, user, rec.Node,
+			rec.BytesIn, rec.BytesOut); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) prune() {
+	if s.retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-s.retention).UnixMilli()
+	res, err := s.db.Exec(`DELETE FROM requests WHERE ts < ?`, cutoff)
+	if err != nil {
+		log.Warnf("Failed to prune stats: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.WithField("rows", n).Debug("Pruned old request records")
+	}
+}
+
+// userKey identifies the caller for accounting: the login name, or
+// "anonymous" for requests without a Tailscale identity (e.g. Funnel).
+func userKey(rec *router.Record) string {
+	if rec.User != "" {
+		return rec.User
+	}
+	return "anonymous"
+}
+
+func statusClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// PathStat is one row of TopPaths.
+type PathStat struct {
+	Route    string  `json:"route"`
+	Path     string  `json:"path"`
+	Requests int64   `json:"requests"`
+	AvgMs    float64 `json:"avg_ms"`
+}
+
+// TopPaths returns the most requested paths since the given time.
+func (s *Store) TopPaths(ctx context.Context, since time.Time, limit int) ([]PathStat, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT route, path, COUNT(*), AVG(duration_ms)
+		FROM requests WHERE ts >= ?
+		GROUP BY route, path ORDER BY COUNT(*) DESC LIMIT ?`, since.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []PathStat
+	for rows.Next() {
+		var p PathStat
+		if err := rows.Scan(&p.Route, &p.Path, &p.Requests, &p.AvgMs); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// CounterStat is an aggregated row keyed by route and either status class
+// or user.
+type CounterStat struct {
+	Route    string `json:"route"`
+	Key      string `json:"key"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// StatusBreakdown aggregates requests per route and status class since the
+// given day.
+func (s *Store) StatusBreakdown(ctx context.Context, since time.Time) ([]CounterStat, error) {
+	return s.counters(ctx, "status_class", since)
+}
+
+// UserUsage aggregates requests and bytes per route and user since the
+// given day.
+func (s *Store) UserUsage(ctx context.Context, since time.Time) ([]CounterStat, error) {
+	return s.counters(ctx, "user", since)
+}
+
+func (s *Store) counters(ctx context.Context, column string, since time.Time) ([]CounterStat, error) {
+	// column is one of two constants above, never user input.
+	rows, err := s.db.QueryContext(ctx, `SELECT route, `+column+`, SUM(requests), SUM(bytes_in), SUM(bytes_out)
+		FROM counters WHERE day >= ?
+		GROUP BY route, `+column+` ORDER BY route, SUM(requests) DESC`, since.UTC().Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []CounterStat
+	for rows.Next() {
+		var c CounterStat
+		if err := rows.Scan(&c.Route, &c.Key, &c.Requests, &c.BytesIn, &c.BytesOut); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// UsageStat is one row of Usage: what a user did through a route from one
+// of their nodes.
+type UsageStat struct {
+	Route    string `json:"route"`
+	User     string `json:"user"`
+	Node     string `json:"node,omitempty"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// Usage aggregates requests and bytes per route, user and node since the
+// given day, busiest first within each route. An empty route covers all
+// of them.
+func (s *Store) Usage(ctx context.Context, since time.Time, route string) ([]UsageStat, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT route, user, node, SUM(requests), SUM(bytes_in), SUM(bytes_out)
+		FROM usage WHERE day >= ? AND (? = '' OR route = ?)
+		GROUP BY route, user, node ORDER BY route, SUM(requests) DESC`,
+		since.UTC().Format(time.DateOnly), route, route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []UsageStat
+	for rows.Next() {
+		var u UsageStat
+		if err := rows.Scan(&u.Route, &u.User, &u.Node, &u.Requests, &u.BytesIn, &u.BytesOut); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
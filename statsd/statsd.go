@@ -0,0 +1,137 @@
+// Package statsd sends request metrics to a StatsD or DogStatsD agent.
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+const (
+	// maxPacket keeps datagrams within a typical MTU, as the agents
+	// recommend.
+	maxPacket     = 1432
+	flushInterval = time.Second
+)
+
+// Sink is a router.Recorder sending a counter and a timer per request:
+// <prefix>.requests, <prefix>.request_errors for 5xx responses,
+// <prefix>.requests_aborted and <prefix>.request_duration. With tags, the
+// route and status class are DogStatsD tags; without, the route is part of
+// the name, as in <prefix>.<route>.requests.
+type Sink struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Dial connects to the agent at addr, a host:port for UDP or
+// unix:///path for a Unix datagram socket. Lines are batched and sent at
+// least every second until ctx is done.
+func Dial(ctx context.Context, addr, prefix string, tags bool) (*Sink, error) {
+	network := "udp"
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		network, addr = "unixgram", path
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd agent: %v", err)
+	}
+	s := &Sink{conn: conn, prefix: strings.TrimSuffix(prefix, "."), tags: tags}
+	go s.run(ctx)
+	return s, nil
+}
+
+func (s *Sink) run(ctx context.Context) {
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			s.flush()
+			s.mu.Unlock()
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.flush()
+			s.conn.Close()
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Record implements router.Recorder.
+func (s *Sink) Record(rec *router.Record) {
+	status := strconv.Itoa(rec.Status/100) + "xx"
+	ms := strconv.FormatFloat(float64(rec.Duration)/float64(time.Millisecond), 'f', 3, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(rec.Route, "requests", "1|c", status)
+	if rec.Status >= 500 {
+		s.add(rec.Route, "request_errors", "1|c", status)
+	}
+	if rec.Aborted {
+		s.add(rec.Route, "requests_aborted", "1|c", status)
+	}
+	s.add(rec.Route, "request_duration", ms+"|ms", status)
+}
+
+// add appends a line, sending the batch first if it would get too big.
+func (s *Sink) add(route, name, value, status string) {
+	var line string
+	if s.tags {
+		line = fmt.Sprintf("%s.%s:%s|#route:%s,status_class:%s\n", s.prefix, name, value, tagValue(route), status)
+	} else {
+		line = fmt.Sprintf("%s.%s.%s:%s\n", s.prefix, nameSegment(route), name, value)
+	}
+	if s.buf.Len()+len(line) > maxPacket {
+		s.flush()
+	}
+	s.buf.WriteString(line)
+}
+
+func (s *Sink) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	// Drop the trailing newline; agents accept either.
+	if _, err := s.conn.Write(bytes.TrimSuffix(s.buf.Bytes(), []byte("\n"))); err != nil {
+		log.Debugf("Failed to send statsd metrics: %v", err)
+	}
+	s.buf.Reset()
+}
+
+// nameSegment makes a route name safe as part of a metric name.
+func nameSegment(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// tagValue makes a route name safe as a DogStatsD tag value.
+func tagValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/admin"
+	"github.com/whitehawk2/tsrouter/adminclient"
+	"github.com/whitehawk2/tsrouter/certs"
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/metrics"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/router"
+	"tailscale.com/client/tailscale"
+)
+
+const statusTimeout = 10 * time.Second
+
+func statusCommand() *command {
+	fs := newFlagSet("status")
+	flags := config.BindFlags(fs, config.ScopeAll)
+	output := outputFlag(fs)
+
+	return &command{
+		name:    "status",
+		summary: "Show readiness, backend health and recent latency of a running instance",
+		description: `
+Queries the admin API of a running instance (admin_addr must be set) and
+prints each route's backend health, request count, error ratio and latency
+percentiles over the metrics window, followed by the node's Tailscale
+addresses, DERP region, key expiry and the peers currently online.`,
+		examples: []string{
+			"tsrouter status --config tsrouter.yaml",
+			"tsrouter status --admin-addr 127.0.0.1:9180",
+		},
+		flags: fs,
+		run: func(ctx context.Context, args []string) error {
+			cfg, _, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			if cfg.AdminAddr == "" {
+				return fmt.Errorf("admin_addr is required to query a running instance")
+			}
+
+			st, err := fetchStatus(ctx, cfg.AdminAddr)
+			if err != nil {
+				return err
+			}
+			if output.json() {
+				return printJSON(st)
+			}
+
+			ready := "no"
+			if st.Ready {
+				ready = "yes"
+			}
+			fmt.Printf("Hostname: %s\nReady:    %s\nUptime:   %s\n\n", st.Hostname, ready, st.Uptime.Round(time.Second))
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "ROUTE\tPORT\tPATH\tTARGET\tHEALTHY\tREQUESTS (%s)\tERRORS\tP50\tP95\tP99\n", st.Window)
+			for _, r := range st.Routes {
+				healthy := "-"
+				if r.Healthy != nil {
+					healthy = fmt.Sprint(*r.Healthy)
+				}
+				fmt.Fprintf(w, "%s\t%d/%s\t%s\t%s\t%s\t%d\t%.2f%%\t%s\t%s\t%s\n",
+					r.Name, r.Port, r.Protocol, r.Path, r.Target, healthy,
+					r.Stats.Requests, r.Stats.ErrorRatio*100,
+					formatLatency(r.Stats.P50), formatLatency(r.Stats.P95), formatLatency(r.Stats.P99))
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if len(st.Certs) > 0 {
+				fmt.Println()
+				w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "CERTIFICATE\tEXPIRES\tRENEWALS")
+				for _, c := range st.Certs {
+					fmt.Fprintf(w, "%s\t%s (in %s)\t%d\n", c.Name, c.Expires.Local().Format(time.DateTime), time.Until(c.Expires).Round(time.Hour), c.Renewals)
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			if st.Node != nil {
+				return printNodeStatus(st.Node)
+			}
+			return nil
+		},
+	}
+}
+
+func printNodeStatus(n *admin.NodeStatus) error {
+	expiry := "disabled"
+	if n.KeyExpiry != nil {
+		expiry = n.KeyExpiry.Local().Format(time.DateTime)
+	}
+	fmt.Printf("\nNode:       %s\nIPs:        %s\nDERP:       %s\nKey expiry: %s\n\n",
+		n.DNSName, strings.Join(n.IPs, ", "), orNone(n.DERP), expiry)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tIP\tOS\tCONNECTION\tACTIVE\tLAST HANDSHAKE")
+	for _, p := range n.Peers {
+		conn := "relay " + p.Relay
+		if p.Addr != "" {
+			conn = "direct " + p.Addr
+		} else if p.Relay == "" {
+			conn = "-"
+		}
+		handshake := "-"
+		if !p.LastHandshake.IsZero() {
+			handshake = time.Since(p.LastHandshake).Round(time.Second).String() + " ago"
+		}
+		ip := ""
+		if len(p.IPs) > 0 {
+			ip = p.IPs[0]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\n", p.Hostname, ip, p.OS, conn, p.Active, handshake)
+	}
+	return w.Flush()
+}
+
+func fetchStatus(ctx context.Context, adminAddr string) (*admin.Status, error) {
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+
+	st, err := adminclient.NewClient(adminAddr).Status(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query instance: %v", err)
+	}
+	return st, nil
+}
+
+func formatLatency(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(100 * time.Microsecond).String()
+}
+
+// instanceStatus builds the admin status of the serving instance.
+func instanceStatus(cfg *models.Config, started time.Time, health *router.Health, switches *router.Switches, m *metrics.Metrics, lc *tailscale.LocalClient, sel *certs.Selector) func(ctx context.Context) admin.Status {
+	return func(ctx context.Context) admin.Status {
+		stats := map[string]metrics.RouteStats{}
+		for _, st := range m.Snapshot() {
+			stats[st.Route] = st
+		}
+
+		st := admin.Status{
+			Hostname: cfg.Hostname,
+			Uptime:   time.Since(started),
+			Window:   m.Window(),
+		}
+		for _, r := range cfg.Routes {
+			rs := admin.RouteStatus{
+				Name:     r.Name,
+				Port:     r.Port,
+				Protocol: r.Protocol,
+				Path:     r.Path,
+				Target:   r.Target,
+				Stats:    stats[r.Name],
+			}
+			if t := switches.Target(r.Name); t != "" {
+				rs.Target = t
+			}
+			rs.Stats.Route = r.Name
+			if cfg.HealthCheckInterval > 0 {
+				healthy := health.Healthy(r.Name)
+				rs.Healthy = &healthy
+			}
+			st.Routes = append(st.Routes, rs)
+		}
+		st.Node = nodeStatus(ctx, lc)
+		st.Certs = []admin.CertStatus{}
+		for _, c := range sel.Stats() {
+			st.Certs = append(st.Certs, admin.CertStatus{Name: c.Name, Expires: c.NotAfter, Renewals: c.Renewals})
+		}
+		return st
+	}
+}
+
+// nodeStatus asks tailscaled about the node and its online peers, or
+// returns nil if it can't answer yet.
+func nodeStatus(ctx context.Context, lc *tailscale.LocalClient) *admin.NodeStatus {
+	ts, err := lc.Status(ctx)
+	if err != nil || ts.Self == nil {
+		return nil
+	}
+	n := &admin.NodeStatus{
+		DNSName:   strings.TrimSuffix(ts.Self.DNSName, "."),
+		IPs:       []string{},
+		DERP:      ts.Self.Relay,
+		KeyExpiry: ts.Self.KeyExpiry,
+		Peers:     []admin.PeerStatus{},
+	}
+	for _, ip := range ts.TailscaleIPs {
+		n.IPs = append(n.IPs, ip.String())
+	}
+	for _, p := range ts.Peer {
+		if !p.Online {
+			continue
+		}
+		ps := admin.PeerStatus{
+			Hostname:      p.HostName,
+			DNSName:       strings.TrimSuffix(p.DNSName, "."),
+			IPs:           []string{},
+			OS:            p.OS,
+			Addr:          p.CurAddr,
+			Relay:         p.Relay,
+			Active:        p.Active,
+			LastHandshake: p.LastHandshake,
+			RxBytes:       p.RxBytes,
+			TxBytes:       p.TxBytes,
+		}
+		for _, ip := range p.TailscaleIPs {
+			ps.IPs = append(ps.IPs, ip.String())
+		}
+		n.Peers = append(n.Peers, ps)
+	}
+	// Peers using the service first.
+	sort.Slice(n.Peers, func(i, j int) bool {
+		if n.Peers[i].Active != n.Peers[j].Active {
+			return n.Peers[i].Active
+		}
+		return n.Peers[i].Hostname < n.Peers[j].Hostname
+	})
+	return n
+}
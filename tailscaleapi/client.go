@@ -0,0 +1,129 @@
+// Package tailscaleapi is a small client for the parts of the Tailscale v2
+// API that tsrouter needs.
+package tailscaleapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"golang.org/x/oauth2"
+)
+
+const (
+	DefaultBaseURL = "https://api.tailscale.com/api/v2"
+	TokenURL       = "https://api.tailscale.com/api/v2/oauth/token"
+
+	// DefaultTailnet makes the API resolve the tailnet from the credentials:
+	// the one the OAuth client belongs to.
+	DefaultTailnet = "-"
+)
+
+// Client talks to the Tailscale API on behalf of a single tailnet. The
+// HTTPClient is expected to add authentication, e.g. an OAuth2 client.
+type Client struct {
+	HTTPClient *http.Client
+	BaseURL    string
+	Tailnet    string
+}
+
+func NewClient(httpClient *http.Client, tailnet string) *Client {
+	return &Client{
+		HTTPClient: httpClient,
+		BaseURL:    DefaultBaseURL,
+		Tailnet:    tailnet,
+	}
+}
+
+// tailnetPath returns an API path scoped to the client's tailnet.
+func (c *Client) tailnetPath(format string, a ...interface{}) string {
+	return fmt.Sprintf("/tailnet/%s", url.PathEscape(c.Tailnet)) + fmt.Sprintf(format, a...)
+}
+
+// do sends a request to the API, JSON-encoding in (if non-nil) as the body
+// and decoding the response into out (if non-nil).
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	endpoint := c.BaseURL + path
+
+	var body io.Reader
+	var jsonBody []byte
+	if in != nil {
+		var err error
+		jsonBody, err = json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		body = bytes.NewReader(jsonBody)
+	}
+
+	log.WithFields(log.Fields{
+		"method":   method,
+		"endpoint": endpoint,
+		"body":     string(jsonBody),
+	}).Debug("Sending API request")
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// Without it, the policy file comes back as HuJSON, with comments.
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return RequestError(method, path, err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.WithFields(log.Fields{
+			"status_code": resp.StatusCode,
+			"endpoint":    endpoint,
+			"response":    string(bodyBytes),
+		}).Debug("API request failed")
+		class := errdefs.ErrAPI
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			class = errdefs.ErrAuth
+		}
+		return errdefs.Wrap(class, fmt.Errorf("%s %s: HTTP %d - %s", method, path, resp.StatusCode, string(bodyBytes)))
+	}
+
+	if out == nil || len(bodyBytes) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(bodyBytes, out); err != nil {
+		return errdefs.Wrap(errdefs.ErrAPI, fmt.Errorf("failed to decode response: %v", err))
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// RequestError describes err, from sending a request to the API through
+// the OAuth client, as an errdefs.ErrAuth error if the token was refused
+// and an errdefs.ErrAPI one otherwise.
+func RequestError(method, path string, err error) error {
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) {
+		return errdefs.Wrap(errdefs.ErrAuth, fmt.Errorf("%s %s: OAuth token request rejected: %v", method, path, re))
+	}
+	if isTimeout(err) {
+		return errdefs.Wrap(errdefs.ErrAPI, fmt.Errorf("%s %s: timed out waiting for the Tailscale API, is it reachable? (%v)", method, path, err))
+	}
+	return errdefs.Wrap(errdefs.ErrAPI, fmt.Errorf("failed to send request: %v", err))
+}
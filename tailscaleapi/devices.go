@@ -0,0 +1,35 @@
+package tailscaleapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+func (c *Client) ListDevices(ctx context.Context) ([]models.TailscaleDevice, error) {
+	var resp struct {
+		Devices []models.TailscaleDevice `json:"devices"`
+	}
+	if err := c.do(ctx, "GET", c.tailnetPath("/devices"), nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	return resp.Devices, nil
+}
+
+// DeleteDevice removes a device from the tailnet.
+func (c *Client) DeleteDevice(ctx context.Context, id string) error {
+	if err := c.do(ctx, "DELETE", "/device/"+url.PathEscape(id), nil, nil); err != nil {
+		return fmt.Errorf("failed to delete device %s: %w", id, err)
+	}
+	return nil
+}
+
+// ExpireDevice expires a device's node key, forcing it to re-authenticate.
+func (c *Client) ExpireDevice(ctx context.Context, id string) error {
+	if err := c.do(ctx, "POST", "/device/"+url.PathEscape(id)+"/expire", nil, nil); err != nil {
+		return fmt.Errorf("failed to expire device %s: %w", id, err)
+	}
+	return nil
+}
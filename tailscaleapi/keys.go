@@ -0,0 +1,83 @@
+package tailscaleapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// KeyOptions describes an auth key to create.
+type KeyOptions struct {
+	Description   string
+	Expiry        time.Duration
+	Reusable      bool
+	Ephemeral     bool
+	Preauthorized bool
+	Tags          []string
+}
+
+// CreateAuthKey creates a new auth key. The returned key's Key field holds
+// the secret, which the API only ever reveals once.
+func (c *Client) CreateAuthKey(ctx context.Context, opts KeyOptions) (*models.TailscaleAuthKey, error) {
+	var caps models.AuthKeyCapabilities
+	caps.Devices.Create = models.AuthKeyCreateCapabilities{
+		Reusable:      opts.Reusable,
+		Ephemeral:     opts.Ephemeral,
+		Preauthorized: opts.Preauthorized,
+		Tags:          opts.Tags,
+	}
+
+	reqBody := map[string]interface{}{
+		"capabilities":  caps,
+		"expirySeconds": int(opts.Expiry.Seconds()),
+	}
+	if opts.Description != "" {
+		reqBody["description"] = opts.Description
+	}
+
+	var authKey models.TailscaleAuthKey
+	if err := c.do(ctx, "POST", c.tailnetPath("/keys"), reqBody, &authKey); err != nil {
+		return nil, fmt.Errorf("failed to generate auth key: %w", err)
+	}
+	return &authKey, nil
+}
+
+// ListKeys returns all keys in the tailnet visible to the caller.
+func (c *Client) ListKeys(ctx context.Context) ([]models.TailscaleAuthKey, error) {
+	var resp struct {
+		Keys []models.TailscaleAuthKey `json:"keys"`
+	}
+	if err := c.do(ctx, "GET", c.tailnetPath("/keys"), nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
+
+	// The listing only carries IDs, so fetch each key for its details.
+	keys := make([]models.TailscaleAuthKey, 0, len(resp.Keys))
+	for _, k := range resp.Keys {
+		key, err := c.GetKey(ctx, k.ID)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, nil
+}
+
+func (c *Client) GetKey(ctx context.Context, id string) (*models.TailscaleAuthKey, error) {
+	var key models.TailscaleAuthKey
+	if err := c.do(ctx, "GET", c.tailnetPath("/keys/%s", url.PathEscape(id)), nil, &key); err != nil {
+		return nil, fmt.Errorf("failed to get key %s: %w", id, err)
+	}
+	return &key, nil
+}
+
+// RevokeKey deletes a key so it can no longer be used to register nodes.
+func (c *Client) RevokeKey(ctx context.Context, id string) error {
+	if err := c.do(ctx, "DELETE", c.tailnetPath("/keys/%s", url.PathEscape(id)), nil, nil); err != nil {
+		return fmt.Errorf("failed to revoke key %s: %w", id, err)
+	}
+	return nil
+}
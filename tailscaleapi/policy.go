@@ -0,0 +1,18 @@
+package tailscaleapi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/whitehawk2/tsrouter/models"
+)
+
+// GetPolicy returns the tailnet policy file. The OAuth client needs the
+// policy_file:read scope.
+func (c *Client) GetPolicy(ctx context.Context) (*models.TailscalePolicy, error) {
+	var p models.TailscalePolicy
+	if err := c.do(ctx, "GET", c.tailnetPath("/acl"), nil, &p); err != nil {
+		return nil, fmt.Errorf("failed to get tailnet policy: %w", err)
+	}
+	return &p, nil
+}
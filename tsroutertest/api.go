@@ -0,0 +1,374 @@
+// Package tsroutertest helps test tsrouter configs without a tailnet: API
+// fakes the parts of the Tailscale API tsrouter uses, and Serve runs a
+// config's routes on loopback listeners with made-up caller identities.
+package tsroutertest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// accessToken is the OAuth token the fake hands out for any client
+// credentials.
+const accessToken = "tsroutertest-token"
+
+// API is an in-memory fake of the Tailscale API's OAuth token, auth key,
+// device and policy file endpoints, for any tailnet name.
+type API struct {
+	// ClientID and ClientSecret, when set, are the only credentials the
+	// token endpoint accepts.
+	ClientID     string
+	ClientSecret string
+
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	keys     []*models.TailscaleAuthKey
+	devices  []models.TailscaleDevice
+	policy   models.TailscalePolicy
+	requests []string
+	nextID   int
+}
+
+// NewAPI starts a fake API, closed when the test ends.
+func NewAPI(tb testing.TB) *API {
+	tb.Helper()
+	a := &API{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/oauth/token", a.token)
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/keys", a.authorized(a.listKeys))
+	mux.HandleFunc("POST /api/v2/tailnet/{tailnet}/keys", a.authorized(a.createKey))
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/keys/{id}", a.authorized(a.getKey))
+	mux.HandleFunc("DELETE /api/v2/tailnet/{tailnet}/keys/{id}", a.authorized(a.revokeKey))
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/devices", a.authorized(a.listDevices))
+	mux.HandleFunc("DELETE /api/v2/device/{id}", a.authorized(a.deleteDevice))
+	mux.HandleFunc("POST /api/v2/device/{id}/expire", a.authorized(a.expireDevice))
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/acl", a.authorized(a.getPolicy))
+	a.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		a.requests = append(a.requests, r.Method+" "+strings.TrimPrefix(r.URL.Path, "/api/v2"))
+		a.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	tb.Cleanup(a.srv.Close)
+	return a
+}
+
+// BaseURL is the API's base URL, in place of tailscaleapi.DefaultBaseURL.
+func (a *API) BaseURL() string {
+	return a.srv.URL + "/api/v2"
+}
+
+// TokenURL is the OAuth token endpoint, in place of tailscaleapi.TokenURL.
+func (a *API) TokenURL() string {
+	return a.srv.URL + "/api/v2/oauth/token"
+}
+
+// Client returns an API client for the fake, authenticating with the
+// OAuth client credentials like tsrouter does.
+func (a *API) Client(ctx context.Context) *tailscaleapi.Client {
+	oauthConfig := &clientcredentials.Config{
+		ClientID:     a.ClientID,
+		ClientSecret: a.ClientSecret,
+		TokenURL:     a.TokenURL(),
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, a.srv.Client())
+	c := tailscaleapi.NewClient(oauthConfig.Client(ctx), tailscaleapi.DefaultTailnet)
+	c.BaseURL = a.BaseURL()
+	return c
+}
+
+// Requests returns the requests the API got so far, as "METHOD /path"
+// with the /api/v2 prefix left out, e.g. "GET /tailnet/-/devices".
+func (a *API) Requests() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.requests)
+}
+
+// AddDevice adds a device to the tailnet, filling in its IDs and times if
+// they're unset, and returns it.
+func (a *API) AddDevice(d models.TailscaleDevice) models.TailscaleDevice {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if d.ID == "" {
+		d.ID = a.id("d")
+	}
+	if d.NodeID == "" {
+		d.NodeID = "n" + d.ID
+	}
+	if d.Name == "" {
+		d.Name = d.Hostname + ".tsroutertest.ts.net"
+	}
+	if d.Created.IsZero() {
+		d.Created = time.Now().UTC()
+	}
+	if d.LastSeen.IsZero() {
+		d.LastSeen = d.Created
+	}
+	a.devices = append(a.devices, d)
+	return d
+}
+
+// Devices returns the devices in the tailnet.
+func (a *API) Devices() []models.TailscaleDevice {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.devices)
+}
+
+// Keys returns every auth key created, revoked ones included. Their Key
+// fields hold the secrets.
+func (a *API) Keys() []models.TailscaleAuthKey {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys := make([]models.TailscaleAuthKey, 0, len(a.keys))
+	for _, k := range a.keys {
+		keys = append(keys, *k)
+	}
+	return keys
+}
+
+// Register joins a node named hostname to the tailnet with an auth key, as
+// tsnet would: the key must be valid, is used up unless it's reusable,
+// and gives the device its tags.
+func (a *API) Register(authKey, hostname string) (models.TailscaleDevice, error) {
+	a.mu.Lock()
+	var key *models.TailscaleAuthKey
+	for _, k := range a.keys {
+		if k.Key == authKey {
+			key = k
+		}
+	}
+	switch {
+	case key == nil:
+		a.mu.Unlock()
+		return models.TailscaleDevice{}, fmt.Errorf("unknown auth key")
+	case key.Invalid || key.Revoked != nil || time.Now().After(key.Expires):
+		a.mu.Unlock()
+		return models.TailscaleDevice{}, fmt.Errorf("auth key %s is invalid, revoked or expired", key.ID)
+	}
+	create := key.Capabilities.Devices.Create
+	if !create.Reusable {
+		key.Invalid = true
+	}
+	a.mu.Unlock()
+
+	return a.AddDevice(models.TailscaleDevice{
+		Hostname:   hostname,
+		Tags:       create.Tags,
+		Authorized: create.Preauthorized,
+		Expires:    time.Now().UTC().Add(180 * 24 * time.Hour),
+	}), nil
+}
+
+// SetPolicy sets the tailnet policy file.
+func (a *API) SetPolicy(p models.TailscalePolicy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.policy = p
+}
+
+// id returns a new object ID with prefix. a.mu must be held.
+func (a *API) id(prefix string) string {
+	a.nextID++
+	return fmt.Sprintf("%s%d", prefix, a.nextID)
+}
+
+func (a *API) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if r.PostFormValue("grant_type") != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	if (a.ClientID != "" && id != a.ClientID) || (a.ClientSecret != "" && secret != a.ClientSecret) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "bearer",
+		"expires_in":   3600,
+	})
+}
+
+// authorized rejects requests without the fake's OAuth token, as the API
+// does without a valid one.
+func (a *API) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+accessToken {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "API token invalid"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *API) listKeys(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Like the API, the listing only carries IDs.
+	type id struct {
+		ID string `json:"id"`
+	}
+	ids := []id{}
+	for _, k := range a.keys {
+		if k.Revoked == nil {
+			ids = append(ids, id{k.ID})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": ids})
+}
+
+func (a *API) createKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Capabilities  models.AuthKeyCapabilities `json:"capabilities"`
+		ExpirySeconds int                        `json:"expirySeconds"`
+		Description   string                     `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	for _, tag := range req.Capabilities.Devices.Create.Tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": fmt.Sprintf("invalid tag %q", tag)})
+			return
+		}
+	}
+	expiry := time.Duration(req.ExpirySeconds) * time.Second
+	if expiry == 0 {
+		expiry = 90 * 24 * time.Hour
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now().UTC()
+	key := &models.TailscaleAuthKey{
+		ID:           a.id("k"),
+		Description:  req.Description,
+		Created:      now,
+		Expires:      now.Add(expiry),
+		Ephemeral:    req.Capabilities.Devices.Create.Ephemeral,
+		Capabilities: req.Capabilities,
+	}
+	key.Key = "tskey-auth-" + key.ID + "-" + secret()
+	a.keys = append(a.keys, key)
+	writeJSON(w, http.StatusOK, key)
+}
+
+func (a *API) getKey(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	k := a.key(r.PathValue("id"))
+	if k == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+		return
+	}
+	// The secret is only revealed when the key is created.
+	key := *k
+	key.Key = ""
+	writeJSON(w, http.StatusOK, key)
+}
+
+func (a *API) revokeKey(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	k := a.key(r.PathValue("id"))
+	if k == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+		return
+	}
+	now := time.Now().UTC()
+	k.Revoked = &now
+	k.Invalid = true
+	w.WriteHeader(http.StatusOK)
+}
+
+// key returns the unrevoked key with id. a.mu must be held.
+func (a *API) key(id string) *models.TailscaleAuthKey {
+	for _, k := range a.keys {
+		if k.ID == id && k.Revoked == nil {
+			return k
+		}
+	}
+	return nil
+}
+
+func (a *API) listDevices(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	devices := a.devices
+	if devices == nil {
+		devices = []models.TailscaleDevice{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
+
+func (a *API) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := a.device(r.PathValue("id"))
+	if i < 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+		return
+	}
+	a.devices = slices.Delete(a.devices, i, i+1)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *API) expireDevice(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := a.device(r.PathValue("id"))
+	if i < 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+		return
+	}
+	a.devices[i].Expires = time.Now().UTC()
+	w.WriteHeader(http.StatusOK)
+}
+
+// device returns the index of the device with id, or -1. a.mu must be
+// held.
+func (a *API) device(id string) int {
+	return slices.IndexFunc(a.devices, func(d models.TailscaleDevice) bool {
+		return d.ID == id || d.NodeID == id
+	})
+}
+
+func (a *API) getPolicy(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	writeJSON(w, http.StatusOK, a.policy)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func secret() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,115 @@
+package tsroutertest
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+)
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	a := NewAPI(t)
+	api := a.Client(ctx)
+
+	created, err := api.CreateAuthKey(ctx, tailscaleapi.KeyOptions{
+		Description:   "web",
+		Expiry:        time.Hour,
+		Ephemeral:     true,
+		Preauthorized: true,
+		Tags:          []string{"tag:server"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.Key == "" {
+		t.Fatalf("created key %+v has no ID or secret", created)
+	}
+
+	keys, err := api.ListKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != created.ID || keys[0].Description != "web" || keys[0].Key != "" {
+		t.Fatalf("listed keys %+v, want %s without its secret", keys, created.ID)
+	}
+	if got := keys[0].Capabilities.Devices.Create.Tags; !slices.Equal(got, []string{"tag:server"}) {
+		t.Errorf("key tags = %v, want [tag:server]", got)
+	}
+
+	d, err := a.Register(created.Key, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.HasTag("tag:server") {
+		t.Errorf("registered device tags = %v, want tag:server", d.Tags)
+	}
+	if _, err := a.Register(created.Key, "web2"); err == nil {
+		t.Error("single-use key registered a second device")
+	}
+
+	if err := api.RevokeKey(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := api.ListKeys(ctx); err != nil || len(keys) != 0 {
+		t.Errorf("keys after revoking = %v, %v; want none", keys, err)
+	}
+	if err := api.RevokeKey(ctx, created.ID); err == nil {
+		t.Error("revoking a revoked key succeeded")
+	}
+}
+
+func TestAPIDevices(t *testing.T) {
+	ctx := context.Background()
+	a := NewAPI(t)
+	api := a.Client(ctx)
+	web := a.AddDevice(models.TailscaleDevice{Hostname: "web", Tags: []string{"tag:server"}})
+	a.AddDevice(models.TailscaleDevice{Hostname: "db"})
+
+	devices, err := api.ListDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].ID != web.ID || devices[0].Name != "web.tsroutertest.ts.net" {
+		t.Fatalf("devices = %+v", devices)
+	}
+
+	if err := api.DeleteDevice(ctx, web.ID); err != nil {
+		t.Fatal(err)
+	}
+	devices, err = api.ListDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Hostname != "db" {
+		t.Errorf("devices after deleting web = %+v, want only db", devices)
+	}
+	if err := api.DeleteDevice(ctx, web.ID); err == nil {
+		t.Error("deleting a deleted device succeeded")
+	}
+
+	want := []string{
+		"POST /oauth/token",
+		"GET /tailnet/-/devices",
+		"DELETE /device/" + web.ID,
+		"GET /tailnet/-/devices",
+		"DELETE /device/" + web.ID,
+	}
+	if got := a.Requests(); !slices.Equal(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+}
+
+func TestAPIRejectsWrongCredentials(t *testing.T) {
+	ctx := context.Background()
+	a := NewAPI(t)
+	a.ClientID, a.ClientSecret = "id", "secret"
+	api := a.Client(ctx)
+	a.ClientSecret = "other"
+	if _, err := api.ListDevices(ctx); err == nil {
+		t.Error("listing devices with the wrong client secret succeeded")
+	}
+}
@@ -0,0 +1,221 @@
+package tsroutertest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/router"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// LoadConfig loads and validates the config file at path as tsrouter
+// serve does, with the defaults and TSROUTER_* environment variables, and
+// fails the test if it's invalid.
+func LoadConfig(tb testing.TB, path string) *models.Config {
+	tb.Helper()
+	cfg, src, err := config.Resolve(&config.Flags{ConfigPath: path})
+	if err != nil {
+		tb.Fatalf("failed to load config: %v", err)
+	}
+	if err := config.Validate(cfg, src); err != nil {
+		tb.Fatalf("%v", err)
+	}
+	return cfg
+}
+
+// ParseConfig is LoadConfig for a YAML config given inline.
+func ParseConfig(tb testing.TB, yaml string) *models.Config {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "tsrouter.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	return LoadConfig(tb, path)
+}
+
+// Identity is a caller as the node's WhoIs would describe it.
+type Identity struct {
+	Login       string // e.g. alice@example.com; empty for a tagged node
+	DisplayName string
+	Node        string // the node's name, e.g. alice-laptop
+	Tags        []string
+
+	// Caps are the app capabilities the tailnet policy grants the node,
+	// for acl_grants.
+	Caps tailcfg.PeerCapMap
+}
+
+// Router serves a config's routes on loopback listeners, one per tailnet
+// port, in place of a tsnet node. HTTPS ports are served as plain HTTP,
+// and requests carry the Identity of the Client that sent them.
+type Router struct {
+	addrs map[int]string // tailnet port -> loopback address
+	main  int
+
+	mu      sync.Mutex
+	callers map[string]*apitype.WhoIsResponse // client address -> identity
+	nodes   int
+}
+
+// Serve starts serving cfg's routes, as returned by LoadConfig, until the
+// test ends. Unless opts has a WhoIs of its own, callers are identified
+// by the Client they use.
+func Serve(tb testing.TB, cfg *models.Config, opts router.Options) *Router {
+	tb.Helper()
+	rt := &Router{addrs: map[int]string{}, callers: map[string]*apitype.WhoIsResponse{}}
+	if opts.WhoIs == nil {
+		opts.WhoIs = rt.whoIs
+	}
+	if opts.Processes == nil {
+		opts.Processes = &router.Processes{}
+		tb.Cleanup(opts.Processes.Close)
+	}
+
+	byPort := map[int][]models.Route{}
+	for _, r := range cfg.Routes {
+		byPort[r.Port] = append(byPort[r.Port], r)
+	}
+	ports := make([]int, 0, len(byPort))
+	for port := range byPort {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	for _, port := range ports {
+		rs := byPort[port]
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatalf("failed to listen for port %d: %v", port, err)
+		}
+		rt.addrs[port] = ln.Addr().String()
+
+		if rs[0].Protocol == "tcp" {
+			p := router.NewTCPProxy(rs[0], opts.DialerFor(rs[0]))
+			go p.Serve(ln)
+			tb.Cleanup(func() { shutdown(p.Shutdown) })
+			continue
+		}
+		handler, err := router.New(rs, opts)
+		if err != nil {
+			ln.Close()
+			tb.Fatalf("port %d: %v", port, err)
+		}
+		srv := &http.Server{Handler: handler}
+		go srv.Serve(ln)
+		tb.Cleanup(func() { shutdown(srv.Shutdown) })
+		if rt.main == 0 || port == 443 {
+			rt.main = port
+		}
+	}
+	return rt
+}
+
+func shutdown(f func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f(ctx)
+}
+
+// URL returns the base URL of the node's main port: 443, or the first
+// HTTP port.
+func (rt *Router) URL() string {
+	return rt.PortURL(rt.main)
+}
+
+// PortURL returns the base URL of a tailnet port, empty if no route uses
+// it.
+func (rt *Router) PortURL(port int) string {
+	addr, ok := rt.addrs[port]
+	if !ok {
+		return ""
+	}
+	return "http://" + addr
+}
+
+// Addr returns the loopback address serving a tailnet port, such as a tcp
+// route's, empty if no route uses it.
+func (rt *Router) Addr(port int) string {
+	return rt.addrs[port]
+}
+
+// Client returns an HTTP client whose requests come from id, or from an
+// address with no Tailscale identity if id is nil. It doesn't follow
+// redirects, so tests see sign-in and other redirects as they are.
+func (rt *Router) Client(id *Identity) *http.Client {
+	var who *apitype.WhoIsResponse
+	if id != nil {
+		who = rt.whoIsResponse(id)
+	}
+	dialer := &net.Dialer{}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err == nil && who != nil {
+					rt.mu.Lock()
+					rt.callers[conn.LocalAddr().String()] = who
+					rt.mu.Unlock()
+				}
+				return conn, err
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (rt *Router) whoIsResponse(id *Identity) *apitype.WhoIsResponse {
+	rt.mu.Lock()
+	rt.nodes++
+	n := rt.nodes
+	rt.mu.Unlock()
+
+	name := id.Node
+	if name == "" {
+		name = fmt.Sprintf("node%d", n)
+	}
+	who := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			ID:           tailcfg.NodeID(n),
+			StableID:     tailcfg.StableNodeID(fmt.Sprintf("n%d", n)),
+			Name:         name + ".tsroutertest.ts.net.",
+			ComputedName: name,
+			Tags:         id.Tags,
+			Addresses:    []netip.Prefix{netip.PrefixFrom(netip.AddrFrom4([4]byte{100, 64, byte(n >> 8), byte(n)}), 32)},
+		},
+		CapMap: id.Caps,
+	}
+	if id.Login != "" {
+		who.UserProfile = &tailcfg.UserProfile{
+			ID:          tailcfg.UserID(n),
+			LoginName:   id.Login,
+			DisplayName: id.DisplayName,
+		}
+	} else {
+		who.UserProfile = &tailcfg.UserProfile{LoginName: "tagged-devices", DisplayName: "Tagged Devices"}
+	}
+	return who
+}
+
+func (rt *Router) whoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	who, ok := rt.callers[remoteAddr]
+	if !ok {
+		return nil, fmt.Errorf("no Tailscale identity for %s", remoteAddr)
+	}
+	return who, nil
+}
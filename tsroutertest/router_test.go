@@ -0,0 +1,80 @@
+package tsroutertest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/whitehawk2/tsrouter/router"
+)
+
+func TestServeRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("X-User"))
+	}))
+	defer backend.Close()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	cfg := ParseConfig(t, fmt.Sprintf(`
+hostname: web
+routes:
+  - name: app
+    path: /app/
+    target: %s
+    identity_headers:
+      X-User: "{{.UserProfile.LoginName}}"
+  - name: echo
+    port: 2222
+    protocol: tcp
+    target: %s
+`, backend.URL, echo.Addr()))
+	rt := Serve(t, cfg, router.Options{})
+
+	for _, tc := range []struct {
+		id   *Identity
+		want string
+	}{
+		{&Identity{Login: "alice@example.com", Node: "alice-laptop"}, "/app/page alice@example.com"},
+		{nil, "/app/page "},
+	} {
+		resp, err := rt.Client(tc.id).Get(rt.URL() + "/app/page")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != tc.want {
+			t.Errorf("GET /app/page as %v: %s %q, want 200 %q", tc.id, resp.Status, body, tc.want)
+		}
+	}
+
+	conn, err := net.Dial("tcp", rt.Addr(2222))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("tcp route echoed %q, %v; want ping", buf, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/audit"
+	"github.com/whitehawk2/tsrouter/router"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tsnet"
+)
+
+// errExpired is the cause of the shutdown when ttl or ttl_idle runs out.
+var errExpired = errors.New("node expired")
+
+// activity tracks when the node last served anything: a completed request
+// or a new connection, which covers tcp ports.
+type activity struct {
+	last atomic.Int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// Record implements router.Recorder.
+func (a *activity) Record(*router.Record) {
+	a.touch()
+}
+
+func (a *activity) listener(ln net.Listener) net.Listener {
+	return &activityListener{Listener: ln, a: a}
+}
+
+type activityListener struct {
+	net.Listener
+	a *activity
+}
+
+func (l *activityListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.a.touch()
+	}
+	return c, err
+}
+
+// watchTTL calls expire once the node has been up for ttl, or idle for
+// idleTTL. Either may be 0 to disable it.
+func watchTTL(ctx context.Context, ttl, idleTTL time.Duration, a *activity, expire context.CancelCauseFunc) {
+	var deadline <-chan time.Time
+	if ttl > 0 {
+		t := time.NewTimer(ttl)
+		defer t.Stop()
+		deadline = t.C
+	}
+	var check <-chan time.Time
+	if idleTTL > 0 {
+		t := time.NewTicker(min(max(idleTTL/10, time.Second), time.Minute))
+		defer t.Stop()
+		check = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			expire(fmt.Errorf("%w: ttl of %s reached", errExpired, ttl))
+			return
+		case <-check:
+			if a.idle() >= idleTTL {
+				expire(fmt.Errorf("%w: no requests for %s", errExpired, idleTTL))
+				return
+			}
+		}
+	}
+}
+
+// destroyNode removes an expired node from the tailnet and deletes its
+// state, so nothing is left behind once it's served its purpose.
+func destroyNode(api *tailscaleapi.Client, s *tsnet.Server, lc *tailscale.LocalClient, auditLog *audit.Log, dir string) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	st, err := lc.StatusWithoutPeers(ctx)
+	if err == nil && st.Self != nil {
+		id := string(st.Self.ID)
+		err = api.DeleteDevice(ctx, id)
+		recordAudit(auditLog, "device.delete", id, map[string]string{"reason": "expired"}, err)
+	}
+	if err != nil {
+		log.Warnf("Failed to delete expired node, it will be removed once it has been offline for a while: %v", err)
+	} else {
+		log.Info("Deleted expired node from the tailnet")
+	}
+
+	s.Close()
+	if err := os.RemoveAll(dir); err != nil {
+		log.Warnf("Failed to remove node state: %v", err)
+	}
+}
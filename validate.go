@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/whitehawk2/tsrouter/config"
+	"github.com/whitehawk2/tsrouter/errdefs"
+	"github.com/whitehawk2/tsrouter/models"
+	"github.com/whitehawk2/tsrouter/router"
+	"github.com/whitehawk2/tsrouter/tailscaleapi"
+)
+
+const targetDialTimeout = 3 * time.Second
+
+type preflightOptions struct {
+	checkCredentials bool
+}
+
+func validateCommand() *command {
+	fs := newFlagSet("validate")
+	flags := config.BindFlags(fs, config.ScopeAll)
+	offline := fs.Bool("offline", false, "Skip verifying credentials against the Tailscale API")
+
+	return &command{
+		name:    "validate",
+		summary: "Check a config file, its environment and credentials without registering a node",
+		examples: []string{
+			"tsrouter validate --config tsrouter.yaml",
+			"tsrouter validate --config tsrouter.yaml --offline",
+		},
+		flags: fs,
+		run: func(ctx context.Context, args []string) error {
+			if flags.ConfigPath == "" {
+				return fmt.Errorf("--config is required")
+			}
+
+			cfg, src, err := loadConfig(flags)
+			if err != nil {
+				return err
+			}
+			if err := config.Validate(cfg, src); err != nil {
+				return err
+			}
+
+			return preflight(ctx, cfg, preflightOptions{checkCredentials: !*offline})
+		},
+	}
+}
+
+// preflight runs every check serve would depend on short of registering a
+// node. Unreachable targets are only warned about, since a CI runner
+// usually can't see the backends.
+func preflight(ctx context.Context, cfg *models.Config, opts preflightOptions) error {
+	var missing []string
+	for _, opt := range []struct{ name, value string }{
+		{"client_id", cfg.ClientID},
+		{"client_secret", cfg.ClientSecret},
+	} {
+		if opt.value == "" {
+			missing = append(missing, opt.name)
+		}
+	}
+	if len(missing) > 0 {
+		return errdefs.Wrap(errdefs.ErrConfig, fmt.Errorf("missing required settings: %s", strings.Join(missing, ", ")))
+	}
+	if cfg.Tailnet == "" || cfg.Tailnet == tailscaleapi.DefaultTailnet {
+		log.Info("Credentials configured, using the OAuth client's tailnet")
+	} else {
+		log.Info("Credentials configured")
+	}
+
+	for _, r := range cfg.Routes {
+		if strings.HasPrefix(r.Target, "file://") || strings.HasPrefix(r.Target, "mock://") {
+			continue // checked by config.Validate
+		}
+		if len(r.OnDemand.Command) > 0 {
+			log.WithField("route", r.Name).Infof("Target %s is started on demand, not probed", r.Target)
+			continue
+		}
+		if r.ViaTailnet {
+			log.WithField("route", r.Name).Infof("Target %s is dialed through the tailnet, not probed", r.Target)
+			continue
+		}
+		network, addr, err := router.TargetAddr(r)
+		if err != nil {
+			log.WithField("route", r.Name).Warnf("Target %s can't be probed: %v", r.Target, err)
+			continue
+		}
+
+		conn, err := net.DialTimeout(network, addr, targetDialTimeout)
+		if err != nil {
+			log.WithField("route", r.Name).Warnf("Target %s is not reachable: %v", r.Target, err)
+			continue
+		}
+		conn.Close()
+		log.WithField("route", r.Name).Infof("Target %s is reachable", r.Target)
+	}
+
+	if opts.checkCredentials {
+		api, err := newAPIClient(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		if _, err := api.ListDevices(ctx); err != nil {
+			return fmt.Errorf("credentials rejected by the Tailscale API: %w", err)
+		}
+		log.WithField("tailnet", api.Tailnet).Info("Credentials OK")
+		checkReachability(ctx, api, cfg)
+	}
+
+	log.Infof("Config for %s is valid (%d routes)", cfg.Hostname, len(cfg.Routes))
+	return nil
+}